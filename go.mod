@@ -5,6 +5,7 @@ go 1.20
 require (
 	github.com/colinmarc/hdfs/v2 v2.3.0
 	github.com/jcmturner/gokrb5/v8 v8.4.2
+	golang.org/x/crypto v0.0.0-20201112155050-0c6587e931a9
 )
 
 require (
@@ -15,7 +16,6 @@ require (
 	github.com/jcmturner/goidentity/v6 v6.0.1 // indirect
 	github.com/jcmturner/rpc/v2 v2.0.3 // indirect
 	github.com/stretchr/testify v1.8.0 // indirect
-	golang.org/x/crypto v0.0.0-20201112155050-0c6587e931a9 // indirect
 	golang.org/x/net v0.0.0-20200114155413-6afb5195e5aa // indirect
 	google.golang.org/protobuf v1.27.1 // indirect
 )
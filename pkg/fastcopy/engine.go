@@ -0,0 +1,229 @@
+// Package fastcopy is the copy engine of cluster-fastcopy: it streams the files of a directory
+// from a Source (e.g. hdfs) into a Sink (e.g. a fastcopy peer's /upload) with a pool of workers.
+// It can be embedded by Go services that copy between clusters programmatically:
+//
+//	engine := &fastcopy.Engine{Source: fastcopy.HDFSSource{Client: client}, Sink: fastcopy.HTTPSink{TargetURL: "http://peer:8080/upload"}}
+//	result, err := engine.Copy("/data/events/", "/data/events/")
+package fastcopy
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const DefaultWorkers = 32
+
+// the workers of the priority lane unless Engine.PriorityWorkers says otherwise
+const DefaultPriorityWorkers = 2
+
+// a file to copy
+type File struct {
+	Path string // full path on the source
+	Name string // name in the destination dir
+	Size int64
+	// 1 for the second, speculative attempt at the file, which a sink must write without disturbing the first
+	Attempt int
+}
+
+// where files are copied from
+type Source interface {
+	// lists the files (not dirs) directly in dir
+	List(dir string) ([]File, error)
+	Open(file File) (io.ReadCloser, error)
+}
+
+// where files are copied to
+type Sink interface {
+	// writes the contents of r as file.Name into the dir 'to'
+	Write(to string, file File, r io.Reader) (WriteResult, error)
+}
+
+// what a sink wrote. the digests are base64 encoded, as returned by a fastcopy peer's /upload
+type WriteResult struct {
+	Path    string `json:"path"`
+	Written int64  `json:"written"`
+	MD5     string `json:"md5"`
+	SHA256  string `json:"sha256"`
+	Resumed int64  `json:"resumed,omitempty"` // of Written, the bytes kept from an interrupted write
+}
+
+// the files to copy from one directory into another
+type Job struct {
+	From  string
+	To    string
+	Files []File
+}
+
+type Copied struct {
+	File   File
+	Result WriteResult
+	At     time.Time
+}
+
+type Failed struct {
+	File File
+	Err  error
+}
+
+type Result struct {
+	Copied []Copied
+	Failed []Failed
+}
+
+// copies files from Source to Sink with Workers files in parallel (DefaultWorkers if 0)
+type Engine struct {
+	Source  Source
+	Sink    Sink
+	Workers int
+	// called by a worker before it opens a file, e.g. to wait for capacity. an error fails the file without
+	// opening it, otherwise done is called with the outcome of the file once it was written
+	Admit func(file File) (done func(err error), err error)
+	// starts a second attempt at files whose transfer straggles if set, see speculate.go
+	Speculation *Speculation
+	// the files Priority returns true for, e.g. small metadata files, are copied by a lane of PriorityWorkers
+	// workers of their own (DefaultPriorityWorkers if 0), so they aren't queued behind large data files
+	Priority        func(file File) bool
+	PriorityWorkers int
+}
+
+// lists the files of 'from' to copy into 'to'
+func (e *Engine) Plan(from string, to string) (*Job, error) {
+	files, err := e.Source.List(from)
+	if err != nil {
+		return nil, err
+	}
+	return &Job{From: from, To: to, Files: files}, nil
+}
+
+// copies the files of the job and returns which were copied and which failed
+func (e *Engine) Run(job *Job) Result {
+	workers := e.Workers
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	var wg sync.WaitGroup
+	results := newCollector(len(job.Files))
+	var s *speculator
+	if e.Speculation != nil {
+		s = &speculator{Speculation: *e.Speculation}
+	}
+	// starts n workers copying the files sent to the returned queue until it's closed
+	startWorkers := func(n int) chan File {
+		queue := make(chan File)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for file := range queue {
+					res, err := e.copyFile(job.To, file, s)
+					results.record(file, res, err)
+				}
+			}()
+		}
+		return queue
+	}
+	files := job.Files
+	if e.Priority != nil {
+		var priority []File
+		files = make([]File, 0, len(job.Files))
+		for _, file := range job.Files {
+			if e.Priority(file) {
+				priority = append(priority, file)
+			} else {
+				files = append(files, file)
+			}
+		}
+		laneWorkers := e.PriorityWorkers
+		if laneWorkers <= 0 {
+			laneWorkers = DefaultPriorityWorkers
+		}
+		lane := startWorkers(laneWorkers)
+		go func() {
+			for _, file := range priority {
+				lane <- file
+			}
+			close(lane)
+		}()
+	}
+	queue := startWorkers(workers)
+	for _, file := range files {
+		queue <- file
+	}
+	close(queue)
+	wg.Wait()
+	return results.result
+}
+
+// collects the outcome of each file from the workers of a run. a file is recorded once, as copied or failed,
+// however many attempts the workers made at it
+type collector struct {
+	mu       sync.Mutex
+	result   Result
+	recorded map[string]bool
+}
+
+func newCollector(files int) *collector {
+	return &collector{
+		result:   Result{Copied: make([]Copied, 0, files), Failed: make([]Failed, 0)},
+		recorded: make(map[string]bool, files),
+	}
+}
+
+func (c *collector) record(file File, res WriteResult, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.recorded[file.Path] {
+		return
+	}
+	c.recorded[file.Path] = true
+	if err != nil {
+		c.result.Failed = append(c.result.Failed, Failed{file, err})
+	} else {
+		c.result.Copied = append(c.result.Copied, Copied{file, res, time.Now()})
+	}
+}
+
+// turns a panic of the source or sink while copying file into its error, deferred by whatever runs them. one
+// bad file then neither crashes the process nor leaves the rest of the queue stuck behind its worker
+func catchPanic(file File, err *error) {
+	if p := recover(); p != nil {
+		*err = fmt.Errorf("copying %s panicked: %v", file.Path, p)
+	}
+}
+
+// plans and runs a job copying the files of 'from' into 'to'
+func (e *Engine) Copy(from string, to string) (Result, error) {
+	job, err := e.Plan(from, to)
+	if err != nil {
+		return Result{}, err
+	}
+	return e.Run(job), nil
+}
+
+func (e *Engine) copyFile(to string, file File, s *speculator) (res WriteResult, err error) {
+	write := e.write
+	if s != nil {
+		write = func(to string, file File) (WriteResult, error) { return e.writeSpeculatively(to, file, s) }
+	}
+	if e.Admit != nil {
+		done, admitErr := e.Admit(file)
+		if admitErr != nil {
+			return WriteResult{}, admitErr
+		}
+		// with the outcome set by catchPanic too, which runs first
+		defer func() { done(err) }()
+	}
+	defer catchPanic(file, &err)
+	return write(to, file)
+}
+
+func (e *Engine) write(to string, file File) (WriteResult, error) {
+	r, err := e.Source.Open(file)
+	if err != nil {
+		return WriteResult{}, err
+	}
+	defer r.Close()
+	return e.Sink.Write(to, file, r)
+}
@@ -0,0 +1,203 @@
+package fastcopy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// an in-memory directory tree
+type memSource map[string]map[string]string
+
+func (m memSource) List(dir string) ([]File, error) {
+	files, ok := m[dir]
+	if !ok {
+		return nil, fmt.Errorf("%s does not exist", dir)
+	}
+	list := make([]File, 0, len(files))
+	for name, data := range files {
+		list = append(list, File{Path: dir + "/" + name, Name: name, Size: int64(len(data))})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+func (m memSource) Open(file File) (io.ReadCloser, error) {
+	dir := file.Path[:strings.LastIndex(file.Path, "/")]
+	return io.NopCloser(strings.NewReader(m[dir][file.Name])), nil
+}
+
+type memSink struct {
+	mu    sync.Mutex
+	files map[string]string
+}
+
+func (m *memSink) Write(to string, file File, r io.Reader) (WriteResult, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return WriteResult{}, err
+	}
+	if file.Name == "broken" {
+		return WriteResult{}, errors.New("disk full")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[to+"/"+file.Name] = string(data)
+	return WriteResult{Path: to + "/" + file.Name, Written: int64(len(data))}, nil
+}
+
+func TestEngineCopy(t *testing.T) {
+	source := memSource{"/src": {"a": "hello", "b": "world!", "broken": "x"}}
+	sink := &memSink{files: make(map[string]string)}
+	var admitted, done int32
+	engine := &Engine{Source: source, Sink: sink, Workers: 2, Admit: func(f File) (func(error), error) {
+		atomic.AddInt32(&admitted, 1)
+		return func(error) { atomic.AddInt32(&done, 1) }, nil
+	}}
+
+	result, err := engine.Copy("/src", "/dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Copied) != 2 || sink.files["/dst/a"] != "hello" || sink.files["/dst/b"] != "world!" {
+		t.Errorf("expected a and b to be copied, got %+v", sink.files)
+	}
+	if len(result.Failed) != 1 || result.Failed[0].File.Name != "broken" {
+		t.Errorf("expected broken to fail, got %+v", result.Failed)
+	}
+	if admitted != 3 || done != 3 {
+		t.Errorf("expected every file to be admitted and done, got %d and %d", admitted, done)
+	}
+
+	engine.Admit = func(f File) (func(error), error) { return nil, errors.New("no capacity") }
+	result = engine.Run(&Job{To: "/dst", Files: []File{{Path: "/src/a", Name: "a"}}})
+	if len(result.Failed) != 1 || result.Failed[0].Err.Error() != "no capacity" {
+		t.Errorf("expected admission errors to fail the file, got %+v", result)
+	}
+
+	if _, err := engine.Copy("/missing", "/dst"); err == nil {
+		t.Error("expected listing a missing dir to fail")
+	}
+}
+
+// a sink panicking on the files it's given
+type panickingSink struct{ Sink }
+
+func (p panickingSink) Write(to string, file File, r io.Reader) (WriteResult, error) {
+	if file.Name == "panics" {
+		var res *WriteResult
+		return *res, nil
+	}
+	return p.Sink.Write(to, file, r)
+}
+
+func TestEngineRecordsPanics(t *testing.T) {
+	source := memSource{"/src": {"a": "hello", "panics": "x", "b": "world!"}}
+	sink := panickingSink{&memSink{files: make(map[string]string)}}
+	var outcomes []error
+	var mu sync.Mutex
+	engine := &Engine{Source: source, Sink: sink, Workers: 1, Admit: func(f File) (func(error), error) {
+		return func(err error) {
+			mu.Lock()
+			outcomes = append(outcomes, err)
+			mu.Unlock()
+		}, nil
+	}}
+	result, err := engine.Copy("/src", "/dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Copied) != 2 || len(result.Failed) != 1 || !strings.Contains(result.Failed[0].Err.Error(), "/src/panics panicked") {
+		t.Errorf("expected the panicking file to fail and the rest to be copied, got %+v", result)
+	}
+	var failed int
+	for _, err := range outcomes {
+		if err != nil {
+			failed++
+		}
+	}
+	if len(outcomes) != 3 || failed != 1 {
+		t.Errorf("expected every admission to be done with its outcome, got %v", outcomes)
+	}
+
+	_, err = TeeSink{Sinks: []Sink{sink, &memSink{files: make(map[string]string)}}}.Write("/dst", File{Path: "/src/panics", Name: "panics"}, strings.NewReader("x"))
+	var tee *TeeError
+	if !errors.As(err, &tee) || tee.Errs[0] == nil || tee.Errs[1] != nil {
+		t.Errorf("expected only the panicking sink of a tee to fail, got %v", err)
+	}
+}
+
+// a sink holding large files until released
+type blockingSink struct {
+	release chan struct{}
+	written chan string
+}
+
+func (b *blockingSink) Write(to string, file File, r io.Reader) (WriteResult, error) {
+	if file.Size > 4 {
+		<-b.release
+	}
+	b.written <- file.Name
+	return WriteResult{Written: file.Size}, nil
+}
+
+func TestEnginePriorityLane(t *testing.T) {
+	source := memSource{"/src": {"a-large": "data data", "b-large": "more data", "_SUCCESS": ""}}
+	sink := &blockingSink{release: make(chan struct{}), written: make(chan string, 3)}
+	engine := &Engine{Source: source, Sink: sink, Workers: 1, Priority: func(f File) bool { return f.Size <= 4 }}
+	done := make(chan Result)
+	go func() {
+		result, _ := engine.Copy("/src", "/dst")
+		done <- result
+	}()
+	select {
+	case name := <-sink.written:
+		if name != "_SUCCESS" {
+			t.Errorf("expected _SUCCESS to be written first, got %s", name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the small file to be copied while the large ones are held up")
+	}
+	close(sink.release)
+	if result := <-done; len(result.Copied) != 3 {
+		t.Errorf("expected every file to be copied, got %+v", result)
+	}
+}
+
+func TestHTTPSink(t *testing.T) {
+	corrupt := false
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		if corrupt {
+			data = append(data, '!')
+		}
+		sum := sha256.Sum256(data)
+		json.NewEncoder(w).Encode(WriteResult{Path: r.URL.Query().Get("to") + "/" + r.URL.Query().Get("fileName"), Written: int64(len(data)), SHA256: base64.StdEncoding.EncodeToString(sum[:])})
+	}))
+	defer peer.Close()
+
+	sink := HTTPSink{TargetURL: peer.URL + "/upload"}
+	res, err := sink.Write("/dst", File{Name: "a b"}, bytes.NewReader([]byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Path != "/dst/a b" || res.Written != 5 {
+		t.Errorf("unexpected result %+v", res)
+	}
+	corrupt = true
+	if _, err := sink.Write("/dst", File{Name: "a"}, bytes.NewReader([]byte("hello"))); err == nil {
+		t.Error("expected a digest mismatch to fail the write")
+	}
+}
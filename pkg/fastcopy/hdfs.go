@@ -0,0 +1,41 @@
+package fastcopy
+
+import (
+	"io"
+	"path"
+
+	"github.com/colinmarc/hdfs/v2"
+)
+
+// reads files from hdfs
+type HDFSSource struct {
+	Client *hdfs.Client
+	// chunks of DefaultPrefetchChunkSize read ahead of the sink, see Prefetch. 0 reads synchronously
+	ReadAhead int
+}
+
+func (s HDFSSource) List(dir string) ([]File, error) {
+	infos, err := s.Client.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]File, 0, len(infos))
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		files = append(files, File{Path: path.Join(dir, info.Name()), Name: info.Name(), Size: info.Size()})
+	}
+	return files, nil
+}
+
+func (s HDFSSource) Open(file File) (io.ReadCloser, error) {
+	r, err := s.Client.Open(file.Path)
+	if err != nil {
+		return nil, err
+	}
+	if s.ReadAhead <= 0 {
+		return r, nil
+	}
+	return Prefetch(r, s.ReadAhead, DefaultPrefetchChunkSize), nil
+}
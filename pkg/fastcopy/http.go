@@ -0,0 +1,58 @@
+package fastcopy
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// a non-OK response from the peer
+type StatusError struct {
+	StatusCode int
+	Msg        string
+}
+
+func (e *StatusError) Error() string {
+	return e.Msg
+}
+
+// sends files to a fastcopy peer's /upload endpoint, which writes them to its cluster.
+// the sha256 the peer computed is checked against the bytes sent
+type HTTPSink struct {
+	TargetURL string       // e.g. http://peer:8080/upload
+	Client    *http.Client // http.DefaultClient if nil
+}
+
+func (s HTTPSink) Write(to string, file File, r io.Reader) (WriteResult, error) {
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	params := url.Values{"fileName": {file.Name}, "to": {to}}
+	if file.Attempt > 0 {
+		params.Set("attempt", strconv.Itoa(file.Attempt))
+	}
+	uploadURL := s.TargetURL + "?" + params.Encode()
+	digest := sha256.New()
+	resp, err := client.Post(uploadURL, "application/octet-stream", io.TeeReader(r, digest))
+	if err != nil {
+		return WriteResult{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return WriteResult{}, &StatusError{resp.StatusCode, fmt.Sprintf("/upload returned non-OK status for file '%s': %d", file.Name, resp.StatusCode)}
+	}
+	var res WriteResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return WriteResult{}, fmt.Errorf("/upload returned an unreadable response for file '%s': %w", file.Name, err)
+	}
+	if sent := base64.StdEncoding.EncodeToString(digest.Sum(nil)); res.SHA256 != "" && res.SHA256 != sent {
+		return res, fmt.Errorf("peer wrote sha256 %s for file '%s', sent %s", res.SHA256, file.Name, sent)
+	}
+	return res, nil
+}
@@ -0,0 +1,127 @@
+package fastcopy
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// the segments ParallelRead splits a file into unless told otherwise
+const DefaultSegmentSize = 8 << 20
+
+var errParallelClosed = errors.New("fastcopy: read from closed parallel reader")
+
+// ParallelRead reads the first 'size' bytes of a file through several readers of it at once and returns them
+// reassembled in order. The file is split into segments of segmentSize bytes and reader i reads segments i,
+// i+len(readers), ... so a large file is read from several datanodes in parallel instead of one block pipeline.
+// At most one segment per reader is buffered. Closing the returned reader closes all readers
+func ParallelRead(readers []io.ReadSeekCloser, size int64, segmentSize int64) io.ReadCloser {
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+	p := &parallelReader{
+		readers:     readers,
+		size:        size,
+		segmentSize: segmentSize,
+		segments:    make([]chan segment, len(readers)),
+		stop:        make(chan struct{}),
+	}
+	for i := range readers {
+		p.segments[i] = make(chan segment)
+		p.wg.Add(1)
+		go p.stream(i)
+	}
+	return p
+}
+
+type segment struct {
+	data []byte
+	err  error
+}
+
+type parallelReader struct {
+	readers     []io.ReadSeekCloser
+	size        int64
+	segmentSize int64
+	segments    []chan segment // per reader, its segments in order
+	stop        chan struct{}
+	wg          sync.WaitGroup
+	next        int64 // the segment Read continues with
+	cur         []byte
+	err         error
+	closeOnce   sync.Once
+	closeErr    error
+}
+
+func (p *parallelReader) stream(i int) {
+	defer p.wg.Done()
+	r := p.readers[i]
+	for seg := int64(i); seg*p.segmentSize < p.size; seg += int64(len(p.readers)) {
+		off := seg * p.segmentSize
+		buf := make([]byte, min64(p.segmentSize, p.size-off))
+		_, err := r.Seek(off, io.SeekStart)
+		if err == nil {
+			_, err = io.ReadFull(r, buf)
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF // shorter than size
+		}
+		select {
+		case p.segments[i] <- segment{buf, err}:
+		case <-p.stop:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *parallelReader) Read(b []byte) (int, error) {
+	select {
+	case <-p.stop:
+		return 0, errParallelClosed
+	default:
+	}
+	for len(p.cur) == 0 {
+		if p.err != nil {
+			return 0, p.err
+		}
+		if p.next*p.segmentSize >= p.size {
+			return 0, io.EOF
+		}
+		select {
+		case s := <-p.segments[p.next%int64(len(p.readers))]:
+			p.next++
+			if p.err = s.err; p.err == nil {
+				p.cur = s.data
+			}
+		case <-p.stop:
+			p.err = errParallelClosed
+		}
+	}
+	n := copy(b, p.cur)
+	p.cur = p.cur[n:]
+	return n, nil
+}
+
+// stops the readers, waits for reads in progress to return and closes them
+func (p *parallelReader) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.stop)
+		p.wg.Wait()
+		for _, r := range p.readers {
+			if err := r.Close(); err != nil && p.closeErr == nil {
+				p.closeErr = err
+			}
+		}
+	})
+	return p.closeErr
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,83 @@
+package fastcopy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+)
+
+// a reader of a shared file that counts closes
+type seekSource struct {
+	*bytes.Reader
+	closes *int32
+}
+
+func (s seekSource) Close() error {
+	atomic.AddInt32(s.closes, 1)
+	return nil
+}
+
+func openSeekSources(data []byte, n int, closes *int32) []io.ReadSeekCloser {
+	readers := make([]io.ReadSeekCloser, n)
+	for i := range readers {
+		readers[i] = seekSource{bytes.NewReader(data), closes}
+	}
+	return readers
+}
+
+func TestParallelRead(t *testing.T) {
+	data := make([]byte, 100003)
+	rand.New(rand.NewSource(1)).Read(data)
+	for _, streams := range []int{1, 3, 8} {
+		for _, segmentSize := range []int64{1000, 4096, 1 << 20} {
+			var closes int32
+			r := ParallelRead(openSeekSources(data, streams, &closes), int64(len(data)), segmentSize)
+			got, err := io.ReadAll(r)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("%d streams of %d byte segments: expected the data unchanged, got %d bytes %v", streams, segmentSize, len(got), err)
+			}
+			r.Close()
+			if closes != int32(streams) {
+				t.Errorf("expected all %d readers closed, got %d", streams, closes)
+			}
+		}
+	}
+}
+
+func TestParallelReadOnlyReadsSize(t *testing.T) {
+	var closes int32
+	got, err := io.ReadAll(ParallelRead(openSeekSources([]byte("0123456789"), 2, &closes), 7, 2))
+	if err != nil || string(got) != "0123456" {
+		t.Errorf("expected the first 7 bytes, got %q %v", got, err)
+	}
+}
+
+func TestParallelReadShortFile(t *testing.T) {
+	var closes int32
+	r := ParallelRead(openSeekSources(make([]byte, 5000), 3, &closes), 8000, 1000)
+	got, err := io.ReadAll(r)
+	if !errors.Is(err, io.ErrUnexpectedEOF) || len(got) != 5000 {
+		t.Errorf("expected 5000 bytes then an unexpected EOF, got %d bytes %v", len(got), err)
+	}
+	if err := r.Close(); err != nil || closes != 3 {
+		t.Errorf("expected the readers closed after a failed read, got %d %v", closes, err)
+	}
+}
+
+func TestParallelReadClose(t *testing.T) {
+	var closes int32
+	r := ParallelRead(openSeekSources(make([]byte, 1<<20), 4, &closes), 1<<20, 1000)
+	if _, err := io.ReadFull(r, make([]byte, 2500)); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if closes != 4 {
+		t.Errorf("expected all readers closed, got %d", closes)
+	}
+	if _, err := r.Read(make([]byte, 10)); err == nil {
+		t.Error("expected reads after close to fail")
+	}
+}
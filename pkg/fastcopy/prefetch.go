@@ -0,0 +1,109 @@
+package fastcopy
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// the chunk size Prefetch reads in unless told otherwise
+const DefaultPrefetchChunkSize = 1 << 20
+
+var errPrefetchClosed = errors.New("fastcopy: read from closed prefetch reader")
+
+// Prefetch reads r ahead in a goroutine, keeping up to 'chunks' chunks of chunkSize bytes buffered, so reads from a
+// high-latency source overlap with whatever consumes the returned reader, e.g. an HTTP upload. Closing the returned
+// reader stops reading ahead and closes r
+func Prefetch(r io.ReadCloser, chunks int, chunkSize int) io.ReadCloser {
+	if chunkSize <= 0 {
+		chunkSize = DefaultPrefetchChunkSize
+	}
+	p := &prefetchReader{
+		src:  r,
+		full: make(chan []byte, chunks),
+		free: make(chan []byte, chunks+1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	// one buffer per queued chunk, plus one being filled and one being consumed
+	for i := 0; i < chunks+1; i++ {
+		p.free <- make([]byte, chunkSize)
+	}
+	go p.fill(make([]byte, chunkSize))
+	return p
+}
+
+type prefetchReader struct {
+	src       io.ReadCloser
+	full      chan []byte // chunks read ahead, in order. closed after the last one
+	free      chan []byte // buffers to read the next chunks into
+	stop      chan struct{}
+	done      chan struct{} // closed once fill returned and won't touch src anymore
+	err       error         // why fill stopped, read once full is closed
+	cur       []byte
+	buf       []byte // the buffer backing cur
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (p *prefetchReader) fill(buf []byte) {
+	defer close(p.done)
+	defer close(p.full)
+	for {
+		n, err := io.ReadFull(p.src, buf)
+		if n > 0 {
+			select {
+			case p.full <- buf[:n]:
+			case <-p.stop:
+				return
+			}
+		}
+		if err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			p.err = err
+			return
+		}
+		select {
+		case buf = <-p.free:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *prefetchReader) Read(b []byte) (int, error) {
+	select {
+	case <-p.stop:
+		return 0, errPrefetchClosed
+	default:
+	}
+	for len(p.cur) == 0 {
+		if p.buf != nil {
+			select {
+			case p.free <- p.buf:
+			default: // fill stopped and holds no buffer, every one came back
+			}
+			p.buf = nil
+		}
+		chunk, ok := <-p.full
+		if !ok {
+			return 0, p.err
+		}
+		p.cur, p.buf = chunk, chunk[:cap(chunk)]
+	}
+	n := copy(b, p.cur)
+	p.cur = p.cur[n:]
+	return n, nil
+}
+
+// stops reading ahead, waits for a read in progress to return and closes the source
+func (p *prefetchReader) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.stop)
+		<-p.done
+		p.closeErr = p.src.Close()
+	})
+	return p.closeErr
+}
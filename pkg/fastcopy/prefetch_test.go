@@ -0,0 +1,83 @@
+package fastcopy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// a source that counts how far it was read and whether it was closed
+type countingSource struct {
+	r      io.Reader
+	read   int64
+	closed int32
+}
+
+func (c *countingSource) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *countingSource) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return nil
+}
+
+func TestPrefetch(t *testing.T) {
+	data := make([]byte, 1000003)
+	rand.New(rand.NewSource(1)).Read(data)
+	for _, chunks := range []int{0, 1, 4} {
+		src := &countingSource{r: iotest.HalfReader(bytes.NewReader(data))}
+		r := Prefetch(src, chunks, 4096)
+		got, err := io.ReadAll(iotest.OneByteReader(io.LimitReader(r, 10)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rest, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(append(got, rest...), data) {
+			t.Errorf("%d chunks: expected the data unchanged", chunks)
+		}
+		r.Close()
+		if atomic.LoadInt32(&src.closed) != 1 {
+			t.Errorf("%d chunks: expected the source to be closed", chunks)
+		}
+	}
+}
+
+func TestPrefetchReadsAheadBounded(t *testing.T) {
+	src := &countingSource{r: bytes.NewReader(make([]byte, 1<<20))}
+	r := Prefetch(src, 4, 1024)
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	// give it time to read ahead: 4 queued chunks, the one being consumed and the one being filled
+	time.Sleep(50 * time.Millisecond)
+	if read := atomic.LoadInt64(&src.read); read > 6*1024 {
+		t.Errorf("expected at most 6 chunks read ahead, got %d bytes", read)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(buf); err == nil {
+		t.Error("expected reads after close to fail")
+	}
+}
+
+func TestPrefetchPropagatesErrors(t *testing.T) {
+	broken := errors.New("datanode went away")
+	src := &countingSource{r: io.MultiReader(bytes.NewReader(make([]byte, 5000)), iotest.ErrReader(broken))}
+	got, err := io.ReadAll(Prefetch(src, 2, 1024))
+	if !errors.Is(err, broken) || len(got) != 5000 {
+		t.Errorf("expected 5000 bytes then the source's error, got %d bytes and %v", len(got), err)
+	}
+}
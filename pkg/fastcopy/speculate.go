@@ -0,0 +1,140 @@
+package fastcopy
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// a transfer from a slow datanode or over a flaky route can take far longer than the others and hold up the end of
+// the job. with Engine.Speculation set, a file still being written once it took Factor times as long as the median
+// throughput of the finished files predicts is started a second time, as File.Attempt 1, and whichever attempt
+// finishes first is kept. the other one fails its next read, which aborts its write
+
+// errors the reads of the attempt that lost the race
+var ErrSpeculationLost = errors.New("another attempt at the file finished first")
+
+// when to start a second attempt at a straggling file
+type Speculation struct {
+	Factor     float64       // times the expected duration a transfer may take before it's a straggler
+	MinElapsed time.Duration // transfers running for less are never stragglers
+	MinSamples int           // finished files needed before the median throughput is trusted
+	Interval   time.Duration // how often running transfers are checked, a second if 0
+}
+
+// the throughput of the files finished so far
+type speculator struct {
+	Speculation
+	mu    sync.Mutex
+	rates []float64 // bytes per second
+}
+
+func (s *speculator) record(size int64, elapsed time.Duration) {
+	if size <= 0 || elapsed <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rates = append(s.rates, float64(size)/elapsed.Seconds())
+}
+
+// whether a transfer of size bytes running for elapsed is a straggler
+func (s *speculator) straggling(size int64, elapsed time.Duration) bool {
+	if elapsed < s.MinElapsed {
+		return false
+	}
+	s.mu.Lock()
+	if len(s.rates) < s.MinSamples || len(s.rates) == 0 {
+		s.mu.Unlock()
+		return false
+	}
+	rates := append([]float64(nil), s.rates...)
+	s.mu.Unlock()
+	sort.Float64s(rates)
+	median := rates[len(rates)/2]
+	expected := time.Duration(float64(size) / median * float64(time.Second))
+	return float64(elapsed) > s.Factor*float64(expected)
+}
+
+// a reader failing with ErrSpeculationLost once cancelled
+type cancelReader struct {
+	r         io.Reader
+	cancelled atomic.Bool
+}
+
+func (c *cancelReader) Read(p []byte) (int, error) {
+	if c.cancelled.Load() {
+		return 0, ErrSpeculationLost
+	}
+	return c.r.Read(p)
+}
+
+// writes the file, starting a second attempt if the first one straggles, and returns the first to succeed.
+// the attempt that lost is left to fail on its own
+func (e *Engine) writeSpeculatively(to string, file File, s *speculator) (WriteResult, error) {
+	type outcome struct {
+		res     WriteResult
+		err     error
+		elapsed time.Duration
+	}
+	outcomes := make(chan outcome, 2)
+	var attempts []*cancelReader
+	start := func(attempt int) {
+		f := file
+		f.Attempt = attempt
+		c := &cancelReader{}
+		attempts = append(attempts, c)
+		go func() {
+			started := time.Now()
+			res, err := e.writeCancelable(to, f, c)
+			outcomes <- outcome{res, err, time.Since(started)}
+		}()
+	}
+	interval := s.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	started := time.Now()
+	start(0)
+	var firstErr error
+	for pending := 1; pending > 0; {
+		select {
+		case o := <-outcomes:
+			pending--
+			if o.err == nil {
+				for _, c := range attempts {
+					c.cancelled.Store(true)
+				}
+				s.record(file.Size, o.elapsed)
+				return o.res, nil
+			}
+			if firstErr == nil {
+				firstErr = o.err
+			}
+		case <-ticker.C:
+			if len(attempts) == 1 && s.straggling(file.Size, time.Since(started)) {
+				start(1)
+				pending++
+			}
+		}
+	}
+	return WriteResult{}, firstErr
+}
+
+// like write, reading through c so the attempt can be cancelled
+func (e *Engine) writeCancelable(to string, file File, c *cancelReader) (res WriteResult, err error) {
+	defer catchPanic(file, &err)
+	r, err := e.Source.Open(file)
+	if err != nil {
+		return WriteResult{}, err
+	}
+	defer r.Close()
+	c.r = r
+	return e.Sink.Write(to, file, c)
+}
@@ -0,0 +1,67 @@
+package fastcopy
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a sink whose first attempt at "slow" reads a byte at a time, like a transfer from a struggling datanode
+type stragglingSink struct {
+	mu       sync.Mutex
+	attempts map[int]int
+	lost     chan error
+}
+
+func (s *stragglingSink) Write(to string, file File, r io.Reader) (WriteResult, error) {
+	s.mu.Lock()
+	s.attempts[file.Attempt]++
+	s.mu.Unlock()
+	if file.Name == "slow" && file.Attempt == 0 {
+		var data []byte
+		b := make([]byte, 1)
+		for {
+			time.Sleep(20 * time.Millisecond)
+			n, err := r.Read(b)
+			data = append(data, b[:n]...)
+			if err == io.EOF {
+				return WriteResult{Written: int64(len(data))}, nil
+			}
+			if err != nil {
+				s.lost <- err
+				return WriteResult{}, err
+			}
+		}
+	}
+	data, err := io.ReadAll(r)
+	return WriteResult{Path: to + "/" + file.Name, Written: int64(len(data))}, err
+}
+
+func TestEngineSpeculation(t *testing.T) {
+	source := memSource{"/src": {"a": "hello", "b": "world", "c": "again", "slow": "slow contents"}}
+	sink := &stragglingSink{attempts: make(map[int]int), lost: make(chan error, 1)}
+	engine := &Engine{Source: source, Sink: sink, Workers: 1, Speculation: &Speculation{
+		Factor: 2, MinElapsed: 10 * time.Millisecond, MinSamples: 3, Interval: 5 * time.Millisecond,
+	}}
+
+	result, err := engine.Copy("/src", "/dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Copied) != 4 || len(result.Failed) != 0 {
+		t.Fatalf("expected every file to be copied, got %+v", result)
+	}
+	if sink.attempts[1] != 1 || sink.attempts[0] != 4 {
+		t.Errorf("expected one speculative attempt, got %v", sink.attempts)
+	}
+	select {
+	case err := <-sink.lost:
+		if !errors.Is(err, ErrSpeculationLost) {
+			t.Errorf("expected the straggling attempt to be cancelled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected the straggling attempt to be cancelled")
+	}
+}
@@ -0,0 +1,101 @@
+package fastcopy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// a sink that failed its write stops reading, the tee carries on with the others
+var errSinkStopped = errors.New("sink stopped reading")
+
+// writes every file to all of Sinks at once, e.g. to replicate a cluster to two DR sites, reading the source a
+// single time: what's read is teed to the sinks as it streams, so the slowest sink sets the pace. a sink failing
+// doesn't stop the others, the write then fails with a *TeeError
+type TeeSink struct {
+	Sinks []Sink
+}
+
+// the outcome of each sink of a TeeSink write that failed on some of them, in the order of Sinks. Errs is nil
+// for the sinks that wrote the file
+type TeeError struct {
+	Results []WriteResult
+	Errs    []error
+}
+
+func (e *TeeError) Error() string {
+	msgs := make([]string, 0, len(e.Errs))
+	for i, err := range e.Errs {
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("sink %d: %s", i, err))
+		}
+	}
+	return fmt.Sprintf("%d of %d sinks failed: %s", len(msgs), len(e.Errs), strings.Join(msgs, "; "))
+}
+
+func (e *TeeError) Unwrap() []error {
+	return e.Errs
+}
+
+// returns the result of the first sink if all of them wrote the file
+func (s TeeSink) Write(to string, file File, r io.Reader) (WriteResult, error) {
+	n := len(s.Sinks)
+	readers := make([]*io.PipeReader, n)
+	writers := make([]*io.PipeWriter, n)
+	for i := range s.Sinks {
+		readers[i], writers[i] = io.Pipe()
+	}
+	results := make([]WriteResult, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i, sink := range s.Sinks {
+		wg.Add(1)
+		go func(i int, sink Sink) {
+			defer wg.Done()
+			defer readers[i].CloseWithError(errSinkStopped)
+			defer catchPanic(file, &errs[i])
+			results[i], errs[i] = sink.Write(to, file, readers[i])
+		}(i, sink)
+	}
+	tee(r, writers)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return WriteResult{}, &TeeError{results, errs}
+		}
+	}
+	return results[0], nil
+}
+
+// copies r into all of writers until it ends, leaving out the writers whose reader stopped. the writers are
+// closed with the error r ended with
+func tee(r io.Reader, writers []*io.PipeWriter) {
+	live := make([]*io.PipeWriter, len(writers))
+	copy(live, writers)
+	buf := make([]byte, 32*1024)
+	for len(live) > 0 {
+		n, err := r.Read(buf)
+		if n > 0 {
+			for i := 0; i < len(live); i++ {
+				if _, werr := live[i].Write(buf[:n]); werr != nil {
+					live = append(live[:i], live[i+1:]...)
+					i--
+				}
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			for _, w := range writers {
+				w.CloseWithError(err)
+			}
+			return
+		}
+	}
+	for _, w := range writers {
+		w.Close()
+	}
+}
@@ -0,0 +1,44 @@
+package fastcopy
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// a sink failing before it reads anything
+type refusingSink struct{}
+
+func (refusingSink) Write(to string, file File, r io.Reader) (WriteResult, error) {
+	return WriteResult{}, errors.New("target unavailable")
+}
+
+func TestTeeSink(t *testing.T) {
+	first, second := &memSink{files: make(map[string]string)}, &memSink{files: make(map[string]string)}
+	data := strings.Repeat("0123456789", 10000)
+	res, err := TeeSink{Sinks: []Sink{first, second}}.Write("/dst", File{Name: "a"}, strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Written != int64(len(data)) || first.files["/dst/a"] != data || second.files["/dst/a"] != data {
+		t.Errorf("expected both sinks to get the whole file, got %d and %d bytes", len(first.files["/dst/a"]), len(second.files["/dst/a"]))
+	}
+
+	_, err = TeeSink{Sinks: []Sink{refusingSink{}, first}}.Write("/dst", File{Name: "b"}, strings.NewReader(data))
+	var tee *TeeError
+	if !errors.As(err, &tee) || tee.Errs[0] == nil || tee.Errs[1] != nil {
+		t.Fatalf("expected only the refusing sink to fail, got %v", err)
+	}
+	if first.files["/dst/b"] != data || tee.Results[1].Written != int64(len(data)) {
+		t.Error("expected the other sink to carry on with the whole file")
+	}
+
+	source := io.MultiReader(strings.NewReader("abc"), iotest.ErrReader(errors.New("read failed")))
+	if _, err := (TeeSink{Sinks: []Sink{first, second}}).Write("/dst", File{Name: "c"}, source); err == nil {
+		t.Error("expected a source error to fail every sink")
+	} else if tee, ok := err.(*TeeError); !ok || tee.Errs[0] == nil || tee.Errs[1] == nil {
+		t.Errorf("expected both sinks to fail, got %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/briansterle/cluster-fastcopy/pkg/fastcopy"
+	"github.com/colinmarc/hdfs/v2"
+)
+
+// AIMD concurrency control for a single job: the number of parallel transfers grows by one
+// per round of healthy transfers and is halved when uploads time out, the peer answers 5xx,
+// the namenode reports overload or a transfer runs much slower than the job's baseline
+type aimdLimiter struct {
+	mu           sync.Mutex
+	cond         *sync.Cond
+	limit        float64
+	max          float64
+	active       int
+	lastDecrease time.Time
+	baseline     float64 // moving average of seconds per MB of healthy transfers
+}
+
+const (
+	initialAdaptiveWorkers = 4
+	slowTransferFactor     = 3 // a transfer this many times slower than the baseline counts as congestion
+	baselineWeight         = 0.2
+)
+
+func newAIMDLimiter(max int) *aimdLimiter {
+	initial := float64(initialAdaptiveWorkers)
+	if initial > float64(max) {
+		initial = float64(max)
+	}
+	l := &aimdLimiter{limit: initial, max: float64(max)}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// blocks until another transfer may start, returns its start time for release
+func (l *aimdLimiter) acquire() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for float64(l.active) >= l.limit {
+		l.cond.Wait()
+	}
+	l.active++
+	return time.Now()
+}
+
+// records the outcome of a transfer started at 'start' and adjusts the limit
+func (l *aimdLimiter) release(start time.Time, size int64, err error) {
+	elapsed := time.Since(start).Seconds()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	defer l.cond.Broadcast()
+
+	congested := isCongestionSignal(err)
+	if err == nil && size >= 1024*1024 {
+		perMB := elapsed / (float64(size) / (1024 * 1024))
+		if l.baseline > 0 && perMB > slowTransferFactor*l.baseline {
+			congested = true
+		} else if l.baseline == 0 {
+			l.baseline = perMB
+		} else {
+			l.baseline = (1-baselineWeight)*l.baseline + baselineWeight*perMB
+		}
+	}
+
+	switch {
+	case congested:
+		// transfers that were already running when we backed off don't count again
+		if start.Before(l.lastDecrease) {
+			return
+		}
+		l.limit /= 2
+		if l.limit < 1 {
+			l.limit = 1
+		}
+		l.lastDecrease = time.Now()
+		log.Printf("adaptive concurrency: backing off to %d parallel transfers", int(l.limit))
+	case err == nil:
+		before := int(l.limit)
+		l.limit += 1 / l.limit
+		if l.limit > l.max {
+			l.limit = l.max
+		}
+		if int(l.limit) > before {
+			log.Printf("adaptive concurrency: ramping up to %d parallel transfers", int(l.limit))
+		}
+	}
+}
+
+// the current number of allowed parallel transfers
+func (l *aimdLimiter) current() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+// namenode exceptions signalling it is overloaded or failing over
+var overloadExceptions = []string{"RetriableException", "StandbyException", "ServerTooBusy", "CallQueueOverflowException"}
+
+// whether a transfer error means the source namenode, the network or the peer is overloaded
+// (as opposed to a problem with the file itself)
+func isCongestionSignal(err error) bool {
+	if err == nil {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var statusErr *fastcopy.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= http.StatusInternalServerError || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	var remoteErr hdfs.Error
+	if errors.As(err, &remoteErr) {
+		for _, e := range overloadExceptions {
+			if strings.Contains(remoteErr.Exception(), e) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/briansterle/cluster-fastcopy/pkg/fastcopy"
+)
+
+func TestAIMDLimiter(t *testing.T) {
+	l := newAIMDLimiter(16)
+	if l.current() != initialAdaptiveWorkers {
+		t.Fatalf("expected to start with %d workers, got %d", initialAdaptiveWorkers, l.current())
+	}
+
+	for i := 0; i < 40; i++ {
+		l.release(l.acquire(), 0, nil)
+	}
+	grown := l.current()
+	if grown <= initialAdaptiveWorkers {
+		t.Errorf("expected healthy transfers to ramp up concurrency, got %d", grown)
+	}
+
+	// two concurrent failures in the same round only halve the limit once
+	a, b := l.acquire(), l.acquire()
+	overloaded := &fastcopy.StatusError{StatusCode: 503, Msg: "unavailable"}
+	l.release(a, 0, overloaded)
+	l.release(b, 0, overloaded)
+	if l.current() != grown/2 {
+		t.Errorf("expected limit to halve to %d, got %d", grown/2, l.current())
+	}
+
+	time.Sleep(time.Millisecond)
+	l.release(l.acquire(), 0, &fastcopy.StatusError{StatusCode: 404, Msg: "not found"})
+	if l.current() != grown/2 {
+		t.Errorf("expected 4xx to leave the limit alone, got %d", l.current())
+	}
+}
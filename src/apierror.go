@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// every endpoint answers errors with the same JSON envelope,
+// {"error": {"code": "NOT_FOUND", "status": 404, "message": "...", "retriable": false}}, whose code is the gRPC
+// status code matching the http status, so clients can tell what went wrong without parsing messages. the reports
+// of /copy, /bench and /selftest are sent whole even when the work they describe failed
+
+// the body of an error response
+type APIError struct {
+	Code      string        `json:"code"`   // the gRPC status code name, e.g. INVALID_ARGUMENT
+	Status    int           `json:"status"` // the http status it was answered with
+	Message   string        `json:"message"`
+	Details   []interface{} `json:"details,omitempty"`
+	Retriable bool          `json:"retriable"` // whether the same request may succeed later
+}
+
+type errorEnvelope struct {
+	Error APIError `json:"error"`
+}
+
+// the gRPC status code names of the http statuses, as mapped by grpc-gateway
+var grpcCodes = map[int]string{
+	http.StatusBadRequest:                   "INVALID_ARGUMENT",
+	http.StatusUnauthorized:                 "UNAUTHENTICATED",
+	http.StatusForbidden:                    "PERMISSION_DENIED",
+	http.StatusNotFound:                     "NOT_FOUND",
+	http.StatusMethodNotAllowed:             "UNIMPLEMENTED",
+	http.StatusConflict:                     "ABORTED",
+	http.StatusPreconditionFailed:           "FAILED_PRECONDITION",
+	http.StatusRequestEntityTooLarge:        "OUT_OF_RANGE",
+	http.StatusRequestedRangeNotSatisfiable: "OUT_OF_RANGE",
+	http.StatusUnprocessableEntity:          "DATA_LOSS",
+	http.StatusTooManyRequests:              "RESOURCE_EXHAUSTED",
+	499:                                     "CANCELLED",
+	http.StatusInternalServerError:          "INTERNAL",
+	http.StatusNotImplemented:               "UNIMPLEMENTED",
+	http.StatusBadGateway:                   "UNAVAILABLE",
+	http.StatusServiceUnavailable:           "UNAVAILABLE",
+	http.StatusGatewayTimeout:               "DEADLINE_EXCEEDED",
+}
+
+// the codes of errors that may go away by themselves, so a client can retry
+var retriableCodes = map[string]bool{"UNAVAILABLE": true, "RESOURCE_EXHAUSTED": true, "DEADLINE_EXCEEDED": true, "ABORTED": true}
+
+func grpcCode(status int) string {
+	if code, ok := grpcCodes[status]; ok {
+		return code
+	}
+	if status >= http.StatusInternalServerError {
+		return "INTERNAL"
+	}
+	return "UNKNOWN"
+}
+
+func newAPIError(msg string, status int, details ...interface{}) APIError {
+	code := grpcCode(status)
+	return APIError{Code: code, Status: status, Message: strings.TrimSpace(msg), Details: details, Retriable: retriableCodes[code]}
+}
+
+// answers the request with an error envelope, in place of http.Error
+func writeError(w http.ResponseWriter, msg string, status int, details ...interface{}) {
+	body, _ := json.Marshal(errorEnvelope{newAPIError(msg, status, details...)})
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body)
+	w.Write([]byte("\n"))
+}
+
+// sends a report of work that failed, e.g. a copy's response, with the status of the failure
+func writeReport(w http.ResponseWriter, report []byte, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(report)
+}
+
+// the message of a peer's error response, or its body as it is for peers predating the error envelope
+func peerErrorMessage(body []byte) string {
+	var envelope errorEnvelope
+	if err := json.Unmarshal(body, &envelope); err == nil && envelope.Error.Code != "" {
+		return envelope.Error.Message
+	}
+	return string(bytes.TrimSpace(body))
+}
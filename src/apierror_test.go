@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestErrorEnvelope(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleJobs(rec, httptest.NewRequest("GET", "/jobs/missing", nil))
+	var envelope errorEnvelope
+	if err := json.Unmarshal(rec.Body.Bytes(), &envelope); err != nil {
+		t.Fatalf("expected an error envelope, got %s", rec.Body)
+	}
+	if rec.Code != http.StatusNotFound || rec.Header().Get("Content-Type") != "application/json" ||
+		envelope.Error.Code != "NOT_FOUND" || envelope.Error.Status != 404 || envelope.Error.Retriable || envelope.Error.Message != "job missing not found" {
+		t.Errorf("unexpected error %d %+v", rec.Code, envelope.Error)
+	}
+
+	for status, want := range map[int]string{400: "INVALID_ARGUMENT", 409: "ABORTED", 503: "UNAVAILABLE", 507: "INTERNAL", 418: "UNKNOWN"} {
+		if err := newAPIError("", status); err.Code != want || err.Retriable != retriableCodes[want] {
+			t.Errorf("%d: expected %s, got %+v", status, want, err)
+		}
+	}
+	if !newAPIError("", http.StatusServiceUnavailable).Retriable || newAPIError("", http.StatusBadRequest).Retriable {
+		t.Error("expected only transient errors to be retriable")
+	}
+
+	if msg := peerErrorMessage(rec.Body.Bytes()); msg != "job missing not found" {
+		t.Errorf("expected the envelope's message, got %q", msg)
+	}
+	if msg := peerErrorMessage([]byte("old peer says no\n")); msg != "old peer says no" {
+		t.Errorf("expected the body of a peer predating the envelope, got %q", msg)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// large or sensitive copies need a second pair of eyes. a copy of more than FASTCOPY_APPROVAL_MAX_BYTES or
+// FASTCOPY_APPROVAL_MAX_FILES, or reading or writing below a prefix of FASTCOPY_APPROVAL_PROTECTED, is planned
+// and then waits as pending_approval, moving nothing, until someone other than its submitter approves it with
+// POST /jobs/{id}/approve?by=<identity>. POST /jobs/{id}/reject?by=<identity> turns it down, as does the
+// caller going away or FASTCOPY_APPROVAL_TIMEOUT (24h by default) passing. a pending /copy keeps its request
+// open, use heartbeat=<interval> to keep it alive through proxies. identities are the ones callers claim with
+// 'submittedBy' and 'by', authenticate them in front of fastcopy
+
+const (
+	// a /copy waiting for approval
+	StatePendingApproval = "pending_approval"
+	// a /copy turned down, or not approved in time
+	StateRejected = "rejected"
+
+	defaultApprovalTimeout = 24 * time.Hour
+)
+
+// what makes a copy need approval
+type approvalPolicy struct {
+	maxBytes  int64    // 0 for no limit
+	maxFiles  int      // 0 for no limit
+	protected []string // path prefixes
+	timeout   time.Duration
+}
+
+var (
+	approvalSettings     approvalPolicy
+	approvalSettingsOnce sync.Once
+)
+
+// parses FASTCOPY_APPROVAL_MAX_BYTES, FASTCOPY_APPROVAL_MAX_FILES, FASTCOPY_APPROVAL_PROTECTED and
+// FASTCOPY_APPROVAL_TIMEOUT
+func loadApprovalPolicy() (approvalPolicy, error) {
+	p := approvalPolicy{timeout: defaultApprovalTimeout}
+	if v := os.Getenv("FASTCOPY_APPROVAL_MAX_BYTES"); v != "" {
+		n, err := parseByteSize(v)
+		if err != nil || n == 0 {
+			return p, fmt.Errorf("invalid FASTCOPY_APPROVAL_MAX_BYTES '%s', expected a byte size like 10T", v)
+		}
+		p.maxBytes = n
+	}
+	if v := os.Getenv("FASTCOPY_APPROVAL_MAX_FILES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return p, fmt.Errorf("invalid FASTCOPY_APPROVAL_MAX_FILES '%s', expected a positive integer", v)
+		}
+		p.maxFiles = n
+	}
+	for _, prefix := range strings.Split(os.Getenv("FASTCOPY_APPROVAL_PROTECTED"), ",") {
+		if prefix = strings.TrimSpace(prefix); prefix == "" {
+			continue
+		}
+		if !path.IsAbs(prefix) {
+			return p, fmt.Errorf("invalid FASTCOPY_APPROVAL_PROTECTED prefix '%s', expected an absolute path", prefix)
+		}
+		p.protected = append(p.protected, path.Clean(prefix))
+	}
+	if v := os.Getenv("FASTCOPY_APPROVAL_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return p, fmt.Errorf("invalid FASTCOPY_APPROVAL_TIMEOUT '%s', expected a duration like 24h", v)
+		}
+		p.timeout = d
+	}
+	return p, nil
+}
+
+// lazy loads the approval policy
+func getApprovalPolicy() approvalPolicy {
+	approvalSettingsOnce.Do(func() {
+		p, err := loadApprovalPolicy()
+		if err != nil {
+			log.Fatal(err)
+		}
+		approvalSettings = p
+	})
+	return approvalSettings
+}
+
+// why a copy of files and bytes reading froms and writing 'to' needs approval, nil if it doesn't
+func (p approvalPolicy) reasons(files int, bytes int64, froms []string, to string) []string {
+	var reasons []string
+	if p.maxBytes > 0 && bytes > p.maxBytes {
+		reasons = append(reasons, fmt.Sprintf("copies %d bytes, more than %d", bytes, p.maxBytes))
+	}
+	if p.maxFiles > 0 && files > p.maxFiles {
+		reasons = append(reasons, fmt.Sprintf("copies %d files, more than %d", files, p.maxFiles))
+	}
+	for _, prefix := range p.protected {
+		for _, from := range froms {
+			if from = path.Clean(from); from == prefix || within(from, prefix) || within(prefix, from) {
+				reasons = append(reasons, fmt.Sprintf("reads %s, protected by %s", from, prefix))
+			}
+		}
+		if to := path.Clean(to); to == prefix || within(to, prefix) || within(prefix, to) {
+			reasons = append(reasons, fmt.Sprintf("writes %s, protected by %s", to, prefix))
+		}
+	}
+	return reasons
+}
+
+// the approval a job waits or waited for
+type JobApproval struct {
+	Reasons     []string   `json:"reasons"`
+	SubmittedBy string     `json:"submittedBy"`
+	ApprovedBy  string     `json:"approvedBy,omitempty"`
+	RejectedBy  string     `json:"rejectedBy,omitempty"`
+	DecidedAt   *time.Time `json:"decidedAt,omitempty"`
+
+	decided chan struct{} // closed once approved or rejected
+}
+
+var errNotApproved = errors.New("not approved")
+
+// holds the job as pending_approval until it's approved, returning errNotApproved when it's rejected, times out
+// or ctx is done
+func (j *Job) awaitApproval(ctx context.Context, reasons []string, submittedBy string, timeout time.Duration) error {
+	approval := &JobApproval{Reasons: reasons, SubmittedBy: submittedBy, decided: make(chan struct{})}
+	j.mu.Lock()
+	j.state, j.approval = StatePendingApproval, approval
+	j.mu.Unlock()
+	j.logf("waiting for approval, submitted by %s: %s", submittedBy, strings.Join(reasons, "; "))
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var why string
+	select {
+	case <-approval.decided:
+	case <-timer.C:
+		why = fmt.Sprintf("not approved within %s", timeout)
+	case <-ctx.Done():
+		why = "the caller went away before it was approved"
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if why == "" && approval.RejectedBy != "" {
+		why = "rejected by " + approval.RejectedBy
+	}
+	if why != "" {
+		if approval.DecidedAt == nil {
+			close(approval.decided)
+			now := j.now()
+			approval.DecidedAt = &now
+		}
+		return fmt.Errorf("%w: %s", errNotApproved, why)
+	}
+	// the job starts once approved, the wait isn't held against its throughput or SLA
+	j.state = StateRunning
+	j.startedAt = j.now()
+	j.lastProgress = j.startedAt
+	j.samples = []rateSample{{j.startedAt, 0}}
+	return nil
+}
+
+// approves or rejects the job pending approval as identity 'by'
+func (j *Job) decide(approve bool, by string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	a := j.approval
+	if a == nil || j.state != StatePendingApproval || a.DecidedAt != nil {
+		return fmt.Errorf("job %s isn't pending approval", j.id)
+	}
+	if approve && by == a.SubmittedBy {
+		return fmt.Errorf("job %s was submitted by %s, another identity must approve it", j.id, by)
+	}
+	now := j.now()
+	a.DecidedAt = &now
+	if approve {
+		a.ApprovedBy = by
+	} else {
+		a.RejectedBy = by
+	}
+	close(a.decided)
+	return nil
+}
+
+// POST /jobs/{id}/approve?by=<identity> and POST /jobs/{id}/reject?by=<identity>
+func handleApproval(w http.ResponseWriter, r *http.Request, job *Job, approve bool) {
+	if r.Method != http.MethodPost {
+		writeError(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	by := r.URL.Query().Get("by")
+	if by == "" || !validHeaderValue(by) {
+		writeError(w, "'by' must name who decides", http.StatusBadRequest)
+		return
+	}
+	if err := job.decide(approve, by); err != nil {
+		writeError(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if approve {
+		job.logf("approved by %s", by)
+	} else {
+		job.logf("rejected by %s", by)
+	}
+	json, _ := json.MarshalIndent(job.status(), "", "  ")
+	w.Write(json)
+}
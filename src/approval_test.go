@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func useApprovalPolicy(t *testing.T, p approvalPolicy) {
+	approvalSettingsOnce.Do(func() {})
+	prev := approvalSettings
+	approvalSettings = p
+	t.Cleanup(func() { approvalSettings = prev })
+}
+
+func TestApprovalReasons(t *testing.T) {
+	t.Setenv("FASTCOPY_APPROVAL_MAX_BYTES", "1K")
+	t.Setenv("FASTCOPY_APPROVAL_MAX_FILES", "10")
+	t.Setenv("FASTCOPY_APPROVAL_PROTECTED", "/data/pii, /finance")
+	p, err := loadApprovalPolicy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reasons := p.reasons(2, 100, []string{"/data/clicks"}, "/replica/clicks"); reasons != nil {
+		t.Errorf("expected a small copy of unprotected paths to need no approval, got %v", reasons)
+	}
+	if reasons := p.reasons(11, 2048, []string{"/data/pii/users"}, "/finance"); len(reasons) != 4 {
+		t.Errorf("expected every reason to be given, got %v", reasons)
+	}
+	if reasons := p.reasons(1, 1, []string{"/data"}, "/dst"); len(reasons) != 1 {
+		t.Errorf("expected a copy of a dir holding a protected one to need approval, got %v", reasons)
+	}
+	t.Setenv("FASTCOPY_APPROVAL_PROTECTED", "relative/path")
+	if _, err := loadApprovalPolicy(); err == nil {
+		t.Error("expected a relative protected prefix to be refused")
+	}
+}
+
+func TestCopyWaitsForApproval(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{"/data/pii/users.csv": "alice,bob"})
+	peer := httptest.NewServer(apiMux())
+	defer peer.Close()
+	useApprovalPolicy(t, approvalPolicy{protected: []string{"/data/pii"}, timeout: time.Minute})
+
+	copyDone := make(chan *httptest.ResponseRecorder)
+	copy := func(jobID string) {
+		query := url.Values{"from": {"/data/pii"}, "to": {"/dst"}, "targetURL": {peer.URL + "/upload"}, "jobId": {jobID}, "submittedBy": {"alice"}}
+		rec := httptest.NewRecorder()
+		handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+		copyDone <- rec
+	}
+	decide := func(jobID, action, by string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleJobs(rec, httptest.NewRequest("POST", "/jobs/"+jobID+"/"+action+"?by="+by, nil))
+		return rec
+	}
+	pending := func(jobID string) {
+		for i := 0; i < 1000; i++ {
+			if job := getJob(jobID); job != nil && job.status().State == StatePendingApproval {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("expected job %s to wait for approval", jobID)
+	}
+
+	go copy("pii-1")
+	pending("pii-1")
+	if _, ok := fs.get("/dst/users.csv"); ok {
+		t.Fatal("expected nothing copied before approval")
+	}
+	if rec := decide("pii-1", "approve", "alice"); rec.Code != http.StatusConflict {
+		t.Errorf("expected the submitter's own approval to be refused, got %d", rec.Code)
+	}
+	if rec := decide("pii-1", "approve", "bob"); rec.Code != http.StatusOK {
+		t.Fatalf("expected bob's approval to be taken, got %d %s", rec.Code, rec.Body)
+	}
+	if rec := <-copyDone; rec.Code != http.StatusOK {
+		t.Fatalf("expected the approved copy to succeed, got %d %s", rec.Code, rec.Body)
+	}
+	if rec := decide("pii-1", "approve", "carol"); rec.Code != http.StatusConflict {
+		t.Errorf("expected a finished job's approval to be refused, got %d", rec.Code)
+	}
+	if s := getJob("pii-1").status(); s.Approval == nil || s.Approval.ApprovedBy != "bob" {
+		t.Errorf("expected the approval in the job's status, got %+v", s.Approval)
+	}
+
+	go copy("pii-2")
+	pending("pii-2")
+	decide("pii-2", "reject", "bob")
+	if rec := <-copyDone; rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "rejected by bob") {
+		t.Errorf("expected the rejected copy to fail, got %d %s", rec.Code, rec.Body)
+	}
+	if s := getJob("pii-2").status(); s.State != StateRejected {
+		t.Errorf("expected the job to be rejected, got %s", s.State)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaults for /bench, the shape of the README's benchmark
+const (
+	DefaultBenchFiles    = 10
+	DefaultBenchFileSize = 128 << 20
+)
+
+type BenchResponse struct {
+	To           string        `json:"to"`
+	Files        int           `json:"files"`
+	FileSize     int64         `json:"fileSize"`
+	Written      int64         `json:"written"`
+	FilesCopied  int64         `json:"filesCopied"`
+	CopyFailures []CopyFailure `json:"copyFailures"`
+	Throughput   float64       `json:"throughputMbps"`
+	ElapsedSecs  float64       `json:"elapsedSecs"`
+}
+
+// random test data generator
+type RandomReadCloser struct {
+	size     int64
+	position int64
+}
+
+func (r *RandomReadCloser) Read(p []byte) (n int, err error) {
+	if r.position >= r.size {
+		return 0, io.EOF
+	}
+	remaining := r.size - r.position
+	if int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err = rand.Read(p)
+	if err != nil {
+		return n, err
+	}
+	r.position += int64(n)
+	return n, nil
+}
+
+func (r *RandomReadCloser) Close() error {
+	// Perform any cleanup if necessary
+	return nil
+}
+
+// serves random data of the planned size instead of reading hdfs
+func syntheticSource(args CopyArgs) (io.ReadCloser, error) {
+	return &RandomReadCloser{size: args.Size}, nil
+}
+
+// Pushes 'files' files of 'size' random bytes (default 10 x 128M) through the copy path
+// into 'to' on 'targetURL' and reports the throughput, to baseline a link without touching real data.
+// accepts the same transfer options as /copy
+func handleBench(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	to := q.Get("to")
+	targetURL := q.Get("targetURL")
+	if to == "" || targetURL == "" {
+		writeError(w, "'to' and 'targetURL' query params must be provided.", http.StatusBadRequest)
+		return
+	}
+	files := DefaultBenchFiles
+	if v := q.Get("files"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, fmt.Sprintf("'files' must be a positive integer, got '%s'", v), http.StatusBadRequest)
+			return
+		}
+		files = n
+	}
+	fileSize := int64(DefaultBenchFileSize)
+	if v := q.Get("size"); v != "" {
+		n, err := parseByteSize(v)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fileSize = n
+	}
+	opts, err := parseCopyOptions(r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.Delta = false // random data never shares blocks with the target
+
+	tasks := make([]CopyArgs, files)
+	for i := range tasks {
+		name := fmt.Sprintf("bench-%05d", i)
+		tasks[i] = CopyArgs{File: name, Path: name, To: to, Size: fileSize}
+	}
+	log.Printf("Benchmarking %d x %d bytes to %s", files, fileSize, targetURL)
+
+	start := time.Now()
+	copied, _, copyFailures := runTransfers(syntheticSource, []string{targetURL}, tasks, opts, nil)
+	elapsed := time.Since(start).Seconds()
+
+	var written int64
+	for _, f := range copied {
+		written += f.Upload.Written
+	}
+	resp := BenchResponse{
+		To:           to,
+		Files:        files,
+		FileSize:     fileSize,
+		Written:      written,
+		FilesCopied:  int64(len(copied)),
+		CopyFailures: copyFailures,
+		Throughput:   (float64(written) * 8 / elapsed) / 1000000, // conversion to mbps
+		ElapsedSecs:  elapsed,
+	}
+	json, _ := json.MarshalIndent(resp, "", "  ")
+	log.Println(string(json))
+	if len(copyFailures) > 0 {
+		writeReport(w, json, http.StatusInternalServerError)
+		return
+	}
+	w.Write(json)
+}
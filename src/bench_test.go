@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBench(t *testing.T) {
+	var received int64
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		atomic.AddInt64(&received, n)
+		json.NewEncoder(w).Encode(UploadResponse{Path: r.URL.Query().Get("fileName"), Written: n})
+	}))
+	defer target.Close()
+
+	query := url.Values{"to": {"/tmp/bench"}, "targetURL": {target.URL + "/upload"}, "files": {"4"}, "size": {"64K"}}
+	rec := httptest.NewRecorder()
+	handleBench(rec, httptest.NewRequest("POST", "/bench?"+query.Encode(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var resp BenchResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.FilesCopied != 4 || resp.Written != 4*64<<10 || received != resp.Written {
+		t.Errorf("expected 4 files of 64K written, got %+v with %d bytes received", resp, received)
+	}
+}
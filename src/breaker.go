@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errTargetUnavailable = errors.New("target unavailable")
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// circuit breaker around uploads to a single target host. after 'threshold' consecutive
+// connection failures or 5xx responses the circuit opens and every upload fails fast for
+// 'cooldown', after which a single probe upload decides whether it closes again
+type circuitBreaker struct {
+	mu        sync.Mutex
+	host      string
+	state     string
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	probes    int // how many probes were started, telling a probe's release from a later one's
+	threshold int
+	cooldown  time.Duration
+}
+
+// returns errTargetUnavailable if uploads to the host should fail fast. the returned func must be called once
+// the upload is done, whatever its outcome: a probe upload failing before it reached the target, e.g. on opening
+// its source, records nothing and would otherwise keep every later upload waiting on it
+func (b *circuitBreaker) allow() (func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return nil, fmt.Errorf("%w: circuit breaker for %s is open after %d consecutive failures", errTargetUnavailable, b.host, b.failures)
+		}
+		b.state = breakerHalfOpen
+	case breakerHalfOpen:
+		if b.probing {
+			return nil, fmt.Errorf("%w: circuit breaker for %s is waiting on a probe upload", errTargetUnavailable, b.host)
+		}
+	default:
+		return func() {}, nil
+	}
+	b.probing = true
+	b.probes++
+	probe := b.probes
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.probing && b.probes == probe {
+			b.probing = false // the next upload probes instead
+		}
+	}, nil
+}
+
+// records the outcome of an upload. err is the error from the http client, status the response code
+func (b *circuitBreaker) record(err error, status int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	failed := err != nil || status >= http.StatusInternalServerError
+	if b.state == breakerHalfOpen {
+		b.probing = false
+	}
+	if !failed {
+		if b.state != breakerClosed {
+			log.Printf("circuit breaker for %s closed, target is reachable again", b.host)
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		log.Printf("circuit breaker for %s opened after %d consecutive failures", b.host, b.failures)
+	}
+}
+
+var (
+	breakers   = make(map[string]*circuitBreaker)
+	breakersMu sync.Mutex
+)
+
+// the breaker threshold and cooldown from env FASTCOPY_BREAKER_THRESHOLD and FASTCOPY_BREAKER_COOLDOWN, or their defaults
+func breakerSettings() (int, time.Duration) {
+	threshold, cooldown := defaultBreakerThreshold, defaultBreakerCooldown
+	if v, err := strconv.Atoi(os.Getenv("FASTCOPY_BREAKER_THRESHOLD")); err == nil && v > 0 {
+		threshold = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("FASTCOPY_BREAKER_COOLDOWN")); err == nil && v > 0 {
+		cooldown = v
+	}
+	return threshold, cooldown
+}
+
+// returns the circuit breaker shared by every job uploading to the host of targetURL.
+// thresholds are configured with env FASTCOPY_BREAKER_THRESHOLD and FASTCOPY_BREAKER_COOLDOWN (e.g. 30s)
+func targetBreaker(targetURL string) *circuitBreaker {
+	host := targetURL
+	if u, err := url.Parse(targetURL); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b, ok := breakers[host]
+	if !ok {
+		threshold, cooldown := breakerSettings()
+		b = &circuitBreaker{host: host, state: breakerClosed, threshold: threshold, cooldown: cooldown}
+		breakers[host] = b
+	}
+	return b
+}
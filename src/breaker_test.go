@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := &circuitBreaker{host: "dr-site:8080", state: breakerClosed, threshold: 3, cooldown: 10 * time.Millisecond}
+	for i := 0; i < 3; i++ {
+		if _, err := b.allow(); err != nil {
+			t.Fatalf("expected breaker to allow uploads before the threshold, got %s", err)
+		}
+		b.record(nil, 503)
+	}
+	if _, err := b.allow(); !errors.Is(err, errTargetUnavailable) {
+		t.Fatalf("expected open breaker to fail fast, got %v", err)
+	}
+
+	time.Sleep(15 * time.Millisecond)
+	if _, err := b.allow(); err != nil {
+		t.Fatalf("expected a probe after the cooldown, got %s", err)
+	}
+	if _, err := b.allow(); err == nil {
+		t.Fatal("expected only a single probe while half-open")
+	}
+	b.record(nil, 200)
+	if _, err := b.allow(); err != nil || b.state != breakerClosed {
+		t.Errorf("expected successful probe to close the breaker, got %v in state %s", err, b.state)
+	}
+}
+
+func TestCircuitBreakerProbeFailingBeforeSending(t *testing.T) {
+	b := &circuitBreaker{host: "dr-site:8080", state: breakerClosed, threshold: 1, cooldown: 10 * time.Millisecond}
+	b.record(nil, 503)
+	time.Sleep(15 * time.Millisecond)
+	release, err := b.allow()
+	if err != nil {
+		t.Fatalf("expected a probe after the cooldown, got %s", err)
+	}
+	// the probe fails on opening its source, recording nothing
+	release()
+	release, err = b.allow()
+	if err != nil {
+		t.Fatalf("expected the next upload to probe instead, got %s", err)
+	}
+	b.record(nil, 200)
+	release()
+	if _, err := b.allow(); err != nil || b.state != breakerClosed {
+		t.Errorf("expected the probe to close the breaker, got %v in state %s", err, b.state)
+	}
+}
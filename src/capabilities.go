@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+)
+
+// GET /capabilities tells a sender what this receiver supports. before a job the sender asks each target and
+// adapts: options that only make transfers cheaper, like delta or resume, are turned off for a target lacking
+// them and the copy goes on with whole files, options whose guarantees a target can't give, like staging or
+// encryption, fail the copy before anything is sent. a target answering 404 predates capabilities and is sent
+// to as configured, like before
+
+// the features a receiver may support
+const (
+	FeatureResume       = "resume"       // /partial and uploads appending at resumeFrom
+	FeatureDelta        = "delta"        // /signature and /patch
+	FeatureSwap         = "swap"         // atomic swaps of staging dirs with /swap
+	FeatureMkdir        = "mkdir"        // empty dirs created with /mkdir
+	FeatureChecksum     = "checksum"     // /checksum of written files
+	FeatureEncryption   = "encryption"   // uploads encrypted with a shared key
+	FeatureContentTypes = "contentTypes" // content types kept in an xattr
+	FeatureSpeculation  = "speculation"  // second attempts at an upload written aside
+	FeatureQuarantine   = "quarantine"   // /quarantine
+	FeatureListing      = "ls"           // /ls of a dir, for reconciling a copy against it
+)
+
+// what a receiver supports
+type Capabilities struct {
+	APIVersion string   `json:"apiVersion"`
+	Features   []string `json:"features"`
+	Digests    []string `json:"digests"`    // the algorithms of the Digest header uploads are checked against
+	Validators []string `json:"validators"` // the formats validate= can check
+}
+
+func (c *Capabilities) supports(feature string) bool {
+	return contains(c.Features, feature)
+}
+
+// the capabilities of this server
+func localCapabilities() Capabilities {
+	features := []string{FeatureResume, FeatureDelta, FeatureSwap, FeatureMkdir, FeatureChecksum, FeatureContentTypes, FeatureSpeculation, FeatureListing}
+	// the keys themselves are only loaded once an upload needs them
+	if os.Getenv("FASTCOPY_ENCRYPTION_KEY") != "" || os.Getenv("FASTCOPY_ENCRYPTION_KEYS") != "" {
+		features = append(features, FeatureEncryption)
+	}
+	if getQuarantineDir() != "" {
+		features = append(features, FeatureQuarantine)
+	}
+	sort.Strings(features)
+	return Capabilities{
+		APIVersion: APIVersion,
+		Features:   features,
+		Digests:    []string{"md5", "sha-256"},
+		Validators: sortedKeys(validators),
+	}
+}
+
+func handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	json, _ := json.Marshal(localCapabilities())
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+// asks the peer what it supports, nil if it predates /capabilities or can't be asked. failing to reach it is
+// left for the precheck and the transfers to report
+func peerCapabilities(targetURL string) *Capabilities {
+	resp, err := httpClient.Get(peerURL(targetURL, "/capabilities", nil))
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	var caps Capabilities
+	if err := json.NewDecoder(resp.Body).Decode(&caps); err != nil {
+		return nil
+	}
+	return &caps
+}
+
+// adapts opts to what the target supports, returning the adaptations made, or an error if the copy can't be
+// made as asked
+func adaptToPeer(opts *CopyOptions, targetURL string, caps *Capabilities) ([]string, error) {
+	if caps == nil {
+		return nil, nil
+	}
+	var adapted []string
+	turnOff := func(option string, enabled *bool, feature string) {
+		if *enabled && !caps.supports(feature) {
+			*enabled = false
+			adapted = append(adapted, fmt.Sprintf("%s doesn't support %s, %s is turned off", targetURL, feature, option))
+		}
+	}
+	turnOff("delta", &opts.Delta, FeatureDelta)
+	turnOff("resume", &opts.Resume, FeatureResume)
+	turnOff("speculate", &opts.Speculate, FeatureSpeculation)
+	turnOff("reconcile", &opts.Reconcile, FeatureListing)
+	if opts.ContentType != "" && !caps.supports(FeatureContentTypes) {
+		opts.ContentType = ""
+		adapted = append(adapted, fmt.Sprintf("%s doesn't support %s, contentType is turned off", targetURL, FeatureContentTypes))
+	}
+
+	required := map[string]bool{
+		FeatureSwap:       opts.Staging,
+		FeatureMkdir:      opts.CopyEmptyDirs,
+		FeatureChecksum:   opts.VerifySample > 0,
+		FeatureEncryption: opts.Encrypt,
+	}
+	for _, feature := range sortedKeys(required) {
+		if required[feature] && !caps.supports(feature) {
+			return adapted, fmt.Errorf("%s doesn't support %s, which the copy's options need", targetURL, feature)
+		}
+	}
+	for _, format := range opts.Validate {
+		if !contains(caps.Validators, format) {
+			return adapted, fmt.Errorf("%s can't validate %s files", targetURL, format)
+		}
+	}
+	return adapted, nil
+}
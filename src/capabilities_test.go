@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCapabilities(t *testing.T) {
+	server := httptest.NewServer(apiMux())
+	defer server.Close()
+	caps := peerCapabilities(server.URL + "/upload")
+	if caps == nil || caps.APIVersion != APIVersion || !caps.supports(FeatureDelta) || caps.supports(FeatureEncryption) || !contains(caps.Validators, "parquet") {
+		t.Fatalf("unexpected capabilities %+v", caps)
+	}
+	legacy := httptest.NewServer(http.NotFoundHandler())
+	defer legacy.Close()
+	if caps := peerCapabilities(legacy.URL + "/upload"); caps != nil {
+		t.Errorf("expected no capabilities from a peer predating them, got %+v", caps)
+	}
+
+	old := &Capabilities{Features: []string{FeatureResume, FeatureMkdir}, Validators: []string{"parquet"}}
+	opts := CopyOptions{Delta: true, Resume: true, CopyEmptyDirs: true, Validate: []string{"parquet"}}
+	adapted, err := adaptToPeer(&opts, "http://old/upload", old)
+	if err != nil || opts.Delta || !opts.Resume || len(adapted) != 1 || !strings.Contains(adapted[0], "delta is turned off") {
+		t.Errorf("expected only delta to be turned off, got %+v %v %v", opts, adapted, err)
+	}
+	for _, opts := range []CopyOptions{{Staging: true}, {Encrypt: true}, {Validate: []string{"orc"}}} {
+		if _, err := adaptToPeer(&opts, "http://old/upload", old); err == nil {
+			t.Errorf("expected %+v to be refused", opts)
+		}
+	}
+	if _, err := adaptToPeer(&CopyOptions{Staging: true}, "http://older/upload", nil); err != nil {
+		t.Errorf("expected a peer without capabilities to be sent to as configured, got %v", err)
+	}
+}
+
+func TestCopyAdaptsToPeer(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{"/data/a": "aaaa"})
+	api := apiMux()
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/capabilities" {
+			json.NewEncoder(w).Encode(Capabilities{APIVersion: APIVersion, Features: []string{FeatureResume, FeatureListing}})
+			return
+		}
+		if r.URL.Path == "/signature" {
+			t.Error("expected no signature to be asked of a peer without delta")
+		}
+		api.ServeHTTP(w, r)
+	}))
+	defer peer.Close()
+
+	query := url.Values{"from": {"/data"}, "to": {"/backup"}, "targetURL": {peer.URL + "/upload"}, "delta": {"true"}, "precheck": {"none"}}
+	rec := httptest.NewRecorder()
+	handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+	var resp CopyResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if rec.Code != http.StatusOK || len(resp.Adaptations) != 1 {
+		t.Fatalf("expected the copy to go on without delta, got %d %+v", rec.Code, resp)
+	}
+	if data, _ := fs.get("/backup/a"); data != "aaaa" {
+		t.Errorf("expected a to be copied whole, got %q", data)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// the warning of a copied file whose source changed while it was copied, the copy may be torn
+const WarningSourceChanged = "sourceChangedDuringCopy"
+
+// a copied file consumers should know more about
+type CopyWarning struct {
+	Path    string `json:"path"` // the source
+	Warning string `json:"warning"`
+	Detail  string `json:"detail"`
+}
+
+// compares the length and modification time of the copied files' sources with the ones they were planned with.
+// returns warnings for the sources that changed and, for those still there, the files planned again with their
+// current length and modification time
+func changedSources(client FileSystem, copied []CopiedFile) ([]CopyArgs, []CopyWarning) {
+	var changed []CopyArgs
+	var warnings []CopyWarning
+	for _, c := range copied {
+		args := c.Args
+		info, err := client.Stat(args.Path)
+		if err != nil {
+			warnings = append(warnings, CopyWarning{args.Path, WarningSourceChanged, fmt.Sprintf("cannot stat the source after copying it: %s", err)})
+			continue
+		}
+		if info.Size() == args.Size && info.ModTime().Equal(args.ModTime) {
+			continue
+		}
+		detail := fmt.Sprintf("length changed from %d to %d bytes", args.Size, info.Size())
+		if info.Size() == args.Size {
+			detail = fmt.Sprintf("modified at %s, after it was listed", info.ModTime().UTC().Format(time.RFC3339))
+		}
+		warnings = append(warnings, CopyWarning{args.Path, WarningSourceChanged, detail + " while it was copied"})
+		args.Size, args.ModTime = info.Size(), info.ModTime()
+		changed = append(changed, args)
+	}
+	return changed, warnings
+}
+
+// copies the files whose source changed during their first copy once more. returns the copied files with the
+// second copies in place of the first and without the ones that failed, the warnings left for sources that changed
+// again or are gone, and the failed second copies
+func recopyChanged(open sourceOpener, client FileSystem, targetURL string, copied []CopiedFile, changed []CopyArgs, warnings []CopyWarning, opts CopyOptions, job *Job) ([]CopiedFile, []CopyWarning, []CopyFailure) {
+	job.logf("Copying %d files again, their source changed while they were copied", len(changed))
+	recopied, skipped, failures := runTransfers(open, []string{targetURL}, changed, opts, job)
+	for _, s := range skipped {
+		failures = append(failures, CopyFailure{Path: s.Path, Reason: s.Reason})
+	}
+	again := make(map[string]*CopiedFile, len(changed))
+	for _, args := range changed {
+		again[args.Path] = nil
+	}
+	for i := range recopied {
+		again[recopied[i].Args.Path] = &recopied[i]
+	}
+	kept := copied[:0]
+	for _, c := range copied {
+		second, ok := again[c.Args.Path]
+		if !ok {
+			kept = append(kept, c)
+		} else if second != nil {
+			kept = append(kept, *second)
+		}
+	}
+	var left []CopyWarning
+	for _, w := range warnings {
+		if _, ok := again[w.Path]; !ok {
+			left = append(left, w)
+		}
+	}
+	_, changedAgain := changedSources(client, recopied)
+	return kept, append(left, changedAgain...), failures
+}
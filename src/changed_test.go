@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSourceChangedDuringCopy(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{"/src/part-00000": "hello", "/src/part-00001": "world"})
+
+	// appends to part-00001 while its first copy is being uploaded
+	var uploads int
+	peer := http.NewServeMux()
+	peer.HandleFunc("/ready", handleReady)
+	peer.HandleFunc("/ls", handleLs)
+	peer.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fileName") == "part-00001" {
+			if uploads++; uploads == 1 {
+				fs.put(map[string]string{"/src/part-00001": "world, appended"})
+			}
+		}
+		handleUpload(w, r)
+	})
+	server := httptest.NewServer(peer)
+	defer server.Close()
+
+	copy := func(query url.Values) CopyResponse {
+		rec := httptest.NewRecorder()
+		handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+		}
+		var resp CopyResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return resp
+	}
+	query := url.Values{"from": {"/src"}, "to": {"/dst"}, "targetURL": {server.URL + "/upload"}, "reconcile": {"false"}}
+	resp := copy(query)
+	if len(resp.Warnings) != 1 || resp.Warnings[0].Path != "/src/part-00001" || resp.Warnings[0].Warning != WarningSourceChanged || !strings.Contains(resp.Warnings[0].Detail, "from 5 to 15 bytes") {
+		t.Fatalf("expected a sourceChangedDuringCopy warning for part-00001, got %+v", resp.Warnings)
+	}
+	if resp.State != StateSucceeded || resp.FilesCopied != 2 {
+		t.Errorf("expected the copy to succeed with a warning, got %+v", resp)
+	}
+
+	uploads = 0
+	fs.put(map[string]string{"/src/part-00001": "world"})
+	query.Set("recopyChanged", "true")
+	query.Set("reconcile", "true")
+	resp = copy(query)
+	if len(resp.Warnings) != 0 || uploads != 2 || resp.Written != 20 || resp.Reconciled == nil || !*resp.Reconciled {
+		t.Errorf("expected part-00001 to be copied again without a warning, got %d uploads and %+v", uploads, resp)
+	}
+	if data, _ := fs.get("/dst/part-00001"); data != "world, appended" {
+		t.Errorf("expected the second copy to have the appended data, got '%s'", data)
+	}
+}
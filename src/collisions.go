@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// two source files must never be written to the same destination path, the later one would silently replace
+// the earlier. collisions are caught when the copy is planned: between the 'from' dirs of a multi-source copy
+// that share a name, and between the planned files, e.g. a source file named like the manifest written next
+// to it. 'collisions' decides what happens to the later of two colliding sources
+const (
+	CollisionsFail   = "fail"   // default: refuse the copy before anything is sent, naming the collisions
+	CollisionsSuffix = "suffix" // write the later one under its name suffixed with -1, -2, ... before the extension
+	CollisionsSkip   = "skip"   // leave the later one out, listed in skipped
+)
+
+var collisionPolicies = []string{CollisionsFail, CollisionsSuffix, CollisionsSkip}
+
+func validCollisionPolicy(p string) bool {
+	return p == "" || contains(collisionPolicies, p)
+}
+
+// name with -n inserted before its extension, part-00000-1.parquet
+func suffixedName(name string, n int) string {
+	ext := filepath.Ext(name)
+	if ext == name {
+		ext = "" // a dotfile like .metadata has no extension to keep
+	}
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), n, ext)
+}
+
+// the first of name suffixed with -1, -2, ... that isn't taken
+func freeName(name string, taken func(string) bool) string {
+	for n := 1; ; n++ {
+		if s := suffixedName(name, n); !taken(s) {
+			return s
+		}
+	}
+}
+
+// resolves the 'from' dirs sharing a name, which would be copied into the same dir under 'to', by policy.
+// returns the sources to copy and the ones skipped
+func resolveSourceCollisions(sources []copySource, to string, policy string) ([]copySource, []SkippedFile, error) {
+	resolved := make([]copySource, 0, len(sources))
+	var skipped []SkippedFile
+	var collisions []string
+	names := make(map[string]string)
+	for _, src := range sources {
+		if src.name == "" {
+			return sources, nil, nil // a single 'from' copied into 'to' itself
+		}
+		other, ok := names[src.name]
+		switch {
+		case !ok:
+		case policy == CollisionsSuffix:
+			src.name = freeName(src.name, func(name string) bool { _, ok := names[name]; return ok })
+		case policy == CollisionsSkip:
+			skipped = append(skipped, SkippedFile{src.from, fmt.Sprintf("collides with %s in %s", other, filepath.Join(to, src.name))})
+			continue
+		default:
+			collisions = append(collisions, fmt.Sprintf("'%s' and '%s' would both be copied into %s", other, src.from, filepath.Join(to, src.name)))
+		}
+		names[src.name] = src.from
+		resolved = append(resolved, src)
+	}
+	if len(collisions) > 0 {
+		return nil, nil, fmt.Errorf("%s, set collisions=suffix or collisions=skip to copy them anyway", strings.Join(collisions, "; "))
+	}
+	return resolved, skipped, nil
+}
+
+// resolves the planned tasks writing to the same destination path as an earlier task, or as one of reserved,
+// the files the copy writes itself, by policy. returns the tasks to copy and the ones skipped
+func resolveCollisions(tasks []CopyArgs, reserved []string, policy string) ([]CopyArgs, []SkippedFile, error) {
+	written := make(map[string]string, len(tasks)+len(reserved))
+	for _, p := range reserved {
+		written[p] = "the copy's own " + filepath.Base(p)
+	}
+	resolved := make([]CopyArgs, 0, len(tasks))
+	var skipped []SkippedFile
+	var collisions []string
+	for _, t := range tasks {
+		dest := filepath.Join(t.To, t.File)
+		other, ok := written[dest]
+		switch {
+		case !ok:
+		case policy == CollisionsSuffix:
+			t.File = freeName(t.File, func(name string) bool { _, ok := written[filepath.Join(t.To, name)]; return ok })
+			dest = filepath.Join(t.To, t.File)
+		case policy == CollisionsSkip:
+			skipped = append(skipped, SkippedFile{t.Path, fmt.Sprintf("collides with %s at %s", other, dest)})
+			continue
+		default:
+			collisions = append(collisions, fmt.Sprintf("%s and %s would both be written to %s", other, t.Path, dest))
+		}
+		written[dest] = t.Path
+		resolved = append(resolved, t)
+	}
+	if len(collisions) > 0 {
+		return nil, nil, fmt.Errorf("%s, set collisions=suffix or collisions=skip to copy them anyway", strings.Join(collisions, "; "))
+	}
+	return resolved, skipped, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestResolveCollisions(t *testing.T) {
+	sources := []copySource{{from: "/data/a", name: "a"}, {from: "/archive/a", name: "a"}, {from: "/old/a", name: "a"}}
+	if _, _, err := resolveSourceCollisions(sources, "/dst", ""); err == nil || !strings.Contains(err.Error(), "'/data/a' and '/archive/a' would both be copied into /dst/a") {
+		t.Errorf("expected sources sharing a name to be refused by default, got %v", err)
+	}
+	resolved, _, _ := resolveSourceCollisions(sources, "/dst", CollisionsSuffix)
+	if len(resolved) != 3 || resolved[1].name != "a-1" || resolved[2].name != "a-2" {
+		t.Errorf("expected the later sources to be suffixed, got %+v", resolved)
+	}
+	resolved, skipped, _ := resolveSourceCollisions(sources, "/dst", CollisionsSkip)
+	if len(resolved) != 1 || len(skipped) != 2 || skipped[0].Path != "/archive/a" {
+		t.Errorf("expected the later sources to be skipped, got %+v %+v", resolved, skipped)
+	}
+
+	tasks := []CopyArgs{
+		{Path: "/data/part-00000.parquet", File: "part-00000.parquet", To: "/dst"},
+		{Path: "/link/part-00000.parquet", File: "part-00000.parquet", To: "/dst"},
+		{Path: "/data/_MANIFEST.tsv", File: "_MANIFEST.tsv", To: "/dst"},
+		{Path: "/data/.metadata", File: ".metadata", To: "/dst"},
+		{Path: "/data/sub/.metadata", File: ".metadata", To: "/dst"},
+	}
+	if _, _, err := resolveCollisions(tasks, []string{"/dst/_MANIFEST.tsv"}, ""); err == nil || !strings.Contains(err.Error(), "the copy's own _MANIFEST.tsv and /data/_MANIFEST.tsv") {
+		t.Errorf("expected colliding files to be refused by default, got %v", err)
+	}
+	suffixed, _, _ := resolveCollisions(tasks, []string{"/dst/_MANIFEST.tsv"}, CollisionsSuffix)
+	var names []string
+	for _, t := range suffixed {
+		names = append(names, t.File)
+	}
+	if strings.Join(names, ",") != "part-00000.parquet,part-00000-1.parquet,_MANIFEST-1.tsv,.metadata,.metadata-1" {
+		t.Errorf("unexpected suffixed names %v", names)
+	}
+}
+
+func TestCopyCollisions(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{"/data/a/part-00000": "new", "/archive/a/part-00000": "old"})
+	peer := httptest.NewServer(apiMux())
+	defer peer.Close()
+
+	copySources := func(policy string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(CopyRequest{From: []string{"/data/a", "/archive/a"}, To: "/backup", TargetURL: peer.URL + "/upload"})
+		query := url.Values{"collisions": {policy}, "precheck": {"none"}}
+		r := httptest.NewRequest("POST", "/copy?"+query.Encode(), strings.NewReader(string(body)))
+		r.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		handleCopy(rec, r)
+		return rec
+	}
+	if rec := copySources(""); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected the colliding copy to be refused, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := copySources(CollisionsSuffix); rec.Code != http.StatusOK {
+		t.Fatalf("expected the suffixed copy to succeed, got %d: %s", rec.Code, rec.Body)
+	}
+	if data, _ := fs.get("/backup/a/part-00000"); data != "new" {
+		t.Errorf("expected the first source in /backup/a, got %q", data)
+	}
+	if data, _ := fs.get("/backup/a-1/part-00000"); data != "old" {
+		t.Errorf("expected the second source in /backup/a-1, got %q", data)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// listings and job reports can be megabytes of JSON, so the control-plane endpoints gzip their responses for
+// clients that accept it. the data path, uploads and downloads, is left alone: its bytes are mostly compressed
+// already and compressing them would cost more cpu than it saves on the link
+
+// responses smaller than this are sent as they are, gzip wouldn't save anything worth the overhead
+const minGzipSize = 1024
+
+// gzips the responses of h for requests with Accept-Encoding: gzip
+func gzipResponses(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			h(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.finish()
+		h(gw, r)
+	}
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "gzip") && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
+// holds back the response until it's large enough to be worth compressing
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status int
+	buf    []byte
+	gz     *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= minGzipSize {
+		if w.ResponseWriter.Header().Get("Content-Type") == "" {
+			// net/http would sniff the compressed bytes instead
+			w.ResponseWriter.Header().Set("Content-Type", http.DetectContentType(w.buf))
+		}
+		w.ResponseWriter.Header().Set("Content-Encoding", "gzip")
+		w.ResponseWriter.Header().Del("Content-Length")
+		w.writeStatus()
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+		if _, err := w.gz.Write(w.buf); err != nil {
+			return 0, err
+		}
+		w.buf = nil
+	}
+	return len(p), nil
+}
+
+// sends what's held back compressed, and what the gzip writer holds, so a heartbeat reaches the client
+func (w *gzipResponseWriter) Flush() {
+	if w.gz == nil {
+		w.ResponseWriter.Header().Set("Content-Encoding", "gzip")
+		w.ResponseWriter.Header().Del("Content-Length")
+		w.writeStatus()
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+		w.gz.Write(w.buf)
+		w.buf = nil
+	}
+	w.gz.Flush()
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// for http.ResponseController to reach the connection's deadlines
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *gzipResponseWriter) writeStatus() {
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+}
+
+// sends what's held back, uncompressed if the response stayed small
+func (w *gzipResponseWriter) finish() {
+	if w.gz != nil {
+		w.gz.Close()
+		return
+	}
+	w.writeStatus()
+	if len(w.buf) > 0 {
+		w.ResponseWriter.Write(w.buf)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGzipResponses(t *testing.T) {
+	fs := useMemFS(t)
+	files := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		files[fmt.Sprintf("/data/part-%05d", i)] = "x"
+	}
+	fs.put(files)
+	get := func(path string, acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		apiMux().ServeHTTP(rec, r)
+		return rec
+	}
+
+	rec := get("/ls?path=/data", "gzip, deflate")
+	if rec.Header().Get("Content-Encoding") != "gzip" || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("expected a gzipped listing, got %v", rec.Header())
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []LsEntry
+	if err := json.NewDecoder(gz).Decode(&entries); err != nil || len(entries) != 100 {
+		t.Errorf("expected the listing to decompress, got %d entries %v", len(entries), err)
+	}
+
+	if rec := get("/ls?path=/data", ""); rec.Header().Get("Content-Encoding") != "" || !json.Valid(rec.Body.Bytes()) {
+		t.Errorf("expected a plain listing without Accept-Encoding, got %v", rec.Header())
+	}
+	if rec := get("/ls?path=/data", "gzip;q=0"); rec.Header().Get("Content-Encoding") != "" {
+		t.Error("expected gzip;q=0 to be declined")
+	}
+	// small responses and errors keep their status and aren't worth compressing
+	if rec := get("/ls?path=/missing", "gzip"); rec.Code != http.StatusNotFound || rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("expected a plain 404, got %d %v", rec.Code, rec.Header())
+	}
+	// the data path is never compressed
+	fs.put(map[string]string{"/data/big": strings.Repeat("a", 1<<16)})
+	if rec := get("/download?path=/data/big", "gzip"); rec.Header().Get("Content-Encoding") != "" || rec.Body.Len() != 1<<16 {
+		t.Errorf("expected downloads not to be compressed, got %v", rec.Header())
+	}
+	if body, _ := io.ReadAll(get("/health", "gzip").Body); string(body) != "{\"status\":\"200 OK\"}" {
+		t.Errorf("unexpected health %s", body)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/briansterle/cluster-fastcopy/pkg/fastcopy"
+	"github.com/colinmarc/hdfs/v2/hadoopconf"
+)
+
+// shown in place of secret values
+const redacted = "REDACTED"
+
+// the effective configuration of this instance, as served by /config. secrets are redacted
+type RuntimeConfig struct {
+	Hdfs       HdfsConfig       `json:"hdfs"`
+	Kerberos   KerberosConfig   `json:"kerberos"`
+	Limits     LimitsConfig     `json:"limits"`
+	Encryption EncryptionConfig `json:"encryption"`
+	Logging    LoggingConfig    `json:"logging"`
+	Defaults   DefaultsConfig   `json:"defaults"`
+}
+
+type HdfsConfig struct {
+	Namenode        string            `json:"namenode,omitempty"` // HDFS_NAMENODE, overrides the hadoop conf
+	HadoopConfDir   string            `json:"hadoopConfDir,omitempty"`
+	Namenodes       []string          `json:"namenodes,omitempty"` // from the hadoop conf
+	ConfError       string            `json:"confError,omitempty"`
+	DialTimeout     string            `json:"dialTimeout"`
+	NamenodeTimeout string            `json:"namenodeTimeout"` // 0s = none
+	DatanodeTimeout string            `json:"datanodeTimeout"` // 0s = none
+	Retries         int               `json:"retries"`
+	RetryBackoff    string            `json:"retryBackoff"`
+	UseDatanodeHost *bool             `json:"useDatanodeHostname,omitempty"` // FASTCOPY_HDFS_USE_DATANODE_HOSTNAME, overrides the hadoop conf
+	DatanodeAddrs   map[string]string `json:"datanodeAddresses,omitempty"`
+}
+
+type KerberosConfig struct {
+	Enabled      bool                `json:"enabled"`
+	User         string              `json:"user,omitempty"`
+	Realm        string              `json:"realm,omitempty"`
+	Keytab       string              `json:"keytab,omitempty"` // the path, never the keytab itself
+	Krb5Conf     string              `json:"krb5Conf"`
+	KDCs         []string            `json:"kdcs,omitempty"`         // KRB_KDC, used instead of krb5Conf
+	Realms       map[string][]string `json:"realms,omitempty"`       // KRB_REALMS, trusted realms and their kdcs
+	DomainRealms map[string]string   `json:"domainRealms,omitempty"` // KRB_DOMAIN_REALMS
+}
+
+type LimitsConfig struct {
+	BandwidthSchedule      string              `json:"bandwidthSchedule,omitempty"`
+	CurrentMbps            float64             `json:"currentMbps"` // 0 = unlimited
+	MaxInflightBytes       int64               `json:"maxInflightBytes"`
+	InflightBytes          int64               `json:"inflightBytes"`
+	ReadAheadBytes         int64               `json:"readAheadBytes"`
+	SourceCacheBytes       int64               `json:"sourceCacheBytes,omitempty"`
+	SourceCacheMaxFile     int64               `json:"sourceCacheMaxFile,omitempty"`
+	NamenodeJMX            string              `json:"namenodeJmx,omitempty"`
+	NamenodeAdmission      string              `json:"namenodeAdmission,omitempty"`
+	BreakerThreshold       int                 `json:"breakerThreshold"`
+	BreakerCooldown        string              `json:"breakerCooldown"`
+	UploadTimeout          string              `json:"uploadTimeout"`
+	DefaultWorkers         int                 `json:"defaultWorkers"`
+	InitialAdaptiveWorkers int                 `json:"initialAdaptiveWorkers"`
+	DefaultBenchFiles      int                 `json:"defaultBenchFiles"`
+	DefaultBenchFileSize   int64               `json:"defaultBenchFileSize"`
+	TargetLimits           []TargetLimitConfig `json:"targetLimits,omitempty"`
+}
+
+// FASTCOPY_TARGET_LIMITS of one host, with the streams it has in flight
+type TargetLimitConfig struct {
+	Host         string  `json:"host"`
+	Mbps         float64 `json:"mbps"`    // 0 = unlimited
+	Streams      int     `json:"streams"` // 0 = unlimited
+	StreamsInUse int     `json:"streamsInUse"`
+}
+
+type EncryptionConfig struct {
+	DefaultKey string   `json:"defaultKey,omitempty"` // REDACTED when configured
+	KeyIDs     []string `json:"keyIds,omitempty"`
+}
+
+type LoggingConfig struct {
+	File       string `json:"file,omitempty"`
+	MaxSize    int64  `json:"maxSize,omitempty"`
+	MaxAge     string `json:"maxAge,omitempty"`
+	MaxBackups int    `json:"maxBackups,omitempty"`
+	Syslog     string `json:"syslog,omitempty"`
+}
+
+type DefaultsConfig struct {
+	Precheck      string `json:"precheck"`
+	Scheduling    string `json:"scheduling"`
+	Reconcile     bool   `json:"reconcile"`
+	SelfTestDir   string `json:"selfTestDir"`
+	SuccessMarker string `json:"successMarker"`
+	Manifest      string `json:"manifest"`
+}
+
+// collects the effective configuration from env, the hadoop conf and the limiters
+func runtimeConfig() RuntimeConfig {
+	threshold, cooldown := breakerSettings()
+	cfg := RuntimeConfig{
+		Hdfs: HdfsConfig{
+			Namenode:      os.Getenv("HDFS_NAMENODE"),
+			HadoopConfDir: os.Getenv("HADOOP_CONF_DIR"),
+		},
+		Kerberos: KerberosConfig{
+			Enabled:  os.Getenv("KRB_ENABLED") == "true",
+			User:     os.Getenv("KRB_USER"),
+			Realm:    os.Getenv("KRB_REALM"),
+			Keytab:   os.Getenv("KRB_KEYTAB"),
+			Krb5Conf: krb5ConfPath(),
+			KDCs:     krb5KDCs(),
+		},
+		Limits: LimitsConfig{
+			BandwidthSchedule:      os.Getenv("FASTCOPY_BANDWIDTH_SCHEDULE"),
+			BreakerThreshold:       threshold,
+			BreakerCooldown:        cooldown.String(),
+			UploadTimeout:          httpClient.Timeout.String(),
+			DefaultWorkers:         DefaultWorkers,
+			InitialAdaptiveWorkers: initialAdaptiveWorkers,
+			DefaultBenchFiles:      DefaultBenchFiles,
+			DefaultBenchFileSize:   DefaultBenchFileSize,
+			ReadAheadBytes:         int64(getReadAhead()) * fastcopy.DefaultPrefetchChunkSize,
+		},
+		Defaults: DefaultsConfig{
+			Precheck:      PrecheckReady,
+			Scheduling:    ScheduleDirectory,
+			Reconcile:     true,
+			SelfTestDir:   DefaultSelfTestDir,
+			SuccessMarker: SuccessMarker,
+			Manifest:      ManifestFileName,
+		},
+	}
+	if conf, err := hadoopconf.LoadFromEnvironment(); err != nil {
+		cfg.Hdfs.ConfError = err.Error()
+	} else {
+		cfg.Hdfs.Namenodes = conf.Namenodes()
+	}
+	for _, l := range sortedTargetLimits() {
+		cfg.Limits.TargetLimits = append(cfg.Limits.TargetLimits, TargetLimitConfig{l.host, l.mbps, l.streams, l.inUse()})
+	}
+	if cache := getSourceCache(); cache != nil {
+		cfg.Limits.SourceCacheBytes, cfg.Limits.SourceCacheMaxFile = cache.maxBytes, cache.maxFile
+	}
+	if s, err := loadHdfsClientSettings(); err == nil {
+		cfg.Hdfs.DialTimeout, cfg.Hdfs.NamenodeTimeout, cfg.Hdfs.DatanodeTimeout = s.dialTimeout.String(), s.namenodeTimeout.String(), s.datanodeTimeout.String()
+		cfg.Hdfs.Retries, cfg.Hdfs.RetryBackoff = s.retries, s.retryBackoff.String()
+		if s.useHostname != "" {
+			useHostname := s.useHostname == "true"
+			cfg.Hdfs.UseDatanodeHost = &useHostname
+		}
+		if len(s.datanodeAddrs) > 0 {
+			cfg.Hdfs.DatanodeAddrs = s.datanodeAddrs
+		}
+	}
+	if realms, err := krb5Realms(); err == nil && len(realms) > 0 {
+		cfg.Kerberos.Realms = realms
+	}
+	if domains, err := krb5DomainRealms(); err == nil && len(domains) > 0 {
+		cfg.Kerberos.DomainRealms = domains
+	}
+	if limiter := getBandwidthLimiter(); limiter != nil {
+		cfg.Limits.CurrentMbps = limiter.currentMbps()
+	}
+	if limiter := getInflightLimiter(); limiter != nil {
+		cfg.Limits.MaxInflightBytes = limiter.max
+		cfg.Limits.InflightBytes = limiter.inUse()
+	}
+	if gate := getNamenodeGate(); gate != nil {
+		cfg.Limits.NamenodeJMX = os.Getenv("FASTCOPY_NAMENODE_JMX")
+		cfg.Limits.NamenodeAdmission, _ = gate.current()
+	}
+	if settings, err := loadLogSettings(); err == nil {
+		cfg.Logging = LoggingConfig{File: settings.file, Syslog: settings.syslog}
+		if settings.file != "" {
+			cfg.Logging.MaxSize, cfg.Logging.MaxBackups = settings.maxSize, settings.maxBackups
+			if settings.maxAge > 0 {
+				cfg.Logging.MaxAge = settings.maxAge.String()
+			}
+		}
+	}
+	if os.Getenv("FASTCOPY_ENCRYPTION_KEY") != "" {
+		cfg.Encryption.DefaultKey = redacted
+	}
+	for _, entry := range strings.Split(os.Getenv("FASTCOPY_ENCRYPTION_KEYS"), ",") {
+		// only the ids, the keys after '=' are never shown
+		if kid, _, ok := strings.Cut(strings.TrimSpace(entry), "="); ok {
+			cfg.Encryption.KeyIDs = append(cfg.Encryption.KeyIDs, kid)
+		}
+	}
+	sort.Strings(cfg.Encryption.KeyIDs)
+	return cfg
+}
+
+// Dumps the effective configuration of this instance with secrets redacted
+func handleConfig(w http.ResponseWriter, r *http.Request) {
+	json, _ := json.MarshalIndent(runtimeConfig(), "", "  ")
+	w.Write(json)
+}
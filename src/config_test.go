@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestConfigRedactsSecrets(t *testing.T) {
+	key := "c2VjcmV0LWtleS1tYXRlcmlhbC0zMi1ieXRlcy1sb25nIQ=="
+	t.Setenv("FASTCOPY_ENCRYPTION_KEY", key)
+	t.Setenv("FASTCOPY_ENCRYPTION_KEYS", "teamb=b2xkLWtleSwgZG8gbm90IGxlYWsgdGhpcyBvbmUgZWl0aGVy, teama="+key)
+	t.Setenv("FASTCOPY_BREAKER_THRESHOLD", "7")
+	t.Setenv("KRB_KEYTAB", "/etc/security/fastcopy.keytab")
+
+	rec := httptest.NewRecorder()
+	handleConfig(rec, httptest.NewRequest("GET", "/config", nil))
+	body := rec.Body.String()
+	for _, secret := range []string{key, "b2xkLWtleSwgZG8gbm90IGxlYWsgdGhpcyBvbmUgZWl0aGVy"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("expected /config to redact %s, got %s", secret, body)
+		}
+	}
+
+	cfg := runtimeConfig()
+	if cfg.Encryption.DefaultKey != redacted {
+		t.Errorf("expected configured default key to show as %s, got %q", redacted, cfg.Encryption.DefaultKey)
+	}
+	if len(cfg.Encryption.KeyIDs) != 2 || cfg.Encryption.KeyIDs[0] != "teama" || cfg.Encryption.KeyIDs[1] != "teamb" {
+		t.Errorf("expected key ids [teama teamb], got %v", cfg.Encryption.KeyIDs)
+	}
+	if cfg.Limits.BreakerThreshold != 7 || cfg.Kerberos.Keytab != "/etc/security/fastcopy.keytab" {
+		t.Errorf("expected effective env config, got %+v %+v", cfg.Limits, cfg.Kerberos)
+	}
+}
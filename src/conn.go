@@ -1,9 +1,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"os/user"
+	"strings"
+	"sync"
 
 	"github.com/colinmarc/hdfs/v2"
 	"github.com/colinmarc/hdfs/v2/hadoopconf"
@@ -12,44 +16,208 @@ import (
 	"github.com/jcmturner/gokrb5/v8/keytab"
 )
 
-var HdfsClient *hdfs.Client
+var HdfsClient FileSystem
 
-// lazy loads the global hdfs.Client
+// lazy loads the global hdfs client. tests can set HdfsClient to a fake FileSystem
 // for local testing, the env var HDFS_NAMENODE can be set (e.g. export HDFS_NAMENODE=localhost:9000)
 // for production use with Kerberos, set $HADOOP_CONF_DIR to point at a dir with hdfs-site.xml and core-site.xml fie
 // for kerberos props, set env vars RUNAS_USER to configure the kerberos principal and RUNAS_KEYTAB to configure the
 // keytab to use for authentication
-func GetHdfsClient() *hdfs.Client {
+func GetHdfsClient() FileSystem {
+	hdfsMu.Lock()
+	defer hdfsMu.Unlock()
 	if HdfsClient == nil {
-		namenode := os.Getenv("HDFS_NAMENODE") // for basic local testing, set this env var
-		fmt.Println(namenode)
-		if namenode != "" {
-			client, err := hdfs.New(namenode)
-			if err != nil {
-				log.Fatalf("failed to create hdfs client: %s", err)
+		client, err := newHdfsClient()
+		if err != nil {
+			log.Fatal(err)
+		}
+		HdfsClient = client
+	}
+	return HdfsClient
+}
+
+// guards HdfsClient, which reloadCredentials replaces at runtime
+var hdfsMu sync.Mutex
+
+// replaces the global hdfs client and returns the previous one
+func swapHdfsClient(client FileSystem) FileSystem {
+	hdfsMu.Lock()
+	defer hdfsMu.Unlock()
+	prev := HdfsClient
+	HdfsClient = client
+	return prev
+}
+
+// connects to hdfs, reconnecting transparently whenever the namenode connection drops
+func newHdfsClient() (FileSystem, error) {
+	settings := getHdfsClientSettings()
+	return newReconnectingFS(timed(dialHdfs), settings.retries, settings.retryBackoff)
+}
+
+// connects to the namenode of HDFS_NAMENODE or the hadoop conf, with KRB_ENABLED=true authenticating with
+// the keytab as it is now
+func dialHdfs() (FileSystem, error) {
+	conf, err := hadoopconf.LoadFromEnvironment()
+	if err != nil {
+		return nil, fmt.Errorf("cannot load the hadoop conf: %w", err)
+	}
+	opts := hdfs.ClientOptionsFromConf(conf)
+	getHdfsClientSettings().apply(&opts)
+	if namenode := os.Getenv("HDFS_NAMENODE"); namenode != "" { // for basic local testing, set this env var
+		u, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create hdfs client: %w", err)
+		}
+		opts.Addresses, opts.User = strings.Split(namenode, ","), u.Username
+	} else if os.Getenv("KRB_ENABLED") == "true" {
+		krb, err := makeKerberosClient()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create kerberos client: %w", err)
+		}
+		opts.KerberosClient = krb
+	}
+	client, err := hdfs.NewClient(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create hdfs client: %w", err)
+	}
+	return hdfsFS{client}, nil
+}
+
+// the kerberos config makeKerberosClient reads unless KRB5_CONFIG names another file
+const defaultKrb5ConfPath = "/etc/krb5.conf"
+
+// the krb5.conf to read, KRB5_CONFIG like the MIT tools
+func krb5ConfPath() string {
+	if path := os.Getenv("KRB5_CONFIG"); path != "" {
+		return path
+	}
+	return defaultKrb5ConfPath
+}
+
+// the kdcs of KRB_KDC, a comma separated list of host[:port]
+func krb5KDCs() []string {
+	var kdcs []string
+	for _, kdc := range strings.Split(os.Getenv("KRB_KDC"), ",") {
+		if kdc = strings.TrimSpace(kdc); kdc != "" {
+			kdcs = append(kdcs, kdc)
+		}
+	}
+	return kdcs
+}
+
+// the realms other than KRB_REALM and their kdcs, KRB_REALMS=REALM.B=kdc1:88|kdc2;REALM.C=kdc3
+func krb5Realms() (map[string][]string, error) {
+	realms := make(map[string][]string)
+	for _, entry := range strings.Split(os.Getenv("KRB_REALMS"), ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		realm, list, _ := strings.Cut(entry, "=")
+		realm = strings.TrimSpace(realm)
+		for _, kdc := range strings.Split(list, "|") {
+			if kdc = strings.TrimSpace(kdc); kdc != "" {
+				realms[realm] = append(realms[realm], kdc)
 			}
-			HdfsClient = client
-			return HdfsClient
 		}
-		conf, _ := hadoopconf.LoadFromEnvironment()
-		opts := hdfs.ClientOptionsFromConf(conf)
-		if os.Getenv("KRB_ENABLED") == "true" {
-			opts.KerberosClient = makeKerberosClient()
+		if realm == "" || len(realms[realm]) == 0 {
+			return nil, fmt.Errorf("invalid KRB_REALMS entry '%s', expected REALM=kdc[:port]|kdc...", entry)
+		}
+	}
+	return realms, nil
+}
+
+// the realms of hosts and domains, KRB_DOMAIN_REALMS=.b.example.com=REALM.B,nn1.c.example.com=REALM.C
+func krb5DomainRealms() (map[string]string, error) {
+	domains := make(map[string]string)
+	for _, entry := range strings.Split(os.Getenv("KRB_DOMAIN_REALMS"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		domain, realm, _ := strings.Cut(entry, "=")
+		domain, realm = strings.TrimSpace(domain), strings.TrimSpace(realm)
+		if domain == "" || realm == "" {
+			return nil, fmt.Errorf("invalid KRB_DOMAIN_REALMS entry '%s', expected .domain=REALM or host=REALM", entry)
+		}
+		domains[domain] = realm
+	}
+	return domains, nil
+}
+
+// a krb5.conf for the default realm and any other realms, each served by the given kdcs, with hosts and
+// domains mapped to their realms
+func inlineKrb5Conf(defaultRealm string, realms map[string][]string, domains map[string]string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[libdefaults]\n  default_realm = %s\n  dns_lookup_kdc = false\n  dns_lookup_realm = false\n\n[realms]\n", defaultRealm)
+	for _, realm := range sortedKeys(realms) {
+		fmt.Fprintf(&b, "  %s = {\n", realm)
+		for _, kdc := range realms[realm] {
+			fmt.Fprintf(&b, "    kdc = %s\n", kdc)
 		}
-		client, err := hdfs.NewClient(opts)
+		b.WriteString("  }\n")
+	}
+	if len(domains) > 0 {
+		b.WriteString("\n[domain_realm]\n")
+		for _, domain := range sortedKeys(domains) {
+			fmt.Fprintf(&b, "  %s = %s\n", domain, domains[domain])
+		}
+	}
+	return b.String()
+}
+
+// loads the kerberos config: with KRB_KDC set, one describing KRB_REALM and its kdcs, plus the realms of
+// KRB_REALMS and the mappings of KRB_DOMAIN_REALMS, so no file needs to be mounted, otherwise krb5ConfPath()
+func loadKrb5Conf() (*config.Config, error) {
+	realms, err := krb5Realms()
+	if err != nil {
+		return nil, err
+	}
+	domains, err := krb5DomainRealms()
+	if err != nil {
+		return nil, err
+	}
+	if kdcs := krb5KDCs(); len(kdcs) > 0 {
+		realms[os.Getenv("KRB_REALM")] = kdcs
+		conf, err := config.NewFromString(inlineKrb5Conf(os.Getenv("KRB_REALM"), realms, domains))
 		if err != nil {
-			log.Fatalf("failed to create hdfs client: %s", err)
+			return nil, fmt.Errorf("cannot build a kerberos config from KRB_KDC: %w", err)
 		}
-		HdfsClient = client
+		return conf, nil
 	}
-	return HdfsClient
+	if len(realms) > 0 || len(domains) > 0 {
+		return nil, errors.New("KRB_REALMS and KRB_DOMAIN_REALMS extend the inline kerberos config and need KRB_KDC, add the realms to the kerberos config file instead")
+	}
+	path := krb5ConfPath()
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("kerberos config %s is missing, set KRB5_CONFIG or KRB_KDC: %w", path, err)
+	}
+	conf, err := config.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %w", path, err)
+	}
+	return conf, nil
+}
+
+// the keytab's location, KRB_KEYTAB or the secret it references
+func keytabPath() (string, error) {
+	if strings.HasPrefix(os.Getenv("KRB_KEYTAB"), "jceks://hdfs") {
+		return "", errors.New("KRB_KEYTAB can't come from a credential provider on hdfs, the keytab is needed to reach hdfs")
+	}
+	return secretEnv("KRB_KEYTAB")
 }
 
 // make a kerberos client. reads from env for configs.
-func makeKerberosClient() *client.Client {
-	kt, _ := keytab.Load(os.Getenv("KRB_KEYTAB"))
-	file, _ := os.Open("/etc/krb5.conf")
-	defer file.Close()
-	krb5conf, _ := config.NewFromReader(file)
-	return client.NewWithKeytab(os.Getenv("KRB_USER"), os.Getenv("KRB_REALM"), kt, krb5conf)
+func makeKerberosClient() (*client.Client, error) {
+	path, err := keytabPath()
+	if err != nil {
+		return nil, err
+	}
+	kt, err := keytab.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load keytab KRB_KEYTAB=%s: %w", path, err)
+	}
+	krb5conf, err := loadKrb5Conf()
+	if err != nil {
+		return nil, err
+	}
+	return client.NewWithKeytab(os.Getenv("KRB_USER"), os.Getenv("KRB_REALM"), kt, krb5conf), nil
 }
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// with contentStore=<dir> a copy writes every file into that content store on the target, under a path derived
+// from its sha256, <dir>/<first 2 hex digits>/<hex sha256>, and maps the copied names to their objects in a
+// _CONTENT_MANIFEST.tsv in 'to'. content the store already has, from this copy or any earlier one into it, isn't
+// sent again, and a copy of the manifest is a snapshot of the dataset costing no more than the manifest
+
+// written to the destination dir of a contentStore copy
+const ContentManifestFileName = "_CONTENT_MANIFEST.tsv"
+
+// a file of a contentStore copy
+type contentFile struct {
+	args   CopyArgs // as planned, into 'to'
+	sha256 string   // base64
+	object CopyArgs // the upload of its content into the store
+}
+
+// what a contentStore copy sends
+type contentPlan struct {
+	files        []contentFile
+	tasks        []CopyArgs      // the objects to send, one per content the store lacks
+	stored       map[string]bool // the objects the store already had
+	bytes        int64
+	filesDeduped int
+	bytesDeduped int64
+}
+
+// reads every planned file to hash it, with up to 'workers' at once, and leaves out those whose content is
+// already in the store on the target or sent for another file of the copy
+func planContentStore(client FileSystem, targetURL string, store string, tasks []CopyArgs, workers int) (contentPlan, error) {
+	sums := make([]string, len(tasks))
+	errs := make([]error, len(tasks))
+	var wg sync.WaitGroup
+	work := make(chan int)
+	for i := 0; i < workers && i < len(tasks); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				sum, err := fileChecksum(client, tasks[i].Path)
+				sums[i], errs[i] = sum.SHA256, err
+			}
+		}()
+	}
+	for i := range tasks {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return contentPlan{}, fmt.Errorf("cannot hash the files for the content store: %w", err)
+	}
+
+	plan := contentPlan{stored: make(map[string]bool)}
+	listings := make(map[string]map[string]int64) // the store's dirs listed so far
+	seen := make(map[string]bool)                 // the objects sent or found in the store
+	for i, t := range tasks {
+		raw, _ := base64.StdEncoding.DecodeString(sums[i])
+		name := hex.EncodeToString(raw)
+		object := CopyArgs{From: t.From, File: name, Path: t.Path, To: filepath.Join(store, name[:2]), Size: t.Size, ModTime: t.ModTime}
+		plan.files = append(plan.files, contentFile{t, sums[i], object})
+		path := filepath.Join(object.To, object.File)
+		if seen[path] {
+			plan.filesDeduped++
+			plan.bytesDeduped += t.Size
+			continue
+		}
+		seen[path] = true
+		listing, ok := listings[object.To]
+		if !ok {
+			entries, err := listPeer(targetURL, object.To)
+			if err != nil {
+				return contentPlan{}, fmt.Errorf("cannot list the content store %s: %w", object.To, err)
+			}
+			listing = make(map[string]int64, len(entries))
+			for _, e := range entries {
+				if !e.IsDir {
+					listing[e.Name] = e.Size
+				}
+			}
+			listings[object.To] = listing
+		}
+		if size, ok := listing[object.File]; ok && size == t.Size {
+			plan.stored[path] = true
+			plan.filesDeduped++
+			plan.bytesDeduped += t.Size
+			continue
+		}
+		plan.tasks = append(plan.tasks, object)
+		plan.bytes += t.Size
+	}
+	return plan, nil
+}
+
+// checks every object sent holds the content it's named by, quarantining those that don't: their source changed
+// after it was hashed. returns the copied objects that do and the failures of the others
+func (p contentPlan) checkCopied(targetURL string, copied []CopiedFile, job *Job) ([]CopiedFile, []CopyFailure) {
+	expected := make(map[string]string, len(p.files))
+	for _, f := range p.files {
+		expected[filepath.Join(f.object.To, f.object.File)] = f.sha256
+	}
+	kept := make([]CopiedFile, 0, len(copied))
+	var failures []CopyFailure
+	for _, c := range copied {
+		object := filepath.Join(c.Args.To, c.Args.File)
+		want := expected[object]
+		if c.Upload.SHA256 == want {
+			kept = append(kept, c)
+			continue
+		}
+		reason := "changed after it was hashed for the content store, its object holds other content"
+		q := QuarantinedFile{Path: object, Source: c.Args.Path, Reason: "contentStore: " + reason, Expected: map[string]string{"sha-256": want}, Actual: map[string]string{"sha-256": c.Upload.SHA256}}
+		if _, err := requestQuarantine(targetURL, q); err != nil {
+			reason += fmt.Sprintf(", cannot quarantine it: %s", err)
+		}
+		job.logf("Failed to copy %s: %s", c.Args.Path, reason)
+		failures = append(failures, CopyFailure{Path: c.Args.Path, Reason: reason, Size: c.Args.Size})
+	}
+	return kept, failures
+}
+
+// renders the manifest of the files written into root or below whose object is in the store, stored before or
+// copied: a header line, then one tab separated line per file with its path relative to root, size, hex sha256
+// and object path
+func (p contentPlan) renderManifest(root string, copied []CopiedFile) []byte {
+	delivered := make(map[string]bool, len(p.stored)+len(copied))
+	for object := range p.stored {
+		delivered[object] = true
+	}
+	for _, c := range copied {
+		delivered[filepath.Join(c.Args.To, c.Args.File)] = true
+	}
+	var lines []string
+	for _, f := range p.files {
+		dest, object := filepath.Join(f.args.To, f.args.File), filepath.Join(f.object.To, f.object.File)
+		rel, err := filepath.Rel(root, dest)
+		if err != nil || !within(dest, root) || !delivered[object] {
+			continue
+		}
+		lines = append(lines, rel+"\t"+strconv.FormatInt(f.args.Size, 10)+"\t"+f.object.File+"\t"+object+"\n")
+	}
+	sort.Strings(lines)
+
+	var buf bytes.Buffer
+	buf.WriteString("path\tsize\tsha256\tobject\n")
+	for _, line := range lines {
+		buf.WriteString(line)
+	}
+	return buf.Bytes()
+}
+
+// uploads the content manifest of the files under 'to' into 'to' on the target
+func (p contentPlan) writeManifest(targetURL string, to string, copied []CopiedFile, opts CopyOptions) error {
+	manifest := p.renderManifest(to, copied)
+	args := CopyArgs{File: ContentManifestFileName, Path: ContentManifestFileName, To: to, Size: int64(len(manifest))}
+	opts.Delta = false
+	_, err := send(bytes.NewReader(manifest), targetURL, args, opts)
+	return err
+}
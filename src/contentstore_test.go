@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestContentStoreCopy(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{"/src/a.txt": "same", "/src/b.txt": "same", "/src/sub/c.txt": "other"})
+	peer := httptest.NewServer(apiMux())
+	defer peer.Close()
+
+	copy := func(to string) CopyResponse {
+		query := url.Values{"from": {"/src"}, "to": {to}, "targetURL": {peer.URL + "/upload"}, "recursive": {"true"}, "contentStore": {"/cas"}}
+		rec := httptest.NewRecorder()
+		handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+		var resp CopyResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if rec.Code != http.StatusOK || resp.State != StateSucceeded {
+			t.Fatalf("copy to %s failed: %d %s", to, rec.Code, rec.Body)
+		}
+		return resp
+	}
+	if resp := copy("/ds1"); resp.FilesCopied != 2 || resp.FilesDeduped != 1 || resp.Written != 9 {
+		t.Errorf("expected the identical files sent once, got %+v", resp)
+	}
+	sum := sha256.Sum256([]byte("same"))
+	same := hex.EncodeToString(sum[:])
+	if data, ok := fs.get("/cas/" + same[:2] + "/" + same); !ok || data != "same" {
+		t.Fatalf("expected the content stored under its hash, got %q %v", data, ok)
+	}
+	if _, ok := fs.get("/ds1/a.txt"); ok {
+		t.Error("expected nothing but the manifest in 'to'")
+	}
+	manifest, _ := fs.get("/ds1/" + ContentManifestFileName)
+	lines := strings.Split(strings.TrimSpace(manifest), "\n")
+	if len(lines) != 4 || lines[1] != "a.txt\t4\t"+same+"\t/cas/"+same[:2]+"/"+same || !strings.HasPrefix(lines[3], "sub/c.txt\t5\t") {
+		t.Errorf("unexpected manifest:\n%s", manifest)
+	}
+
+	// a second dataset of the same content only costs its manifest
+	if resp := copy("/ds2"); resp.FilesCopied != 0 || resp.FilesDeduped != 3 || resp.Written != 0 {
+		t.Errorf("expected the content already in the store left out, got %+v", resp)
+	}
+	if second, _ := fs.get("/ds2/" + ContentManifestFileName); second != manifest {
+		t.Errorf("expected the same manifest, got:\n%s", second)
+	}
+}
+
+func TestContentStoreOptions(t *testing.T) {
+	for _, query := range []string{"contentStore=relative", "contentStore=/cas&manifest=true", "contentStore=/cas&targetURL=http://peer2/upload"} {
+		rec := httptest.NewRecorder()
+		handleCopy(rec, httptest.NewRequest("POST", "/copy?from=/src&to=/dst&targetURL=http://peer/upload&"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("expected %s to be refused, got %d %s", query, rec.Code, rec.Body)
+		}
+	}
+}
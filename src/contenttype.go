@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// with contentType=extension the sender types every file by its extension, FASTCOPY_CONTENT_TYPES first and the
+// system's mime types after, with contentType=sniff by its first 512 bytes, falling back to the extension. the
+// type is sent along and the target keeps it in an xattr of the file, where /ls?contentTypes=true and /download
+// find it. files of unknown type stay application/octet-stream and get no xattr
+
+const (
+	ContentTypeExtension = "extension"
+	ContentTypeSniff     = "sniff"
+)
+
+// the type of an upload's content, as detected by the sender
+const contentTypeHeader = "X-Fastcopy-Content-Type"
+
+// the xattr the target keeps a file's content type in
+const contentTypeXAttr = "user.fastcopy.content-type"
+
+const defaultContentType = "application/octet-stream"
+
+var (
+	contentTypes     map[string]string
+	contentTypesOnce sync.Once
+)
+
+// parses FASTCOPY_CONTENT_TYPES, extensions mapped to types like .parquet=application/vnd.apache.parquet,.avro=application/avro
+func loadContentTypes() (map[string]string, error) {
+	types := make(map[string]string)
+	spec := os.Getenv("FASTCOPY_CONTENT_TYPES")
+	if spec == "" {
+		return types, nil
+	}
+	for _, mapping := range strings.Split(spec, ",") {
+		ext, typ, ok := strings.Cut(strings.TrimSpace(mapping), "=")
+		if _, _, err := mime.ParseMediaType(typ); !ok || !strings.HasPrefix(ext, ".") || err != nil {
+			return nil, fmt.Errorf("invalid FASTCOPY_CONTENT_TYPES mapping '%s', expected .ext=type/subtype", mapping)
+		}
+		types[strings.ToLower(ext)] = typ
+	}
+	return types, nil
+}
+
+// lazy loads the configured content types by extension
+func getContentTypes() map[string]string {
+	contentTypesOnce.Do(func() {
+		types, err := loadContentTypes()
+		if err != nil {
+			log.Fatal(err)
+		}
+		contentTypes = types
+	})
+	return contentTypes
+}
+
+func validContentTypeMode(mode string) bool {
+	return mode == "" || mode == ContentTypeExtension || mode == ContentTypeSniff
+}
+
+// the type of a file by its extension, "" if unknown
+func typeByExtension(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if typ, ok := getContentTypes()[ext]; ok {
+		return typ
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// the content type of the file read from r for mode, "" if unknown, and the reader to send it from. sniffing
+// peeks at the start of the file, through ReadAt for a resumable source so it can still be seeked
+func detectContentType(r io.Reader, name string, mode string) (string, io.Reader) {
+	if mode == "" {
+		return "", r
+	}
+	if mode == ContentTypeSniff {
+		var head []byte
+		if src, ok := asResumable(r); ok {
+			buf := make([]byte, 512)
+			n, _ := src.ReadAt(buf, 0)
+			head = buf[:n]
+		} else {
+			br := bufio.NewReaderSize(r, 512)
+			head, _ = br.Peek(512)
+			r = br
+		}
+		if typ := http.DetectContentType(head); typ != defaultContentType {
+			return typ, r
+		}
+	}
+	return typeByExtension(name), r
+}
+
+// keeps the content type the sender detected for an upload written to path
+func storeContentType(client FileSystem, path string, r *http.Request) {
+	typ := r.Header.Get(contentTypeHeader)
+	if typ == "" || typ == defaultContentType {
+		return
+	}
+	if _, _, err := mime.ParseMediaType(typ); err != nil {
+		log.Printf("Ignoring the invalid content type '%s' of %s", typ, path)
+		return
+	}
+	if err := client.SetXAttr(path, contentTypeXAttr, typ); err != nil {
+		log.Printf("Failed to keep the content type of %s, are xattrs enabled? %s", path, err)
+	}
+}
+
+// the content type kept for the file at path, "" if none
+func storedContentType(client FileSystem, path string) string {
+	attrs, err := client.ListXAttrs(path)
+	if err != nil {
+		return ""
+	}
+	return attrs[contentTypeXAttr]
+}
+
+// GET /download?path= serves a file with the content type it was copied with. a Range header is served by
+// seeking the file, so pulls can be resumed and huge files fetched in parallel parts; the ETag, from the file's
+// mtime and length, lets If-Range tell when the file changed between parts
+func handleDownload(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeError(w, "'path' query param must be provided.", http.StatusBadRequest)
+		return
+	}
+	client := GetHdfsClient()
+	reader, err := client.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		writeError(w, fmt.Sprintf("%s does not exist", path), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, fmt.Sprintf("Failed to open %s: %s", path, err), http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+	info := reader.Stat()
+	if info.IsDir() {
+		writeError(w, fmt.Sprintf("%s is a directory", path), http.StatusBadRequest)
+		return
+	}
+	typ := storedContentType(client, path)
+	if typ == "" {
+		typ = defaultContentType
+	}
+	w.Header().Set("Content-Type", typ)
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), reader)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func useContentTypes(t *testing.T, types map[string]string) {
+	contentTypesOnce.Do(func() {})
+	prev := contentTypes
+	contentTypes = types
+	t.Cleanup(func() { contentTypes = prev })
+}
+
+func TestDetectContentType(t *testing.T) {
+	useContentTypes(t, map[string]string{".parquet": "application/vnd.apache.parquet"})
+	png := "\x89PNG\x0d\x0a\x1a\x0a" + strings.Repeat("\x00", 600)
+	for _, c := range []struct {
+		name, data, mode, want string
+	}{
+		{"part-00000.parquet", "PAR1", ContentTypeExtension, "application/vnd.apache.parquet"},
+		{"schema.JSON", "{}", ContentTypeExtension, "application/json"},
+		{"image", png, ContentTypeExtension, ""},
+		{"image", png, ContentTypeSniff, "image/png"},
+		{"part-00000.parquet", "PAR1\x00\x01", ContentTypeSniff, "application/vnd.apache.parquet"},
+		{"schema.json", "{}", "", ""},
+	} {
+		typ, r := detectContentType(io.NopCloser(strings.NewReader(c.data)), c.name, c.mode)
+		if typ != c.want {
+			t.Errorf("%s with %q: expected %q, got %q", c.name, c.mode, c.want, typ)
+		}
+		if data, _ := io.ReadAll(r); string(data) != c.data {
+			t.Errorf("%s with %q: expected the whole file to be left to send", c.name, c.mode)
+		}
+	}
+
+	t.Setenv("FASTCOPY_CONTENT_TYPES", ".avro=application/avro, .orc=application/x-orc")
+	if types, err := loadContentTypes(); err != nil || types[".orc"] != "application/x-orc" {
+		t.Errorf("unexpected types %v %v", types, err)
+	}
+	t.Setenv("FASTCOPY_CONTENT_TYPES", "avro=application/avro")
+	if _, err := loadContentTypes(); err == nil {
+		t.Error("expected a mapping without a leading dot to be rejected")
+	}
+}
+
+func TestContentTypeCopy(t *testing.T) {
+	fs := useMemFS(t)
+	useContentTypes(t, map[string]string{})
+	fs.put(map[string]string{"/data/index.html": "<html><body>hi</body></html>", "/data/blob": "\x00\x01\x02"})
+	peer := httptest.NewServer(apiMux())
+	defer peer.Close()
+
+	query := url.Values{"from": {"/data"}, "to": {"/backup"}, "targetURL": {peer.URL + "/upload"}, "contentType": {"sniff"}, "precheck": {"none"}}
+	rec := httptest.NewRecorder()
+	handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the copy to succeed, got %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	handleLs(rec, httptest.NewRequest("GET", "/ls?path=/backup&contentTypes=true", nil))
+	var entries []LsEntry
+	json.NewDecoder(rec.Body).Decode(&entries)
+	if len(entries) != 2 || entries[0].ContentType != "" || entries[1].ContentType != "text/html; charset=utf-8" {
+		t.Errorf("unexpected listing %+v", entries)
+	}
+
+	rec = httptest.NewRecorder()
+	handleDownload(rec, httptest.NewRequest("GET", "/download?path=/backup/index.html", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/html; charset=utf-8" || rec.Body.String() != "<html><body>hi</body></html>" {
+		t.Errorf("unexpected download %d %s: %s", rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	handleDownload(rec, httptest.NewRequest("GET", "/download?path=/backup/blob", nil))
+	if rec.Header().Get("Content-Type") != defaultContentType {
+		t.Errorf("expected a file without a type to be served as %s, got %s", defaultContentType, rec.Header().Get("Content-Type"))
+	}
+	rec = httptest.NewRecorder()
+	handleDownload(rec, httptest.NewRequest("GET", "/download?path=/backup/missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected a missing file to answer 404, got %d", rec.Code)
+	}
+}
+
+func TestDownloadRange(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{"/data/huge": "0123456789abcdef"})
+	download := func(header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/download?path=/data/huge", nil)
+		r.Header = header
+		rec := httptest.NewRecorder()
+		handleDownload(rec, r)
+		return rec
+	}
+
+	rec := download(http.Header{"Range": {"bytes=10-"}})
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "abcdef" || rec.Header().Get("Content-Range") != "bytes 10-15/16" {
+		t.Errorf("expected the rest of the file from byte 10, got %d %s: %s", rec.Code, rec.Header().Get("Content-Range"), rec.Body)
+	}
+	etag := rec.Header().Get("ETag")
+	if rec := download(http.Header{"Range": {"bytes=4-7"}, "If-Range": {etag}}); rec.Code != http.StatusPartialContent || rec.Body.String() != "4567" {
+		t.Errorf("expected bytes 4-7 of an unchanged file, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := download(http.Header{"Range": {"bytes=4-7"}, "If-Range": {`"stale"`}}); rec.Code != http.StatusOK || rec.Body.String() != "0123456789abcdef" {
+		t.Errorf("expected the whole file once it changed, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := download(http.Header{"Range": {"bytes=20-"}}); rec.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("expected a range past the end to answer 416, got %d", rec.Code)
+	}
+}
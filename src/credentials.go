@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// the hdfs client authenticates with the keytab as it was when the client was built. after a keytab
+// rotation reloadCredentials builds a new client and swaps it in; jobs already running keep the client
+// they started with, which is closed once they're done
+
+// how often the keytab is checked for changes unless FASTCOPY_KEYTAB_POLL is set
+const defaultKeytabPoll = time.Minute
+
+// how long a replaced client stays open for uploads still writing with it, the server's WriteTimeout
+const retiredClientGrace = 15 * time.Minute
+
+var errKerberosDisabled = errors.New("kerberos isn't enabled, there are no credentials to reload")
+
+type ReloadResponse struct {
+	Principal  string    `json:"principal"`
+	Keytab     string    `json:"keytab"`
+	ReloadedAt time.Time `json:"reloadedAt"`
+}
+
+// parses FASTCOPY_KEYTAB_POLL, 0 disables watching the keytab
+func keytabPollInterval() (time.Duration, error) {
+	v := os.Getenv("FASTCOPY_KEYTAB_POLL")
+	if v == "" {
+		return defaultKeytabPoll, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid FASTCOPY_KEYTAB_POLL '%s', expected a duration like 1m or 0 to disable", v)
+	}
+	return d, nil
+}
+
+// rebuilds the kerberos and hdfs clients from the current keytab and swaps them in. the current client
+// is kept if the new credentials are invalid or can't reach the namenode
+func reloadCredentials() (ReloadResponse, error) {
+	if os.Getenv("KRB_ENABLED") != "true" {
+		return ReloadResponse{}, errKerberosDisabled
+	}
+	forgetSecrets() // the keytab's location may have been rotated in its secret store too
+	if problems := validateKerberos(); len(problems) > 0 {
+		return ReloadResponse{}, fmt.Errorf("keeping the current credentials: %w", errors.Join(problems...))
+	}
+	client, err := newHdfsClient()
+	if err != nil {
+		return ReloadResponse{}, fmt.Errorf("keeping the current credentials: %w", err)
+	}
+	if _, err := client.Stat("/"); err != nil {
+		client.Close()
+		return ReloadResponse{}, fmt.Errorf("keeping the current credentials, the namenode rejected the new ones: %w", err)
+	}
+	if prev := swapHdfsClient(client); prev != nil {
+		go retireClient(prev, runningJobs(), retiredClientGrace, time.Minute)
+	}
+	getClientPool().retireAll() // running copies keep their clients until they finish
+	path, _ := keytabPath()
+	res := ReloadResponse{os.Getenv("KRB_USER") + "@" + os.Getenv("KRB_REALM"), path, time.Now()}
+	log.Printf("reloaded kerberos credentials of %s from %s", res.Principal, res.Keytab)
+	return res, nil
+}
+
+// the jobs running now
+func runningJobs() []*Job {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	var running []*Job
+	for _, job := range jobs {
+		if job.running() {
+			running = append(running, job)
+		}
+	}
+	return running
+}
+
+// closes a replaced client once the grace period passed and the jobs that may still use it finished
+func retireClient(client FileSystem, jobs []*Job, grace time.Duration, poll time.Duration) {
+	time.Sleep(grace)
+	for _, job := range jobs {
+		for job.running() {
+			time.Sleep(poll)
+		}
+	}
+	if err := client.Close(); err != nil {
+		log.Printf("failed to close the replaced hdfs client: %s", err)
+	}
+}
+
+// calls reload whenever the file at path changes, checking every interval until stop is closed
+func watchKeytab(path string, interval time.Duration, reload func() error, stop <-chan struct{}) {
+	last, _ := os.Stat(path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue // mid rotation, or gone: keep the current credentials
+		}
+		if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+			continue
+		}
+		last = info
+		log.Printf("keytab %s changed, reloading credentials", path)
+		if err := reload(); err != nil {
+			log.Printf("failed to reload credentials, trying again on the next change: %s", err)
+		}
+	}
+}
+
+// POST /admin/reload-credentials rebuilds the kerberos and hdfs clients from the keytab, e.g. after a rotation
+func handleReloadCredentials(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	res, err := reloadCredentials()
+	if errors.Is(err, errKerberosDisabled) {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json, _ := json.MarshalIndent(res, "", "  ")
+	w.Write(json)
+}
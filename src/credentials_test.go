@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReloadCredentialsNeedsKerberos(t *testing.T) {
+	t.Setenv("KRB_ENABLED", "")
+	rec := httptest.NewRecorder()
+	handleReloadCredentials(rec, httptest.NewRequest("GET", "/admin/reload-credentials", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected GET to be rejected, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	handleReloadCredentials(rec, httptest.NewRequest("POST", "/admin/reload-credentials", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected a reload without kerberos to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestReloadCredentialsKeepsClientOnInvalidKeytab(t *testing.T) {
+	fs := useMemFS(t)
+	t.Setenv("KRB_ENABLED", "true")
+	t.Setenv("KRB_USER", "fastcopy")
+	t.Setenv("KRB_REALM", "EXAMPLE.COM")
+	t.Setenv("KRB_KEYTAB", filepath.Join(t.TempDir(), "missing.keytab"))
+	if _, err := reloadCredentials(); err == nil {
+		t.Fatal("expected a reload with a missing keytab to fail")
+	}
+	if GetHdfsClient() != FileSystem(fs) {
+		t.Error("expected the current client to be kept")
+	}
+}
+
+func TestWatchKeytab(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fastcopy.keytab")
+	if err := os.WriteFile(path, []byte("v1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var reloads int32
+	stop := make(chan struct{})
+	defer close(stop)
+	go watchKeytab(path, 5*time.Millisecond, func() error { atomic.AddInt32(&reloads, 1); return nil }, stop)
+
+	time.Sleep(30 * time.Millisecond)
+	if n := atomic.LoadInt32(&reloads); n != 0 {
+		t.Fatalf("expected no reload of an unchanged keytab, got %d", n)
+	}
+	if err := os.WriteFile(path, []byte("v2, rotated"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&reloads) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if n := atomic.LoadInt32(&reloads); n != 1 {
+		t.Errorf("expected one reload after the rotation, got %d", n)
+	}
+}
+
+// counts Close calls
+type closeCounter struct {
+	*memFS
+	closed int32
+}
+
+func (c *closeCounter) Close() error {
+	atomic.AddInt32(&c.closed, 1)
+	return nil
+}
+
+func TestRetireClientWaitsForJobs(t *testing.T) {
+	job, err := startJob("", "/src", "/dst", "http://t/upload", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &closeCounter{memFS: newMemFS()}
+	done := make(chan struct{})
+	go func() {
+		retireClient(client, []*Job{job}, 0, time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if atomic.LoadInt32(&client.closed) != 0 {
+		t.Fatal("expected the client to stay open while the job runs")
+	}
+	job.finish(CopyResponse{JobID: job.id, State: StateSucceeded})
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the client to be closed once the job finished")
+	}
+	if atomic.LoadInt32(&client.closed) != 1 {
+		t.Error("expected the client to be closed once")
+	}
+}
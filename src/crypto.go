@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Upload bodies can be encrypted end to end between two fastcopy processes with AES-256-GCM.
+// Each upload is sealed with its own key, derived with HKDF-SHA256 from the configured key and a
+// random 32 byte salt sent in a header, so nonces never repeat under one key however many uploads
+// a long-lived key protects. The plaintext is cut into segments, each sealed as its own frame:
+//
+//	[4 byte big-endian ciphertext length][ciphertext + 16 byte tag]
+//
+// The 12 byte nonce of each frame is a random 7 byte prefix (sent in a header), a 4 byte
+// frame counter and a 1 byte flag marking the final frame, so frames can't be reordered,
+// dropped or truncated without failing authentication. Uploads of senders predating the
+// derived keys, sealed with the configured key itself, are still decrypted.
+const (
+	encryptionAlgorithm       = "aes-256-gcm-hkdf-sha256"
+	legacyEncryptionAlgorithm = "aes-256-gcm" // sealed with the configured key, without a salt
+	encryptionHeader          = "X-Fastcopy-Encryption"
+	encryptionKeyHeader       = "X-Fastcopy-Key-Id"
+	encryptionNonceHdr        = "X-Fastcopy-Nonce"
+	encryptionSaltHdr         = "X-Fastcopy-Salt"
+	defaultKeyID              = "default"
+	segmentSize               = 64 * 1024
+	noncePrefixSize           = 7
+	saltSize                  = 32
+	maxFrameSize              = segmentSize + 16
+)
+
+var (
+	keyring     map[string][]byte
+	keyringErr  error
+	keyringOnce sync.Once
+)
+
+// lazy loads the encryption keys from env.
+// FASTCOPY_ENCRYPTION_KEY is the pre-shared key used when no key id is requested.
+// FASTCOPY_ENCRYPTION_KEYS holds additional per-job keys as a comma separated list of id=key.
+// keys are base64 encoded 32 byte AES-256 keys and must be configured identically on both sides.
+// either variable, or a single key in the list, may reference a secret store, see secretEnv
+func loadKeyring() error {
+	keyringOnce.Do(func() {
+		keyring = make(map[string][]byte)
+		v, err := secretEnv("FASTCOPY_ENCRYPTION_KEY")
+		if err != nil {
+			keyringErr = err
+			return
+		}
+		if v != "" {
+			keyring[defaultKeyID], keyringErr = decodeKey(defaultKeyID, v)
+		}
+		keys, err := secretEnv("FASTCOPY_ENCRYPTION_KEYS")
+		if err != nil {
+			keyringErr = err
+			return
+		}
+		for _, entry := range strings.Split(keys, ",") {
+			if keyringErr != nil || strings.TrimSpace(entry) == "" {
+				continue
+			}
+			kid, v, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			if !ok {
+				keyringErr = fmt.Errorf("malformed FASTCOPY_ENCRYPTION_KEYS entry %q, expected id=key", entry)
+				continue
+			}
+			if v, err = secretValue(v); err != nil {
+				keyringErr = fmt.Errorf("cannot resolve encryption key '%s': %w", kid, err)
+				continue
+			}
+			keyring[kid], keyringErr = decodeKey(kid, v)
+		}
+	})
+	return keyringErr
+}
+
+// returns the encryption key with the given id, the pre-shared key if id is empty
+func encryptionKey(id string) ([]byte, error) {
+	if err := loadKeyring(); err != nil {
+		return nil, err
+	}
+	if id == "" {
+		id = defaultKeyID
+	}
+	key, ok := keyring[id]
+	if !ok {
+		return nil, fmt.Errorf("no encryption key configured with id '%s'", id)
+	}
+	return key, nil
+}
+
+func decodeKey(id string, v string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+	if err != nil {
+		return nil, fmt.Errorf("encryption key '%s' is not valid base64: %s", id, err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key '%s' must be 32 bytes, got %d", id, len(key))
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// the key an upload is sealed with, derived from the configured key and the upload's salt
+func uploadKey(key []byte, salt []byte) ([]byte, error) {
+	derived := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte("fastcopy upload")), derived); err != nil {
+		return nil, err
+	}
+	return derived, nil
+}
+
+func frameNonce(prefix []byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encrypts a plaintext stream into framed ciphertext
+type encryptReader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	plain   []byte
+	out     []byte
+	done    bool
+}
+
+// wraps r so it is encrypted with the key 'keyID', setting the headers the receiver needs to decrypt it
+func newEncryptReader(r io.Reader, keyID string, h http.Header) (*encryptReader, error) {
+	key, err := encryptionKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if key, err = uploadKey(key, salt); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if keyID == "" {
+		keyID = defaultKeyID
+	}
+	h.Set(encryptionHeader, encryptionAlgorithm)
+	h.Set(encryptionKeyHeader, keyID)
+	h.Set(encryptionNonceHdr, base64.StdEncoding.EncodeToString(prefix))
+	h.Set(encryptionSaltHdr, base64.StdEncoding.EncodeToString(salt))
+	return &encryptReader{src: r, aead: aead, prefix: prefix, plain: make([]byte, segmentSize)}, nil
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(e.src, e.plain)
+		final := false
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			final = true
+		} else if err != nil {
+			return 0, err
+		}
+		frame := make([]byte, 4, 4+n+e.aead.Overhead())
+		frame = e.aead.Seal(frame, frameNonce(e.prefix, e.counter, final), e.plain[:n], nil)
+		binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+		e.out = frame
+		e.counter++
+		e.done = final
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+var errDecryptionFailed = errors.New("upload body failed decryption")
+
+// decrypts framed ciphertext produced by encryptReader
+type decryptReader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	frame   []byte
+	plain   []byte
+	out     []byte
+	done    bool
+	err     error
+}
+
+// builds a decryptReader from the encryption headers of an upload request
+func newDecryptReader(r io.Reader, h http.Header) (*decryptReader, error) {
+	alg := h.Get(encryptionHeader)
+	if alg != encryptionAlgorithm && alg != legacyEncryptionAlgorithm {
+		return nil, fmt.Errorf("unsupported encryption algorithm '%s'", alg)
+	}
+	key, err := encryptionKey(h.Get(encryptionKeyHeader))
+	if err != nil {
+		return nil, err
+	}
+	if alg == encryptionAlgorithm {
+		salt, err := base64.StdEncoding.DecodeString(h.Get(encryptionSaltHdr))
+		if err != nil || len(salt) != saltSize {
+			return nil, fmt.Errorf("invalid %s header", encryptionSaltHdr)
+		}
+		if key, err = uploadKey(key, salt); err != nil {
+			return nil, err
+		}
+	}
+	prefix, err := base64.StdEncoding.DecodeString(h.Get(encryptionNonceHdr))
+	if err != nil || len(prefix) != noncePrefixSize {
+		return nil, fmt.Errorf("invalid %s header", encryptionNonceHdr)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{src: r, aead: aead, prefix: prefix, frame: make([]byte, maxFrameSize), plain: make([]byte, 0, segmentSize)}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.done {
+			return 0, io.EOF
+		}
+		d.err = d.readFrame()
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+func (d *decryptReader) readFrame() error {
+	var size [4]byte
+	if _, err := io.ReadFull(d.src, size[:]); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("%w: stream truncated before final frame", errDecryptionFailed)
+		}
+		return err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxFrameSize {
+		return fmt.Errorf("%w: frame of %d bytes exceeds maximum", errDecryptionFailed, n)
+	}
+	if _, err := io.ReadFull(d.src, d.frame[:n]); err != nil {
+		return err
+	}
+	// a frame is only ever valid as final or non-final, try non-final first as it's the common case
+	plain, err := d.aead.Open(d.plain[:0], frameNonce(d.prefix, d.counter, false), d.frame[:n], nil)
+	if err != nil {
+		plain, err = d.aead.Open(d.plain[:0], frameNonce(d.prefix, d.counter, true), d.frame[:n], nil)
+		if err != nil {
+			return fmt.Errorf("%w: frame %d failed authentication", errDecryptionFailed, d.counter)
+		}
+		d.done = true
+	}
+	d.out = plain
+	d.counter++
+	return nil
+}
+
+// Err returns the reason decryption failed, if it did
+func (d *decryptReader) Err() error {
+	if errors.Is(d.err, errDecryptionFailed) {
+		return d.err
+	}
+	return nil
+}
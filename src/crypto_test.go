@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestEncryptRoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	t.Setenv("FASTCOPY_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(key))
+
+	for _, size := range []int{0, 13, segmentSize, 3*segmentSize + 7} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+
+		h := http.Header{}
+		enc, err := newEncryptReader(bytes.NewReader(plain), "", h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ciphertext, err := io.ReadAll(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dec, err := newDecryptReader(bytes.NewReader(ciphertext), h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(dec)
+		if err != nil {
+			t.Fatalf("decrypting %d bytes: %s", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("round trip of %d bytes returned different data", size)
+		}
+
+		// dropping the final frame must be detected
+		if size > segmentSize {
+			dec, _ = newDecryptReader(bytes.NewReader(ciphertext[:4+maxFrameSize]), h)
+			if _, err := io.ReadAll(dec); !errors.Is(err, errDecryptionFailed) {
+				t.Errorf("expected truncation to fail decryption, got %v", err)
+			}
+		}
+	}
+}
+
+func TestEncryptDerivesKeyPerUpload(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	t.Setenv("FASTCOPY_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(key))
+	plain := []byte("the same content")
+
+	first, second := http.Header{}, http.Header{}
+	enc, _ := newEncryptReader(bytes.NewReader(plain), "", first)
+	ciphertext, _ := io.ReadAll(enc)
+	newEncryptReader(bytes.NewReader(plain), "", second)
+	if first.Get(encryptionSaltHdr) == second.Get(encryptionSaltHdr) {
+		t.Error("expected every upload to get a salt of its own")
+	}
+	// the salt is authenticated through the key it derives
+	first.Set(encryptionSaltHdr, second.Get(encryptionSaltHdr))
+	dec, err := newDecryptReader(bytes.NewReader(ciphertext), first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(dec); !errors.Is(err, errDecryptionFailed) {
+		t.Errorf("expected another upload's salt to fail decryption, got %v", err)
+	}
+	first.Del(encryptionSaltHdr)
+	if _, err := newDecryptReader(bytes.NewReader(ciphertext), first); err == nil {
+		t.Error("expected an upload without its salt to be refused")
+	}
+
+	// an upload of a sender predating the derived keys, sealed with the configured key
+	key, _ = encryptionKey("") // the keyring is loaded once per process
+	aead, _ := newGCM(key)
+	prefix := make([]byte, noncePrefixSize)
+	frame := aead.Seal(make([]byte, 4), frameNonce(prefix, 0, true), plain, nil)
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+	legacy := http.Header{}
+	legacy.Set(encryptionHeader, legacyEncryptionAlgorithm)
+	legacy.Set(encryptionNonceHdr, base64.StdEncoding.EncodeToString(prefix))
+	dec, err = newDecryptReader(bytes.NewReader(frame), legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(dec); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("expected a legacy upload to decrypt, got %q %v", got, err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// a single slow or failing datanode can drag a whole copy down. the connections the hdfs client dials to datanodes
+// count the bytes read through them and the failures, dialing or reading, by datanode address. /metrics serves the
+// totals, and a copy's response the reads of each datanode while it ran, which include those of copies running
+// at the same time
+
+// the reads from a datanode
+type DatanodeStats struct {
+	Datanode  string `json:"datanode"`
+	BytesRead int64  `json:"bytesRead"`
+	Errors    int64  `json:"errors"`
+}
+
+type datanodeCounter struct {
+	read   atomic.Int64
+	errors atomic.Int64
+}
+
+var (
+	datanodeCounters   = make(map[string]*datanodeCounter)
+	datanodeCountersMu sync.Mutex
+)
+
+func datanodeCounterFor(addr string) *datanodeCounter {
+	datanodeCountersMu.Lock()
+	defer datanodeCountersMu.Unlock()
+	c, ok := datanodeCounters[addr]
+	if !ok {
+		c = &datanodeCounter{}
+		datanodeCounters[addr] = c
+	}
+	return c
+}
+
+// wraps the datanode dial func of the hdfs client to count what's read from each datanode
+func countDatanodeReads(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c := datanodeCounterFor(normalizeHostPort(addr))
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			c.errors.Add(1)
+			return nil, err
+		}
+		return &datanodeConn{conn, c}, nil
+	}
+}
+
+type datanodeConn struct {
+	net.Conn
+	counter *datanodeCounter
+}
+
+func (c *datanodeConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.counter.read.Add(int64(n))
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		c.counter.errors.Add(1)
+	}
+	return n, err
+}
+
+// the reads from each datanode so far
+func datanodeSnapshot() map[string]DatanodeStats {
+	datanodeCountersMu.Lock()
+	defer datanodeCountersMu.Unlock()
+	stats := make(map[string]DatanodeStats, len(datanodeCounters))
+	for addr, c := range datanodeCounters {
+		stats[addr] = DatanodeStats{Datanode: addr, BytesRead: c.read.Load(), Errors: c.errors.Load()}
+	}
+	return stats
+}
+
+// the reads from each datanode since the snapshot before, of the datanodes read from or failing since
+func datanodesSince(before map[string]DatanodeStats) []DatanodeStats {
+	var since []DatanodeStats
+	now := datanodeSnapshot()
+	for _, addr := range sortedKeys(now) {
+		s := now[addr]
+		s.BytesRead -= before[addr].BytesRead
+		s.Errors -= before[addr].Errors
+		if s.BytesRead > 0 || s.Errors > 0 {
+			since = append(since, s)
+		}
+	}
+	return since
+}
+
+// writes the per datanode counters in the Prometheus text format
+func writeDatanodeMetrics(w io.Writer) {
+	stats := datanodeSnapshot()
+	if len(stats) == 0 {
+		return
+	}
+	addrs := sortedKeys(stats)
+	fmt.Fprintln(w, "# HELP fastcopy_hdfs_datanode_read_bytes_total Bytes read from a datanode by the hdfs client.")
+	fmt.Fprintln(w, "# TYPE fastcopy_hdfs_datanode_read_bytes_total counter")
+	for _, addr := range addrs {
+		fmt.Fprintf(w, "fastcopy_hdfs_datanode_read_bytes_total{datanode=%q} %d\n", addr, stats[addr].BytesRead)
+	}
+	fmt.Fprintln(w, "# HELP fastcopy_hdfs_datanode_errors_total Failures dialing or reading a datanode.")
+	fmt.Fprintln(w, "# TYPE fastcopy_hdfs_datanode_errors_total counter")
+	for _, addr := range addrs {
+		fmt.Fprintf(w, "fastcopy_hdfs_datanode_errors_total{datanode=%q} %d\n", addr, stats[addr].Errors)
+	}
+}
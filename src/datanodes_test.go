@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDatanodeStats(t *testing.T) {
+	datanodeCountersMu.Lock()
+	prev := datanodeCounters
+	datanodeCounters = make(map[string]*datanodeCounter)
+	datanodeCountersMu.Unlock()
+	t.Cleanup(func() { datanodeCounters = prev })
+
+	before := datanodeSnapshot()
+	dial := countDatanodeReads(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == "dn2:9866" {
+			return nil, errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		go func() {
+			server.Write([]byte("block data"))
+			server.Close()
+		}()
+		return client, nil
+	})
+	conn, err := dial(context.Background(), "tcp", "dn1:9866")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(conn)
+	conn.Close()
+	if _, err := dial(context.Background(), "tcp", "dn2:9866"); err == nil {
+		t.Fatal("expected the dial to fail")
+	}
+
+	expected := []DatanodeStats{{"dn1:9866", 10, 0}, {"dn2:9866", 0, 1}}
+	if since := datanodesSince(before); len(since) != 2 || since[0] != expected[0] || since[1] != expected[1] {
+		t.Errorf("expected %+v, got %+v", expected, since)
+	}
+	if since := datanodesSince(datanodeSnapshot()); len(since) != 0 {
+		t.Errorf("expected nothing read since the last snapshot, got %+v", since)
+	}
+
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`fastcopy_hdfs_datanode_read_bytes_total{datanode="dn1:9866"} 10`,
+		`fastcopy_hdfs_datanode_errors_total{datanode="dn2:9866"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), line+"\n") {
+			t.Errorf("expected %s in:\n%s", line, rec.Body)
+		}
+	}
+}
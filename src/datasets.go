@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// datasets are defined centrally, by their paths, the /copy params filtering them, where they're delivered and
+// who owns them, and jobs are submitted as dataset=clickstream_daily without knowing any path. they're read
+// from the JSON list in FASTCOPY_DATASETS, or looked up by name in a catalog, GET FASTCOPY_DATASET_CATALOG/{name}
+// answering a dataset as JSON or 404. a copy of a dataset is labelled dataset=<name> and owners=<owner,...>
+
+// a named set of source dirs and how they're copied
+type Dataset struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Paths       []string          `json:"paths"`
+	To          string            `json:"to"`
+	TargetURLs  []string          `json:"targetURLs"`
+	Params      map[string]string `json:"params,omitempty"` // filters and other /copy params
+	Owners      []string          `json:"owners,omitempty"`
+}
+
+// params a dataset decides, a copy of it can't give them
+var datasetParams = []string{"from", "to", "targetURL"}
+
+type datasetCatalog struct {
+	url      string // empty without a catalog
+	datasets map[string]Dataset
+}
+
+var (
+	datasets     datasetCatalog
+	datasetsOnce sync.Once
+)
+
+// reads the datasets in FASTCOPY_DATASETS and the catalog's url, FASTCOPY_DATASET_CATALOG
+func loadDatasets() (datasetCatalog, error) {
+	c := datasetCatalog{url: strings.TrimSuffix(os.Getenv("FASTCOPY_DATASET_CATALOG"), "/"), datasets: make(map[string]Dataset)}
+	if c.url != "" {
+		if u, err := url.Parse(c.url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return c, fmt.Errorf("invalid FASTCOPY_DATASET_CATALOG '%s', expected an http(s) url", c.url)
+		}
+	}
+	path := os.Getenv("FASTCOPY_DATASETS")
+	if path == "" {
+		return c, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return c, fmt.Errorf("cannot read FASTCOPY_DATASETS: %w", err)
+	}
+	var list []Dataset
+	if err := json.Unmarshal(data, &list); err != nil {
+		return c, fmt.Errorf("invalid FASTCOPY_DATASETS %s: %w", path, err)
+	}
+	for _, d := range list {
+		if err := validateDataset(d); err != nil {
+			return c, fmt.Errorf("invalid dataset in FASTCOPY_DATASETS: %w", err)
+		}
+		c.datasets[d.Name] = d
+	}
+	return c, nil
+}
+
+// lazy loads the datasets
+func getDatasets() datasetCatalog {
+	datasetsOnce.Do(func() {
+		c, err := loadDatasets()
+		if err != nil {
+			log.Fatal(err)
+		}
+		datasets = c
+	})
+	return datasets
+}
+
+// checks the dataset names its paths and destination, and that its params make a valid copy
+func validateDataset(d Dataset) error {
+	if d.Name == "" || strings.ContainsAny(d.Name, "/?&= ") {
+		return fmt.Errorf("'%s' is not a valid dataset name", d.Name)
+	}
+	if len(d.Paths) == 0 || d.To == "" || len(d.TargetURLs) == 0 {
+		return fmt.Errorf("dataset %s must give 'paths', 'to' and 'targetURLs'", d.Name)
+	}
+	q := url.Values{}
+	for k, v := range d.Params {
+		q.Set(k, v)
+	}
+	for _, p := range append(datasetParams, templateForbiddenParams...) {
+		if _, ok := q[p]; ok {
+			return fmt.Errorf("dataset %s can't set '%s' in its params", d.Name, p)
+		}
+	}
+	if _, err := parseCopyOptions(&http.Request{URL: &url.URL{RawQuery: q.Encode()}}); err != nil {
+		return fmt.Errorf("dataset %s: %w", d.Name, err)
+	}
+	return nil
+}
+
+var errDatasetNotFound = errors.New("dataset not found")
+
+// the dataset named name, from FASTCOPY_DATASETS or else the catalog
+func (c datasetCatalog) lookup(name string) (Dataset, error) {
+	if d, ok := c.datasets[name]; ok {
+		return d, nil
+	}
+	if c.url == "" {
+		return Dataset{}, fmt.Errorf("%w: %s", errDatasetNotFound, name)
+	}
+	resp, err := httpClient.Get(c.url + "/" + url.PathEscape(name))
+	if err != nil {
+		return Dataset{}, fmt.Errorf("dataset catalog unavailable: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return Dataset{}, fmt.Errorf("%w: %s", errDatasetNotFound, name)
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return Dataset{}, fmt.Errorf("dataset catalog returned non-OK status %d for %s: %s", resp.StatusCode, name, msg)
+	}
+	var d Dataset
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxCopyRequestBytes)).Decode(&d); err != nil {
+		return Dataset{}, fmt.Errorf("invalid dataset %s from the catalog: %w", name, err)
+	}
+	if d.Name != name {
+		return Dataset{}, fmt.Errorf("the catalog answered dataset '%s' for %s", d.Name, name)
+	}
+	if err := validateDataset(d); err != nil {
+		return Dataset{}, fmt.Errorf("invalid dataset from the catalog: %w", err)
+	}
+	return d, nil
+}
+
+// turns r's 'dataset' param into the copy it describes: its paths, destination and params, the caller's own
+// params taking precedence over the dataset's. several paths are copied as a JSON body, each into 'to'/<name>.
+// returns the http status to fail with
+func applyDataset(r *http.Request) (int, error) {
+	q := r.URL.Query()
+	name := q.Get("dataset")
+	if name == "" {
+		return http.StatusOK, nil
+	}
+	for _, p := range datasetParams {
+		if _, ok := q[p]; ok {
+			return http.StatusBadRequest, fmt.Errorf("dataset %s gives '%s', it can't be set", name, p)
+		}
+	}
+	if isJSONRequest(r) {
+		return http.StatusBadRequest, fmt.Errorf("dataset %s gives the dirs to copy, drop the JSON body", name)
+	}
+	d, err := getDatasets().lookup(name)
+	if errors.Is(err, errDatasetNotFound) {
+		return http.StatusNotFound, err
+	}
+	if err != nil {
+		return http.StatusBadGateway, err
+	}
+	for k, v := range d.Params {
+		if _, ok := q[k]; !ok {
+			q.Set(k, v)
+		}
+	}
+	q.Set("to", d.To)
+	q["targetURL"] = d.TargetURLs
+	labels := []string{"dataset=" + name}
+	if len(d.Owners) > 0 {
+		labels = append(labels, "owners="+strings.Join(d.Owners, ","))
+	}
+	q["label"] = append(q["label"], labels...) // the dataset's labels win
+	if len(d.Paths) == 1 {
+		q.Set("from", d.Paths[0])
+	} else {
+		body, _ := json.Marshal(CopyRequest{From: d.Paths})
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.Header.Set("Content-Type", "application/json")
+	}
+	r.URL.RawQuery = q.Encode()
+	return http.StatusOK, nil
+}
+
+// GET /datasets lists the datasets of FASTCOPY_DATASETS, GET /datasets/{name} looks one up, in the catalog too
+func handleDatasets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	c := getDatasets()
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/datasets"), "/")
+	if name == "" {
+		list := make([]Dataset, 0, len(c.datasets))
+		for _, name := range sortedKeys(c.datasets) {
+			list = append(list, c.datasets[name])
+		}
+		json, _ := json.MarshalIndent(list, "", "  ")
+		w.Write(json)
+		return
+	}
+	d, err := c.lookup(name)
+	if errors.Is(err, errDatasetNotFound) {
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	json, _ := json.MarshalIndent(d, "", "  ")
+	w.Write(json)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// serves datasets from FASTCOPY_DATASETS and the catalog for the duration of the test
+func useDatasets(t *testing.T, list []Dataset, catalogURL string) {
+	path := filepath.Join(t.TempDir(), "datasets.json")
+	data, _ := json.Marshal(list)
+	os.WriteFile(path, data, 0644)
+	t.Setenv("FASTCOPY_DATASETS", path)
+	t.Setenv("FASTCOPY_DATASET_CATALOG", catalogURL)
+	c, err := loadDatasets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	datasetsOnce.Do(func() {})
+	prev := datasets
+	datasets = c
+	t.Cleanup(func() { datasets = prev })
+}
+
+func TestLoadDatasets(t *testing.T) {
+	for _, d := range []Dataset{
+		{Name: "no paths", To: "/dst", TargetURLs: []string{"http://dr/upload"}},
+		{Name: "clicks", Paths: []string{"/src"}, To: "/dst"},
+		{Name: "clicks", Paths: []string{"/src"}, To: "/dst", TargetURLs: []string{"http://dr/upload"}, Params: map[string]string{"from": "/other"}},
+		{Name: "clicks", Paths: []string{"/src"}, To: "/dst", TargetURLs: []string{"http://dr/upload"}, Params: map[string]string{"workers": "lots"}},
+	} {
+		if err := validateDataset(d); err == nil {
+			t.Errorf("expected %+v to be refused", d)
+		}
+	}
+	t.Setenv("FASTCOPY_DATASET_CATALOG", "catalog.example.com")
+	if _, err := loadDatasets(); err == nil {
+		t.Error("expected a catalog without a scheme to be refused")
+	}
+}
+
+func TestCopyDataset(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{"/data/clicks/part-00000": "hello", "/data/clicks/.hidden": "x", "/data/views/part-00000": "world"})
+	peer := httptest.NewServer(apiMux())
+	defer peer.Close()
+	catalog := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/datasets/web_daily" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(Dataset{Name: "web_daily", Paths: []string{"/data/clicks", "/data/views"}, To: "/replica/web", TargetURLs: []string{peer.URL + "/upload"}})
+	}))
+	defer catalog.Close()
+	useDatasets(t, []Dataset{{
+		Name:       "clickstream_daily",
+		Paths:      []string{"/data/clicks"},
+		To:         "/replica/clicks",
+		TargetURLs: []string{peer.URL + "/upload"},
+		Params:     map[string]string{"skipHidden": "true"},
+		Owners:     []string{"web-analytics", "oncall"},
+	}}, catalog.URL+"/datasets")
+
+	copy := func(query url.Values) (*httptest.ResponseRecorder, CopyResponse) {
+		rec := httptest.NewRecorder()
+		handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+		var resp CopyResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec, resp
+	}
+	rec, resp := copy(url.Values{"dataset": {"clickstream_daily"}})
+	if rec.Code != http.StatusOK || resp.FilesCopied != 1 || resp.Labels["dataset"] != "clickstream_daily" || resp.Labels["owners"] != "web-analytics,oncall" {
+		t.Fatalf("expected the dataset to be copied, got %d %s", rec.Code, rec.Body)
+	}
+	if _, ok := fs.get("/replica/clicks/part-00000"); !ok {
+		t.Error("expected the dataset's file at its destination")
+	}
+
+	rec, resp = copy(url.Values{"dataset": {"web_daily"}})
+	if rec.Code != http.StatusOK || resp.FilesCopied != 3 {
+		t.Fatalf("expected the catalog's dataset to be copied, got %d %s", rec.Code, rec.Body)
+	}
+	if _, ok := fs.get("/replica/web/views/part-00000"); !ok {
+		t.Error("expected each path of the dataset copied under 'to'")
+	}
+
+	if rec, _ := copy(url.Values{"dataset": {"clickstream_daily"}, "to": {"/elsewhere"}}); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected overriding the dataset's destination to be refused, got %d", rec.Code)
+	}
+	if rec, _ := copy(url.Values{"dataset": {"missing"}}); rec.Code != http.StatusNotFound {
+		t.Errorf("expected an unknown dataset to answer 404, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handleDatasets(rec, httptest.NewRequest("GET", "/datasets", nil))
+	var list []Dataset
+	json.Unmarshal(rec.Body.Bytes(), &list)
+	if len(list) != 1 || list[0].Name != "clickstream_daily" {
+		t.Errorf("expected the configured datasets to be listed, got %s", rec.Body)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// with FASTCOPY_DEDUP_CACHE set, every file delivered to a target is remembered in that file across jobs, and a
+// copy with dedup=true leaves out the files that are provably already there: the source file still has the
+// size and modification time it had when it was delivered, and the destination still has a file of that size
+
+// a file delivered to a target, one line of the cache file
+type DeliveredFile struct {
+	Target        string    `json:"target"` // the peer's host
+	Path          string    `json:"path"`   // in the destination
+	Size          int64     `json:"size"`
+	Source        string    `json:"source"`
+	SourceModTime time.Time `json:"sourceModTime"`
+	SHA256        string    `json:"sha256"`
+	DeliveredAt   time.Time `json:"deliveredAt"`
+}
+
+type dedupCache struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]DeliveredFile // by target and path
+	lines   int                      // in the file, rewritten once mostly superseded entries
+}
+
+var (
+	dedup     *dedupCache
+	dedupOnce sync.Once
+)
+
+func dedupKey(target string, path string) string {
+	return target + "|" + path
+}
+
+// the host of the target's url, the same peer behind different paths shares its cache entries
+func dedupTarget(targetURL string) string {
+	u, err := url.Parse(targetURL)
+	if err != nil || u.Host == "" {
+		return targetURL
+	}
+	return u.Host
+}
+
+// reads the cache named by FASTCOPY_DEDUP_CACHE. returns nil without an error when it isn't set
+func loadDedupCache() (*dedupCache, error) {
+	path := os.Getenv("FASTCOPY_DEDUP_CACHE")
+	if path == "" {
+		return nil, nil
+	}
+	c := &dedupCache{path: path, entries: make(map[string]DeliveredFile)}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, fmt.Errorf("cannot create the dir of FASTCOPY_DEDUP_CACHE: %w", err)
+		}
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot open FASTCOPY_DEDUP_CACHE: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var e DeliveredFile
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue // a line torn by a crash, the file is copied again
+		}
+		c.entries[dedupKey(e.Target, e.Path)] = e
+		c.lines++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read FASTCOPY_DEDUP_CACHE: %w", err)
+	}
+	if c.lines > 2*len(c.entries)+1000 {
+		if err := c.compact(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// lazy loads the dedup cache, nil when it isn't configured
+func getDedupCache() *dedupCache {
+	dedupOnce.Do(func() {
+		c, err := loadDedupCache()
+		if err != nil {
+			log.Fatal(err)
+		}
+		dedup = c
+	})
+	return dedup
+}
+
+// rewrites the file with only the current entries
+func (c *dedupCache) compact() error {
+	tmp := c.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("cannot compact FASTCOPY_DEDUP_CACHE: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range c.entries {
+		enc.Encode(e)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("cannot compact FASTCOPY_DEDUP_CACHE: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("cannot compact FASTCOPY_DEDUP_CACHE: %w", err)
+	}
+	c.lines = len(c.entries)
+	return os.Rename(tmp, c.path)
+}
+
+// remembers the copied files as delivered to the target
+func (c *dedupCache) record(targetURL string, copied []CopiedFile) error {
+	if len(copied) == 0 {
+		return nil
+	}
+	target := dedupTarget(targetURL)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, err := os.OpenFile(c.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, file := range copied {
+		e := DeliveredFile{target, filepath.Join(file.Args.To, file.Args.File), file.Args.Size, file.Args.Path, file.Args.ModTime, file.Upload.SHA256, file.CopiedAt}
+		c.entries[dedupKey(e.Target, e.Path)] = e
+		enc.Encode(e)
+		c.lines++
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// leaves out the tasks already delivered to the target. a file counts as delivered when the cache has it
+// with the source's current size and modification time and the destination still lists it with that size.
+// returns the tasks left to copy, and the files and bytes left out
+func (c *dedupCache) filter(targetURL string, tasks []CopyArgs) ([]CopyArgs, int, int64) {
+	target := dedupTarget(targetURL)
+	listings := make(map[string]map[string]int64) // the destination dirs listed so far, nil if listing failed
+	kept := make([]CopyArgs, 0, len(tasks))
+	var files int
+	var bytes int64
+	for _, t := range tasks {
+		c.mu.Lock()
+		e, ok := c.entries[dedupKey(target, filepath.Join(t.To, t.File))]
+		c.mu.Unlock()
+		if !ok || e.Size != t.Size || e.Source != t.Path || !e.SourceModTime.Equal(t.ModTime) {
+			kept = append(kept, t)
+			continue
+		}
+		listing, listed := listings[t.To]
+		if !listed {
+			if entries, err := listPeer(targetURL, t.To); err == nil {
+				listing = make(map[string]int64, len(entries))
+				for _, entry := range entries {
+					if !entry.IsDir {
+						listing[entry.Name] = entry.Size
+					}
+				}
+			}
+			listings[t.To] = listing
+		}
+		if size, ok := listing[t.File]; !ok || size != t.Size {
+			kept = append(kept, t)
+			continue
+		}
+		files++
+		bytes += t.Size
+	}
+	return kept, files, bytes
+}
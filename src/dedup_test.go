@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+// remembers delivered files in a cache file under the test's temp dir for the duration of the test
+func useDedupCache(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "delivered.jsonl")
+	t.Setenv("FASTCOPY_DEDUP_CACHE", path)
+	c, err := loadDedupCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dedupOnce.Do(func() {})
+	prev := dedup
+	dedup = c
+	t.Cleanup(func() { dedup = prev })
+	return path
+}
+
+func TestDedupCopy(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{"/src/part-00000": "hello", "/src/part-00001": "world"})
+	cachePath := useDedupCache(t)
+	peer := http.NewServeMux()
+	peer.HandleFunc("/ready", handleReady)
+	peer.HandleFunc("/ls", handleLs)
+	peer.HandleFunc("/upload", handleUpload)
+	server := httptest.NewServer(peer)
+	defer server.Close()
+
+	copy := func(query url.Values) CopyResponse {
+		rec := httptest.NewRecorder()
+		handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+		}
+		var resp CopyResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return resp
+	}
+	query := url.Values{"from": {"/src"}, "to": {"/dst"}, "targetURL": {server.URL + "/upload"}}
+	if resp := copy(query); resp.FilesCopied != 2 || resp.FilesDeduped != 0 {
+		t.Fatalf("expected the first copy to copy everything, got %+v", resp)
+	}
+
+	query.Set("dedup", "true")
+	if resp := copy(query); resp.FilesCopied != 0 || resp.FilesDeduped != 2 || resp.BytesDeduped != 10 || resp.Written != 0 {
+		t.Errorf("expected both files to be left out, got %+v", resp)
+	}
+
+	fs.put(map[string]string{"/src/part-00001": "world, changed"})
+	fs.Remove("/dst/part-00000")
+	if resp := copy(query); resp.FilesCopied != 2 || resp.FilesDeduped != 0 {
+		t.Errorf("expected the changed source and the file gone from the destination to be copied, got %+v", resp)
+	}
+
+	reloaded, err := loadDedupCache()
+	if err != nil || len(reloaded.entries) != 2 || reloaded.lines != 4 {
+		t.Fatalf("expected 2 files remembered in 4 lines of %s, got %+v %v", cachePath, reloaded, err)
+	}
+	e := reloaded.entries[dedupKey(dedupTarget(server.URL), "/dst/part-00001")]
+	if e.Size != 14 || e.Source != "/src/part-00001" || e.SHA256 == "" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+}
+
+func TestDedupNeedsCache(t *testing.T) {
+	useMemFS(t)
+	dedupOnce.Do(func() {})
+	prev := dedup
+	dedup = nil
+	t.Cleanup(func() { dedup = prev })
+	rec := httptest.NewRecorder()
+	handleCopy(rec, httptest.NewRequest("POST", "/copy?from=/src&to=/dst&dedup=true", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected dedup without a cache to be rejected, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// rsync style delta transfer. The sender fetches the block signatures of the existing
+// destination file from the peer's /signature, scans the source with a rolling checksum
+// and POSTs a stream of ops to the peer's /patch, which rebuilds the file from blocks of
+// the old version plus the literal bytes that changed.
+//
+// The delta stream is a sequence of ops, terminated by opEnd:
+//
+//	'C' [8 byte block index]          copy a block of the old file
+//	'L' [4 byte length][length bytes] literal data
+const (
+	opCopy     = 'C'
+	opLiteral  = 'L'
+	opEnd      = 'E'
+	maxLiteral = 256 * 1024
+
+	minDeltaBlockSize = 2 * 1024
+	maxDeltaBlockSize = 1024 * 1024
+)
+
+type BlockSignature struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+type FileSignature struct {
+	Path      string           `json:"path"`
+	Size      int64            `json:"size"`
+	BlockSize int              `json:"blockSize"`
+	Blocks    []BlockSignature `json:"blocks"`
+}
+
+// picks a block size of roughly sqrt(size), like rsync, so the signature stays small for large files
+func deltaBlockSize(size int64) int {
+	bs := int(math.Sqrt(float64(size)))
+	if bs < minDeltaBlockSize {
+		return minDeltaBlockSize
+	}
+	if bs > maxDeltaBlockSize {
+		return maxDeltaBlockSize
+	}
+	return bs
+}
+
+// rsync's rolling checksum: a is the sum of the window, b the sum of the running sums
+type rollingChecksum struct {
+	a, b uint32
+	size uint32
+}
+
+func newRollingChecksum(window []byte) *rollingChecksum {
+	r := &rollingChecksum{size: uint32(len(window))}
+	for i, c := range window {
+		r.a += uint32(c)
+		r.b += uint32(len(window)-i) * uint32(c)
+	}
+	return r
+}
+
+func (r *rollingChecksum) roll(out byte, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.size*uint32(out)
+}
+
+func (r *rollingChecksum) sum() uint32 {
+	return (r.a & 0xffff) | (r.b&0xffff)<<16
+}
+
+func strongChecksum(block []byte) string {
+	sum := md5.Sum(block)
+	return hex.EncodeToString(sum[:])
+}
+
+// computes the block signatures of an existing file
+func computeSignature(r io.Reader, blockSize int) (FileSignature, error) {
+	sig := FileSignature{BlockSize: blockSize, Blocks: make([]BlockSignature, 0)}
+	block := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, block)
+		if n > 0 {
+			sig.Blocks = append(sig.Blocks, BlockSignature{newRollingChecksum(block[:n]).sum(), strongChecksum(block[:n])})
+			sig.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return sig, err
+		}
+	}
+}
+
+type deltaWriter struct {
+	w       *bufio.Writer
+	copies  int64
+	literal int64
+}
+
+func (d *deltaWriter) copyBlock(idx int) error {
+	var op [9]byte
+	op[0] = opCopy
+	binary.BigEndian.PutUint64(op[1:], uint64(idx))
+	d.copies++
+	_, err := d.w.Write(op[:])
+	return err
+}
+
+func (d *deltaWriter) literalData(data []byte) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxLiteral {
+			n = maxLiteral
+		}
+		var op [5]byte
+		op[0] = opLiteral
+		binary.BigEndian.PutUint32(op[1:], uint32(n))
+		if _, err := d.w.Write(op[:]); err != nil {
+			return err
+		}
+		if _, err := d.w.Write(data[:n]); err != nil {
+			return err
+		}
+		d.literal += int64(n)
+		data = data[n:]
+	}
+	return nil
+}
+
+// scans src with a rolling checksum and writes the ops needed to turn the file described by sig into src
+func writeDelta(w io.Writer, src io.Reader, sig FileSignature) error {
+	bs := sig.BlockSize
+	if bs <= 0 {
+		return errors.New("invalid signature block size")
+	}
+	table := make(map[uint32][]int)
+	for i, b := range sig.Blocks {
+		table[b.Weak] = append(table[b.Weak], i)
+	}
+
+	dw := &deltaWriter{w: bufio.NewWriterSize(w, 64*1024)}
+	buf := make([]byte, 0, 2*bs+maxLiteral)
+	pos, lit := 0, 0 // start of the window, start of the pending literal
+	eof := false
+	var rc *rollingChecksum
+
+	fill := func() error {
+		if lit > 0 {
+			buf = buf[:copy(buf, buf[lit:])]
+			pos -= lit
+			lit = 0
+		}
+		for !eof && len(buf) < cap(buf) {
+			n, err := src.Read(buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+n]
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for {
+		if pos+bs+1 > len(buf) && !eof {
+			if err := fill(); err != nil {
+				return err
+			}
+		}
+		if pos+bs > len(buf) {
+			break // less than a block left, send the rest as literal data
+		}
+		window := buf[pos : pos+bs]
+		if rc == nil {
+			rc = newRollingChecksum(window)
+		}
+		matched := -1
+		if candidates, ok := table[rc.sum()]; ok {
+			strong := strongChecksum(window)
+			for _, idx := range candidates {
+				if sig.Blocks[idx].Strong == strong {
+					matched = idx
+					break
+				}
+			}
+		}
+		if matched >= 0 {
+			if err := dw.literalData(buf[lit:pos]); err != nil {
+				return err
+			}
+			if err := dw.copyBlock(matched); err != nil {
+				return err
+			}
+			pos += bs
+			lit = pos
+			rc = nil
+			continue
+		}
+		if pos+bs < len(buf) {
+			rc.roll(buf[pos], buf[pos+bs])
+		} else {
+			rc = nil
+		}
+		pos++
+		if pos-lit >= maxLiteral {
+			if err := dw.literalData(buf[lit:pos]); err != nil {
+				return err
+			}
+			lit = pos
+		}
+	}
+	if err := dw.literalData(buf[lit:]); err != nil {
+		return err
+	}
+	if err := dw.w.WriteByte(opEnd); err != nil {
+		return err
+	}
+	log.Printf("Delta for %s: %d blocks reused, %d literal bytes", sig.Path, dw.copies, dw.literal)
+	return dw.w.Flush()
+}
+
+// rebuilds a file from the delta ops and the old version of the file
+func applyDelta(w io.Writer, delta io.Reader, basis io.ReaderAt, blockSize int, basisSize int64) error {
+	r := bufio.NewReader(delta)
+	block := make([]byte, blockSize)
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("reading delta op: %w", err)
+		}
+		switch op {
+		case opCopy:
+			var idx [8]byte
+			if _, err := io.ReadFull(r, idx[:]); err != nil {
+				return err
+			}
+			off := int64(binary.BigEndian.Uint64(idx[:])) * int64(blockSize)
+			if off >= basisSize {
+				return fmt.Errorf("delta references block at offset %d beyond the existing file", off)
+			}
+			n, err := basis.ReadAt(block, off)
+			if err != nil && !(err == io.EOF && off+int64(n) == basisSize) {
+				return err
+			}
+			if _, err := w.Write(block[:n]); err != nil {
+				return err
+			}
+		case opLiteral:
+			var size [4]byte
+			if _, err := io.ReadFull(r, size[:]); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(w, r, int64(binary.BigEndian.Uint32(size[:]))); err != nil {
+				return err
+			}
+		case opEnd:
+			return nil
+		default:
+			return fmt.Errorf("unknown delta op %q", op)
+		}
+	}
+}
+
+// derives the url of another endpoint on the peer from the targetURL pointing at its /upload
+func peerURL(targetURL string, endpoint string, params url.Values) string {
+	base := targetURL
+	if u, err := url.Parse(targetURL); err == nil {
+		u.Path = strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/upload") + endpoint
+		u.RawQuery = ""
+		base = u.String()
+	}
+	if len(params) > 0 {
+		base += "?" + params.Encode()
+	}
+	return base
+}
+
+// fetches the signature of the destination file from the peer. returns nil if the file doesn't exist there yet
+func fetchSignature(targetURL string, path string, blockSize int) (*FileSignature, error) {
+	params := url.Values{"path": {path}, "blockSize": {strconv.Itoa(blockSize)}}
+	resp, err := httpClient.Get(peerURL(targetURL, "/signature", params))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("/signature returned non-OK status %d: %s", resp.StatusCode, peerErrorMessage(msg))
+	}
+	var sig FileSignature
+	if err := json.NewDecoder(resp.Body).Decode(&sig); err != nil {
+		return nil, err
+	}
+	return &sig, nil
+}
+
+// Returns the block signatures of the hdfs file provided by query param 'path'
+// using the block size provided by 'blockSize'
+func handleSignature(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	blockSize, err := strconv.Atoi(r.URL.Query().Get("blockSize"))
+	if path == "" || err != nil || blockSize < minDeltaBlockSize || blockSize > maxDeltaBlockSize {
+		writeError(w, "'path' and a valid 'blockSize' query param must be provided.", http.StatusBadRequest)
+		return
+	}
+	reader, err := GetHdfsClient().Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		writeError(w, fmt.Sprintf("%s does not exist", path), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, fmt.Sprintf("Failed to open %s: %s", path, err), http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+
+	sig, err := computeSignature(bufio.NewReaderSize(reader, 1024*1024), blockSize)
+	if err != nil {
+		writeError(w, fmt.Sprintf("Failed to read %s: %s", path, err), http.StatusInternalServerError)
+		return
+	}
+	sig.Path = path
+	json, _ := json.Marshal(sig)
+	w.Write(json)
+}
+
+// Applies a delta stream to the existing hdfs file in 'to' named 'fileName'.
+// The new version is written next to it and renamed over the old one once complete
+func handlePatch(w http.ResponseWriter, r *http.Request) {
+	fileName := r.URL.Query().Get("fileName")
+	to := r.URL.Query().Get("to")
+	blockSize, err := strconv.Atoi(r.URL.Query().Get("blockSize"))
+	if to == "" || fileName == "" || err != nil || blockSize <= 0 {
+		writeError(w, "'to', 'fileName' and 'blockSize' query params must be provided.", http.StatusBadRequest)
+		return
+	}
+	path, err := uploadPath(to, fileName)
+	if err != nil {
+		writeConfineError(w, err)
+		return
+	}
+	if !checkProtocol(w, r) {
+		return
+	}
+	tmpName := fileName + "._COPYING_"
+	unlock, err := lockWrite(path, uploadOrigin(r), 0)
+	if err != nil {
+		writeLockedError(w, err)
+		return
+	}
+	defer unlock()
+	client := GetHdfsClient()
+	if err := checkWriteOnce(client, path); err != nil {
+		writeWriteOnceError(w, err)
+		return
+	}
+	data, dec, ok := openUploadBody(w, r)
+	if !ok {
+		return
+	}
+	defer data.Close()
+
+	basis, err := client.Open(path)
+	if err != nil {
+		writeError(w, fmt.Sprintf("Failed to open %s to patch: %s", path, err), http.StatusConflict)
+		return
+	}
+	defer basis.Close()
+	log.Printf("Patching %s in target: %s\n", fileName, to)
+
+	pr, pw := io.Pipe()
+	go func() {
+		err := applyDelta(pw, data, basis, blockSize, basis.Stat().Size())
+		if err == nil {
+			io.Copy(io.Discard, data) // read to EOF so the Digest trailer is available
+		}
+		pw.CloseWithError(err)
+	}()
+	res, err := WriteHDFS(to, tmpName, pr)
+	pr.Close()
+	tmpPath := filepath.Join(to, tmpName)
+	if !finishUpload(w, r, res, dec, tmpPath, err) {
+		return
+	}
+
+	if err := client.Rename(tmpPath, path); err != nil {
+		client.Remove(tmpPath)
+		writeError(w, fmt.Sprintf("Failed to replace %s with patched file: %s", path, err), http.StatusInternalServerError)
+		return
+	}
+	res.Path = path
+	recordReceived(uploadOrigin(r), res)
+	json, _ := json.Marshal(res)
+	w.Write(json)
+}
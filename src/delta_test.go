@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestDeltaRoundTrip(t *testing.T) {
+	old := make([]byte, 200*1024+123)
+	rand.Read(old)
+
+	// edit the middle of the file and append to it
+	updated := append([]byte{}, old[:50000]...)
+	updated = append(updated, []byte("some inserted bytes")...)
+	updated = append(updated, old[50010:]...)
+	updated = append(updated, []byte("appended")...)
+
+	blockSize := deltaBlockSize(int64(len(old)))
+	sig, err := computeSignature(bytes.NewReader(old), blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var delta bytes.Buffer
+	if err := writeDelta(&delta, bytes.NewReader(updated), sig); err != nil {
+		t.Fatal(err)
+	}
+	if delta.Len() > len(updated)/4 {
+		t.Errorf("expected delta to be much smaller than the file, got %d bytes for %d", delta.Len(), len(updated))
+	}
+
+	var rebuilt bytes.Buffer
+	if err := applyDelta(&rebuilt, &delta, bytes.NewReader(old), blockSize, int64(len(old))); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rebuilt.Bytes(), updated) {
+		t.Error("rebuilt file differs from the updated source")
+	}
+}
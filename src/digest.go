@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// digests computed over the bytes of a single file while it is being written or sent
+type fileDigests struct {
+	md5    hash.Hash
+	sha256 hash.Hash
+}
+
+func newFileDigests() *fileDigests {
+	return &fileDigests{md5: md5.New(), sha256: sha256.New()}
+}
+
+func (d *fileDigests) Write(p []byte) (int, error) {
+	d.md5.Write(p)
+	d.sha256.Write(p)
+	return len(p), nil
+}
+
+func (d *fileDigests) MD5() string {
+	return base64.StdEncoding.EncodeToString(d.md5.Sum(nil))
+}
+
+func (d *fileDigests) SHA256() string {
+	return base64.StdEncoding.EncodeToString(d.sha256.Sum(nil))
+}
+
+// formats the digests as an RFC 3230 Digest header value
+func (d *fileDigests) Header() string {
+	return "md5=" + d.MD5() + ",sha-256=" + d.SHA256()
+}
+
+// wraps a request body so the Digest trailer is filled in once the body has been fully read
+type digestReader struct {
+	r       io.Reader
+	digests *fileDigests
+	trailer http.Header
+}
+
+func newDigestReader(r io.Reader, trailer http.Header) *digestReader {
+	trailer.Set("Digest", "")
+	return &digestReader{r: r, digests: newFileDigests(), trailer: trailer}
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.digests.Write(p[:n])
+	if err == io.EOF {
+		d.trailer.Set("Digest", d.digests.Header())
+	}
+	return n, err
+}
+
+// parses the Digest and Content-MD5 values sent by the client. returns a map
+// of lower-cased algorithm name to base64 encoded digest
+func parseDigests(h http.Header) map[string]string {
+	expected := make(map[string]string)
+	if v := h.Get("Content-MD5"); v != "" {
+		expected["md5"] = strings.TrimSpace(v)
+	}
+	for _, line := range h.Values("Digest") {
+		for _, part := range strings.Split(line, ",") {
+			alg, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+			if !ok || value == "" {
+				continue
+			}
+			expected[strings.ToLower(alg)] = value
+		}
+	}
+	return expected
+}
+
+// compares the digests the client sent (in headers or trailers) against the ones computed while writing
+func verifyDigests(expected map[string]string, res UploadResponse) error {
+	actual := map[string]string{"md5": res.MD5, "sha-256": res.SHA256}
+	for alg, want := range expected {
+		got, ok := actual[alg]
+		if !ok {
+			continue // unsupported algorithms are ignored
+		}
+		if got != want {
+			return fmt.Errorf("%s digest mismatch for %s: expected %s, computed %s", alg, res.Path, want, got)
+		}
+	}
+	return nil
+}
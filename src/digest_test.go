@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestVerifyDigests(t *testing.T) {
+	d := newFileDigests()
+	d.Write([]byte("hello, world!"))
+	res := UploadResponse{Path: "/tmp/in/hello.txt", Written: 13, MD5: d.MD5(), SHA256: d.SHA256()}
+
+	h := http.Header{}
+	h.Set("Digest", d.Header())
+	if err := verifyDigests(parseDigests(h), res); err != nil {
+		t.Errorf("expected digests to match, got %s", err)
+	}
+
+	h = http.Header{}
+	h.Set("Content-MD5", "1B2M2Y8AsgTpgAmY7PhCfg==") // md5 of the empty string
+	if err := verifyDigests(parseDigests(h), res); err == nil {
+		t.Error("expected md5 mismatch to be reported")
+	}
+
+	if err := verifyDigests(parseDigests(http.Header{}), res); err != nil {
+		t.Errorf("expected no verification without digests, got %s", err)
+	}
+}
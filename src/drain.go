@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// with FASTCOPY_REUSE_PORT=true the server listens with SO_REUSEPORT, so a new instance can be started on the
+// same port while the old one still runs and both accept connections. on SIGTERM or SIGINT a server drains: it
+// stops accepting connections, leaving them to the new instance, /ready answers 503 and new copies are refused,
+// while the uploads and copies already running finish, for at most FASTCOPY_DRAIN_TIMEOUT (15m by default).
+// only tcp addresses are shared, not unix sockets or those passed by systemd
+
+const defaultDrainTimeout = 15 * time.Minute
+
+// a draining server closes its idle keep-alive connections, an upload sent on one as it does fails without the
+// server seeing it. such a failure is retried, over a new connection reaching the new instance
+var errReusedConnClosed = errors.New("reused connection to the target failed")
+
+type drainSettings struct {
+	reusePort bool
+	timeout   time.Duration
+}
+
+var (
+	drainConfig     drainSettings
+	drainConfigOnce sync.Once
+)
+
+// parses FASTCOPY_REUSE_PORT and FASTCOPY_DRAIN_TIMEOUT
+func loadDrainSettings() (drainSettings, error) {
+	s := drainSettings{timeout: defaultDrainTimeout}
+	switch v := os.Getenv("FASTCOPY_REUSE_PORT"); v {
+	case "", "false":
+	case "true":
+		s.reusePort = true
+		if runtime.GOOS != "linux" {
+			return s, errors.New("FASTCOPY_REUSE_PORT is only supported on linux")
+		}
+	default:
+		return s, fmt.Errorf("invalid FASTCOPY_REUSE_PORT '%s', expected true or false", v)
+	}
+	if v := os.Getenv("FASTCOPY_DRAIN_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return s, fmt.Errorf("invalid FASTCOPY_DRAIN_TIMEOUT '%s', expected a duration like 15m", v)
+		}
+		s.timeout = d
+	}
+	return s, nil
+}
+
+// lazy loads the drain settings
+func getDrainSettings() drainSettings {
+	drainConfigOnce.Do(func() {
+		s, err := loadDrainSettings()
+		if err != nil {
+			log.Fatal(err)
+		}
+		drainConfig = s
+	})
+	return drainConfig
+}
+
+var draining atomic.Bool
+
+// refuses a request with 503 while the server drains, returning whether it was
+func refuseDraining(w http.ResponseWriter) bool {
+	if !draining.Load() {
+		return false
+	}
+	w.Header().Set("Connection", "close")
+	writeError(w, "server is draining for a restart, retry against the new instance", http.StatusServiceUnavailable)
+	return true
+}
+
+// drains srv once a signal arrives on signals, returning when the requests it serves are done or the timeout
+// passed. srv stops serving right away
+func drainOn(srv *http.Server, signals <-chan os.Signal, timeout time.Duration) error {
+	sig := <-signals
+	log.Printf("received %s, draining for at most %s", sig, timeout)
+	draining.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		return fmt.Errorf("draining: %w", err)
+	}
+	log.Print("drained")
+	return nil
+}
+
+// the signals a server drains on
+func drainSignals() <-chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	return signals
+}
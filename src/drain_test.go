@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func useDrainSettings(t *testing.T, s drainSettings) {
+	drainConfigOnce.Do(func() {})
+	prev := drainConfig
+	drainConfig = s
+	t.Cleanup(func() { drainConfig = prev })
+}
+
+func TestLoadDrainSettings(t *testing.T) {
+	t.Setenv("FASTCOPY_REUSE_PORT", "true")
+	t.Setenv("FASTCOPY_DRAIN_TIMEOUT", "2m")
+	if s, err := loadDrainSettings(); err != nil || !s.reusePort || s.timeout != 2*time.Minute {
+		t.Errorf("unexpected settings %+v, %v", s, err)
+	}
+	t.Setenv("FASTCOPY_REUSE_PORT", "yes")
+	if _, err := loadDrainSettings(); err == nil {
+		t.Error("expected an invalid FASTCOPY_REUSE_PORT to be refused")
+	}
+	t.Setenv("FASTCOPY_REUSE_PORT", "")
+	t.Setenv("FASTCOPY_DRAIN_TIMEOUT", "-1s")
+	if _, err := loadDrainSettings(); err == nil {
+		t.Error("expected a negative FASTCOPY_DRAIN_TIMEOUT to be refused")
+	}
+}
+
+func TestListenReusePort(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT is only set on linux")
+	}
+	useDrainSettings(t, drainSettings{reusePort: true, timeout: time.Minute})
+	old, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old[0].Close()
+	next, err := listen(old[0].Addr().String())
+	if err != nil {
+		t.Fatalf("expected a second instance to listen on the same port: %s", err)
+	}
+	next[0].Close()
+
+	useDrainSettings(t, drainSettings{timeout: time.Minute})
+	if l, err := listen(old[0].Addr().String()); err == nil {
+		l[0].Close()
+		t.Error("expected the port to be taken without FASTCOPY_REUSE_PORT")
+	}
+}
+
+func TestDrainFinishesRunningRequests(t *testing.T) {
+	t.Cleanup(func() { draining.Store(false) })
+	started, release := make(chan struct{}), make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})
+	mux.HandleFunc("/ready", handleReady)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(l)
+
+	result := make(chan error, 1)
+	go func() {
+		res, err := http.Get("http://" + l.Addr().String() + "/slow")
+		if err == nil {
+			res.Body.Close()
+		}
+		result <- err
+	}()
+	<-started
+
+	signals := make(chan os.Signal, 1)
+	drained := make(chan error, 1)
+	go func() { drained <- drainOn(srv, signals, time.Minute) }()
+	signals <- os.Interrupt
+	for !draining.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	rec := httptest.NewRecorder()
+	handleReady(rec, httptest.NewRequest("GET", "/ready", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected /ready to answer 503 while draining, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	handleCopy(rec, httptest.NewRequest("GET", "/copy?from=/src&to=/dst&targetURL=http://peer/upload", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected a new copy to be refused while draining, got %d", rec.Code)
+	}
+
+	select {
+	case <-drained:
+		t.Fatal("expected the drain to wait for the running request")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-result; err != nil {
+		t.Errorf("expected the running request to finish, got %s", err)
+	}
+	if err := <-drained; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	t.Cleanup(func() { draining.Store(false) })
+	started, release := make(chan struct{}), make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+	go http.Get(srv.URL)
+	<-started
+
+	signals := make(chan os.Signal, 1)
+	signals <- os.Interrupt
+	if err := drainOn(srv.Config, signals, 20*time.Millisecond); err == nil {
+		t.Error("expected a drain past its timeout to fail")
+	}
+}
+
+func TestReusedConnFailureRetriable(t *testing.T) {
+	if !retriable(fmt.Errorf("%w: %w", errReusedConnClosed, io.ErrUnexpectedEOF)) {
+		t.Error("expected an upload failing on a reused connection to be retried")
+	}
+	if retriable(io.ErrUnexpectedEOF) {
+		t.Error("expected other transport errors to be left alone")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// copying to a peer running in a cloud is billed by the gigabyte leaving the source, and by the objects written
+// to cloud storage. FASTCOPY_EGRESS_RATES prices each target, e.g. dr-gcp=0.12/0.005,dr-aws:8080=0.09,*=0.02: the
+// USD per GB (2^30 bytes, as cloud providers bill) and optionally, after the slash, per 1000 objects, for a target
+// named by host, or host and port, or every other one with *. a plan estimates the cost of its files to each
+// priced target, the report of a copy the cost of what it delivered
+
+// the price of copying to a target
+type egressRate struct {
+	perGB          float64
+	per1000Objects float64
+}
+
+// the estimated cost of copying to a target
+type EgressEstimate struct {
+	TargetURL      string  `json:"targetURL"`
+	Bytes          int64   `json:"bytes"`
+	Objects        int64   `json:"objects"`
+	PerGB          float64 `json:"usdPerGB"`
+	Per1000Objects float64 `json:"usdPer1000Objects,omitempty"`
+	Cost           float64 `json:"estimatedCostUSD"`
+}
+
+var (
+	egressRates     map[string]egressRate
+	egressRatesOnce sync.Once
+)
+
+// parses FASTCOPY_EGRESS_RATES into the rates by host
+func loadEgressRates() (map[string]egressRate, error) {
+	rates := make(map[string]egressRate)
+	spec := os.Getenv("FASTCOPY_EGRESS_RATES")
+	if spec == "" {
+		return rates, nil
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		host, price, ok := strings.Cut(entry, "=")
+		perGB, perObjects, hasObjects := strings.Cut(price, "/")
+		var rate egressRate
+		var err error
+		if ok && host != "" {
+			rate.perGB, err = strconv.ParseFloat(strings.TrimSpace(perGB), 64)
+			if err == nil && hasObjects {
+				rate.per1000Objects, err = strconv.ParseFloat(strings.TrimSpace(perObjects), 64)
+			}
+		}
+		if !ok || host == "" || err != nil || rate.perGB < 0 || rate.per1000Objects < 0 {
+			return nil, fmt.Errorf("invalid FASTCOPY_EGRESS_RATES entry '%s', expected host=<USD per GB>[/<USD per 1000 objects>]", entry)
+		}
+		host = strings.ToLower(host)
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = strings.Trim(host, "[]")
+		}
+		if _, ok := rates[host]; ok {
+			return nil, fmt.Errorf("FASTCOPY_EGRESS_RATES prices %s more than once", host)
+		}
+		rates[host] = rate
+	}
+	return rates, nil
+}
+
+// lazy loads the egress rates by destination host
+func getEgressRates() map[string]egressRate {
+	egressRatesOnce.Do(func() {
+		rates, err := loadEgressRates()
+		if err != nil {
+			log.Fatal(err)
+		}
+		egressRates = rates
+	})
+	return egressRates
+}
+
+// the rate of the host targetURL points to: the one naming its port, its host or *. false if it isn't priced
+func egressRateFor(targetURL string) (egressRate, bool) {
+	rates := getEgressRates()
+	u, err := url.Parse(targetURL)
+	if len(rates) == 0 || err != nil {
+		return egressRate{}, false
+	}
+	for _, key := range []string{strings.ToLower(u.Host), strings.ToLower(u.Hostname()), "*"} {
+		if rate, ok := rates[key]; ok {
+			return rate, true
+		}
+	}
+	return egressRate{}, false
+}
+
+// estimates copying objects files of bytes to each priced target, nil if none is
+func estimateEgress(targets []string, delivered func(target string) (int64, int64)) []EgressEstimate {
+	var estimates []EgressEstimate
+	for _, target := range targets {
+		rate, ok := egressRateFor(target)
+		if !ok {
+			continue
+		}
+		objects, bytes := delivered(target)
+		cost := float64(bytes)/(1<<30)*rate.perGB + float64(objects)/1000*rate.per1000Objects
+		estimates = append(estimates, EgressEstimate{
+			TargetURL:      target,
+			Bytes:          bytes,
+			Objects:        objects,
+			PerGB:          rate.perGB,
+			Per1000Objects: rate.per1000Objects,
+			Cost:           math.Round(cost*100) / 100,
+		})
+	}
+	return estimates
+}
+
+// the cost of what a copy delivered to each of its targets
+func reportedEgress(targets []string, resp CopyResponse) []EgressEstimate {
+	return estimateEgress(targets, func(target string) (int64, int64) {
+		for _, res := range resp.Targets {
+			if res.TargetURL == target {
+				return res.FilesCopied, res.Written
+			}
+		}
+		return resp.FilesCopied, resp.Written
+	})
+}
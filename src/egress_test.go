@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func useEgressRates(t *testing.T, spec string) {
+	t.Setenv("FASTCOPY_EGRESS_RATES", spec)
+	rates, err := loadEgressRates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	egressRatesOnce.Do(func() {})
+	prev := egressRates
+	egressRates = rates
+	t.Cleanup(func() { egressRates = prev })
+}
+
+func TestEgressRates(t *testing.T) {
+	for _, spec := range []string{"dr-gcp", "dr-gcp=cheap", "dr-gcp=0.1/x", "dr-gcp=-1", "a=0.1,a=0.2"} {
+		t.Setenv("FASTCOPY_EGRESS_RATES", spec)
+		if _, err := loadEgressRates(); err == nil {
+			t.Errorf("%s: expected the rates to be refused", spec)
+		}
+	}
+	useEgressRates(t, "dr-gcp=0.12/0.005,dr-aws:8080=0.09,*=0.02")
+	for target, expected := range map[string]float64{
+		"http://dr-gcp:8080/upload": 0.12,
+		"http://dr-aws:8080/upload": 0.09,
+		"http://dr-aws:9090/upload": 0.02,
+	} {
+		if rate, ok := egressRateFor(target); !ok || rate.perGB != expected {
+			t.Errorf("%s: expected %.2f per GB, got %+v", target, expected, rate)
+		}
+	}
+	estimates := estimateEgress([]string{"http://dr-gcp:8080/upload"}, func(string) (int64, int64) { return 2000, 10 << 30 })
+	if len(estimates) != 1 || estimates[0].Cost != 1.21 || estimates[0].Objects != 2000 {
+		t.Errorf("expected 10 GB and 2000 objects to cost 1.21, got %+v", estimates)
+	}
+}
+
+func TestPlanAndReportEgress(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{"/src/a.txt": "hello", "/src/b.txt": "world"})
+	peer := httptest.NewServer(apiMux())
+	defer peer.Close()
+	useEgressRates(t, "*=0.1/1")
+
+	query := url.Values{"from": {"/src"}, "to": {"/dst"}, "targetURL": {peer.URL + "/upload"}}
+	rec := httptest.NewRecorder()
+	handlePlan(rec, httptest.NewRequest("POST", "/plan?"+query.Encode(), nil))
+	var plan CopyPlan
+	json.Unmarshal(rec.Body.Bytes(), &plan)
+	if len(plan.Egress) != 1 || plan.Egress[0].Objects != 2 || plan.Egress[0].Bytes != 10 {
+		t.Errorf("expected the plan to estimate its egress, got %s", rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+	var resp CopyResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if len(resp.Egress) != 1 || resp.Egress[0].Objects != 2 || resp.Egress[0].Cost != 0 {
+		t.Errorf("expected the report to estimate the delivered egress, got %+v", resp.Egress)
+	}
+}
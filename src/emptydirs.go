@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+// a dir of 'from' with nothing in it, created on the target by a copyEmptyDirs=true copy
+type EmptyDir struct {
+	Path string // in the destination
+	Mode os.FileMode
+}
+
+// Creates the dir provided by 'path' with the octal permissions 'mode', e.g. 750
+func handleMkdir(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	mode, err := strconv.ParseUint(r.URL.Query().Get("mode"), 8, 32)
+	if path == "" || err != nil || os.FileMode(mode)&^os.ModePerm != 0 {
+		writeError(w, "'path' and 'mode', octal permissions like 750, query params must be provided.", http.StatusBadRequest)
+		return
+	}
+	if err := confinePath("path", path); err != nil {
+		writeConfineError(w, err)
+		return
+	}
+	client := GetHdfsClient()
+	if err := client.MkdirAll(path, os.FileMode(mode)); err != nil {
+		writeError(w, fmt.Sprintf("Failed to create the hdfs dir %s", err), http.StatusInternalServerError)
+		return
+	}
+	// mkdirs applies the namenode's umask, set the permissions as given
+	if err := client.Chmod(path, os.FileMode(mode)); err != nil {
+		writeError(w, fmt.Sprintf("Failed to set the permissions of %s: %s", path, err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// asks the peer to create the dir with its permissions
+func requestMkdir(targetURL string, dir EmptyDir) error {
+	q := url.Values{"path": {dir.Path}, "mode": {strconv.FormatUint(uint64(dir.Mode.Perm()), 8)}}
+	resp, err := httpClient.Post(peerURL(targetURL, "/mkdir", q), "application/octet-stream", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("mkdir failed with %s: %s", resp.Status, peerErrorMessage(msg))
+	}
+	return nil
+}
+
+// creates the empty dirs on the target, returning how many were created and the ones that failed
+func createEmptyDirs(targetURL string, dirs []EmptyDir, job *Job) (int, []CopyFailure) {
+	var created int
+	var failures []CopyFailure
+	for _, dir := range dirs {
+		if err := requestMkdir(targetURL, dir); err != nil {
+			job.logf("Failed to create the empty dir %s: %s", dir.Path, err)
+			failures = append(failures, CopyFailure{Path: dir.Path, Reason: err.Error()})
+			continue
+		}
+		job.logf("Created the empty dir %s (%s)", dir.Path, dir.Mode)
+		created++
+	}
+	return created, failures
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestCopyEmptyDirs(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{"/src/b/part-00000": "data"})
+	fs.MkdirAll("/src/a/empty", 0755)
+	fs.Chmod("/src/a/empty", 0750)
+
+	peer := http.NewServeMux()
+	peer.HandleFunc("/ready", handleReady)
+	peer.HandleFunc("/ls", handleLs)
+	peer.HandleFunc("/upload", handleUpload)
+	peer.HandleFunc("/mkdir", handleMkdir)
+	server := httptest.NewServer(peer)
+	defer server.Close()
+
+	query := url.Values{"from": {"/src"}, "to": {"/dst"}, "targetURL": {server.URL + "/upload"}, "recursive": {"true"}, "copyEmptyDirs": {"true"}}
+	rec := httptest.NewRecorder()
+	handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var resp CopyResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp.DirsCreated != 1 || resp.FilesCopied != 1 {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	info, err := fs.Stat("/dst/a/empty")
+	if err != nil || !info.IsDir() || info.Mode().Perm() != 0750 {
+		t.Errorf("expected the empty dir to be created with its permissions, got %v %v", info, err)
+	}
+
+	query.Del("recursive")
+	rec = httptest.NewRecorder()
+	handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected copyEmptyDirs without recursive to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestHandleMkdir(t *testing.T) {
+	fs := useMemFS(t)
+	for query, status := range map[string]int{"path=/d&mode=rwx": 400, "path=/d&mode=17777": 400, "mode=755": 400, "path=/x/y&mode=700": 204} {
+		rec := httptest.NewRecorder()
+		handleMkdir(rec, httptest.NewRequest("POST", "/mkdir?"+query, nil))
+		if rec.Code != status {
+			t.Errorf("%s: expected %d, got %d", query, status, rec.Code)
+		}
+	}
+	if info, err := fs.Stat("/x/y"); err != nil || info.Mode().Perm() != os.FileMode(0700) {
+		t.Errorf("expected /x/y with mode 700, got %v %v", info, err)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/briansterle/cluster-fastcopy/pkg/fastcopy"
+)
+
+// a /copy can fan out to several targets, e.g. to replicate one cluster to two DR sites: with 'targetURL' given
+// more than once every file is read a single time and streamed to all targets at once through a fastcopy.TeeSink.
+// a target failing doesn't hold up the others, the response reports each target's outcome under 'targets' and a
+// file missing on any of them fails the copy
+
+// the outcome of one target of a fanned out copy
+type TargetResult struct {
+	TargetURL    string        `json:"targetURL"`
+	Written      int64         `json:"written"`
+	FilesCopied  int64         `json:"filesCopied"`
+	FilesFailed  int64         `json:"filesFailed"`
+	CopyFailures []CopyFailure `json:"copyFailures,omitempty"`
+	Reconciled   *bool         `json:"reconciled,omitempty"`
+	State        string        `json:"state"`
+}
+
+// checks the targets of a copy. without any the copy goes to an empty targetURL, for the precheck to reject
+func copyTargets(targets []string) ([]string, error) {
+	if len(targets) == 0 {
+		return []string{""}, nil
+	}
+	seen := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		if seen[target] {
+			return nil, fmt.Errorf("target '%s' is given more than once", target)
+		}
+		seen[target] = true
+	}
+	return targets, nil
+}
+
+// rejects the options that only make sense against a single target
+func fanoutIncompatible(opts CopyOptions) error {
+	switch {
+	case opts.Delta:
+		return errors.New("'delta' patches the files of a single target and can't be combined with several targets")
+	case opts.Resume:
+		return errors.New("'resume' continues a single target's partial files and can't be combined with several targets")
+	case opts.Dedup:
+		return errors.New("'dedup' can't be combined with several targets, the cache of delivered files is kept per target")
+	case opts.Staging:
+		return errors.New("'staging' can't be combined with several targets, their swaps couldn't be made at once")
+	case opts.VerifySample > 0:
+		return errors.New("'verifySample' checks a single target and can't be combined with several targets")
+	case opts.RecopyChanged:
+		return errors.New("'recopyChanged' can't be combined with several targets")
+	case opts.CopyEmptyDirs:
+		return errors.New("'copyEmptyDirs' can't be combined with several targets")
+	case opts.ContentStore != "":
+		return errors.New("'contentStore' can't be combined with several targets, the content each store lacks differs")
+	case opts.HiveTable != "":
+		return errors.New("'hiveTable' can't be combined with several targets, it's unclear which cluster's table to register with")
+	}
+	return nil
+}
+
+// where the transfers go: the uploads of the target, or of all targets at once
+func targetsSink(targets []string, byPath map[string]CopyArgs, opts CopyOptions) fastcopy.Sink {
+	if len(targets) == 1 {
+		return uploadSink{targets[0], byPath, opts}
+	}
+	sinks := make([]fastcopy.Sink, 0, len(targets))
+	for _, target := range targets {
+		sinks = append(sinks, breakerSink{targetBreaker(target), uploadSink{target, byPath, opts}})
+	}
+	return fastcopy.TeeSink{Sinks: sinks}
+}
+
+// fails the uploads to a fanned out target while its circuit breaker is open, the other targets carry on. a
+// single target's breaker is checked by admitTransfer before the file is even opened
+type breakerSink struct {
+	breaker *circuitBreaker
+	fastcopy.Sink
+}
+
+func (s breakerSink) Write(to string, file fastcopy.File, r io.Reader) (fastcopy.WriteResult, error) {
+	release, err := s.breaker.allow()
+	if err != nil {
+		return fastcopy.WriteResult{}, err
+	}
+	defer release()
+	return s.Sink.Write(to, file, r)
+}
+
+// the targets a fanned out file failed on and why. nil if it failed before reaching them, e.g. on opening it
+func failedTargets(targets []string, err error) ([]string, string) {
+	var tee *fastcopy.TeeError
+	if !errors.As(err, &tee) {
+		return nil, err.Error()
+	}
+	var failed, reasons []string
+	for i, err := range tee.Errs {
+		if err != nil {
+			failed = append(failed, targets[i])
+			reasons = append(reasons, fmt.Sprintf("%s: %s", targets[i], err))
+		}
+	}
+	return failed, strings.Join(reasons, "; ")
+}
+
+// the Targets of a failure writing to target, which are left empty for a copy to a single target
+func failedOn(targets []string, target string) []string {
+	if len(targets) == 1 {
+		return nil
+	}
+	return []string{target}
+}
+
+// the reason of a failure writing to target, prefixed with the target like the reasons of failedTargets when
+// there are several
+func targetReason(targets []string, target string, err error) string {
+	if len(targets) == 1 {
+		return err.Error()
+	}
+	return fmt.Sprintf("%s: %s", target, err)
+}
+
+// adds the failure writing f.Path to f.Targets, merged into the failure of the same path on other targets, so
+// a file failing on several targets is reported once
+func addFailure(failures []CopyFailure, f CopyFailure) []CopyFailure {
+	for i := range failures {
+		if failures[i].Path == f.Path && len(failures[i].Targets) > 0 && len(f.Targets) > 0 {
+			failures[i].Targets = append(failures[i].Targets, f.Targets...)
+			failures[i].Reason += "; " + f.Reason
+			return failures
+		}
+	}
+	return append(failures, f)
+}
+
+// the outcome of each target of a fanned out copy, nil for a copy to a single target. reconciled has the
+// targets that were reconciled, with whether they matched the plan
+func targetResults(targets []string, tasks []CopyArgs, failures []CopyFailure, reconciled map[string]bool) []TargetResult {
+	if len(targets) == 1 {
+		return nil
+	}
+	results := make([]TargetResult, 0, len(targets))
+	for _, target := range targets {
+		res := TargetResult{TargetURL: target, State: StateSucceeded}
+		failed := make(map[string]bool)
+		for _, f := range failures {
+			if len(f.Targets) == 0 || contains(f.Targets, target) {
+				failed[f.Path] = true
+				res.CopyFailures = append(res.CopyFailures, f)
+				res.State = StateFailed
+			}
+		}
+		if ok, checked := reconciled[target]; checked {
+			res.Reconciled = &ok
+			if !ok {
+				res.State = StateFailed
+			}
+		}
+		res.FilesFailed = int64(len(res.CopyFailures))
+		for _, t := range tasks {
+			if !failed[t.Path] {
+				res.FilesCopied++
+				res.Written += t.Size
+			}
+		}
+		results = append(results, res)
+	}
+	return results
+}
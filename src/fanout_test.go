@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// a second target keeping what it's sent in memory, failing every upload once broken
+type recordingPeer struct {
+	mu     sync.Mutex
+	files  map[string]string
+	broken bool
+}
+
+func (p *recordingPeer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/ready" {
+		handleReady(w, r)
+		return
+	}
+	data, _ := io.ReadAll(r.Body)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.broken {
+		http.Error(w, "disk full", http.StatusInternalServerError)
+		return
+	}
+	path := r.URL.Query().Get("to") + "/" + r.URL.Query().Get("fileName")
+	p.files[path] = string(data)
+	json.NewEncoder(w).Encode(UploadResponse{Path: path, Written: int64(len(data))})
+}
+
+func TestCopyFanout(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{"/data/part-00000": "hello", "/data/part-00001": strings.Repeat("world!", 10000)})
+	first := httptest.NewServer(http.HandlerFunc(handleUpload))
+	defer first.Close()
+	peer := &recordingPeer{files: make(map[string]string)}
+	second := httptest.NewServer(peer)
+	defer second.Close()
+
+	copyTo := func() CopyResponse {
+		query := url.Values{"from": {"/data"}, "to": {"/backup"}, "targetURL": {first.URL + "/upload", second.URL + "/upload"}, "precheck": {"none"}, "reconcile": {"false"}}
+		rec := httptest.NewRecorder()
+		handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+		var resp CopyResponse
+		if err := json.Unmarshal([]byte(strings.TrimSpace(rec.Body.String())), &resp); err != nil {
+			t.Fatalf("%s: %s", err, rec.Body)
+		}
+		return resp
+	}
+
+	resp := copyTo()
+	if resp.State != StateSucceeded || resp.FilesCopied != 2 || len(resp.Targets) != 2 || resp.Targets[1].FilesCopied != 2 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	for _, path := range []string{"/backup/part-00000", "/backup/part-00001"} {
+		written, _ := fs.get(path)
+		source, _ := fs.get("/data/" + path[len("/backup/"):])
+		if written != source || peer.files[path] != source {
+			t.Errorf("%s: expected both targets to get the file", path)
+		}
+	}
+
+	peer.mu.Lock()
+	peer.broken = true
+	peer.mu.Unlock()
+	resp = copyTo()
+	if resp.State != StateFailed || len(resp.CopyFailures) != 2 || len(resp.CopyFailures[0].Targets) != 1 || resp.CopyFailures[0].Targets[0] != second.URL+"/upload" {
+		t.Fatalf("expected the files to fail on the second target, got %+v", resp)
+	}
+	if ok, broken := resp.Targets[0], resp.Targets[1]; ok.State != StateSucceeded || ok.FilesCopied != 2 || broken.State != StateFailed || broken.FilesFailed != 2 || broken.FilesCopied != 0 {
+		t.Errorf("unexpected per target results %+v", resp.Targets)
+	}
+
+	query := url.Values{"from": {"/data"}, "to": {"/backup"}, "targetURL": {first.URL + "/upload", second.URL + "/upload"}, "delta": {"true"}}
+	rec := httptest.NewRecorder()
+	handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected delta to be rejected with several targets, got %d", rec.Code)
+	}
+}
+
+func TestAddFailure(t *testing.T) {
+	targets := []string{"http://a/upload", "http://b/upload"}
+	var failures []CopyFailure
+	for _, target := range targets {
+		failures = addFailure(failures, CopyFailure{Path: "/dst/_MANIFEST", Reason: targetReason(targets, target, errors.New("down")), Targets: failedOn(targets, target)})
+	}
+	failures = addFailure(failures, CopyFailure{Path: "/dst", Reason: "swap failed"})
+	if len(failures) != 2 || len(failures[0].Targets) != 2 || failures[0].Reason != "http://a/upload: down; http://b/upload: down" {
+		t.Errorf("expected the manifest to be reported once for both targets, got %+v", failures)
+	}
+}
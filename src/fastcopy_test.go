@@ -1,43 +1,17 @@
 package main
 
 import (
-	"crypto/rand"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 )
 
-// random test data generator
-type RandomReadCloser struct {
-	size     int64
-	position int64
-}
-
-func (r *RandomReadCloser) Read(p []byte) (n int, err error) {
-	if r.position >= r.size {
-		return 0, io.EOF
-	}
-	remaining := r.size - r.position
-	if int64(len(p)) > remaining {
-		p = p[:remaining]
-	}
-	n, err = rand.Read(p)
-	if err != nil {
-		return n, err
-	}
-	r.position += int64(n)
-	return n, nil
-}
-
-func (r *RandomReadCloser) Close() error {
-	// Perform any cleanup if necessary
-	return nil
-}
-
 func BenchmarkCopy(b *testing.B) {
 	ans := make([]int, 0)
 
@@ -56,6 +30,7 @@ func BenchmarkCopy(b *testing.B) {
 }
 
 func TestUpload(t *testing.T) {
+	fs := useMemFS(t)
 	server := httptest.NewServer(http.HandlerFunc(handleUpload))
 	defer server.Close()
 	route := "/upload?to=%2Ftmp%2Fin%2F&fileName=hello6.txt"
@@ -81,5 +56,136 @@ func TestUpload(t *testing.T) {
 	if data.Written != expected {
 		t.Errorf("unexpected bytes written %d, got %d", expected, data.Written)
 	}
+	if written, _ := fs.get("/tmp/in/hello6.txt"); written != "hello, world!" {
+		t.Errorf("unexpected file contents %q", written)
+	}
+
+}
+
+func TestWriteHDFSOverwrites(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{"/dst/a.txt": "old contents"})
+	res, err := WriteHDFS("/dst", "a.txt", io.NopCloser(strings.NewReader("new")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written, _ := fs.get("/dst/a.txt"); written != "new" || res.Written != 3 {
+		t.Errorf("expected the file to be replaced, got %q (%d bytes written)", written, res.Written)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{
+		"/src/part-00000": "hello",
+		"/src/part-00001": strings.Repeat("x", 100000),
+		"/src/_SUCCESS":   "",
+	})
+	fs.MkdirAll("/src/subdir", 0755)
+
+	peer := http.NewServeMux()
+	peer.HandleFunc("/ready", handleReady)
+	peer.HandleFunc("/ls", handleLs)
+	peer.HandleFunc("/upload", handleUpload)
+	server := httptest.NewServer(peer)
+	defer server.Close()
+
+	query := url.Values{"from": {"/src"}, "to": {"/dst"}, "targetURL": {server.URL + "/upload"}, "manifest": {"true"}}
+	rec := httptest.NewRecorder()
+	handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var resp CopyResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.State != StateSucceeded || resp.Reconciled == nil || !*resp.Reconciled || resp.Written != 100005 {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	for _, name := range []string{"part-00000", "part-00001", "_SUCCESS"} {
+		src, _ := fs.get("/src/" + name)
+		if dst, ok := fs.get("/dst/" + name); !ok || dst != src {
+			t.Errorf("expected %s to be copied", name)
+		}
+	}
+	if _, ok := fs.get("/dst/" + ManifestFileName); !ok {
+		t.Error("expected the manifest to be written")
+	}
 
+	rec = httptest.NewRecorder()
+	query.Set("from", "/missing")
+	handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected listing a missing dir to fail, got %d", rec.Code)
+	}
+}
+
+func TestCopyReadStreams(t *testing.T) {
+	fs := useMemFS(t)
+	large := make([]byte, 20<<20+123)
+	rand.New(rand.NewSource(1)).Read(large)
+	fs.put(map[string]string{"/src/large": string(large), "/src/small": "hello"})
+
+	peer := http.NewServeMux()
+	peer.HandleFunc("/ready", handleReady)
+	peer.HandleFunc("/ls", handleLs)
+	peer.HandleFunc("/upload", handleUpload)
+	server := httptest.NewServer(peer)
+	defer server.Close()
+
+	query := url.Values{"from": {"/src"}, "to": {"/dst"}, "targetURL": {server.URL + "/upload"}, "readStreams": {"3"}, "readStreamsMinSize": {"1M"}}
+	rec := httptest.NewRecorder()
+	handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if dst, _ := fs.get("/dst/large"); dst != string(large) {
+		t.Error("expected the large file read with 3 streams to be copied intact")
+	}
+	if dst, _ := fs.get("/dst/small"); dst != "hello" {
+		t.Error("expected the small file to be copied")
+	}
+
+	query.Set("readStreams", "0")
+	rec = httptest.NewRecorder()
+	handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected readStreams=0 to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestCopyMaxBytes(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{"/src/part-00000": "aaaa", "/src/part-00001": "bbbb", "/src/part-00002": "cccc"})
+	peer := http.NewServeMux()
+	peer.HandleFunc("/ready", handleReady)
+	peer.HandleFunc("/ls", handleLs)
+	peer.HandleFunc("/upload", handleUpload)
+	server := httptest.NewServer(peer)
+	defer server.Close()
+
+	query := url.Values{"from": {"/src"}, "to": {"/dst"}, "targetURL": {server.URL + "/upload"}, "maxBytes": {"5"}}
+	var resp CopyResponse
+	rec := httptest.NewRecorder()
+	handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if rec.Code != http.StatusOK || resp.FilesCopied != 2 || resp.Written != 8 || resp.CutOff == nil || resp.CutOff.ResumeAfter != "/src/part-00001" {
+		t.Fatalf("expected the copy to stop after 2 files, got %d %+v", rec.Code, resp)
+	}
+	if _, ok := fs.get("/dst/part-00002"); ok {
+		t.Error("expected the file past the cut-off not to be copied")
+	}
+
+	query.Set("resumeAfter", resp.CutOff.ResumeAfter)
+	rec = httptest.NewRecorder()
+	handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+	resp = CopyResponse{}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if rec.Code != http.StatusOK || resp.FilesCopied != 1 || resp.CutOff != nil {
+		t.Errorf("expected the follow-up to copy the rest, got %d %+v", rec.Code, resp)
+	}
+	if _, ok := fs.get("/dst/part-00002"); !ok {
+		t.Error("expected the follow-up to copy the file past the cut-off")
+	}
 }
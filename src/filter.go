@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// the source file is still being written, copying it would produce a torn copy
+var errSourceChanged = errors.New("source file changed")
+
+// suffixes and directory names of files still being written by hdfs clients and hadoop jobs
+var (
+	inProgressSuffixes = []string{"._COPYING_", ".tmp"}
+	inProgressDirs     = []string{"_temporary"}
+)
+
+// returns why a listed file should not be copied, or "" if it should
+func skipReason(name string, isDir bool, opts CopyOptions) string {
+	if opts.SkipInProgress {
+		for _, suffix := range inProgressSuffixes {
+			if strings.HasSuffix(name, suffix) {
+				return "in progress: name ends in " + suffix
+			}
+		}
+		if isDir {
+			for _, dir := range inProgressDirs {
+				if name == dir {
+					return "in progress: " + dir + " directory"
+				}
+			}
+		}
+	}
+	if opts.SkipHidden && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+		return "hidden file"
+	}
+	return ""
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSkipReason(t *testing.T) {
+	opts := CopyOptions{SkipInProgress: true, SkipHidden: true}
+	cases := []struct {
+		name  string
+		isDir bool
+		opts  CopyOptions
+		skip  bool
+	}{
+		{"part-00000.parquet", false, opts, false},
+		{"part-00001.parquet._COPYING_", false, opts, true},
+		{"part-00002.parquet.tmp", false, opts, true},
+		{"_temporary", true, opts, true},
+		{".part-00000.parquet.crc", false, opts, true},
+		{"_SUCCESS", false, opts, true},
+		{"part-00001.parquet._COPYING_", false, CopyOptions{}, false},
+		{"_temporary", true, CopyOptions{SkipInProgress: true}, true},
+		{"_metadata", false, CopyOptions{SkipInProgress: true}, false},
+		{".hidden", false, CopyOptions{SkipInProgress: true}, false},
+	}
+	for _, c := range cases {
+		if reason := skipReason(c.name, c.isDir, c.opts); (reason != "") != c.skip {
+			t.Errorf("skipReason(%q, %v, %+v) = %q, expected skip %v", c.name, c.isDir, c.opts, reason, c.skip)
+		}
+	}
+}
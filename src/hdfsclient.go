@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/colinmarc/hdfs/v2"
+)
+
+// the hdfs client has no timeouts of its own, a namenode or datanode that stops answering hangs the call forever.
+// fastcopy dials with FASTCOPY_HDFS_DIAL_TIMEOUT and fails a read or write on a connection idle for longer than
+// FASTCOPY_HDFS_NAMENODE_TIMEOUT or FASTCOPY_HDFS_DATANODE_TIMEOUT, e.g. short ones for same rack copies and long
+// ones for cross dc reads. the calls failing on the connection are retried FASTCOPY_HDFS_RETRIES times.
+//
+// datanodes on an overlay network or behind NAT advertise addresses the client can't reach.
+// FASTCOPY_HDFS_USE_DATANODE_HOSTNAME overrides dfs.client.use.datanode.hostname to dial them by hostname, and
+// FASTCOPY_DATANODE_ADDRESSES rewrites the addresses dialed, e.g. 10.1.0.5=dn1.example.com,10.1.0.6:9866=203.0.113.7:19866.
+// a rewrite naming the port wins over one naming only the host, which keeps the port
+
+const (
+	defaultHdfsDialTimeout     = 20 * time.Second
+	defaultHdfsNamenodeTimeout = time.Minute
+	defaultHdfsDatanodeTimeout = time.Minute
+	defaultHdfsRetries         = 3
+	defaultHdfsRetryBackoff    = time.Second
+)
+
+type hdfsClientSettings struct {
+	dialTimeout     time.Duration
+	namenodeTimeout time.Duration // 0 = none
+	datanodeTimeout time.Duration // 0 = none
+	retries         int
+	retryBackoff    time.Duration
+	useHostname     string            // "true" or "false" overriding the hadoop conf, empty to keep it
+	datanodeAddrs   map[string]string // datanode host or host:port to the host or host:port to dial instead
+}
+
+var (
+	hdfsSettings     hdfsClientSettings
+	hdfsSettingsOnce sync.Once
+)
+
+// parses a duration env var, 0 only where allowZero
+func envDuration(name string, def time.Duration, allowZero bool) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 || (d == 0 && !allowZero) {
+		return 0, fmt.Errorf("invalid %s '%s', expected a duration like 30s", name, v)
+	}
+	return d, nil
+}
+
+// loads the hdfs client settings from env FASTCOPY_HDFS_DIAL_TIMEOUT, FASTCOPY_HDFS_NAMENODE_TIMEOUT,
+// FASTCOPY_HDFS_DATANODE_TIMEOUT (0 disables them), FASTCOPY_HDFS_RETRIES and FASTCOPY_HDFS_RETRY_BACKOFF
+func loadHdfsClientSettings() (hdfsClientSettings, error) {
+	var s hdfsClientSettings
+	var err error
+	if s.dialTimeout, err = envDuration("FASTCOPY_HDFS_DIAL_TIMEOUT", defaultHdfsDialTimeout, false); err != nil {
+		return s, err
+	}
+	if s.namenodeTimeout, err = envDuration("FASTCOPY_HDFS_NAMENODE_TIMEOUT", defaultHdfsNamenodeTimeout, true); err != nil {
+		return s, err
+	}
+	if s.datanodeTimeout, err = envDuration("FASTCOPY_HDFS_DATANODE_TIMEOUT", defaultHdfsDatanodeTimeout, true); err != nil {
+		return s, err
+	}
+	if s.retryBackoff, err = envDuration("FASTCOPY_HDFS_RETRY_BACKOFF", defaultHdfsRetryBackoff, true); err != nil {
+		return s, err
+	}
+	s.retries = defaultHdfsRetries
+	if v := os.Getenv("FASTCOPY_HDFS_RETRIES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return s, fmt.Errorf("invalid FASTCOPY_HDFS_RETRIES '%s', expected a non-negative integer", v)
+		}
+		s.retries = n
+	}
+	if s.useHostname = os.Getenv("FASTCOPY_HDFS_USE_DATANODE_HOSTNAME"); s.useHostname != "" && s.useHostname != "true" && s.useHostname != "false" {
+		return s, fmt.Errorf("invalid FASTCOPY_HDFS_USE_DATANODE_HOSTNAME '%s', expected true or false", s.useHostname)
+	}
+	if s.datanodeAddrs, err = parseDatanodeAddrs(os.Getenv("FASTCOPY_DATANODE_ADDRESSES")); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// parses FASTCOPY_DATANODE_ADDRESSES, from=to pairs of hosts or host:ports
+func parseDatanodeAddrs(spec string) (map[string]string, error) {
+	addrs := make(map[string]string)
+	if spec == "" {
+		return addrs, nil
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		from, to, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		from, to = strings.ToLower(strings.TrimSpace(from)), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid FASTCOPY_DATANODE_ADDRESSES entry '%s', expected host[:port]=host[:port]", entry)
+		}
+		if _, ok := addrs[from]; ok {
+			return nil, fmt.Errorf("FASTCOPY_DATANODE_ADDRESSES rewrites %s more than once", from)
+		}
+		addrs[from] = to
+	}
+	return addrs, nil
+}
+
+// the address to dial for the datanode at addr
+func (s hdfsClientSettings) datanodeAddr(addr string) string {
+	addr = normalizeHostPort(addr)
+	if to, ok := s.datanodeAddrs[strings.ToLower(addr)]; ok {
+		return to
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	to, ok := s.datanodeAddrs[strings.ToLower(host)]
+	if !ok {
+		return addr
+	}
+	if _, _, err := net.SplitHostPort(to); err == nil {
+		return to
+	}
+	return net.JoinHostPort(to, port)
+}
+
+// lazy loads the hdfs client settings
+func getHdfsClientSettings() hdfsClientSettings {
+	hdfsSettingsOnce.Do(func() {
+		s, err := loadHdfsClientSettings()
+		if err != nil {
+			log.Fatal(err)
+		}
+		hdfsSettings = s
+	})
+	return hdfsSettings
+}
+
+// sets the dial funcs of the client's namenode and datanode connections and how datanodes are addressed
+func (s hdfsClientSettings) apply(opts *hdfs.ClientOptions) {
+	opts.NamenodeDialFunc = s.dialFunc(s.namenodeTimeout)
+	dial := s.dialFunc(s.datanodeTimeout)
+	opts.DatanodeDialFunc = countDatanodeReads(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dial(ctx, network, s.datanodeAddr(addr))
+	})
+	if s.useHostname != "" {
+		opts.UseDatanodeHostname = s.useHostname == "true"
+	}
+}
+
+func (s hdfsClientSettings) dialFunc(idle time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: s.dialTimeout, KeepAlive: 30 * time.Second}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialPreferring(ctx, dialer, network, addr)
+		if err != nil || idle == 0 {
+			return conn, err
+		}
+		return &idleTimeoutConn{Conn: conn, idle: idle}, nil
+	}
+}
+
+// a connection whose reads and writes fail once they made no progress for idle
+type idleTimeoutConn struct {
+	net.Conn
+	idle time.Duration
+}
+
+func (c *idleTimeoutConn) Read(p []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.idle))
+	return c.Conn.Read(p)
+}
+
+func (c *idleTimeoutConn) Write(p []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.idle))
+	return c.Conn.Write(p)
+}
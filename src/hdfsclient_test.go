@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/colinmarc/hdfs/v2"
+)
+
+func TestLoadHdfsClientSettings(t *testing.T) {
+	s, err := loadHdfsClientSettings()
+	if err != nil || s.dialTimeout != defaultHdfsDialTimeout || s.retries != defaultHdfsRetries {
+		t.Errorf("expected the defaults, got %+v %v", s, err)
+	}
+	t.Setenv("FASTCOPY_HDFS_DATANODE_TIMEOUT", "0")
+	t.Setenv("FASTCOPY_HDFS_RETRIES", "0")
+	if s, err := loadHdfsClientSettings(); err != nil || s.datanodeTimeout != 0 || s.retries != 0 {
+		t.Errorf("expected the datanode timeout and retries to be disabled, got %+v %v", s, err)
+	}
+	for name, value := range map[string]string{
+		"FASTCOPY_HDFS_DIAL_TIMEOUT":     "0",
+		"FASTCOPY_HDFS_NAMENODE_TIMEOUT": "soon",
+		"FASTCOPY_HDFS_RETRIES":          "-1",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := loadHdfsClientSettings(); err == nil {
+				t.Errorf("expected %s=%s to be rejected", name, value)
+			}
+		})
+	}
+}
+
+func TestIdleTimeoutConn(t *testing.T) {
+	// a datanode that accepts the connection and then never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+
+	s := hdfsClientSettings{dialTimeout: time.Second}
+	conn, err := s.dialFunc(50*time.Millisecond)(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) || !isConnectionError(err) {
+		t.Errorf("expected the read to time out as a connection error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected the read to time out after 50ms, took %s", elapsed)
+	}
+}
+
+func TestDatanodeAddresses(t *testing.T) {
+	t.Setenv("FASTCOPY_DATANODE_ADDRESSES", "10.1.0.5=dn1.example.com, 10.1.0.6:9866=203.0.113.7:19866")
+	t.Setenv("FASTCOPY_HDFS_USE_DATANODE_HOSTNAME", "true")
+	s, err := loadHdfsClientSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, expected := range map[string]string{
+		"10.1.0.5:9866": "dn1.example.com:9866",
+		"10.1.0.6:9866": "203.0.113.7:19866",
+		"10.1.0.6:9867": "10.1.0.6:9867",
+		"10.1.0.7:9866": "10.1.0.7:9866",
+	} {
+		if got := s.datanodeAddr(addr); got != expected {
+			t.Errorf("%s: expected %s, got %s", addr, expected, got)
+		}
+	}
+
+	// a datanode advertising an address the client can't reach, rewritten to where it listens
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	s.datanodeAddrs = map[string]string{"192.0.2.1:9866": ln.Addr().String()}
+	var opts hdfs.ClientOptions
+	s.apply(&opts)
+	if !opts.UseDatanodeHostname {
+		t.Error("expected datanodes to be dialed by hostname")
+	}
+	conn, err := opts.DatanodeDialFunc(context.Background(), "tcp", "192.0.2.1:9866")
+	if err != nil {
+		t.Fatalf("expected the rewritten address to be dialed, got %v", err)
+	}
+	conn.Close()
+
+	for name, value := range map[string]string{
+		"FASTCOPY_DATANODE_ADDRESSES":         "10.1.0.5",
+		"FASTCOPY_HDFS_USE_DATANODE_HOSTNAME": "yes",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := loadHdfsClientSettings(); err == nil {
+				t.Errorf("expected %s=%s to be rejected", name, value)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/colinmarc/hdfs/v2"
+)
+
+// the subset of hdfs.Client fastcopy uses, so handlers can be tested against an in-memory fake
+type FileSystem interface {
+	Open(name string) (HdfsReader, error)
+	Create(name string) (io.WriteCloser, error)
+	Append(name string) (io.WriteCloser, error)
+	ReadDir(dirname string) ([]os.FileInfo, error)
+	ReadFile(filename string) ([]byte, error)
+	Stat(name string) (os.FileInfo, error)
+	MkdirAll(dirname string, perm os.FileMode) error
+	Chmod(name string, perm os.FileMode) error
+	ListXAttrs(name string) (map[string]string, error)
+	SetXAttr(name, key, value string) error
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+	CreateSnapshot(dir, name string) (string, error)
+	DeleteSnapshot(dir, name string) error
+	Close() error
+}
+
+// an open hdfs file, as returned by hdfs.Client.Open
+type HdfsReader interface {
+	io.ReadSeekCloser
+	io.ReaderAt
+	Stat() os.FileInfo
+}
+
+// a FileSystem backed by a real hdfs cluster
+type hdfsFS struct {
+	*hdfs.Client
+}
+
+func (fs hdfsFS) Open(name string) (HdfsReader, error) {
+	r, err := fs.Client.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (fs hdfsFS) Create(name string) (io.WriteCloser, error) {
+	w, err := fs.Client.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (fs hdfsFS) Append(name string) (io.WriteCloser, error) {
+	w, err := fs.Client.Append(name)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
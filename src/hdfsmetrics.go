@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// when throughput drops, the namenode and the network to the peer are the usual suspects. every namenode call of
+// the hdfs client, opening, creating, listing, renaming and the like, is timed into a histogram per operation
+// served by /metrics as fastcopy_hdfs_rpc_duration_seconds. the data itself, streamed to and from datanodes,
+// isn't part of it
+
+// the upper bounds of the latency buckets, in seconds
+var rpcBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// a Prometheus style histogram of durations
+type latencyHistogram struct {
+	counts []uint64 // per bucket, the last one counting those above every bound
+	sum    float64
+	count  uint64
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(rpcBuckets)+1)
+	}
+	secs := d.Seconds()
+	i := 0
+	for i < len(rpcBuckets) && secs > rpcBuckets[i] {
+		i++
+	}
+	h.counts[i]++
+	h.sum += secs
+	h.count++
+}
+
+var (
+	rpcLatencies   = make(map[string]*latencyHistogram)
+	rpcLatenciesMu sync.Mutex
+)
+
+// records that the namenode call op took d
+func observeRPC(op string, d time.Duration) {
+	rpcLatenciesMu.Lock()
+	defer rpcLatenciesMu.Unlock()
+	h, ok := rpcLatencies[op]
+	if !ok {
+		h = &latencyHistogram{}
+		rpcLatencies[op] = h
+	}
+	h.observe(d)
+}
+
+// times a namenode call as op
+func timeRPC[T any](op string, call func() (T, error)) (T, error) {
+	start := time.Now()
+	v, err := call()
+	observeRPC(op, time.Since(start))
+	return v, err
+}
+
+// writes the histograms in the Prometheus text format
+func writeRPCMetrics(w io.Writer) {
+	rpcLatenciesMu.Lock()
+	defer rpcLatenciesMu.Unlock()
+	if len(rpcLatencies) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "# HELP fastcopy_hdfs_rpc_duration_seconds Latency of the namenode calls of the hdfs client by operation.")
+	fmt.Fprintln(w, "# TYPE fastcopy_hdfs_rpc_duration_seconds histogram")
+	for _, op := range sortedKeys(rpcLatencies) {
+		h := rpcLatencies[op]
+		var cumulative uint64
+		for i, bound := range rpcBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "fastcopy_hdfs_rpc_duration_seconds_bucket{op=%q,le=\"%g\"} %d\n", op, bound, cumulative)
+		}
+		fmt.Fprintf(w, "fastcopy_hdfs_rpc_duration_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", op, h.count)
+		fmt.Fprintf(w, "fastcopy_hdfs_rpc_duration_seconds_sum{op=%q} %g\n", op, h.sum)
+		fmt.Fprintf(w, "fastcopy_hdfs_rpc_duration_seconds_count{op=%q} %d\n", op, h.count)
+	}
+}
+
+// a FileSystem timing the namenode calls of another
+type timedFS struct {
+	FileSystem
+}
+
+// wraps the clients dial connects into timedFS
+func timed(dial func() (FileSystem, error)) func() (FileSystem, error) {
+	return func() (FileSystem, error) {
+		client, err := dial()
+		if err != nil {
+			return nil, err
+		}
+		return timedFS{client}, nil
+	}
+}
+
+func (fs timedFS) Open(name string) (HdfsReader, error) {
+	return timeRPC("open", func() (HdfsReader, error) { return fs.FileSystem.Open(name) })
+}
+
+func (fs timedFS) Create(name string) (io.WriteCloser, error) {
+	return timeRPC("create", func() (io.WriteCloser, error) { return fs.FileSystem.Create(name) })
+}
+
+func (fs timedFS) Append(name string) (io.WriteCloser, error) {
+	return timeRPC("append", func() (io.WriteCloser, error) { return fs.FileSystem.Append(name) })
+}
+
+func (fs timedFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return timeRPC("readdir", func() ([]os.FileInfo, error) { return fs.FileSystem.ReadDir(dirname) })
+}
+
+func (fs timedFS) Stat(name string) (os.FileInfo, error) {
+	return timeRPC("stat", func() (os.FileInfo, error) { return fs.FileSystem.Stat(name) })
+}
+
+func (fs timedFS) MkdirAll(dirname string, perm os.FileMode) error {
+	_, err := timeRPC("mkdirs", func() (struct{}, error) { return struct{}{}, fs.FileSystem.MkdirAll(dirname, perm) })
+	return err
+}
+
+func (fs timedFS) Remove(name string) error {
+	_, err := timeRPC("delete", func() (struct{}, error) { return struct{}{}, fs.FileSystem.Remove(name) })
+	return err
+}
+
+func (fs timedFS) Rename(oldpath, newpath string) error {
+	_, err := timeRPC("rename", func() (struct{}, error) { return struct{}{}, fs.FileSystem.Rename(oldpath, newpath) })
+	return err
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRPCMetrics(t *testing.T) {
+	rpcLatenciesMu.Lock()
+	prev := rpcLatencies
+	rpcLatencies = make(map[string]*latencyHistogram)
+	rpcLatenciesMu.Unlock()
+	t.Cleanup(func() { rpcLatencies = prev })
+
+	mem := newMemFS()
+	mem.put(map[string]string{"/src/a": "aaaa"})
+	dial := timed(func() (FileSystem, error) { return mem, nil })
+	fs, _ := dial()
+	fs.ReadDir("/src")
+	fs.Open("/src/a")
+	fs.Open("/src/missing")
+	fs.Rename("/src/a", "/src/b")
+	observeRPC("create", 30*time.Millisecond)
+	observeRPC("create", 3*time.Second)
+
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE fastcopy_hdfs_rpc_duration_seconds histogram",
+		`fastcopy_hdfs_rpc_duration_seconds_count{op="open"} 2`,
+		`fastcopy_hdfs_rpc_duration_seconds_count{op="readdir"} 1`,
+		`fastcopy_hdfs_rpc_duration_seconds_count{op="rename"} 1`,
+		`fastcopy_hdfs_rpc_duration_seconds_bucket{op="create",le="0.025"} 0`,
+		`fastcopy_hdfs_rpc_duration_seconds_bucket{op="create",le="0.05"} 1`,
+		`fastcopy_hdfs_rpc_duration_seconds_bucket{op="create",le="5"} 2`,
+		`fastcopy_hdfs_rpc_duration_seconds_bucket{op="create",le="+Inf"} 2`,
+		`fastcopy_hdfs_rpc_duration_seconds_sum{op="create"} 3.03`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("expected %s in:\n%s", line, body)
+		}
+	}
+}
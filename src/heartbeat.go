@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// a proxy or load balancer in front of fastcopy closes a response it sees no bytes of for a while, long before a
+// big synchronous /copy finishes. with 'heartbeat' set, e.g. heartbeat=30s, a copy still running after that
+// interval answers 200 with its first heartbeat and writes a newline at each later one until the report follows,
+// which JSON parsers skip as whitespace. the status can't change once sent, so a copy failing afterwards is told
+// by the report's state, or the error envelope's status. a copy done, or refused, before the first heartbeat
+// answers as it would without one. the job id is in the X-Fastcopy-Job-Id header either way
+
+// the server's WriteTimeout, extended on each heartbeat
+const serverWriteTimeout = 15 * time.Minute
+
+// parses 'heartbeat', 0 when the response isn't kept alive
+func parseHeartbeat(q url.Values) (time.Duration, error) {
+	v := q.Get("heartbeat")
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < time.Second {
+		return 0, fmt.Errorf("'heartbeat' must be a duration of at least 1s like 30s, got '%s'", v)
+	}
+	return d, nil
+}
+
+// keeps a response alive while the request is handled
+type heartbeat struct {
+	w       http.ResponseWriter
+	mu      sync.Mutex
+	started bool // whether the status was sent
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func startHeartbeat(w http.ResponseWriter, interval time.Duration) *heartbeat {
+	h := &heartbeat{w: w, stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(h.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-h.stop:
+				return
+			case <-ticker.C:
+				h.beat()
+			}
+		}
+	}()
+	return h
+}
+
+func (h *heartbeat) beat() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	rc := http.NewResponseController(h.w)
+	if !h.started {
+		h.w.Header().Set("Content-Type", "application/json")
+		h.w.WriteHeader(http.StatusOK)
+		h.started = true
+	}
+	rc.SetWriteDeadline(time.Now().Add(serverWriteTimeout))
+	h.w.Write([]byte("\n"))
+	rc.Flush()
+}
+
+// stops the heartbeat, returning whether the status was sent already
+func (h *heartbeat) finish() bool {
+	close(h.stop)
+	<-h.done
+	return h.started
+}
+
+// writes the error of a request whose status was sent by its heartbeat
+func writeLateError(w http.ResponseWriter, msg string, status int, details ...interface{}) {
+	body, _ := json.Marshal(errorEnvelope{newAPIError(msg, status, details...)})
+	w.Write(body)
+	w.Write([]byte("\n"))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	rec := httptest.NewRecorder()
+	hb := startHeartbeat(rec, 10*time.Millisecond)
+	time.Sleep(35 * time.Millisecond)
+	if !hb.finish() || rec.Code != http.StatusOK || strings.Count(rec.Body.String(), "\n") < 2 {
+		t.Errorf("expected the status and heartbeats to be sent, got %d %q", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	if startHeartbeat(rec, time.Minute).finish() {
+		t.Error("expected nothing sent by a heartbeat stopped before its first beat")
+	}
+	if _, err := parseHeartbeat(url.Values{"heartbeat": {"10ms"}}); err == nil {
+		t.Error("expected a heartbeat under a second to be refused")
+	}
+}
+
+func TestCopyHeartbeat(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{"/data/a": "aaaa"})
+	api := apiMux()
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/upload" {
+			time.Sleep(1200 * time.Millisecond) // a copy running longer than the heartbeat
+		}
+		api.ServeHTTP(w, r)
+	}))
+	defer peer.Close()
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	query := url.Values{"from": {"/data"}, "to": {"/backup"}, "targetURL": {peer.URL + "/upload"}, "precheck": {"none"}, "heartbeat": {"1s"}}
+	resp, err := http.Post(server.URL+"/copy?"+query.Encode(), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(jobIDHeader) == "" {
+		t.Fatalf("expected the status and job id to be sent up front, got %d %v", resp.StatusCode, resp.Header)
+	}
+	body := bufio.NewReader(resp.Body)
+	first, _ := body.ReadByte()
+	if first != '\n' {
+		t.Errorf("expected a heartbeat before the report, got %q", first)
+	}
+	var report CopyResponse
+	if err := json.NewDecoder(body).Decode(&report); err != nil || report.State != StateSucceeded || report.JobID != resp.Header.Get(jobIDHeader) {
+		t.Errorf("expected the report after the heartbeats, got %+v %v", report, err)
+	}
+}
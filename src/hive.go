@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// a copy with hiveTable=db.table registers the partition dirs it copied with the destination's hive metastore,
+// through WebHCat (the HCatalog REST API), so the data is queryable there without a separate repair step.
+// a dir is a partition by the key=value names it ends with, e.g. .../dt=2024-06-01/hour=03
+
+// where WebHCat is reached, from FASTCOPY_WEBHCAT_*
+type webhcatSettings struct {
+	api  string // the WebHCat server, e.g. http://hcat:50111
+	user string // sent as user.name on clusters with simple auth
+}
+
+var (
+	webhcat     *webhcatSettings
+	webhcatOnce sync.Once
+)
+
+// reads FASTCOPY_WEBHCAT_*. returns nil without an error when FASTCOPY_WEBHCAT_API isn't set
+func loadWebhcatSettings() (*webhcatSettings, error) {
+	api := os.Getenv("FASTCOPY_WEBHCAT_API")
+	if api == "" {
+		return nil, nil
+	}
+	if u, err := url.Parse(api); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid FASTCOPY_WEBHCAT_API '%s', expected an http(s) url", api)
+	}
+	return &webhcatSettings{strings.TrimSuffix(api, "/"), os.Getenv("FASTCOPY_WEBHCAT_USER")}, nil
+}
+
+// lazy loads the WebHCat settings, nil when partitions can't be registered
+func getWebhcatSettings() *webhcatSettings {
+	webhcatOnce.Do(func() {
+		s, err := loadWebhcatSettings()
+		if err != nil {
+			log.Fatal(err)
+		}
+		webhcat = s
+	})
+	return webhcat
+}
+
+func (s *webhcatSettings) url(path string) string {
+	u := s.api + "/templeton/v1" + path
+	if s.user != "" {
+		u += "?" + url.Values{"user.name": {s.user}}.Encode()
+	}
+	return u
+}
+
+// a partition registered, or not, after a hiveTable copy
+type HivePartition struct {
+	Spec     string `json:"spec"` // e.g. dt='2024-06-01',hour='03'
+	Location string `json:"location"`
+	Error    string `json:"error,omitempty"`
+}
+
+// splits hiveTable into its database, default unless given, and table
+func parseHiveTable(v string) (string, string, error) {
+	db, table, ok := strings.Cut(v, ".")
+	if !ok {
+		db, table = "default", v
+	}
+	if db == "" || table == "" || strings.ContainsAny(table, "./ ") {
+		return "", "", fmt.Errorf("'hiveTable' must be a table like db.table, got '%s'", v)
+	}
+	return db, table, nil
+}
+
+// the partition spec of dir from the key=value names it ends with, empty if it doesn't end with one
+func partitionSpec(dir string) string {
+	var parts []string
+	for dir = filepath.Clean(dir); dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		key, value, ok := strings.Cut(filepath.Base(dir), "=")
+		if !ok || key == "" {
+			break
+		}
+		// hive escapes special characters in partition dir names like urls
+		if unescaped, err := url.PathUnescape(value); err == nil {
+			value = unescaped
+		}
+		parts = append([]string{fmt.Sprintf("%s='%s'", key, strings.ReplaceAll(value, "'", `\'`))}, parts...)
+	}
+	return strings.Join(parts, ",")
+}
+
+// the partitions of the dirs the tasks wrote files into, below root. the tasks were written into writeTo, which
+// the partitions are located in 'to' of, the same dir unless the copy was staged
+func copiedPartitions(tasks []CopyArgs, root string, writeTo string, to string) []HivePartition {
+	seen := make(map[string]bool)
+	var partitions []HivePartition
+	for _, dir := range destDirs(tasks, root) {
+		if len(tasksInto(tasks, dir)) == 0 {
+			continue
+		}
+		location := filepath.Join(to, strings.TrimPrefix(dir, writeTo))
+		spec := partitionSpec(location)
+		if spec == "" || seen[spec] {
+			continue
+		}
+		seen[spec] = true
+		partitions = append(partitions, HivePartition{Spec: spec, Location: location})
+	}
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i].Location < partitions[j].Location })
+	return partitions
+}
+
+// adds the partition to the table if it isn't there yet
+func addHivePartition(s *webhcatSettings, db string, table string, p HivePartition) error {
+	path := fmt.Sprintf("/ddl/database/%s/table/%s/partition/%s", url.PathEscape(db), url.PathEscape(table), url.PathEscape(p.Spec))
+	body, _ := json.Marshal(map[string]interface{}{"location": p.Location, "ifNotExists": true})
+	req, err := http.NewRequest(http.MethodPut, s.url(path), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("adding partition %s returned non-OK status %d: %s", p.Spec, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// runs MSCK REPAIR TABLE, adding the partitions of every dir of the table the metastore doesn't know yet
+func repairHiveTable(s *webhcatSettings, db string, table string) error {
+	form := url.Values{"exec": {fmt.Sprintf("MSCK REPAIR TABLE `%s`.`%s`;", db, table)}}
+	if s.user != "" {
+		form.Set("user.name", s.user)
+	}
+	resp, err := httpClient.PostForm(s.api+"/templeton/v1/ddl", form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Stderr   string `json:"stderr"`
+		ExitCode int    `json:"exitcode"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("repairing %s.%s returned non-OK status %d: %s", db, table, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return err
+	}
+	if res.ExitCode != 0 {
+		return fmt.Errorf("repairing %s.%s exited with %d: %s", db, table, res.ExitCode, strings.TrimSpace(res.Stderr))
+	}
+	return nil
+}
+
+// registers the partitions with the table, or repairs the whole table if repair is set. returns the partitions
+// with the error of each that failed
+func registerPartitions(s *webhcatSettings, db string, table string, partitions []HivePartition, repair bool, job *Job) []HivePartition {
+	if repair {
+		if err := repairHiveTable(s, db, table); err != nil {
+			job.logf("Failed to repair %s.%s: %s", db, table, err)
+			for i := range partitions {
+				partitions[i].Error = err.Error()
+			}
+			return partitions
+		}
+		job.logf("Repaired %s.%s, covering %d copied partitions", db, table, len(partitions))
+		return partitions
+	}
+	for i, p := range partitions {
+		if err := addHivePartition(s, db, table, p); err != nil {
+			partitions[i].Error = err.Error()
+			job.logf("Failed to add partition %s of %s.%s: %s", p.Spec, db, table, err)
+			continue
+		}
+		job.logf("Added partition %s of %s.%s at %s", p.Spec, db, table, p.Location)
+	}
+	return partitions
+}
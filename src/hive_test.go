@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPartitionSpec(t *testing.T) {
+	for dir, want := range map[string]string{
+		"/warehouse/t/dt=2024-06-01/hour=03": "dt='2024-06-01',hour='03'",
+		"/warehouse/t/dt=2024-06-01/":        "dt='2024-06-01'",
+		"/warehouse/t/ts=10%3A30":            "ts='10:30'",
+		"/warehouse/t/name=o'brien":          `name='o\'brien'`,
+		"/warehouse/t":                       "",
+		"/warehouse/t/dt=1/files":            "",
+	} {
+		if got := partitionSpec(dir); got != want {
+			t.Errorf("partitionSpec(%s) = %s, expected %s", dir, got, want)
+		}
+	}
+}
+
+// serves the WebHCat api for the duration of the test, recording the requests it gets
+func useWebhcat(t *testing.T, exitCode int) *[]string {
+	var mu sync.Mutex
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.EscapedPath()+" "+r.URL.Query().Get("user.name")+" "+string(body))
+		mu.Unlock()
+		if r.URL.Path == "/templeton/v1/ddl" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"exitcode": exitCode, "stderr": "FAILED: SemanticException"})
+			return
+		}
+		w.Write([]byte(`{"partition":"","table":"events","database":"logs"}`))
+	}))
+	t.Cleanup(server.Close)
+	webhcatOnce.Do(func() {})
+	prev := webhcat
+	webhcat = &webhcatSettings{server.URL, "etl"}
+	t.Cleanup(func() { webhcat = prev })
+	return &requests
+}
+
+func TestCopyRegistersHivePartitions(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{
+		"/src/dt=2024-06-01/part-0000": "abc",
+		"/src/dt=2024-06-02/part-0000": "defg",
+		"/src/README":                  "unpartitioned",
+	})
+	requests := useWebhcat(t, 0)
+	peer := http.NewServeMux()
+	peer.HandleFunc("/ready", handleReady)
+	peer.HandleFunc("/ls", handleLs)
+	peer.HandleFunc("/upload", handleUpload)
+	server := httptest.NewServer(peer)
+	defer server.Close()
+
+	copy := func(query url.Values) CopyResponse {
+		rec := httptest.NewRecorder()
+		handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+		var resp CopyResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return resp
+	}
+	query := url.Values{"from": {"/src"}, "to": {"/warehouse/events"}, "targetURL": {server.URL + "/upload"}, "recursive": {"true"}, "hiveTable": {"logs.events"}}
+	resp := copy(query)
+	if resp.State != StateSucceeded || len(resp.HivePartitions) != 2 || resp.HivePartitions[1].Spec != "dt='2024-06-02'" || resp.HivePartitions[1].Location != "/warehouse/events/dt=2024-06-02" {
+		t.Fatalf("expected the 2 partition dirs to be registered, got %+v", resp)
+	}
+	sort.Strings(*requests)
+	if len(*requests) != 2 || !strings.HasPrefix((*requests)[0], "PUT /templeton/v1/ddl/database/logs/table/events/partition/dt=%272024-06-01%27 etl ") || !strings.Contains((*requests)[0], `"location":"/warehouse/events/dt=2024-06-01"`) {
+		t.Errorf("unexpected WebHCat requests %v", *requests)
+	}
+
+	*requests = nil
+	query.Set("hiveRepair", "true")
+	resp = copy(query)
+	if len(*requests) != 1 || !strings.Contains((*requests)[0], "MSCK+REPAIR+TABLE") || resp.State != StateSucceeded {
+		t.Errorf("expected the table to be repaired once, got %v and %+v", *requests, resp)
+	}
+
+	useWebhcat(t, 1)
+	resp = copy(query)
+	if resp.State != StateFailed || len(resp.HivePartitions) != 2 || !strings.Contains(resp.HivePartitions[0].Error, "SemanticException") {
+		t.Errorf("expected a failed repair to fail the copy, got %+v", resp)
+	}
+}
+
+func TestHiveTableOptions(t *testing.T) {
+	useMemFS(t)
+	webhcatOnce.Do(func() {})
+	prev := webhcat
+	webhcat = nil
+	t.Cleanup(func() { webhcat = prev })
+	for _, param := range []string{"hiveTable=logs.events", "hiveRepair=true"} {
+		rec := httptest.NewRecorder()
+		handleCopy(rec, httptest.NewRequest("POST", "/copy?from=/src&to=/dst&"+param, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("expected %s without WebHCat to be rejected, got %d", param, rec.Code)
+		}
+	}
+	if _, _, err := parseHiveTable("logs.events.x"); err == nil {
+		t.Error("expected a table name with 2 dots to be rejected")
+	}
+	if db, table, err := parseHiveTable("events"); err != nil || db != "default" || table != "events" {
+		t.Errorf("expected the default database, got %s %s %v", db, table, err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// server wide cap on the bytes of all transfers in flight, across every job.
+// waiters are served in FIFO order so a large file can't be starved by a stream of small ones
+type inflightLimiter struct {
+	mu      sync.Mutex
+	max     int64
+	used    int64
+	waiters []*inflightWaiter
+}
+
+type inflightWaiter struct {
+	n     int64
+	ready chan struct{}
+}
+
+func newInflightLimiter(max int64) *inflightLimiter {
+	return &inflightLimiter{max: max}
+}
+
+// blocks until n bytes can be put in flight. files larger than the cap take the whole cap.
+// returns the amount acquired, which must be passed back to release
+func (l *inflightLimiter) acquire(n int64) int64 {
+	if n > l.max {
+		n = l.max
+	}
+	l.mu.Lock()
+	if len(l.waiters) == 0 && l.used+n <= l.max {
+		l.used += n
+		l.mu.Unlock()
+		return n
+	}
+	w := &inflightWaiter{n, make(chan struct{})}
+	l.waiters = append(l.waiters, w)
+	l.mu.Unlock()
+	<-w.ready
+	return n
+}
+
+func (l *inflightLimiter) release(n int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.used -= n
+	for len(l.waiters) > 0 && l.used+l.waiters[0].n <= l.max {
+		w := l.waiters[0]
+		l.waiters = l.waiters[1:]
+		l.used += w.n
+		close(w.ready)
+	}
+}
+
+// bytes currently in flight
+func (l *inflightLimiter) inUse() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.used
+}
+
+// parses a byte size like 1048576, 512M or 64GB (binary units)
+func parseByteSize(s string) (int64, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	v = strings.TrimSuffix(strings.TrimSuffix(v, "IB"), "B")
+	multiplier := int64(1)
+	if v != "" {
+		switch v[len(v)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			v = v[:len(v)-1]
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid byte size '%s'", s)
+	}
+	if n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("byte size '%s' is too large", s)
+	}
+	return n * multiplier, nil
+}
+
+var (
+	inflight     *inflightLimiter
+	inflightOnce sync.Once
+)
+
+// lazy loads the global in-flight limiter from env FASTCOPY_MAX_INFLIGHT_BYTES. returns nil if no cap is configured
+func getInflightLimiter() *inflightLimiter {
+	inflightOnce.Do(func() {
+		spec := os.Getenv("FASTCOPY_MAX_INFLIGHT_BYTES")
+		if spec == "" {
+			return
+		}
+		max, err := parseByteSize(spec)
+		if err != nil || max == 0 {
+			log.Fatalf("invalid FASTCOPY_MAX_INFLIGHT_BYTES '%s'", spec)
+		}
+		inflight = newInflightLimiter(max)
+	})
+	return inflight
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInflightLimiterCapsLargeFiles(t *testing.T) {
+	l := newInflightLimiter(100)
+	if got := l.acquire(500); got != 100 {
+		t.Errorf("expected oversized acquire to take the whole cap, got %d", got)
+	}
+}
+
+func TestInflightLimiterBlocks(t *testing.T) {
+	l := newInflightLimiter(100)
+	a := l.acquire(60)
+	acquired := make(chan int64)
+	go func() { acquired <- l.acquire(50) }()
+
+	select {
+	case <-acquired:
+		t.Fatal("expected acquire to block while the cap is exceeded")
+	case <-time.After(20 * time.Millisecond):
+	}
+	l.release(a)
+	if n := <-acquired; n != 50 || l.inUse() != 50 {
+		t.Errorf("expected 50 bytes in flight after release, got %d", l.inUse())
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	for in, want := range map[string]int64{"1048576": 1 << 20, "512M": 512 << 20, "64GB": 64 << 30, "2TiB": 2 << 40} {
+		if got, err := parseByteSize(in); err != nil || got != want {
+			t.Errorf("parseByteSize(%s) = %d, %v, want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"9000000T", "9223372036854775807K", "-1", "many"} {
+		if got, err := parseByteSize(in); err == nil {
+			t.Errorf("expected parseByteSize(%s) to fail, got %d", in, got)
+		}
+	}
+	if got, err := parseByteSize("8388607T"); err != nil || got != 8388607<<40 {
+		t.Errorf("expected the largest size in T to parse, got %d, %v", got, err)
+	}
+}
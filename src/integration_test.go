@@ -0,0 +1,202 @@
+//go:build integration
+
+// End to end tests against a single node hdfs in docker and two fastcopy processes.
+// Run with
+//
+//	go test -tags integration -run Integration -v ./src/
+//
+// They need docker with host networking (linux) and pull apache/hadoop:3.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/colinmarc/hdfs/v2"
+)
+
+const (
+	integrationImage    = "apache/hadoop:3"
+	integrationNamenode = "localhost:8020"
+)
+
+// the sending and receiving fastcopy instances
+var (
+	sourceURL = "http://localhost:18080"
+	targetURL = "http://localhost:18081"
+)
+
+func TestIntegration(t *testing.T) {
+	client := startHDFS(t)
+	binary := buildFastcopy(t)
+	startFastcopy(t, binary, ":18080")
+	startFastcopy(t, binary, ":18081")
+
+	files := map[string][]byte{
+		"part-00000": bytes.Repeat([]byte("fastcopy"), 1<<17),
+		"part-00001": []byte("small"),
+		"_SUCCESS":   nil,
+	}
+	for name, data := range files {
+		writeFile(t, client, "/it/src/"+name, data)
+	}
+
+	t.Run("copy", func(t *testing.T) {
+		resp, status := copyDir(t, url.Values{"from": {"/it/src"}, "to": {"/it/copy"}})
+		if status != http.StatusOK || resp.State != StateSucceeded || resp.Reconciled == nil || !*resp.Reconciled {
+			t.Fatalf("expected a reconciled copy, got %d %+v", status, resp)
+		}
+		for name, data := range files {
+			if copied, err := client.ReadFile("/it/copy/" + name); err != nil || !bytes.Equal(copied, data) {
+				t.Errorf("expected %s to be copied intact: %v", name, err)
+			}
+		}
+	})
+
+	t.Run("verify", func(t *testing.T) {
+		resp, status := copyDir(t, url.Values{"from": {"/it/src"}, "to": {"/it/verified"}, "manifest": {"true"}, "requireSuccess": {"true"}, "precheck": {"upload"}})
+		if status != http.StatusOK || resp.State != StateSucceeded {
+			t.Fatalf("expected a verified copy, got %d %+v", status, resp)
+		}
+		manifest, err := client.ReadFile("/it/verified/" + ManifestFileName)
+		if err != nil || !strings.Contains(string(manifest), "part-00000") {
+			t.Errorf("expected a manifest listing the copied files, got %q: %v", manifest, err)
+		}
+	})
+
+	t.Run("delta", func(t *testing.T) {
+		changed := append([]byte("changed!"), files["part-00000"][8:]...)
+		writeFile(t, client, "/it/src/part-00000", changed)
+		defer writeFile(t, client, "/it/src/part-00000", files["part-00000"])
+		resp, status := copyDir(t, url.Values{"from": {"/it/src"}, "to": {"/it/copy"}, "delta": {"true"}})
+		if status != http.StatusOK || resp.State != StateSucceeded {
+			t.Fatalf("expected a delta copy, got %d %+v", status, resp)
+		}
+		if copied, _ := client.ReadFile("/it/copy/part-00000"); !bytes.Equal(copied, changed) {
+			t.Error("expected the delta copy to bring part-00000 up to date")
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		_, status := copyDir(t, url.Values{"from": {"/it/missing"}, "to": {"/it/failed"}})
+		if status != http.StatusInternalServerError {
+			t.Errorf("expected copying a missing dir to fail, got %d", status)
+		}
+		q := url.Values{"from": {"/it/src"}, "to": {"/it/failed"}, "targetURL": {"http://localhost:1/upload"}, "precheck": {"none"}}
+		resp, _ := copyDir(t, q)
+		if resp.State == StateSucceeded || len(resp.CopyFailures) != len(files) {
+			t.Errorf("expected every file to fail against an unreachable target, got %+v", resp)
+		}
+	})
+}
+
+// starts a namenode and a datanode on the host network, returns a client once hdfs accepts writes
+func startHDFS(t *testing.T) *hdfs.Client {
+	env := []string{
+		"-e", "ENSURE_NAMENODE_DIR=/tmp/hadoop-hadoop/dfs/name",
+		"-e", "CORE-SITE.XML_fs.defaultFS=hdfs://" + integrationNamenode,
+		"-e", "HDFS-SITE.XML_dfs.namenode.rpc-address=" + integrationNamenode,
+		"-e", "HDFS-SITE.XML_dfs.replication=1",
+		"-e", "HDFS-SITE.XML_dfs.permissions.enabled=false",
+	}
+	for _, role := range []string{"namenode", "datanode"} {
+		name := fmt.Sprintf("fastcopy-it-%s-%d", role, os.Getpid())
+		args := append([]string{"run", "-d", "--rm", "--network", "host", "--name", name}, env...)
+		args = append(args, integrationImage, "hdfs", role)
+		if out, err := exec.Command("docker", args...).CombinedOutput(); err != nil {
+			t.Fatalf("failed to start %s: %s\n%s", role, err, out)
+		}
+		t.Cleanup(func() { exec.Command("docker", "rm", "-f", name).Run() })
+	}
+
+	client, err := hdfs.NewClient(hdfs.ClientOptions{Addresses: []string{integrationNamenode}, User: "fastcopy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	deadline := time.Now().Add(2 * time.Minute)
+	for {
+		// the namenode leaves safe mode and the datanode registers before a write succeeds
+		err := client.MkdirAll("/it", 0777)
+		if err == nil {
+			err = client.CreateEmptyFile("/it/.ready")
+		}
+		if err == nil || os.IsExist(err) {
+			return client
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("hdfs did not become writable: %s", err)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func buildFastcopy(t *testing.T) string {
+	binary := filepath.Join(t.TempDir(), "fastcopy")
+	if out, err := exec.Command("go", "build", "-o", binary, ".").CombinedOutput(); err != nil {
+		t.Fatalf("failed to build fastcopy: %s\n%s", err, out)
+	}
+	return binary
+}
+
+// runs a fastcopy process against the test hdfs without kerberos and waits until it's ready
+func startFastcopy(t *testing.T, binary string, addr string) {
+	cmd := exec.Command(binary)
+	cmd.Env = append(os.Environ(), "FASTCOPY_ADDR="+addr, "HDFS_NAMENODE="+integrationNamenode, "HADOOP_USER_NAME=fastcopy", "KRB_ENABLED=false")
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cmd.Process.Kill(); cmd.Wait() })
+
+	readyURL := "http://localhost" + addr + "/ready"
+	for i := 0; i < 60; i++ {
+		if resp, err := http.Get(readyURL); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return
+			}
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	t.Fatalf("fastcopy on %s did not become ready", addr)
+}
+
+func writeFile(t *testing.T, client *hdfs.Client, name string, data []byte) {
+	client.MkdirAll(filepath.Dir(name), 0777)
+	client.Remove(name)
+	w, err := client.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// asks the source instance to copy to the target instance
+func copyDir(t *testing.T, q url.Values) (CopyResponse, int) {
+	if q.Get("targetURL") == "" {
+		q.Set("targetURL", targetURL+"/upload")
+	}
+	resp, err := http.Post(sourceURL+"/copy?"+q.Encode(), "application/octet-stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	var res CopyResponse
+	json.Unmarshal(body, &res)
+	return res, resp.StatusCode
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fastcopy works on IPv6 only and dual-stack networks: FASTCOPY_ADDR may be a bracketed IPv6 address like [::]:8080,
+// peers may be addressed as http://[2001:db8::1]:8080/upload and namenodes and datanodes by IPv6 literals. the
+// hdfs client formats the address of a datanode registered with an IPv6 address without brackets, they're added
+// before dialing. a host resolving to both families is dialed in the order of FASTCOPY_IP_PREFERENCE, ipv4 or
+// ipv6, falling back to the other; by default the resolver's order is kept
+
+const (
+	PreferIPv4 = "ipv4"
+	PreferIPv6 = "ipv6"
+)
+
+var (
+	ipPreference     string
+	ipPreferenceOnce sync.Once
+)
+
+// parses FASTCOPY_IP_PREFERENCE, empty to keep the resolver's order
+func loadIPPreference() (string, error) {
+	v := strings.ToLower(os.Getenv("FASTCOPY_IP_PREFERENCE"))
+	if v != "" && v != PreferIPv4 && v != PreferIPv6 {
+		return "", fmt.Errorf("invalid FASTCOPY_IP_PREFERENCE '%s', expected ipv4 or ipv6", v)
+	}
+	return v, nil
+}
+
+// lazy loads the address family dialed first
+func getIPPreference() string {
+	ipPreferenceOnce.Do(func() {
+		v, err := loadIPPreference()
+		if err != nil {
+			log.Fatal(err)
+		}
+		ipPreference = v
+	})
+	return ipPreference
+}
+
+// brackets the IPv6 host of addr if it lacks them, 2001:db8::5:9866 is [2001:db8::5]:9866
+func normalizeHostPort(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	i := strings.LastIndex(addr, ":")
+	if i < 0 || net.ParseIP(addr[:i]) == nil {
+		return addr
+	}
+	return net.JoinHostPort(addr[:i], addr[i+1:])
+}
+
+// orders ips with the preferred family first, keeping the order within each family
+func preferFamily(ips []net.IPAddr, preference string) []net.IPAddr {
+	sorted := append([]net.IPAddr(nil), ips...)
+	if preference == "" {
+		return sorted
+	}
+	rank := func(ip net.IPAddr) int {
+		if (ip.IP.To4() != nil) == (preference == PreferIPv4) {
+			return 0
+		}
+		return 1
+	}
+	sort.SliceStable(sorted, func(i, j int) bool { return rank(sorted[i]) < rank(sorted[j]) })
+	return sorted
+}
+
+// dials addr with dialer, trying the addresses of a host name in the order of FASTCOPY_IP_PREFERENCE
+func dialPreferring(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	addr = normalizeHostPort(addr)
+	preference := getIPPreference()
+	host, port, err := net.SplitHostPort(addr)
+	if preference == "" || err != nil || net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, ip := range preferFamily(ips, preference) {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, fmt.Errorf("dialing %s: %w", addr, errors.Join(errs...))
+}
+
+// the transport of the requests to peers, dialing in the order of FASTCOPY_IP_PREFERENCE
+func peerTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialPreferring(ctx, dialer, network, addr)
+	}
+	return t
+}
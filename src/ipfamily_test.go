@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func useIPPreference(t *testing.T, preference string) {
+	ipPreferenceOnce.Do(func() {})
+	prev := ipPreference
+	ipPreference = preference
+	t.Cleanup(func() { ipPreference = prev })
+}
+
+func TestNormalizeHostPort(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"2001:db8::5:9866":     "[2001:db8::5]:9866",
+		"[2001:db8::5]:9866":   "[2001:db8::5]:9866",
+		"10.1.0.5:9866":        "10.1.0.5:9866",
+		"dn1.example.com:9866": "dn1.example.com:9866",
+	} {
+		if got := normalizeHostPort(addr); got != expected {
+			t.Errorf("%s: expected %s, got %s", addr, expected, got)
+		}
+	}
+	ips := []net.IPAddr{{IP: net.ParseIP("2001:db8::1")}, {IP: net.ParseIP("10.0.0.1")}, {IP: net.ParseIP("2001:db8::2")}}
+	if sorted := preferFamily(ips, PreferIPv4); sorted[0].IP.String() != "10.0.0.1" || sorted[1].IP.String() != "2001:db8::1" {
+		t.Errorf("expected the IPv4 address first, got %v", sorted)
+	}
+	if sorted := preferFamily(ips, PreferIPv6); sorted[2].IP.String() != "10.0.0.1" {
+		t.Errorf("expected the IPv4 address last, got %v", sorted)
+	}
+	useTargetLimits(t, "[2001:db8::1]=1Gbps/4,[2001:db8::2]:8080=500Mbps")
+	for _, targetURL := range []string{"http://[2001:db8::1]:8080/upload", "http://[2001:db8::2]:8080/upload"} {
+		if targetLimitFor(targetURL) == nil {
+			t.Errorf("expected %s to be limited", targetURL)
+		}
+	}
+}
+
+func TestIPv6Peer(t *testing.T) {
+	useMemFS(t)
+	if _, err := listen("::1:0"); err == nil || !strings.Contains(err.Error(), "bracketed") {
+		t.Errorf("expected an unbracketed IPv6 address to be refused, got %v", err)
+	}
+	listeners, err := listen("[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %s", err)
+	}
+	srv := &http.Server{Handler: apiMux()}
+	go srv.Serve(listeners[0])
+	defer srv.Close()
+
+	targetURL := "http://" + listeners[0].Addr().String() + "/upload"
+	res, err := sendToUpload(strings.NewReader("hello"), targetURL, CopyArgs{File: "a.txt", To: "/dst", Size: 5}, CopyOptions{})
+	if err != nil || res.Written != 5 {
+		t.Errorf("expected the upload to an IPv6 peer to succeed, got %+v %v", res, err)
+	}
+}
+
+func TestDialPreferring(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	dialer := &net.Dialer{Timeout: time.Second}
+	for _, preference := range []string{PreferIPv4, PreferIPv6} {
+		useIPPreference(t, preference)
+		// localhost may resolve to ::1 too, which isn't listened on: the IPv4 address is dialed first or after it
+		conn, err := dialPreferring(context.Background(), dialer, "tcp", net.JoinHostPort("localhost", port))
+		if err != nil {
+			t.Errorf("%s: expected localhost to be dialed, got %v", preference, err)
+			continue
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Hadoop credential providers (`hadoop credential create`) keep secrets in a JCEKS keystore: each secret is
+// a javax.crypto.spec.SecretKeySpec holding the secret's bytes, serialized with java serialization and sealed
+// with PBEWithMD5AndTripleDES under the keystore password. This reads such keystores without a JVM.
+
+const (
+	jceksMagic         = 0xcececece
+	jceksPrivateKey    = 1
+	jceksTrustedCert   = 2
+	jceksSecretKey     = 3
+	jceksIntegritySalt = "Mighty Aphrodite"
+)
+
+// the default password of hadoop credential providers when HADOOP_CREDSTORE_PASSWORD isn't set
+const defaultCredstorePassword = "none"
+
+// returns the secret key entries of a JCEKS keystore by alias
+func readJCEKS(data []byte, password string) (map[string][]byte, error) {
+	if len(data) < 12+sha1.Size {
+		return nil, errors.New("not a JCEKS keystore, too short")
+	}
+	body, sum := data[:len(data)-sha1.Size], data[len(data)-sha1.Size:]
+	h := sha1.New()
+	for _, c := range password {
+		h.Write([]byte{byte(c >> 8), byte(c)})
+	}
+	h.Write([]byte(jceksIntegritySalt))
+	h.Write(body)
+	if !bytes.Equal(h.Sum(nil), sum) {
+		return nil, errors.New("JCEKS keystore integrity check failed, wrong password (HADOOP_CREDSTORE_PASSWORD) or corrupted keystore")
+	}
+
+	r := bytes.NewReader(body)
+	var header struct{ Magic, Version, Count uint32 }
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.Magic != jceksMagic || (header.Version != 1 && header.Version != 2) {
+		return nil, fmt.Errorf("not a JCEKS keystore (magic %x, version %d)", header.Magic, header.Version)
+	}
+	secrets := make(map[string][]byte)
+	for i := uint32(0); i < header.Count; i++ {
+		var tag uint32
+		if err := binary.Read(r, binary.BigEndian, &tag); err != nil {
+			return nil, err
+		}
+		alias, err := readJavaUTF(r)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := r.Seek(8, io.SeekCurrent); err != nil { // creation date
+			return nil, err
+		}
+		switch tag {
+		case jceksPrivateKey:
+			if _, err := readJCEKSBytes(r); err != nil {
+				return nil, err
+			}
+			var certs uint32
+			if err := binary.Read(r, binary.BigEndian, &certs); err != nil {
+				return nil, err
+			}
+			for j := uint32(0); j < certs; j++ {
+				if err := skipJCEKSCert(r, header.Version); err != nil {
+					return nil, err
+				}
+			}
+		case jceksTrustedCert:
+			if err := skipJCEKSCert(r, header.Version); err != nil {
+				return nil, err
+			}
+		case jceksSecretKey:
+			sealed, err := newJavaStream(r).readObject()
+			if err != nil {
+				return nil, fmt.Errorf("entry %s: %w", alias, err)
+			}
+			key, err := unsealJCEKSKey(sealed, password)
+			if err != nil {
+				return nil, fmt.Errorf("entry %s: %w", alias, err)
+			}
+			secrets[alias] = key
+		default:
+			return nil, fmt.Errorf("unknown JCEKS entry type %d", tag)
+		}
+	}
+	return secrets, nil
+}
+
+func readJCEKSBytes(r *bytes.Reader) ([]byte, error) {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	if int64(n) > int64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	return b, err
+}
+
+func skipJCEKSCert(r *bytes.Reader, version uint32) error {
+	if version == 2 {
+		if _, err := readJavaUTF(r); err != nil { // certificate type
+			return err
+		}
+	}
+	_, err := readJCEKSBytes(r)
+	return err
+}
+
+// decrypts a SealedObject holding a SecretKeySpec and returns the key's bytes
+func unsealJCEKSKey(v interface{}, password string) ([]byte, error) {
+	sealed, ok := v.(*javaObject)
+	if !ok {
+		return nil, errors.New("expected a sealed key object")
+	}
+	params, _ := sealed.fields["encodedParams"].([]byte)
+	content, _ := sealed.fields["encryptedContent"].([]byte)
+	if alg, _ := sealed.fields["sealAlg"].(string); !strings.EqualFold(alg, "PBEWithMD5AndTripleDES") {
+		return nil, fmt.Errorf("unsupported seal algorithm '%s'", alg)
+	}
+	var pbe struct {
+		Salt       []byte
+		Iterations int
+	}
+	if _, err := asn1.Unmarshal(params, &pbe); err != nil {
+		return nil, fmt.Errorf("invalid PBE parameters: %w", err)
+	}
+	plain, err := decryptPBEWithMD5AndTripleDES(content, password, pbe.Salt, pbe.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := newJavaStream(bytes.NewReader(plain)).readObject()
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := spec.(*javaObject)
+	if !ok {
+		return nil, errors.New("expected a SecretKeySpec")
+	}
+	key, ok := obj.fields["key"].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("expected a SecretKeySpec, got %s", obj.class.name)
+	}
+	return key, nil
+}
+
+// the SunJCE PBEWithMD5AndTripleDES cipher: each half of the salt is hashed with the password, iteration
+// times, giving the 3DES key and the CBC iv
+func decryptPBEWithMD5AndTripleDES(data []byte, password string, salt []byte, iterations int) ([]byte, error) {
+	if len(salt) != 8 {
+		return nil, fmt.Errorf("expected an 8 byte salt, got %d", len(salt))
+	}
+	if len(data) == 0 || len(data)%des.BlockSize != 0 {
+		return nil, errors.New("encrypted content isn't a whole number of blocks")
+	}
+	salt = append([]byte(nil), salt...)
+	if bytes.Equal(salt[:4], salt[4:]) {
+		salt[0], salt[3] = salt[3], salt[0]
+		salt[1], salt[2] = salt[2], salt[1]
+	}
+	passwd := make([]byte, 0, len(password))
+	for _, c := range password {
+		passwd = append(passwd, byte(c))
+	}
+	derived := make([]byte, 0, 32)
+	for i := 0; i < 2; i++ {
+		digest := salt[i*4 : i*4+4]
+		for j := 0; j < iterations; j++ {
+			h := md5.New()
+			h.Write(digest)
+			h.Write(passwd)
+			digest = h.Sum(nil)
+		}
+		derived = append(derived, digest...)
+	}
+	block, err := des.NewTripleDESCipher(derived[:24])
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, derived[24:]).CryptBlocks(plain, data)
+	pad := int(plain[len(plain)-1])
+	if pad < 1 || pad > des.BlockSize || !bytes.Equal(plain[len(plain)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, errors.New("decryption failed, wrong password")
+	}
+	return plain[:len(plain)-pad], nil
+}
+
+// a java.io.DataInput modified UTF-8 string
+func readJavaUTF(r io.Reader) (string, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// just enough of java object serialization to read sealed keys: objects, strings, arrays and references
+const (
+	javaStreamMagic   = 0xaced
+	javaStreamVersion = 5
+	javaBaseHandle    = 0x7e0000
+	tcNull            = 0x70
+	tcReference       = 0x71
+	tcClassDesc       = 0x72
+	tcObject          = 0x73
+	tcString          = 0x74
+	tcArray           = 0x75
+	tcBlockData       = 0x77
+	tcEndBlockData    = 0x78
+	tcBlockDataLong   = 0x7a
+	tcLongString      = 0x7c
+	scWriteMethod     = 0x01
+)
+
+type javaStream struct {
+	r       *bytes.Reader
+	handles []interface{}
+}
+
+type javaClass struct {
+	name   string
+	flags  byte
+	fields []javaField
+	super  *javaClass
+}
+
+type javaField struct {
+	typ  byte
+	name string
+}
+
+type javaObject struct {
+	class  *javaClass
+	fields map[string]interface{}
+}
+
+func newJavaStream(r *bytes.Reader) *javaStream {
+	return &javaStream{r: r}
+}
+
+// reads the stream header and the object following it
+func (s *javaStream) readObject() (interface{}, error) {
+	var header struct{ Magic, Version uint16 }
+	if err := binary.Read(s.r, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.Magic != javaStreamMagic || header.Version != javaStreamVersion {
+		return nil, errors.New("not a java serialization stream")
+	}
+	return s.readContent()
+}
+
+func (s *javaStream) newHandle(v interface{}) int {
+	s.handles = append(s.handles, v)
+	return len(s.handles) - 1
+}
+
+func (s *javaStream) readContent() (interface{}, error) {
+	tc, err := s.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch tc {
+	case tcNull:
+		return nil, nil
+	case tcReference:
+		var h uint32
+		if err := binary.Read(s.r, binary.BigEndian, &h); err != nil {
+			return nil, err
+		}
+		if h < javaBaseHandle || int(h-javaBaseHandle) >= len(s.handles) {
+			return nil, fmt.Errorf("invalid handle %x", h)
+		}
+		return s.handles[h-javaBaseHandle], nil
+	case tcString:
+		str, err := readJavaUTF(s.r)
+		if err != nil {
+			return nil, err
+		}
+		s.newHandle(str)
+		return str, nil
+	case tcLongString:
+		var n uint64
+		if err := binary.Read(s.r, binary.BigEndian, &n); err != nil {
+			return nil, err
+		}
+		if n > uint64(s.r.Len()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(s.r, b); err != nil {
+			return nil, err
+		}
+		s.newHandle(string(b))
+		return string(b), nil
+	case tcClassDesc:
+		return s.readClassDesc()
+	case tcObject:
+		return s.readOrdinaryObject()
+	case tcArray:
+		return s.readArray()
+	case tcBlockData, tcBlockDataLong:
+		return nil, s.skipBlockData(tc)
+	}
+	return nil, fmt.Errorf("unsupported java serialization type code %x", tc)
+}
+
+func (s *javaStream) readClassDesc() (*javaClass, error) {
+	name, err := readJavaUTF(s.r)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.r.Seek(8, io.SeekCurrent); err != nil { // serialVersionUID
+		return nil, err
+	}
+	class := &javaClass{name: name}
+	s.newHandle(class)
+	var n uint16
+	if class.flags, err = s.r.ReadByte(); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(s.r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	for i := 0; i < int(n); i++ {
+		var f javaField
+		if f.typ, err = s.r.ReadByte(); err != nil {
+			return nil, err
+		}
+		if f.name, err = readJavaUTF(s.r); err != nil {
+			return nil, err
+		}
+		if f.typ == '[' || f.typ == 'L' {
+			if _, err := s.readContent(); err != nil { // the field's class name
+				return nil, err
+			}
+		}
+		class.fields = append(class.fields, f)
+	}
+	if err := s.skipAnnotations(); err != nil {
+		return nil, err
+	}
+	super, err := s.readContent()
+	if err != nil {
+		return nil, err
+	}
+	if super != nil {
+		if class.super, _ = super.(*javaClass); class.super == nil {
+			return nil, errors.New("invalid superclass descriptor")
+		}
+	}
+	return class, nil
+}
+
+func (s *javaStream) readClass() (*javaClass, error) {
+	v, err := s.readContent()
+	if err != nil {
+		return nil, err
+	}
+	class, ok := v.(*javaClass)
+	if !ok {
+		return nil, errors.New("expected a class descriptor")
+	}
+	return class, nil
+}
+
+func (s *javaStream) readOrdinaryObject() (*javaObject, error) {
+	class, err := s.readClass()
+	if err != nil {
+		return nil, err
+	}
+	obj := &javaObject{class: class, fields: make(map[string]interface{})}
+	s.newHandle(obj)
+	var hierarchy []*javaClass
+	for c := class; c != nil; c = c.super {
+		hierarchy = append([]*javaClass{c}, hierarchy...)
+	}
+	for _, c := range hierarchy {
+		for _, f := range c.fields {
+			v, err := s.readValue(f.typ)
+			if err != nil {
+				return nil, err
+			}
+			obj.fields[f.name] = v
+		}
+		if c.flags&scWriteMethod != 0 {
+			if err := s.skipAnnotations(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return obj, nil
+}
+
+var javaPrimitiveSizes = map[byte]int{'B': 1, 'Z': 1, 'C': 2, 'S': 2, 'I': 4, 'F': 4, 'J': 8, 'D': 8}
+
+// reads a field or array element of the given type code. primitives other than bytes are skipped
+func (s *javaStream) readValue(typ byte) (interface{}, error) {
+	if typ == '[' || typ == 'L' {
+		return s.readContent()
+	}
+	size, ok := javaPrimitiveSizes[typ]
+	if !ok {
+		return nil, fmt.Errorf("invalid field type %c", typ)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(s.r, b); err != nil {
+		return nil, err
+	}
+	if typ == 'B' {
+		return b[0], nil
+	}
+	return nil, nil
+}
+
+func (s *javaStream) readArray() (interface{}, error) {
+	class, err := s.readClass()
+	if err != nil {
+		return nil, err
+	}
+	if len(class.name) < 2 || class.name[0] != '[' {
+		return nil, fmt.Errorf("invalid array class %s", class.name)
+	}
+	h := s.newHandle(nil)
+	var n uint32
+	if err := binary.Read(s.r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	elem := class.name[1]
+	if elem == 'B' {
+		if int64(n) > int64(s.r.Len()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(s.r, b); err != nil {
+			return nil, err
+		}
+		s.handles[h] = b
+		return b, nil
+	}
+	elems := make([]interface{}, 0)
+	for i := uint32(0); i < n; i++ {
+		v, err := s.readValue(elem)
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, v)
+	}
+	s.handles[h] = elems
+	return elems, nil
+}
+
+// skips the data a class's writeObject or annotateClass wrote, up to the end block marker
+func (s *javaStream) skipAnnotations() error {
+	for {
+		tc, err := s.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if tc == tcEndBlockData {
+			return nil
+		}
+		if err := s.r.UnreadByte(); err != nil {
+			return err
+		}
+		if _, err := s.readContent(); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *javaStream) skipBlockData(tc byte) error {
+	var n int64
+	if tc == tcBlockData {
+		b, err := s.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		n = int64(b)
+	} else {
+		var l uint32
+		if err := binary.Read(s.r, binary.BigEndian, &l); err != nil {
+			return err
+		}
+		n = int64(l)
+	}
+	_, err := s.r.Seek(n, io.SeekCurrent)
+	return err
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// orchestrators like airflow re-run a task whose worker died, submitting its copy again. a /copy given a
+// 'jobKey' is run once per key: submitting the key again while its job runs waits for that job and answers its
+// outcome, and once it succeeded answers the outcome right away, marked by the X-Fastcopy-Replayed header.
+// a key whose job failed is free again, the retry runs a new job. the key must be submitted with the same
+// params and body each time, another copy under a used key is refused with 409. keys are kept as long as
+// finished jobs are
+
+const replayedHeader = "X-Fastcopy-Replayed"
+
+// the params that don't change what a keyed copy does
+var jobKeyIgnoredParams = []string{"jobKey", "jobId", "heartbeat"}
+
+// a copy submitted under a job key
+type keyedCopy struct {
+	fingerprint string
+	jobID       string
+	done        chan struct{} // closed once the copy finished
+	resp        CopyResponse
+	status      int
+	err         error
+}
+
+func (k *keyedCopy) complete(resp CopyResponse, status int, err error) {
+	k.resp, k.status, k.err = resp, status, err
+	close(k.done)
+}
+
+// waits for the copy and returns its outcome
+func (k *keyedCopy) wait() (CopyResponse, int, error) {
+	<-k.done
+	return k.resp, k.status, k.err
+}
+
+func (k *keyedCopy) failed() bool {
+	select {
+	case <-k.done:
+		return k.err != nil || k.resp.State != StateSucceeded
+	default:
+		return false
+	}
+}
+
+var (
+	jobKeys      = make(map[string]*keyedCopy)
+	jobKeysOrder []string
+	jobKeysMu    sync.Mutex
+)
+
+// what a copy does, its params and body, as a hash. the body is read and put back
+func copyFingerprint(r *http.Request) (string, error) {
+	q := r.URL.Query()
+	for _, p := range jobKeyIgnoredParams {
+		q.Del(p)
+	}
+	h := sha256.New()
+	io.WriteString(h, q.Encode())
+	if r.Body != nil && r.Body != http.NoBody {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxCopyRequestBytes+1))
+		r.Body.Close()
+		if err != nil {
+			return "", fmt.Errorf("cannot read the copy request body: %w", err)
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		h.Write([]byte{0})
+		h.Write(body)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// the copy submitted under r's 'jobKey', and whether r is a new submission to run. a new one is given the job
+// id r asks for, or a random one, which is set on r
+func claimJobKey(r *http.Request) (*keyedCopy, bool, int, error) {
+	q := r.URL.Query()
+	key := q.Get("jobKey")
+	if len(key) > 256 || !validHeaderValue(key) {
+		return nil, false, http.StatusBadRequest, fmt.Errorf("'jobKey' must be at most 256 characters without control characters")
+	}
+	fingerprint, err := copyFingerprint(r)
+	if err != nil {
+		return nil, false, http.StatusBadRequest, err
+	}
+	jobKeysMu.Lock()
+	defer jobKeysMu.Unlock()
+	if k, ok := jobKeys[key]; ok && !k.failed() {
+		if k.fingerprint != fingerprint {
+			return nil, false, http.StatusConflict, fmt.Errorf("job key %s was used for another copy, job %s", key, k.jobID)
+		}
+		q.Set("jobId", k.jobID)
+		r.URL.RawQuery = q.Encode()
+		return k, false, http.StatusOK, nil
+	}
+	if q.Get("jobId") == "" {
+		q.Set("jobId", newJobID())
+		r.URL.RawQuery = q.Encode()
+	}
+	k := &keyedCopy{fingerprint: fingerprint, jobID: q.Get("jobId"), done: make(chan struct{})}
+	if _, ok := jobKeys[key]; !ok {
+		jobKeysOrder = append(jobKeysOrder, key)
+	}
+	jobKeys[key] = k
+	pruneJobKeys()
+	return k, true, http.StatusOK, nil
+}
+
+// drops the keys of the oldest finished copies beyond maxFinishedJobs. jobKeysMu must be held
+func pruneJobKeys() {
+	excess := len(jobKeysOrder) - maxFinishedJobs
+	kept := jobKeysOrder[:0]
+	for _, key := range jobKeysOrder {
+		if excess > 0 {
+			select {
+			case <-jobKeys[key].done:
+				delete(jobKeys, key)
+				excess--
+				continue
+			default:
+			}
+		}
+		kept = append(kept, key)
+	}
+	jobKeysOrder = kept
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCopyWithJobKey(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{"/src/a.txt": "hello"})
+	peer := httptest.NewServer(apiMux())
+	defer peer.Close()
+
+	copy := func(query url.Values) (*httptest.ResponseRecorder, CopyResponse) {
+		rec := httptest.NewRecorder()
+		handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+		var resp CopyResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec, resp
+	}
+	query := url.Values{"from": {"/src"}, "to": {"/dst"}, "targetURL": {peer.URL + "/upload"}, "jobKey": {"dag=replicate/task=copy/2024-06-01"}}
+	rec, first := copy(query)
+	if rec.Code != http.StatusOK || first.FilesCopied != 1 || rec.Header().Get(replayedHeader) != "" {
+		t.Fatalf("expected the first submission to copy, got %d %s", rec.Code, rec.Body)
+	}
+	fs.put(map[string]string{"/src/b.txt": "world"})
+	rec, again := copy(query)
+	if rec.Code != http.StatusOK || again.JobID != first.JobID || again.FilesCopied != 1 || rec.Header().Get(replayedHeader) != "true" {
+		t.Errorf("expected the resubmission to answer the first job, got %d %s", rec.Code, rec.Body)
+	}
+	if _, ok := fs.get("/dst/b.txt"); ok {
+		t.Error("expected the resubmission not to copy again")
+	}
+
+	query.Set("to", "/other")
+	if rec, _ := copy(query); rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), first.JobID) {
+		t.Errorf("expected another copy under the key to be refused, got %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestFailedJobKeyIsFreed(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{"/src/a.txt": "hello"})
+	query := url.Values{"from": {"/src"}, "to": {"/dst"}, "targetURL": {"http://127.0.0.1:1/upload"}, "jobKey": {"retried"}, "retries": {"0"}}
+	rec := httptest.NewRecorder()
+	handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+	if rec.Code == http.StatusOK {
+		t.Fatalf("expected the copy to an unreachable target to fail, got %s", rec.Body)
+	}
+	keyed, submitted, _, err := claimJobKey(httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+	if err != nil || !submitted {
+		t.Fatalf("expected the key of a failed job to be free, got %v", err)
+	}
+	keyed.complete(CopyResponse{State: StateSucceeded}, http.StatusOK, nil)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the states GET /jobs can filter on
+var jobStates = []string{StatePendingApproval, StateRunning, StateSucceeded, StateFailed, StateTargetUnavailable, StateRejected}
+
+// the orders GET /jobs can sort by with ?sort=, prefixed with - for descending. running jobs sort last by finishedAt
+var jobSorts = map[string]func(a, b *JobStatus) bool{
+	"startedAt": func(a, b *JobStatus) bool { return a.StartedAt.Before(b.StartedAt) },
+	"finishedAt": func(a, b *JobStatus) bool {
+		return a.FinishedAt != nil && (b.FinishedAt == nil || a.FinishedAt.Before(*b.FinishedAt))
+	},
+	"elapsedSecs":    func(a, b *JobStatus) bool { return a.ElapsedSecs < b.ElapsedSecs },
+	"bytesRead":      func(a, b *JobStatus) bool { return a.BytesRead < b.BytesRead },
+	"throughputMbps": func(a, b *JobStatus) bool { return a.AvgThroughput < b.AvgThroughput },
+}
+
+// the filters, order and page of a GET /jobs
+type jobQuery struct {
+	labels map[string]string
+	states map[string]bool
+	since  time.Time
+	until  time.Time
+	sort   string
+	desc   bool
+	limit  int // 0 = all
+	offset int
+}
+
+// parses ?label=k=v&state=failed,running&since=&until=&sort=-startedAt&limit=&offset=. since and until bound
+// the start time and take RFC3339 times or durations before now, e.g. since=24h
+func parseJobQuery(q url.Values, now time.Time) (jobQuery, error) {
+	var jq jobQuery
+	var err error
+	if jq.labels, err = parseLabels(q["label"]); err != nil {
+		return jq, err
+	}
+	for _, v := range q["state"] {
+		for _, state := range strings.Split(v, ",") {
+			if !contains(jobStates, state) {
+				return jq, fmt.Errorf("unknown state '%s', expected one of %s", state, strings.Join(jobStates, ", "))
+			}
+			if jq.states == nil {
+				jq.states = make(map[string]bool)
+			}
+			jq.states[state] = true
+		}
+	}
+	if jq.since, err = parseJobTime(q.Get("since"), now); err != nil {
+		return jq, fmt.Errorf("invalid since: %w", err)
+	}
+	if jq.until, err = parseJobTime(q.Get("until"), now); err != nil {
+		return jq, fmt.Errorf("invalid until: %w", err)
+	}
+	jq.sort, jq.desc = "startedAt", false
+	if s := q.Get("sort"); s != "" {
+		jq.sort, jq.desc = strings.TrimPrefix(s, "-"), strings.HasPrefix(s, "-")
+		if _, ok := jobSorts[jq.sort]; !ok {
+			return jq, fmt.Errorf("unknown sort '%s', expected startedAt, finishedAt, elapsedSecs, bytesRead or throughputMbps", s)
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if jq.limit, err = strconv.Atoi(v); err != nil || jq.limit < 1 {
+			return jq, fmt.Errorf("invalid limit '%s', expected a positive integer", v)
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if jq.offset, err = strconv.Atoi(v); err != nil || jq.offset < 0 {
+			return jq, fmt.Errorf("invalid offset '%s', expected a non-negative integer", v)
+		}
+	}
+	return jq, nil
+}
+
+func parseJobTime(v string, now time.Time) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("'%s' is neither an RFC3339 time nor a duration", v)
+	}
+	return t, nil
+}
+
+func contains(values []string, v string) bool {
+	for _, have := range values {
+		if have == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (jq jobQuery) matches(s *JobStatus) bool {
+	if jq.states != nil && !jq.states[s.State] {
+		return false
+	}
+	if !jq.since.IsZero() && s.StartedAt.Before(jq.since) {
+		return false
+	}
+	return jq.until.IsZero() || s.StartedAt.Before(jq.until)
+}
+
+// filters, sorts and pages statuses. returns the page and how many jobs matched in total
+func (jq jobQuery) apply(statuses []JobStatus) ([]JobStatus, int) {
+	matching := statuses[:0]
+	for i := range statuses {
+		if jq.matches(&statuses[i]) {
+			matching = append(matching, statuses[i])
+		}
+	}
+	less := jobSorts[jq.sort]
+	sort.SliceStable(matching, func(a, b int) bool {
+		if jq.desc {
+			return less(&matching[b], &matching[a])
+		}
+		return less(&matching[a], &matching[b])
+	})
+	total := len(matching)
+	if jq.offset >= total {
+		return matching[:0], total
+	}
+	matching = matching[jq.offset:]
+	if jq.limit > 0 && jq.limit < len(matching) {
+		matching = matching[:jq.limit]
+	}
+	return matching, total
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseJobQuery(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	q := url.Values{"state": {"failed,running"}, "since": {"24h"}, "until": {"2024-03-01T11:00:00Z"}, "sort": {"-bytesRead"}, "limit": {"10"}, "offset": {"20"}}
+	jq, err := parseJobQuery(q, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !jq.states[StateFailed] || !jq.states[StateRunning] || jq.states[StateSucceeded] {
+		t.Errorf("unexpected states %v", jq.states)
+	}
+	if !jq.since.Equal(now.Add(-24*time.Hour)) || !jq.until.Equal(now.Add(-time.Hour)) {
+		t.Errorf("unexpected time range %s - %s", jq.since, jq.until)
+	}
+	if jq.sort != "bytesRead" || !jq.desc || jq.limit != 10 || jq.offset != 20 {
+		t.Errorf("unexpected query %+v", jq)
+	}
+
+	for _, bad := range []url.Values{
+		{"state": {"done"}},
+		{"since": {"yesterday"}},
+		{"sort": {"name"}},
+		{"limit": {"0"}},
+		{"offset": {"-1"}},
+		{"label": {"team"}},
+	} {
+		if _, err := parseJobQuery(bad, now); err == nil {
+			t.Errorf("expected %v to be rejected", bad)
+		}
+	}
+}
+
+func TestJobQueryApply(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	finished := start.Add(time.Hour)
+	statuses := func() []JobStatus {
+		return []JobStatus{
+			{ID: "a", State: StateSucceeded, StartedAt: start, FinishedAt: &finished, BytesRead: 30},
+			{ID: "b", State: StateFailed, StartedAt: start.Add(time.Minute), FinishedAt: &finished, BytesRead: 10},
+			{ID: "c", State: StateRunning, StartedAt: start.Add(2 * time.Minute), BytesRead: 20},
+			{ID: "d", State: StateSucceeded, StartedAt: start.Add(3 * time.Minute), FinishedAt: &start, BytesRead: 40},
+		}
+	}
+	ids := func(page []JobStatus) string {
+		s := ""
+		for _, status := range page {
+			s += status.ID
+		}
+		return s
+	}
+	cases := []struct {
+		query string
+		want  string
+		total int
+	}{
+		{"", "abcd", 4},
+		{"state=succeeded", "ad", 2},
+		{"state=running&state=failed", "bc", 2},
+		{"since=2024-03-01T00:01:00Z&until=2024-03-01T00:03:00Z", "bc", 2},
+		{"sort=-bytesRead", "dacb", 4},
+		{"sort=finishedAt", "dabc", 4},
+		{"limit=2", "ab", 4},
+		{"limit=2&offset=3", "d", 4},
+		{"offset=4", "", 4},
+		{"state=succeeded&sort=-startedAt&limit=1", "d", 2},
+	}
+	for _, c := range cases {
+		q, _ := url.ParseQuery(c.query)
+		jq, err := parseJobQuery(q, start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page, total := jq.apply(statuses())
+		if ids(page) != c.want || total != c.total {
+			t.Errorf("%s: expected %s of %d, got %s of %d", c.query, c.want, c.total, ids(page), total)
+		}
+	}
+}
+
+func TestListJobsPaged(t *testing.T) {
+	for _, id := range []string{"test-list-a", "test-list-b", "test-list-c"} {
+		job, err := startJob(id, "/src", "/dst", "http://peer/upload", map[string]string{"filter": "test-list"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id == "test-list-c" {
+			defer job.finish(CopyResponse{State: StateFailed})
+		} else {
+			job.finish(CopyResponse{State: StateSucceeded})
+		}
+	}
+	rec := httptest.NewRecorder()
+	handleJobs(rec, httptest.NewRequest("GET", "/jobs?label=filter=test-list&state=succeeded&sort=-startedAt&limit=1", nil))
+	var statuses []JobStatus
+	if err := json.NewDecoder(rec.Body).Decode(&statuses); err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || statuses[0].ID != "test-list-b" || rec.Header().Get("X-Total-Count") != "2" {
+		t.Errorf("expected the latest of 2 succeeded jobs, got %+v of %s", statuses, rec.Header().Get("X-Total-Count"))
+	}
+
+	rec = httptest.NewRecorder()
+	handleJobs(rec, httptest.NewRequest("GET", "/jobs?state=done", nil))
+	if rec.Code != 400 {
+		t.Errorf("expected an unknown state to be rejected, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a copy with lock=true holds advisory locks on its source dirs and on 'to' at each target for as long as it
+// runs, so two such jobs can't mirror the same destination, or work on the same source tree, at once: the later
+// one is refused with 409 naming the job holding the lock. a lock covers the dir and everything below it. the
+// locks are held by this server and only keep out jobs submitted to it, copies without lock=true ignore them.
+// GET /admin/locks lists them, DELETE /admin/locks/{jobId} force unlocks the locks of a job that is stuck
+
+const (
+	LockSource      = "source"
+	LockDestination = "destination"
+)
+
+// a path locked by a job
+type JobLock struct {
+	Kind     string    `json:"kind"`
+	Location string    `json:"location"` // the target's host for a destination, empty for this cluster
+	Path     string    `json:"path"`
+	JobID    string    `json:"jobId"`
+	Since    time.Time `json:"since"`
+}
+
+// whether l and other lock overlapping paths
+func (l *JobLock) overlaps(other *JobLock) bool {
+	if l.Kind != other.Kind || l.Location != other.Location {
+		return false
+	}
+	a, b := path.Clean(l.Path), path.Clean(other.Path)
+	return a == b || within(a, b) || within(b, a)
+}
+
+func (l *JobLock) String() string {
+	if l.Location == "" {
+		return fmt.Sprintf("%s %s", l.Kind, l.Path)
+	}
+	return fmt.Sprintf("%s %s on %s", l.Kind, l.Path, l.Location)
+}
+
+var (
+	jobLocks   []*JobLock
+	jobLocksMu sync.Mutex
+)
+
+// the locks a copy of sources into 'to' at targets takes
+func copyLocks(jobID string, sources []copySource, to string, targets []string) []*JobLock {
+	now := time.Now()
+	var locks []*JobLock
+	for _, src := range sources {
+		locks = append(locks, &JobLock{Kind: LockSource, Path: src.from, JobID: jobID, Since: now})
+	}
+	for _, target := range targets {
+		host := target
+		if u, err := url.Parse(target); err == nil {
+			host = u.Host
+		}
+		locks = append(locks, &JobLock{Kind: LockDestination, Location: host, Path: to, JobID: jobID, Since: now})
+	}
+	return locks
+}
+
+// takes all of locks or none, failing if another job holds an overlapping one. the returned func releases them
+func acquireJobLocks(locks []*JobLock) (func(), error) {
+	jobLocksMu.Lock()
+	defer jobLocksMu.Unlock()
+	var conflicts []string
+	for _, l := range locks {
+		for _, held := range jobLocks {
+			if l.overlaps(held) {
+				conflicts = append(conflicts, fmt.Sprintf("%s is locked by job %s since %s", l, held.JobID, held.Since.Format(time.RFC3339)))
+			}
+		}
+	}
+	if len(conflicts) > 0 {
+		return nil, fmt.Errorf("%s, retry once it's done or force unlock it with DELETE /admin/locks/{jobId}", strings.Join(conflicts, "; "))
+	}
+	jobLocks = append(jobLocks, locks...)
+	return func() {
+		jobLocksMu.Lock()
+		defer jobLocksMu.Unlock()
+		jobLocks = removeLocks(jobLocks, func(held *JobLock) bool {
+			for _, l := range locks {
+				if held == l {
+					return true
+				}
+			}
+			return false
+		})
+	}, nil
+}
+
+func removeLocks(locks []*JobLock, remove func(*JobLock) bool) []*JobLock {
+	kept := locks[:0]
+	for _, l := range locks {
+		if !remove(l) {
+			kept = append(kept, l)
+		}
+	}
+	return kept
+}
+
+// the locks held by the job with id, or by every job if id is empty
+func heldLocks(id string) []JobLock {
+	jobLocksMu.Lock()
+	defer jobLocksMu.Unlock()
+	var held []JobLock
+	for _, l := range jobLocks {
+		if id == "" || l.JobID == id {
+			held = append(held, *l)
+		}
+	}
+	sort.SliceStable(held, func(i, j int) bool { return held[i].Since.Before(held[j].Since) })
+	return held
+}
+
+// releases the locks of the job with id, returning how many it held
+func forceUnlock(id string) int {
+	jobLocksMu.Lock()
+	defer jobLocksMu.Unlock()
+	n := len(jobLocks)
+	jobLocks = removeLocks(jobLocks, func(l *JobLock) bool { return l.JobID == id })
+	return n - len(jobLocks)
+}
+
+// GET /admin/locks lists the locks held by jobs, oldest first. DELETE /admin/locks/{jobId} releases a job's
+func handleLocks(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/locks"), "/")
+	if id == "" {
+		if r.Method != http.MethodGet {
+			writeError(w, "use GET, or DELETE on /admin/locks/{jobId}", http.StatusMethodNotAllowed)
+			return
+		}
+		list := heldLocks("")
+		if list == nil {
+			list = []JobLock{}
+		}
+		json, _ := json.MarshalIndent(list, "", "  ")
+		w.Write(json)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		writeError(w, "use DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+	n := forceUnlock(id)
+	if n == 0 {
+		writeError(w, fmt.Sprintf("job %s holds no locks", id), http.StatusNotFound)
+		return
+	}
+	log.Printf("Force unlocked the %d locks of job %s", n, id)
+	if job := getJob(id); job != nil {
+		job.logf("its %d locks were force unlocked", n)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
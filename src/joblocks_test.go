@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestJobLocks(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{"/data/events/a": "aaaa"})
+	release, err := acquireJobLocks(copyLocks("nightly-1", []copySource{{from: "/data"}}, "/backup", []string{"http://dr:8080/upload"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	for _, c := range []struct {
+		from, to, target string
+		conflict         bool
+	}{
+		{"/data/events", "/other", "http://dr2:8080/upload", true},   // below the locked source
+		{"/logs", "/backup/2024", "http://dr:8080/upload", true},     // below the locked destination
+		{"/logs", "/backup", "http://dr2:8080/upload", false},        // the same dir on another target
+		{"/database", "/backup-old", "http://dr:8080/upload", false}, // a sibling named alike
+	} {
+		release, err := acquireJobLocks(copyLocks("other", []copySource{{from: c.from}}, c.to, []string{c.target}))
+		if (err != nil) != c.conflict {
+			t.Errorf("%+v: expected a conflict %v, got %v", c, c.conflict, err)
+		}
+		if err == nil {
+			release()
+		}
+	}
+
+	query := url.Values{"from": {"/data/events"}, "to": {"/restore"}, "targetURL": {"http://peer:8080/upload"}, "lock": {"true"}}
+	rec := httptest.NewRecorder()
+	handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "locked by job nightly-1") {
+		t.Errorf("expected the copy to be refused, got %d %s", rec.Code, rec.Body)
+	}
+
+	server := httptest.NewServer(apiMux())
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/admin/locks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var locks []JobLock
+	json.NewDecoder(resp.Body).Decode(&locks)
+	resp.Body.Close()
+	if len(locks) != 2 || locks[1].Kind != LockDestination || locks[1].Location != "dr:8080" {
+		t.Errorf("expected the source and destination locks of nightly-1, got %+v", locks)
+	}
+	req, _ := http.NewRequest(http.MethodDelete, server.URL+"/admin/locks/nightly-1", nil)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected the locks to be released, got %v %v", resp, err)
+	}
+	if held := heldLocks(""); len(held) != 0 {
+		t.Errorf("expected no locks after force unlocking, got %+v", held)
+	}
+	if resp, _ := http.DefaultClient.Do(req); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected a job without locks to be answered 404, got %d", resp.StatusCode)
+	}
+}
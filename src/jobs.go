@@ -0,0 +1,549 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// a /copy that is still transferring
+	StateRunning = "running"
+
+	// throughput is averaged over this trailing window, and a running job that moved no bytes in it is stalled
+	rateWindow = 30 * time.Second
+	// finished jobs kept for GET /jobs, oldest are dropped first
+	maxFinishedJobs = 1000
+	// how often a job's throughput is recorded for its time series, a day of samples is kept
+	seriesInterval   = 10 * time.Second
+	maxSeriesSamples = 8640
+	// log lines kept per job for GET /jobs/{id}/logs, older lines are dropped first. longer lines are truncated
+	maxJobLogLines   = 1000
+	maxJobLogLineLen = 2048
+)
+
+// a point of a job's cumulative progress
+type rateSample struct {
+	at    time.Time
+	bytes int64
+}
+
+// the throughput of a job over one seriesInterval
+type ThroughputSample struct {
+	At          time.Time `json:"at"`
+	BytesRead   int64     `json:"bytesRead"`
+	Throughput  float64   `json:"throughputMbps"`
+	ActiveFiles int       `json:"activeFiles"`
+}
+
+// a file being transferred
+type fileProgress struct {
+	size      int64
+	bytesRead int64
+	started   time.Time
+}
+
+// the live progress of a /copy, kept in memory for GET /jobs/{id}
+type Job struct {
+	mu           sync.Mutex
+	id           string
+	from         string
+	to           string
+	targetURL    string
+	labels       map[string]string
+	state        string
+	startedAt    time.Time
+	finishedAt   time.Time
+	filesPlanned int
+	bytesPlanned int64
+	filesDone    int
+	filesFailed  int
+	bytesRead    int64
+	lastProgress time.Time
+	active       map[string]*fileProgress
+	samples      []rateSample
+	series       []ThroughputSample
+	stop         chan struct{}
+	result       *CopyResponse
+	sla          JobSLA
+	alerts       []JobAlert
+	alerted      map[string]bool // alert kinds raised, see checkSLA
+	yarn         *YarnStatus     // set for copies run as a yarn service
+	approval     *JobApproval    // set for copies needing approval, see approval.go
+	kind         string          // empty for a copy, JobTypeVerify for a /verify
+	logMu        sync.Mutex
+	logs         []string // ring buffer of the last maxJobLogLines lines
+	logsNext     int
+	logsDropped  int
+	now          func() time.Time
+}
+
+type FileStatus struct {
+	Path       string  `json:"path"`
+	Size       int64   `json:"size"`
+	BytesRead  int64   `json:"bytesRead"`
+	Throughput float64 `json:"throughputMbps"`
+}
+
+type JobStatus struct {
+	ID            string             `json:"id"`
+	Type          string             `json:"type,omitempty"` // verify for a /verify job, see verifyjob.go
+	From          string             `json:"from"`
+	To            string             `json:"to"`
+	TargetURL     string             `json:"targetURL"`
+	Labels        map[string]string  `json:"labels,omitempty"`
+	State         string             `json:"state"`
+	StartedAt     time.Time          `json:"startedAt"`
+	FinishedAt    *time.Time         `json:"finishedAt,omitempty"`
+	FilesPlanned  int                `json:"filesPlanned"`
+	FilesDone     int                `json:"filesDone"`
+	FilesFailed   int                `json:"filesFailed"`
+	BytesPlanned  int64              `json:"bytesPlanned"`
+	BytesRead     int64              `json:"bytesRead"`
+	PercentDone   float64            `json:"percentDone"`
+	Throughput    float64            `json:"throughputMbps"`        // moving average over the last 30s
+	AvgThroughput float64            `json:"averageThroughputMbps"` // since the job started
+	Series        []ThroughputSample `json:"throughputSeries,omitempty"`
+	ETASecs       *float64           `json:"etaSecs,omitempty"`
+	EstimatedEnd  *time.Time         `json:"estimatedCompletion,omitempty"`
+	Stalled       bool               `json:"stalled,omitempty"`
+	Alerts        []JobAlert         `json:"alerts,omitempty"`
+	SLABreached   bool               `json:"slaBreached,omitempty"`
+	Yarn          *YarnStatus        `json:"yarn,omitempty"`
+	ActiveFiles   []FileStatus       `json:"activeFiles,omitempty"`
+	Result        *CopyResponse      `json:"result,omitempty"`
+	Locks         []JobLock          `json:"locks,omitempty"` // the advisory locks the job holds, see joblocks.go
+	Approval      *JobApproval       `json:"approval,omitempty"`
+	ElapsedSecs   float64            `json:"elapsedSecs"`
+}
+
+var (
+	jobs      = make(map[string]*Job)
+	jobsOrder []string
+	jobsMu    sync.Mutex
+)
+
+func newJobID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// parses job labels given as key=value, e.g. label=team=analytics&label=dataset=clicks
+func parseLabels(values []string) (map[string]string, error) {
+	labels := make(map[string]string, len(values))
+	for _, v := range values {
+		key, value, ok := strings.Cut(v, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("malformed label '%s', expected key=value", v)
+		}
+		if !validHeaderValue(v) {
+			return nil, fmt.Errorf("label '%s' can't contain control characters, labels are sent to the target in headers", v)
+		}
+		labels[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return labels, nil
+}
+
+// renders labels as sorted key=value pairs for log lines
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// whether the job has every label in 'filter'
+func (j *Job) matches(filter map[string]string) bool {
+	for k, v := range filter {
+		if have, ok := j.labels[k]; !ok || have != v {
+			return false
+		}
+	}
+	return true
+}
+
+// registers a job planning to copy 'tasks'. 'id' may be chosen by the caller to poll the job while /copy runs,
+// a random one is generated if it's empty
+func startJob(id string, from string, to string, targetURL string, labels map[string]string, tasks []CopyArgs) (*Job, error) {
+	if id == "" {
+		id = newJobID()
+	}
+	job := &Job{id: id, from: from, to: to, targetURL: targetURL, labels: labels, state: StateRunning, active: make(map[string]*fileProgress), alerted: make(map[string]bool), stop: make(chan struct{}), now: time.Now}
+	job.startedAt = job.now()
+	job.filesPlanned = len(tasks)
+	for _, t := range tasks {
+		job.bytesPlanned += t.Size
+	}
+	job.samples = []rateSample{{job.startedAt, 0}}
+	job.lastProgress = job.startedAt
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	if existing, ok := jobs[id]; ok && existing.running() {
+		return nil, fmt.Errorf("job %s is already running", id)
+	}
+	if _, ok := jobs[id]; !ok {
+		jobsOrder = append(jobsOrder, id)
+	}
+	jobs[id] = job
+	pruneJobs()
+	go job.recordSeries(seriesInterval)
+	job.logf("started: copying %d files (%d bytes) from %s to %s on %s, labels [%s]", job.filesPlanned, job.bytesPlanned, from, to, targetURL, formatLabels(labels))
+	return job, nil
+}
+
+// sets the expectations the watchdog holds the job to
+func (j *Job) setSLA(sla JobSLA) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.sla = sla
+}
+
+// samples the job's throughput and checks its SLA every interval until it finishes
+func (j *Job) recordSeries(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			j.sample()
+			j.checkSLA()
+		case <-j.stop:
+			return
+		}
+	}
+}
+
+// appends the throughput since the previous sample to the job's time series
+func (j *Job) sample() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := j.now()
+	prev := ThroughputSample{At: j.startedAt}
+	if len(j.series) > 0 {
+		prev = j.series[len(j.series)-1]
+	}
+	if !now.After(prev.At) {
+		return
+	}
+	j.series = append(j.series, ThroughputSample{now, j.bytesRead, mbps(j.bytesRead-prev.BytesRead, now.Sub(prev.At).Seconds()), len(j.active)})
+	if len(j.series) > maxSeriesSamples {
+		j.series = j.series[1:]
+	}
+}
+
+// drops the oldest finished jobs beyond maxFinishedJobs. jobsMu must be held
+func pruneJobs() {
+	finished := 0
+	for _, id := range jobsOrder {
+		if !jobs[id].running() {
+			finished++
+		}
+	}
+	kept := jobsOrder[:0]
+	for _, id := range jobsOrder {
+		if finished > maxFinishedJobs && !jobs[id].running() {
+			delete(jobs, id)
+			finished--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	jobsOrder = kept
+}
+
+func getJob(id string) *Job {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	return jobs[id]
+}
+
+func (j *Job) running() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.state == StateRunning || j.state == StatePendingApproval
+}
+
+// logs a line to the server log and captures it in the job's log. j may be nil
+func (j *Job) logf(format string, v ...interface{}) {
+	if j == nil {
+		log.Printf(format, v...)
+		return
+	}
+	line := fmt.Sprintf(format, v...)
+	log.Printf("job %s: %s", j.id, line)
+	if len(line) > maxJobLogLineLen {
+		line = line[:maxJobLogLineLen] + "..."
+	}
+	line = time.Now().UTC().Format(time.RFC3339Nano) + " " + line
+
+	j.logMu.Lock()
+	defer j.logMu.Unlock()
+	if len(j.logs) < maxJobLogLines {
+		j.logs = append(j.logs, line)
+		return
+	}
+	j.logs[j.logsNext] = line
+	j.logsNext = (j.logsNext + 1) % maxJobLogLines
+	j.logsDropped++
+}
+
+// the captured log lines, oldest first, and how many older lines were dropped
+func (j *Job) capturedLogs() ([]string, int) {
+	j.logMu.Lock()
+	defer j.logMu.Unlock()
+	lines := make([]string, 0, len(j.logs))
+	lines = append(lines, j.logs[j.logsNext:]...)
+	lines = append(lines, j.logs[:j.logsNext]...)
+	return lines, j.logsDropped
+}
+
+// records n more bytes read of the file at 'path'. j may be nil
+func (j *Job) progress(args CopyArgs, n int) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := j.now()
+	f, ok := j.active[args.Path]
+	if !ok {
+		f = &fileProgress{size: args.Size, started: now}
+		j.active[args.Path] = f
+	}
+	f.bytesRead += int64(n)
+	j.bytesRead += int64(n)
+	j.lastProgress = now
+	// one sample per second is plenty for a 30s window
+	if last := j.samples[len(j.samples)-1]; now.Sub(last.at) >= time.Second {
+		j.samples = append(j.samples, rateSample{now, j.bytesRead})
+		for len(j.samples) > 2 && now.Sub(j.samples[1].at) > rateWindow {
+			j.samples = j.samples[1:]
+		}
+	}
+}
+
+// records the end of the transfer of a file. j may be nil
+func (j *Job) fileDone(args CopyArgs, err error) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.active, args.Path)
+	j.filesDone++
+	if err != nil && !errors.Is(err, errSourceChanged) {
+		j.filesFailed++
+	}
+}
+
+// takes n failed files back, they're sent again
+func (j *Job) retrying(n int) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.filesDone -= n
+	j.filesFailed -= n
+}
+
+// records the outcome of the job
+func (j *Job) finish(resp CopyResponse) {
+	close(j.stop)
+	j.sample()
+	j.checkSLA()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.state = resp.State
+	j.finishedAt = j.now()
+	j.active = make(map[string]*fileProgress)
+	j.result = &resp
+	if j.kind == "" {
+		outcomes.record(resp, j.finishedAt)
+	}
+	j.logf("%s after %.1fs, labels [%s]", j.state, j.finishedAt.Sub(j.startedAt).Seconds(), formatLabels(j.labels))
+}
+
+// wraps a source so bytes read from it count towards the job's progress. j may be nil
+func (j *Job) track(open sourceOpener) sourceOpener {
+	if j == nil {
+		return open
+	}
+	return func(args CopyArgs) (io.ReadCloser, error) {
+		r, err := open(args)
+		if err != nil {
+			return nil, err
+		}
+		return &progressReader{r, j, args}, nil
+	}
+}
+
+type progressReader struct {
+	io.ReadCloser
+	job  *Job
+	args CopyArgs
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.ReadCloser.Read(b)
+	if n > 0 {
+		p.job.progress(p.args, n)
+	}
+	return n, err
+}
+
+func mbps(bytes int64, secs float64) float64 {
+	if secs <= 0 {
+		return 0
+	}
+	return (float64(bytes) * 8 / secs) / 1000000 // conversion to mbps
+}
+
+// the job's progress, moving average throughput and estimated completion
+func (j *Job) status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := j.now()
+	end := now
+	if !j.finishedAt.IsZero() {
+		end = j.finishedAt
+	}
+	s := JobStatus{
+		ID:            j.id,
+		Type:          j.kind,
+		From:          j.from,
+		To:            j.to,
+		TargetURL:     j.targetURL,
+		Labels:        j.labels,
+		State:         j.state,
+		StartedAt:     j.startedAt,
+		FilesPlanned:  j.filesPlanned,
+		FilesDone:     j.filesDone,
+		FilesFailed:   j.filesFailed,
+		BytesPlanned:  j.bytesPlanned,
+		BytesRead:     j.bytesRead,
+		PercentDone:   100,
+		AvgThroughput: mbps(j.bytesRead, end.Sub(j.startedAt).Seconds()),
+		Series:        append([]ThroughputSample(nil), j.series...),
+		Result:        j.result,
+		Alerts:        append([]JobAlert(nil), j.alerts...),
+		SLABreached:   j.slaBreached(),
+		Yarn:          j.yarn,
+		ElapsedSecs:   end.Sub(j.startedAt).Seconds(),
+		Locks:         heldLocks(j.id),
+	}
+	if j.approval != nil {
+		approval := *j.approval
+		s.Approval = &approval
+	}
+	if j.bytesPlanned > 0 {
+		s.PercentDone = 100 * float64(j.bytesRead) / float64(j.bytesPlanned)
+	}
+	if !j.finishedAt.IsZero() {
+		s.FinishedAt = &j.finishedAt
+		return s
+	}
+
+	// the trailing window starts at the newest sample at least rateWindow old, or the job's start
+	base := j.samples[0]
+	for _, sample := range j.samples {
+		if now.Sub(sample.at) < rateWindow {
+			break
+		}
+		base = sample
+	}
+	windowSecs := now.Sub(base.at).Seconds()
+	s.Stalled = now.Sub(j.lastProgress) >= rateWindow
+	if !s.Stalled {
+		s.Throughput = mbps(j.bytesRead-base.bytes, windowSecs)
+	}
+	if s.Throughput > 0 {
+		remaining := j.bytesPlanned - j.bytesRead
+		if remaining < 0 {
+			remaining = 0
+		}
+		eta := float64(remaining) * 8 / (s.Throughput * 1000000)
+		estimated := now.Add(time.Duration(eta * float64(time.Second)))
+		s.ETASecs, s.EstimatedEnd = &eta, &estimated
+	}
+	for path, f := range j.active {
+		s.ActiveFiles = append(s.ActiveFiles, FileStatus{path, f.size, f.bytesRead, mbps(f.bytesRead, now.Sub(f.started).Seconds())})
+	}
+	sort.Slice(s.ActiveFiles, func(a, b int) bool { return s.ActiveFiles[a].Path < s.ActiveFiles[b].Path })
+	return s
+}
+
+// GET /jobs lists the running and recent /copy jobs, filtered to jobs with all given labels with
+// e.g. ?label=team=analytics, by state, start time, sorted and paged, see parseJobQuery. the number of
+// matching jobs is in the X-Total-Count header. GET /jobs/{id} returns the progress of one and
+// GET /jobs/{id}/throughput only its throughput time series. GET /jobs/{id}/logs returns the log lines
+// captured for the job as text
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	id, sub, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/"), "/")
+	if id == "" {
+		query, err := parseJobQuery(r.URL.Query(), time.Now())
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		jobsMu.Lock()
+		list := make([]*Job, 0, len(jobsOrder))
+		for _, id := range jobsOrder {
+			if jobs[id].matches(query.labels) {
+				list = append(list, jobs[id])
+			}
+		}
+		jobsMu.Unlock()
+		statuses := make([]JobStatus, 0, len(list))
+		for _, job := range list {
+			s := job.status()
+			s.ActiveFiles, s.Series, s.Result = nil, nil, nil // details are in /jobs/{id}
+			statuses = append(statuses, s)
+		}
+		page, total := query.apply(statuses)
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+		json, _ := json.Marshal(page)
+		w.Write(json)
+		return
+	}
+	job := getJob(id)
+	if job == nil {
+		writeError(w, fmt.Sprintf("job %s not found", id), http.StatusNotFound)
+		return
+	}
+	switch sub {
+	case "":
+		json, _ := json.MarshalIndent(job.status(), "", "  ")
+		w.Write(json)
+	case "throughput":
+		json, _ := json.Marshal(job.status().Series)
+		w.Write(json)
+	case "approve", "reject":
+		handleApproval(w, r, job, sub == "approve")
+	case "logs":
+		lines, dropped := job.capturedLogs()
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if dropped > 0 {
+			fmt.Fprintf(w, "... %d earlier lines dropped\n", dropped)
+		}
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJobProgress(t *testing.T) {
+	tasks := []CopyArgs{{Path: "/src/a", Size: 1000000}, {Path: "/src/b", Size: 3000000}}
+	job, err := startJob("test-progress", "/src", "/dst", "http://peer/upload", nil, tasks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := job.startedAt
+	job.now = func() time.Time { return now }
+
+	// 1MB per second for 10s
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Second)
+		job.progress(tasks[0], 100000)
+		job.progress(tasks[1], 100000)
+	}
+	job.fileDone(tasks[0], nil)
+	s := job.status()
+	if s.BytesRead != 2000000 || s.PercentDone != 50 || s.FilesDone != 1 {
+		t.Errorf("unexpected progress %+v", s)
+	}
+	if s.Throughput < 1.5 || s.Throughput > 1.7 || s.AvgThroughput != 1.6 {
+		t.Errorf("expected ~1.6 Mbps, got %f (average %f)", s.Throughput, s.AvgThroughput)
+	}
+	if s.ETASecs == nil || *s.ETASecs < 9 || *s.ETASecs > 11 {
+		t.Errorf("expected ~10s left, got %v", s.ETASecs)
+	}
+	if len(s.ActiveFiles) != 1 || s.ActiveFiles[0].Path != "/src/b" {
+		t.Errorf("expected /src/b to be the only active file, got %+v", s.ActiveFiles)
+	}
+
+	now = now.Add(time.Minute)
+	if s := job.status(); !s.Stalled || s.ETASecs != nil {
+		t.Errorf("expected a job without progress for a minute to be stalled, got %+v", s)
+	}
+
+	if _, err := startJob("test-progress", "/src", "/dst", "http://peer/upload", nil, tasks); err == nil {
+		t.Error("expected a running job id to be rejected")
+	}
+	job.finish(CopyResponse{State: StateSucceeded})
+
+	rec := httptest.NewRecorder()
+	handleJobs(rec, httptest.NewRequest("GET", "/jobs/test-progress", nil))
+	var status JobStatus
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.State != StateSucceeded || status.Result == nil || status.FinishedAt == nil {
+		t.Errorf("expected finished job with its result, got %+v", status)
+	}
+
+	rec = httptest.NewRecorder()
+	handleJobs(rec, httptest.NewRequest("GET", "/jobs/unknown", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown job, got %d", rec.Code)
+	}
+}
+
+func TestJobThroughputSeries(t *testing.T) {
+	tasks := []CopyArgs{{Path: "/src/a", Size: 10000000}}
+	job, err := startJob("test-series", "/src", "/dst", "http://peer/upload", nil, tasks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := job.startedAt
+	job.now = func() time.Time { return now }
+
+	// 100KB/s for 10s, then nothing for 10s, then 200KB/s for 10s
+	for _, perSecond := range []int{100000, 0, 200000} {
+		for i := 0; i < 10; i++ {
+			now = now.Add(time.Second)
+			job.progress(tasks[0], perSecond)
+		}
+		job.sample()
+	}
+	job.finish(CopyResponse{State: StateFailed})
+
+	rec := httptest.NewRecorder()
+	handleJobs(rec, httptest.NewRequest("GET", "/jobs/test-series/throughput", nil))
+	var series []ThroughputSample
+	if err := json.NewDecoder(rec.Body).Decode(&series); err != nil {
+		t.Fatal(err)
+	}
+	expected := []float64{0.8, 0, 1.6}
+	if len(series) != len(expected) {
+		t.Fatalf("expected %d samples, got %+v", len(expected), series)
+	}
+	for i, mbps := range expected {
+		if series[i].Throughput != mbps {
+			t.Errorf("sample %d: expected %f Mbps, got %f", i, mbps, series[i].Throughput)
+		}
+	}
+}
+
+func TestJobLabels(t *testing.T) {
+	labels, err := parseLabels([]string{"team=analytics", "run=2024-03-01=nightly"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if labels["run"] != "2024-03-01=nightly" {
+		t.Errorf("expected label values to keep '=', got %v", labels)
+	}
+	if _, err := parseLabels([]string{"analytics"}); err == nil {
+		t.Error("expected a label without '=' to be rejected")
+	}
+
+	for id, team := range map[string]string{"test-labels-a": "analytics", "test-labels-b": "ingest"} {
+		job, err := startJob(id, "/src", "/dst", "http://peer/upload", map[string]string{"team": team, "filter": "test-labels"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		job.finish(CopyResponse{State: StateSucceeded})
+	}
+	rec := httptest.NewRecorder()
+	handleJobs(rec, httptest.NewRequest("GET", "/jobs?label=filter=test-labels&label=team=analytics", nil))
+	var statuses []JobStatus
+	if err := json.NewDecoder(rec.Body).Decode(&statuses); err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || statuses[0].ID != "test-labels-a" || statuses[0].Labels["team"] != "analytics" {
+		t.Errorf("expected only the analytics job, got %+v", statuses)
+	}
+}
+
+func TestJobLogs(t *testing.T) {
+	job, err := startJob("test-logs", "/src", "/dst", "http://peer/upload", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxJobLogLines+5; i++ {
+		job.logf("line %d", i)
+	}
+	job.logf("%s", strings.Repeat("x", 3*maxJobLogLineLen))
+	job.finish(CopyResponse{State: StateFailed})
+
+	lines, dropped := job.capturedLogs()
+	if len(lines) != maxJobLogLines || dropped != 8 {
+		t.Fatalf("expected the last %d lines with 8 dropped, got %d lines, %d dropped", maxJobLogLines, len(lines), dropped)
+	}
+	if !strings.HasSuffix(lines[0], " line 7") || !strings.HasSuffix(lines[len(lines)-1], "failed after 0.0s, labels []") {
+		t.Errorf("expected lines oldest first, got %q ... %q", lines[0], lines[len(lines)-1])
+	}
+	if long := lines[len(lines)-2]; len(long) > maxJobLogLineLen+64 {
+		t.Errorf("expected long lines to be truncated, got %d bytes", len(long))
+	}
+
+	rec := httptest.NewRecorder()
+	handleJobs(rec, httptest.NewRequest("GET", "/jobs/test-logs/logs", nil))
+	if body := rec.Body.String(); !strings.HasPrefix(body, "... 8 earlier lines dropped\n") {
+		t.Errorf("expected dropped lines to be noted, got %.80q", body)
+	}
+}
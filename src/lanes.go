@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/briansterle/cluster-fastcopy/pkg/fastcopy"
+)
+
+// small metadata files, e.g. schemas, _metadata and manifests, are often what consumers wait on, but in a large job
+// they queue behind hours of data files. files matching the 'priority' patterns, or no larger than 'prioritySize',
+// are copied by a lane of 'priorityWorkers' workers of their own
+
+// the rule for which files of a job go through the priority lane
+type PriorityRule struct {
+	Patterns []string // globs matched against the file name
+	MaxSize  int64    // files of at most this size, 0 = no size rule
+	Workers  int
+}
+
+func (p PriorityRule) enabled() bool {
+	return len(p.Patterns) > 0 || p.MaxSize > 0
+}
+
+// whether the file goes through the priority lane
+func (p PriorityRule) matches(args CopyArgs) bool {
+	if p.MaxSize > 0 && args.Size <= p.MaxSize {
+		return true
+	}
+	name := filepath.Base(args.File)
+	for _, pattern := range p.Patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parses the 'priority', 'prioritySize' and 'priorityWorkers' params
+func parsePriorityRule(q url.Values) (PriorityRule, error) {
+	rule := PriorityRule{Workers: fastcopy.DefaultPriorityWorkers}
+	if v := q.Get("priority"); v != "" {
+		for _, pattern := range strings.Split(v, ",") {
+			pattern = strings.TrimSpace(pattern)
+			if _, err := filepath.Match(pattern, ""); err != nil || pattern == "" {
+				return rule, fmt.Errorf("invalid 'priority' pattern '%s'", pattern)
+			}
+			rule.Patterns = append(rule.Patterns, pattern)
+		}
+	}
+	if v := q.Get("prioritySize"); v != "" {
+		size, err := parseByteSize(v)
+		if err != nil || size < 1 {
+			return rule, fmt.Errorf("'prioritySize' must be a size like 64K, got '%s'", v)
+		}
+		rule.MaxSize = size
+	}
+	if v := q.Get("priorityWorkers"); v != "" {
+		workers, err := strconv.Atoi(v)
+		if err != nil || workers < 1 {
+			return rule, fmt.Errorf("'priorityWorkers' must be a positive integer, got '%s'", v)
+		}
+		if !rule.enabled() {
+			return rule, fmt.Errorf("'priorityWorkers' requires 'priority' or 'prioritySize'")
+		}
+		rule.Workers = workers
+	}
+	return rule, nil
+}
+
+// the engine's classification of the tasks, nil without a priority rule
+func priorityLane(rule PriorityRule, byPath map[string]CopyArgs) func(fastcopy.File) bool {
+	if !rule.enabled() {
+		return nil
+	}
+	return func(file fastcopy.File) bool { return rule.matches(byPath[file.Path]) }
+}
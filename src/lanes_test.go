@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestPriorityRule(t *testing.T) {
+	rule, err := parsePriorityRule(url.Values{"priority": {"_SUCCESS, *.avsc,_metadata"}, "prioritySize": {"1K"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for args, want := range map[CopyArgs]bool{
+		{File: "_SUCCESS", Size: 0}:                        true,
+		{File: "dt=2024-06-01/schema.avsc", Size: 1 << 20}: true,
+		{File: "part-00000.parquet", Size: 1 << 30}:        false,
+		{File: "part-00001.parquet", Size: 512}:            true,
+		{File: "_metadata.bak", Size: 1 << 20}:             false,
+	} {
+		if got := rule.matches(args); got != want {
+			t.Errorf("%s (%d bytes): expected priority %v", args.File, args.Size, want)
+		}
+	}
+
+	for _, query := range []url.Values{
+		{"priority": {"[a-"}},
+		{"prioritySize": {"0"}},
+		{"priorityWorkers": {"4"}},
+		{"priority": {"_SUCCESS"}, "priorityWorkers": {"0"}},
+	} {
+		if _, err := parsePriorityRule(query); err == nil {
+			t.Errorf("expected %v to be rejected", query)
+		}
+	}
+	if rule, _ := parsePriorityRule(url.Values{}); rule.enabled() || priorityLane(rule, nil) != nil {
+		t.Error("expected no priority lane by default")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// the first socket systemd passes with socket activation, the ones after it follow sequentially
+var listenFdsStart = 3
+
+// listeners for the server: the sockets systemd passed (LISTEN_FDS), otherwise addr, which is a tcp address like
+// :8080 or a unix socket like unix:/run/fastcopy.sock. with FASTCOPY_REUSE_PORT=true a tcp address is shared with
+// another instance listening on it
+func listen(addr string) ([]net.Listener, error) {
+	if listeners, err := systemdListeners(); err != nil || len(listeners) > 0 {
+		return listeners, err
+	}
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		// a socket left behind by a previous run would fail the listen with address already in use
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil && strings.Count(addr, ":") > 1 {
+		return nil, fmt.Errorf("invalid address %s, an IPv6 address must be bracketed like [::1]:8080", addr)
+	}
+	var lc net.ListenConfig
+	if getDrainSettings().reusePort {
+		lc.Control = reusePort
+	}
+	l, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{l}, nil
+}
+
+// the sockets inherited from systemd socket activation, nil when not socket activated
+func systemdListeners() ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS '%s'", os.Getenv("LISTEN_FDS"))
+	}
+	// not meant for child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, n)
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("inherited fd %d is not a listening socket: %w", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
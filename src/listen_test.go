@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestListenUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fastcopy.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// leaves the socket file behind like a crashed process would
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listeners, err := listen("unix:" + path)
+	if err != nil {
+		t.Fatalf("expected a stale socket to be replaced: %s", err)
+	}
+	defer listeners[0].Close()
+	if len(listeners) != 1 || listeners[0].Addr().Network() != "unix" {
+		t.Fatalf("unexpected listeners %v", listeners)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestListenRefusesToReplaceFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fastcopy.sock")
+	os.WriteFile(path, []byte("not a socket"), 0644)
+	if _, err := listen("unix:" + path); err == nil {
+		t.Error("expected listening over a regular file to fail")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "not a socket" {
+		t.Error("expected the regular file to be left alone")
+	}
+}
+
+func TestSystemdListeners(t *testing.T) {
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	if listeners, err := systemdListeners(); err != nil || listeners != nil {
+		t.Errorf("expected sockets meant for another process to be ignored, got %v %v", listeners, err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a raw fd like systemd passes, which systemdListeners takes ownership of
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(start int) { listenFdsStart = start }(listenFdsStart)
+	listenFdsStart = fd
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	listeners, err := systemdListeners()
+	if err != nil || len(listeners) != 1 {
+		t.Fatalf("expected the inherited socket, got %v %v", listeners, err)
+	}
+	defer listeners[0].Close()
+	if listeners[0].Addr().String() != l.Addr().String() {
+		t.Errorf("expected %s, got %s", l.Addr(), listeners[0].Addr())
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("expected LISTEN_FDS to be cleared")
+	}
+}
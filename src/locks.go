@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// two uploads writing the same file at once, e.g. two jobs copying into the same dir, would truncate and append
+// to the same partial file and rename whatever mix of them results into place. an upload, or patch, locks the
+// file it writes, by its destination path, for as long as it's writing: a second one is refused with 409 and the
+// name of the upload holding the lock in X-Fastcopy-Locked-By, and its sender retries the file in a later round.
+// only the attempts of one job at the same file, which speculative attempts write into partial files of their
+// own, share its lock
+
+const lockedByHeader = "X-Fastcopy-Locked-By"
+
+// the file is being written by another upload
+var errPathLocked = errors.New("being written by another upload")
+
+type writeLock struct {
+	holder   string
+	jobID    string
+	since    time.Time
+	attempts map[int]bool // the attempts of the job writing the file
+}
+
+var (
+	writeLocks   = make(map[string]writeLock)
+	writeLocksMu sync.Mutex
+)
+
+// locks path, the destination of the file, for the attempt of the upload from origin, the returned func unlocks
+// it. fails with errPathLocked if another upload holds it, unless it's another attempt of the same named job
+func lockWrite(path string, origin *UploadOrigin, attempt int) (func(), error) {
+	writeLocksMu.Lock()
+	defer writeLocksMu.Unlock()
+	l, ok := writeLocks[path]
+	if ok && (l.jobID == "" || origin == nil || origin.JobID != l.jobID || l.attempts[attempt]) {
+		return nil, &pathLockedError{path, l}
+	}
+	if !ok {
+		l = writeLock{holder: lockHolder(origin), since: time.Now(), attempts: make(map[int]bool)}
+		if origin != nil {
+			l.jobID = origin.JobID
+		}
+		writeLocks[path] = l
+	}
+	l.attempts[attempt] = true
+	return func() {
+		writeLocksMu.Lock()
+		defer writeLocksMu.Unlock()
+		delete(l.attempts, attempt)
+		if len(l.attempts) == 0 {
+			delete(writeLocks, path)
+		}
+	}, nil
+}
+
+type pathLockedError struct {
+	path string
+	lock writeLock
+}
+
+func (e *pathLockedError) Error() string {
+	return fmt.Sprintf("%s is %s, %s for %s", e.path, errPathLocked, e.lock.holder, time.Since(e.lock.since).Round(time.Second))
+}
+
+func (e *pathLockedError) Unwrap() error {
+	return errPathLocked
+}
+
+// the holder of the lock an upload takes, its job if the sender names it
+func lockHolder(origin *UploadOrigin) string {
+	if origin != nil && origin.JobID != "" {
+		return "job " + origin.JobID
+	}
+	return "an upload of an unnamed job"
+}
+
+// answers an upload refused by lockWrite
+func writeLockedError(w http.ResponseWriter, err error) {
+	var locked *pathLockedError
+	if errors.As(err, &locked) {
+		w.Header().Set(lockedByHeader, locked.lock.holder)
+	}
+	writeError(w, err.Error(), http.StatusConflict)
+}
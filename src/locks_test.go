@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUploadWriteLock(t *testing.T) {
+	fs := useMemFS(t)
+	unlock, err := lockWrite("/dst/a.txt", &UploadOrigin{JobID: "nightly-1"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockWrite("/dst/a.txt", &UploadOrigin{JobID: "nightly-2"}, 0); !errors.Is(err, errPathLocked) {
+		t.Errorf("expected a second lock of the file to fail, got %v", err)
+	}
+	if _, err := lockWrite("/dst/a.txt", &UploadOrigin{JobID: "nightly-1"}, 0); !errors.Is(err, errPathLocked) {
+		t.Errorf("expected a second first attempt of the job to fail, got %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	handleUpload(rec, httptest.NewRequest("POST", "/upload?to=/dst&fileName=a.txt", strings.NewReader("hello")))
+	if rec.Code != http.StatusConflict || rec.Header().Get(lockedByHeader) != "job nightly-1" {
+		t.Errorf("expected an upload of the locked file to be refused, got %d %s", rec.Code, rec.Body)
+	}
+	if _, ok := fs.get("/dst/a.txt"); ok {
+		t.Error("expected nothing to be written")
+	}
+	rec = httptest.NewRecorder()
+	handleUpload(rec, httptest.NewRequest("POST", "/upload?to=/dst&fileName=a.txt&attempt=1", strings.NewReader("hello")))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("expected a speculative attempt of another job to be refused, got %d %s", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/upload?to=/dst&fileName=a.txt&attempt=1", strings.NewReader("hello"))
+	req.Header.Set(jobIDHeader, "nightly-1")
+	handleUpload(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected a speculative attempt of the job to write a partial file of its own, got %d %s", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	handlePatch(rec, httptest.NewRequest("POST", "/patch?to=/dst&fileName=a.txt&blockSize=4", strings.NewReader("")))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("expected a patch of the locked file to be refused, got %d %s", rec.Code, rec.Body)
+	}
+
+	peer := httptest.NewServer(apiMux())
+	defer peer.Close()
+	_, err = sendToUpload(strings.NewReader("hello"), peer.URL+"/upload", CopyArgs{File: "a.txt", To: "/dst", Size: 5}, CopyOptions{})
+	if !errors.Is(err, errPathLocked) || !retriable(err) || !strings.Contains(err.Error(), "job nightly-1 is writing it") {
+		t.Errorf("expected the upload to fail retriably naming the lock's holder, got %v", err)
+	}
+
+	unlock()
+	if _, err := sendToUpload(strings.NewReader("hello"), peer.URL+"/upload", CopyArgs{File: "a.txt", To: "/dst", Size: 5}, CopyOptions{}); err != nil {
+		t.Errorf("expected the upload to succeed once the file is unlocked, got %v", err)
+	}
+}
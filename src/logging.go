@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/syslog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLogMaxSize    = 100 << 20
+	defaultLogMaxBackups = 7
+	logBackupTimeFormat  = "20060102T150405.000000000"
+)
+
+// a log file that is rotated once it reaches maxSize bytes or is older than maxAge.
+// rotated files are renamed to <path>.<timestamp> and only the newest maxBackups are kept
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxAge     time.Duration // 0 = rotate by size only
+	maxBackups int
+	file       *os.File
+	size       int64
+	openedAt   time.Time
+	now        func() time.Time
+}
+
+func newRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups, now: time.Now}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// opens or appends to the log file
+func (r *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file, r.size, r.openedAt = file, info.Size(), info.ModTime()
+	if r.size == 0 {
+		r.openedAt = r.now()
+	}
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size > 0 && (r.size+int64(len(p)) > r.maxSize || (r.maxAge > 0 && r.now().Sub(r.openedAt) >= r.maxAge)) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// moves the current file aside, starts a new one and removes the oldest backups
+func (r *rotatingFile) rotate() error {
+	r.file.Close()
+	backup := r.path + "." + r.now().UTC().Format(logBackupTimeFormat)
+	if err := os.Rename(r.path, backup); err != nil {
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	backups, _ := filepath.Glob(r.path + ".*")
+	sort.Strings(backups) // timestamps sort chronologically
+	for len(backups) > r.maxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// log sinks in addition to stderr
+type logSettings struct {
+	file       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	syslog     string
+}
+
+// loads the log sinks from env. FASTCOPY_LOG_FILE adds a rotating file, rotated at FASTCOPY_LOG_MAX_SIZE (default 100M)
+// or FASTCOPY_LOG_MAX_AGE (e.g. 24h) keeping FASTCOPY_LOG_MAX_BACKUPS (default 7) old files.
+// FASTCOPY_LOG_SYSLOG=true adds the local syslog (and so journald), or a remote one given as e.g. udp://loghost:514
+func loadLogSettings() (logSettings, error) {
+	s := logSettings{file: os.Getenv("FASTCOPY_LOG_FILE"), maxSize: defaultLogMaxSize, maxBackups: defaultLogMaxBackups, syslog: os.Getenv("FASTCOPY_LOG_SYSLOG")}
+	if v := os.Getenv("FASTCOPY_LOG_MAX_SIZE"); v != "" {
+		n, err := parseByteSize(v)
+		if err != nil || n == 0 {
+			return s, fmt.Errorf("invalid FASTCOPY_LOG_MAX_SIZE '%s'", v)
+		}
+		s.maxSize = n
+	}
+	if v := os.Getenv("FASTCOPY_LOG_MAX_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return s, fmt.Errorf("invalid FASTCOPY_LOG_MAX_AGE '%s', expected a duration like 24h", v)
+		}
+		s.maxAge = d
+	}
+	if v := os.Getenv("FASTCOPY_LOG_MAX_BACKUPS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return s, fmt.Errorf("invalid FASTCOPY_LOG_MAX_BACKUPS '%s', expected a non-negative integer", v)
+		}
+		s.maxBackups = n
+	}
+	if s.syslog != "" && s.syslog != "true" {
+		if u, err := url.Parse(s.syslog); err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+			return s, fmt.Errorf("invalid FASTCOPY_LOG_SYSLOG '%s', expected true or udp://host:port", s.syslog)
+		}
+	}
+	return s, nil
+}
+
+// sends the standard logger to stderr and the sinks configured in env
+func setupLogging() error {
+	settings, err := loadLogSettings()
+	if err != nil {
+		return err
+	}
+	sinks := []io.Writer{os.Stderr}
+	if settings.file != "" {
+		file, err := newRotatingFile(settings.file, settings.maxSize, settings.maxAge, settings.maxBackups)
+		if err != nil {
+			return fmt.Errorf("cannot open log file %s: %w", settings.file, err)
+		}
+		sinks = append(sinks, file)
+	}
+	if settings.syslog != "" {
+		var network, addr string
+		if settings.syslog != "true" {
+			u, _ := url.Parse(settings.syslog)
+			network, addr = u.Scheme, u.Host
+		}
+		w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, "fastcopy")
+		if err != nil {
+			return fmt.Errorf("cannot connect to syslog: %w", err)
+		}
+		sinks = append(sinks, w)
+	}
+	log.SetOutput(io.MultiWriter(sinks...))
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "fastcopy.log")
+	r, err := newRotatingFile(path, 100, time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+
+	line := strings.Repeat("x", 39) + "\n"
+	for i := 0; i < 7; i++ {
+		now = now.Add(time.Second)
+		r.Write([]byte(line))
+	}
+	// 2 lines fit in 100 bytes, so 7 lines rotated 3 times and only the newest 2 backups are kept
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 backups, got %v", backups)
+	}
+	if data, _ := os.ReadFile(path); string(data) != line {
+		t.Errorf("expected the current file to hold the last line, got %q", data)
+	}
+
+	now = now.Add(2 * time.Hour)
+	r.Write([]byte(line))
+	if data, _ := os.ReadFile(path); string(data) != line {
+		t.Errorf("expected the file to be rotated after max age, got %q", data)
+	}
+}
+
+func TestLogSettings(t *testing.T) {
+	t.Setenv("FASTCOPY_LOG_MAX_SIZE", "10M")
+	t.Setenv("FASTCOPY_LOG_SYSLOG", "udp://loghost:514")
+	s, err := loadLogSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.maxSize != 10<<20 || s.maxBackups != defaultLogMaxBackups {
+		t.Errorf("unexpected settings %+v", s)
+	}
+	t.Setenv("FASTCOPY_LOG_SYSLOG", "loghost")
+	if _, err := loadLogSettings(); err == nil {
+		t.Error("expected a syslog address without a scheme to be rejected")
+	}
+}
@@ -3,223 +3,1464 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"os"
 	"path/filepath"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/colinmarc/hdfs/v2"
+	"github.com/briansterle/cluster-fastcopy/pkg/fastcopy"
 )
 
 var httpClient = &http.Client{
-	Timeout: 15 * time.Minute,
+	Timeout:   15 * time.Minute,
+	Transport: peerTransport(),
 }
 
 type UploadResponse struct {
 	Path    string `json:"path"`
 	Written int64  `json:"written"`
+	MD5     string `json:"md5"`
+	SHA256  string `json:"sha256"`
+	Resumed int64  `json:"resumed,omitempty"` // of Written, the bytes kept from an interrupted upload
 }
 
 type CopyResponse struct {
-	From           string        `json:"from"`
-	To             string        `json:"to"`
-	Written        int64         `json:"written"`
-	FilesRequested int64         `json:"filesRequested"`
-	FilesCopied    int64         `json:"filesCopied"`
-	CopyFailures   []CopyFailure `json:"copyFailures"`
-	Throughput     float64       `json:"throughputMbps"`
-	ElapsedSecs    float64       `json:"elapsedSecs"`
+	JobID          string            `json:"jobId"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	From           string            `json:"from"`
+	To             string            `json:"to"`
+	Written        int64             `json:"written"`
+	FilesRequested int64             `json:"filesRequested"`
+	FilesCopied    int64             `json:"filesCopied"`
+	CopyFailures   []CopyFailure     `json:"copyFailures"`
+	FilesSkipped   int64             `json:"filesSkipped"`
+	Skipped        []SkippedFile     `json:"skipped,omitempty"`
+	Snapshot       string            `json:"snapshot,omitempty"`
+	Staging        string            `json:"staging,omitempty"`
+	Previous       string            `json:"previous,omitempty"`
+	FilesSampled   int64             `json:"filesSampled,omitempty"`
+	DirsCreated    int64             `json:"dirsCreated,omitempty"`
+	CutOff         *CutOff           `json:"cutOff,omitempty"` // where a maxBytes copy stopped
+	FilesDeduped   int64             `json:"filesDeduped,omitempty"`
+	BytesDeduped   int64             `json:"bytesDeduped,omitempty"`
+	Warnings       []CopyWarning     `json:"warnings,omitempty"`
+	Adaptations    []string          `json:"adaptations,omitempty"` // options turned off for a target lacking them, see capabilities.go
+	Datanodes      []DatanodeStats   `json:"datanodes,omitempty"`   // the reads from each source datanode while the copy ran
+	HivePartitions []HivePartition   `json:"hivePartitions,omitempty"`
+	State          string            `json:"state"`
+	Reconciled     *bool             `json:"reconciled,omitempty"`
+	Discrepancies  []string          `json:"discrepancies,omitempty"`
+	Verification   *VerifyResult     `json:"verification,omitempty"`
+	Yarn           *YarnStatus       `json:"yarn,omitempty"`
+	Sources        []SourceResult    `json:"sources,omitempty"`  // per 'from' dir of a multi-source copy
+	Targets        []TargetResult    `json:"targets,omitempty"`  // per target of a copy fanned out to several
+	Egress         []EgressEstimate  `json:"egress,omitempty"`   // the cost of the copy to each priced target, see egress.go
+	Receipts       []DeliveryReceipt `json:"receipts,omitempty"` // signed by each target, with receipt=true
+	Throughput     float64           `json:"throughputMbps"`
+	ElapsedSecs    float64           `json:"elapsedSecs"`
 }
 
 type CopyFailure struct {
+	Path              string `json:"path"`
+	Reason            string `json:"reason"`
+	Size              int64  `json:"size"`
+	TargetUnavailable bool   `json:"targetUnavailable,omitempty"`
+	// of a copy to several targets, the ones the file failed on. empty if it failed on all of them
+	Targets []string `json:"targets,omitempty"`
+}
+
+type SkippedFile struct {
 	Path   string `json:"path"`
 	Reason string `json:"reason"`
-	Size   int64  `json:"size"`
 }
 
+// the outcome of a /copy
+const (
+	StateSucceeded         = "succeeded"
+	StateFailed            = "failed"
+	StateTargetUnavailable = "target_unavailable" // the target's circuit breaker opened, remaining files failed fast
+)
+
 type CopyArgs struct {
-	From string
-	File string
-	Path string
-	To   string
+	From    string
+	File    string
+	Path    string
+	To      string
+	Size    int64
+	ModTime time.Time // of the source file when it was listed
+	Attempt int       // 1 when sent again because the first attempt straggles, see speculate.go
+}
+
+// job level options for /copy, parsed from the query params
+type CopyOptions struct {
+	Encrypt         bool
+	EncryptionKeyID string
+	Delta           bool
+	Workers         int
+	Adaptive        bool
+	Scheduling      string
+	Precheck        string
+	Reconcile       bool
+	Manifest        bool
+	RequireSuccess  bool
+	WriteSuccess    bool
+	SkipInProgress  bool
+	SkipHidden      bool
+	SkipChanging    bool
+	UseSnapshot     bool
+	SnapshotName    string
+	DeleteSnapshot  bool
+	Sample          int
+	SamplePercent   float64
+	Transport       string
+	Staging         bool
+	VerifySample    float64
+	SLA             JobSLA
+	ReadStreams     int
+	ReadStreamsMin  int64
+	Shard           Shard
+	Recursive       bool
+	MaxDepth        int
+	Symlinks        string
+	CopyEmptyDirs   bool
+	MaxBytes        int64
+	ResumeAfter     string
+	Dedup           bool
+	RecopyChanged   bool
+	Validate        []string // formats the target checks the structure of
+	HiveDatabase    string
+	HiveTable       string // registers the copied partitions with, if set
+	HiveRepair      bool
+	Resume          bool // sends only what's missing from the partial files of interrupted uploads
+	Speculate       bool
+	SpeculateFactor float64
+	Priority        PriorityRule // files copied by a lane of workers of their own
+	ContentType     string       // how files are typed for the target, see contenttype.go
+	Collisions      string       // what happens to files colliding at the destination, see collisions.go
+	Retries         int          // rounds of sending the files failing with a transient error again, see retry.go
+	RetryDelay      time.Duration
+	Origin          UploadOrigin  // where the uploads come from, see metadata.go
+	Lock            bool          // holds advisory locks on the sources and 'to', see joblocks.go
+	ContentStore    string        // the dir on the target the files' content is stored in by hash, see contentstore.go
+	TTL             time.Duration // after which the targets delete 'to', see retention.go
+	Receipt         bool          // asks every target for a signed receipt of the files, see receipts.go
+}
+
+const DefaultWorkers = fastcopy.DefaultWorkers
+
+// files from this size on are read with 'readStreams' readers unless 'readStreamsMinSize' says otherwise
+const DefaultReadStreamsMinSize = 1 << 30
+
+// the address the server listens on unless FASTCOPY_ADDR is set
+const DefaultAddr = ":8080"
+
+func parseCopyOptions(r *http.Request) (CopyOptions, error) {
+	q := r.URL.Query()
+	opts := CopyOptions{
+		EncryptionKeyID: q.Get("encryptionKeyId"),
+		Delta:           q.Get("delta") == "true",
+		Workers:         DefaultWorkers,
+		ReadStreams:     1,
+		ReadStreamsMin:  DefaultReadStreamsMinSize,
+		Adaptive:        q.Get("adaptive") == "true",
+		Scheduling:      q.Get("scheduling"),
+		Precheck:        q.Get("precheck"),
+		Reconcile:       q.Get("reconcile") != "false",
+		Manifest:        q.Get("manifest") == "true",
+		RequireSuccess:  q.Get("requireSuccess") == "true",
+		WriteSuccess:    q.Get("writeSuccess") == "true",
+		SkipInProgress:  q.Get("skipInProgress") == "true",
+		SkipHidden:      q.Get("skipHidden") == "true",
+		SkipChanging:    q.Get("skipChanging") == "true",
+		SnapshotName:    q.Get("snapshotName"),
+		DeleteSnapshot:  q.Get("deleteSnapshot") == "true",
+		Staging:         q.Get("staging") == "true",
+		Recursive:       q.Get("recursive") == "true",
+		MaxDepth:        DefaultMaxDepth,
+		Symlinks:        q.Get("symlinks"),
+		CopyEmptyDirs:   q.Get("copyEmptyDirs") == "true",
+		ResumeAfter:     q.Get("resumeAfter"),
+		Dedup:           q.Get("dedup") == "true",
+		RecopyChanged:   q.Get("recopyChanged") == "true",
+		HiveRepair:      q.Get("hiveRepair") == "true",
+		Resume:          q.Get("resume") == "true",
+		Speculate:       q.Get("speculate") == "true",
+		ContentType:     q.Get("contentType"),
+		Collisions:      q.Get("collisions"),
+		Origin:          UploadOrigin{SubmittedBy: q.Get("submittedBy")},
+		Lock:            q.Get("lock") == "true",
+		ContentStore:    q.Get("contentStore"),
+		Receipt:         q.Get("receipt") == "true",
+	}
+	if v := q.Get("workers"); v != "" {
+		workers, err := strconv.Atoi(v)
+		if err != nil || workers < 1 {
+			return opts, fmt.Errorf("'workers' must be a positive integer, got '%s'", v)
+		}
+		opts.Workers = workers
+	}
+	if v := q.Get("readStreams"); v != "" {
+		streams, err := strconv.Atoi(v)
+		if err != nil || streams < 1 {
+			return opts, fmt.Errorf("'readStreams' must be a positive integer, got '%s'", v)
+		}
+		opts.ReadStreams = streams
+	}
+	if v := q.Get("readStreamsMinSize"); v != "" {
+		size, err := parseByteSize(v)
+		if err != nil {
+			return opts, fmt.Errorf("'readStreamsMinSize' must be a size like 512M, got '%s'", v)
+		}
+		opts.ReadStreamsMin = size
+	}
+	if v := q.Get("maxDepth"); v != "" {
+		depth, err := strconv.Atoi(v)
+		if err != nil || depth < 0 {
+			return opts, fmt.Errorf("'maxDepth' must be a non-negative integer, got '%s'", v)
+		}
+		if !opts.Recursive {
+			return opts, errors.New("'maxDepth' requires recursive=true")
+		}
+		opts.MaxDepth = depth
+	}
+	if opts.CopyEmptyDirs && !opts.Recursive {
+		return opts, errors.New("'copyEmptyDirs' requires recursive=true")
+	}
+	if !validSymlinkPolicy(opts.Symlinks) {
+		return opts, fmt.Errorf("unknown symlinks policy '%s', expected one of %v", opts.Symlinks, symlinkPolicies)
+	}
+	if v := q.Get("maxBytes"); v != "" {
+		size, err := parseByteSize(v)
+		if err != nil || size < 1 {
+			return opts, fmt.Errorf("'maxBytes' must be a size like 500G, got '%s'", v)
+		}
+		opts.MaxBytes = size
+	}
+	if v := q.Get("shard"); v != "" {
+		shard, err := parseShard(v)
+		if err != nil {
+			return opts, err
+		}
+		opts.Shard = shard
+	}
+	if v := q.Get("sample"); v != "" {
+		sample, err := strconv.Atoi(v)
+		if err != nil || sample < 1 {
+			return opts, fmt.Errorf("'sample' must be a positive integer, got '%s'", v)
+		}
+		opts.Sample = sample
+	}
+	sla, err := parseSLA(q)
+	if err != nil {
+		return opts, err
+	}
+	opts.SLA = sla
+	if v := q.Get("validate"); v != "" {
+		formats, err := parseValidate(v)
+		if err != nil {
+			return opts, err
+		}
+		opts.Validate = formats
+	}
+	if v := q.Get("hiveTable"); v != "" {
+		if getWebhcatSettings() == nil {
+			return opts, errors.New("'hiveTable' needs the destination's WebHCat, FASTCOPY_WEBHCAT_API isn't set")
+		}
+		db, table, err := parseHiveTable(v)
+		if err != nil {
+			return opts, err
+		}
+		opts.HiveDatabase, opts.HiveTable = db, table
+	}
+	if opts.HiveRepair && opts.HiveTable == "" {
+		return opts, errors.New("'hiveRepair' requires hiveTable")
+	}
+	if v := q.Get("verifySample"); v != "" {
+		percent, err := parseVerifySample(v)
+		if err != nil {
+			return opts, err
+		}
+		opts.VerifySample = percent
+	}
+	if v := q.Get("samplePercent"); v != "" {
+		percent, err := strconv.ParseFloat(v, 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return opts, fmt.Errorf("'samplePercent' must be a number in (0, 100], got '%s'", v)
+		}
+		opts.SamplePercent = percent
+	}
+	opts.Transport = q.Get("transport")
+	if _, err := getTransport(opts.Transport); err != nil {
+		return opts, fmt.Errorf("%s, expected one of %v", err, transportNames())
+	}
+	if opts.Sample > 0 && opts.SamplePercent > 0 {
+		return opts, errors.New("only one of 'sample' and 'samplePercent' can be given")
+	}
+	if (opts.Sample > 0 || opts.SamplePercent > 0) && opts.WriteSuccess {
+		return opts, errors.New("'writeSuccess' can't mark a sampled copy complete")
+	}
+	if !validPrecheck(opts.Precheck) {
+		return opts, fmt.Errorf("unknown precheck '%s', expected ready, upload or none", opts.Precheck)
+	}
+	if !validScheduling(opts.Scheduling) {
+		return opts, fmt.Errorf("unknown scheduling '%s', expected one of %v", opts.Scheduling, schedulingStrategies)
+	}
+	if opts.Dedup && getDedupCache() == nil {
+		return opts, errors.New("'dedup' needs the cache of delivered files, FASTCOPY_DEDUP_CACHE isn't set")
+	}
+	if opts.Dedup && opts.Staging {
+		return opts, errors.New("'dedup' can't be combined with staging=true, a staged copy starts from an empty dir")
+	}
+	if opts.ContentStore != "" && (opts.Dedup || opts.Manifest || opts.RecopyChanged) {
+		return opts, errors.New("'contentStore' deduplicates the files by content and writes a manifest of its own, it can't be combined with dedup, manifest or recopyChanged")
+	}
+	if v := q.Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return opts, fmt.Errorf("'ttl' must be a positive duration like 72h, got '%s'", v)
+		}
+		opts.TTL = d
+	}
+	if opts.SpeculateFactor, err = parseSpeculateFactor(q); err != nil {
+		return opts, err
+	}
+	if opts.Priority, err = parsePriorityRule(q); err != nil {
+		return opts, err
+	}
+	if opts.Retries, opts.RetryDelay, err = parseRetries(q); err != nil {
+		return opts, err
+	}
+	if opts.Speculate && (opts.Delta || opts.Resume) {
+		return opts, errors.New("'speculate' sends a file twice at once and can't be combined with delta=true or resume=true")
+	}
+	if opts.Resume && (opts.Delta || opts.ReadStreams > 1) {
+		return opts, errors.New("'resume' seeks a single reader past what the target has and can't be combined with delta=true or readStreams")
+	}
+	if err := checkSubmittedBy(opts.Origin.SubmittedBy); err != nil {
+		return opts, err
+	}
+	if !validCollisionPolicy(opts.Collisions) {
+		return opts, fmt.Errorf("unknown collisions policy '%s', expected one of %v", opts.Collisions, collisionPolicies)
+	}
+	if !validContentTypeMode(opts.ContentType) {
+		return opts, fmt.Errorf("unknown contentType '%s', expected extension or sniff", opts.ContentType)
+	}
+	if opts.ContentType != "" && opts.Delta {
+		return opts, errors.New("'contentType' can't be combined with delta=true, patched files keep their type")
+	}
+	if opts.Staging && opts.Delta {
+		return opts, errors.New("'delta' patches the files in 'to' and can't be combined with staging=true")
+	}
+	opts.UseSnapshot = q.Get("useSnapshot") == "true" || opts.SnapshotName != ""
+	if opts.DeleteSnapshot && !opts.UseSnapshot {
+		return opts, errors.New("'deleteSnapshot' requires useSnapshot=true")
+	}
+	opts.Encrypt = q.Get("encrypt") == "true" || opts.EncryptionKeyID != ""
+	if opts.Encrypt {
+		if _, err := encryptionKey(opts.EncryptionKeyID); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
 }
 
+// writes data to to/fileName through its partial file, see resume.go
 func WriteHDFS(to string, fileName string, data io.ReadCloser) (UploadResponse, error) {
+	path := filepath.Join(to, fileName)
+	return writeThrough(to, path, partialPath(path), data)
+}
+
+// writes data into the file 'partial' and renames it to path once complete
+func writeThrough(to string, path string, partial string, data io.ReadCloser) (UploadResponse, error) {
 	var msg string
 	client := GetHdfsClient()
 	client.MkdirAll(to, os.FileMode(0755))
+	client.Remove(partial) // Truncate the file to 0 bytes
 
-	path := filepath.Join(to, fileName)
-	client.Remove(path) // Truncate the file to 0 bytes
-
-	file, err := client.Create(path)
+	file, err := client.Create(partial)
 	if err != nil {
 		msg = fmt.Sprintf("Error creating file in hdfs %s", err)
 		return UploadResponse{}, errors.New(msg)
 	}
-	defer file.Close()
+	return writePartial(client, file, partial, newFileDigests(), 0, data, path)
+}
 
-	written, err := io.Copy(file, data)
+// copies data into the partial file of path after its first 'offset' bytes, which digests already hold, and renames
+// it into place. a failed copy leaves the partial file behind to resume
+func writePartial(client FileSystem, file io.WriteCloser, partial string, digests *fileDigests, offset int64, data io.Reader, path string) (UploadResponse, error) {
+	written, err := io.Copy(io.MultiWriter(file, digests), data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		msg = fmt.Sprintf("Error copying request body into file %s %s", fileName, err)
-		return UploadResponse{}, errors.New(msg)
+		return UploadResponse{}, fmt.Errorf("Error copying request body into file %s %s", filepath.Base(path), err)
+	}
+	// checked again now it's complete, another upload of path may have landed meanwhile
+	if err := checkWriteOnce(client, path); err != nil {
+		client.Remove(partial)
+		return UploadResponse{}, err
+	}
+	client.Remove(path) // replaced by the new version
+	if err := client.Rename(partial, path); err != nil {
+		return UploadResponse{}, fmt.Errorf("Error moving the written file into place %s", err)
 	}
-
 	return UploadResponse{
 		Path:    path,
-		Written: written,
+		Written: offset + written,
+		MD5:     digests.MD5(),
+		SHA256:  digests.SHA256(),
+		Resumed: offset,
 	}, nil
 }
 
-func sendToUpload(reader *hdfs.FileReader, targetURL string, args CopyArgs, wg *sync.WaitGroup, ch chan CopyFailure) {
-	defer wg.Done()
-	uploadUrl := targetURL + "?fileName=" + args.File + "&to=" + args.To
+// opens the source of a file to copy
+type sourceOpener func(args CopyArgs) (io.ReadCloser, error)
 
-	req, err := http.NewRequest(http.MethodPost, uploadUrl, reader)
+// reads files to copy from hdfs. with opts.SkipChanging files whose length changed since listing fail with errSourceChanged
+func hdfsSource(client FileSystem, opts CopyOptions) sourceOpener {
+	return func(args CopyArgs) (io.ReadCloser, error) {
+		log.Printf("Reading from path: %s\n", args.Path)
+		reader, err := client.Open(args.Path)
+		if err != nil {
+			log.Printf("Failed to read file %s\n", args.File)
+			return nil, err
+		}
+		if opts.SkipChanging {
+			if size := reader.Stat().Size(); size != args.Size {
+				reader.Close()
+				return nil, fmt.Errorf("%w: length changed from %d to %d bytes since listing", errSourceChanged, args.Size, size)
+			}
+		}
+		if opts.Resume {
+			// resuming seeks the reader itself, see resumePoint
+			return reader, nil
+		}
+		if opts.ReadStreams > 1 && args.Size >= opts.ReadStreamsMin {
+			return parallelRead(client, reader, args, opts.ReadStreams)
+		}
+		if chunks := getReadAhead(); chunks > 0 {
+			// overlap reading the next chunks from the datanodes with sending this one
+			return fastcopy.Prefetch(reader, chunks, fastcopy.DefaultPrefetchChunkSize), nil
+		}
+		return reader, nil
+	}
+}
+
+// reads a large file through 'streams' readers at once, each from its own segments, so it's read from several
+// datanodes in parallel. 'first' is one of them, already open
+func parallelRead(client FileSystem, first HdfsReader, args CopyArgs, streams int) (io.ReadCloser, error) {
+	readers := []io.ReadSeekCloser{first}
+	for len(readers) < streams {
+		reader, err := client.Open(args.Path)
+		if err != nil {
+			for _, r := range readers {
+				r.Close()
+			}
+			return nil, err
+		}
+		readers = append(readers, reader)
+	}
+	return fastcopy.ParallelRead(readers, args.Size, fastcopy.DefaultSegmentSize), nil
+}
+
+// streams reader to the target's /upload (or /patch for delta transfers) and returns the target's response
+func sendToUpload(reader io.Reader, targetURL string, args CopyArgs, opts CopyOptions) (UploadResponse, error) {
+	params := url.Values{"fileName": {args.File}, "to": {args.To}}
+	if len(opts.Validate) > 0 {
+		params.Set("validate", strings.Join(opts.Validate, ","))
+	}
+	if args.Attempt > 0 {
+		log.Printf("Sending '%s' again, attempt %d is straggling", args.File, args.Attempt)
+		params.Set("attempt", strconv.Itoa(args.Attempt))
+	}
+	size := args.Size
+
+	header := http.Header{}
+	contentType, reader := detectContentType(reader, args.File, opts.ContentType)
+	if contentType != "" {
+		header.Set(contentTypeHeader, contentType)
+	}
+	trailer := http.Header{}
+	var resumeFrom int64
+	var prefix *fileDigests
+	src, resumable := asResumable(reader)
+	if opts.Resume && resumable {
+		if resumeFrom, prefix = resumePoint(src, targetURL, args); resumeFrom > 0 {
+			params.Set("resumeFrom", strconv.FormatInt(resumeFrom, 10))
+			header.Set(prefixDigestHeader, prefix.SHA256())
+		}
+	}
+	uploadUrl := targetURL + "?" + params.Encode()
+	var body io.Reader = reader
+	var patch bool
+	if !opts.Encrypt {
+		// encrypted uploads are authenticated by GCM instead, a plaintext digest would leak information about the content
+		digests := newDigestReader(body, trailer)
+		if prefix != nil {
+			digests.digests = prefix // the target checks the digest of the whole file
+		}
+		body = digests
+	}
+	if opts.Delta {
+		blockSize := deltaBlockSize(size)
+		sig, err := fetchSignature(targetURL, filepath.Join(args.To, args.File), blockSize)
+		if err != nil {
+			log.Printf("Failed to fetch signature of '%s' from target: %s", args.File, err)
+			return UploadResponse{}, err
+		}
+		if sig != nil {
+			pr, pw := io.Pipe()
+			defer pr.Close()
+			src := body
+			go func() { pw.CloseWithError(writeDelta(pw, src, *sig)) }()
+			body = pr
+			params := url.Values{
+				"fileName":  {args.File},
+				"to":        {args.To},
+				"blockSize": {strconv.Itoa(sig.BlockSize)},
+			}
+			if len(opts.Validate) > 0 {
+				params.Set("validate", strings.Join(opts.Validate, ","))
+			}
+			uploadUrl = peerURL(targetURL, "/patch", params)
+			patch = true
+		}
+	}
+	if opts.Encrypt {
+		enc, err := newEncryptReader(body, opts.EncryptionKeyID, header)
+		if err != nil {
+			log.Printf("Failed to encrypt file '%s': %s", args.File, err)
+			return UploadResponse{}, err
+		}
+		body = enc
+	}
+	setProtocolHeaders(header, requiredFeatures(opts, resumeFrom, args.Attempt, patch))
+	setOriginHeaders(header, opts.Origin)
+	body = throttleTarget(throttle(body), targetURL)
+
+	req, err := http.NewRequest(http.MethodPost, uploadUrl, body)
 	if err != nil {
 		log.Printf("Failed to create request for file '%s': %s", args.File, err)
-		ch <- CopyFailure{args.Path, err.Error(), reader.Stat().Size()}
+		return UploadResponse{}, err
 	}
 
+	for k, v := range header {
+		req.Header[k] = v
+	}
 	req.Header.Set("Content-Type", "application/octet-stream")
 	req.Header.Set("Connection", "keep-alive")
+	req.Header.Set(sourceHeader, args.Path)
+	if !opts.Encrypt {
+		req.Trailer = trailer
+	}
 
+	var reused bool
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
+	}))
 	resp, err := httpClient.Do(req)
+	if errors.Is(err, fastcopy.ErrSpeculationLost) {
+		return UploadResponse{}, err // not the target's fault
+	}
+	if err != nil && reused {
+		// the target may have closed the idle connection as it drains for a restart
+		err = fmt.Errorf("%w: %w", errReusedConnClosed, err)
+	}
 	if err != nil {
+		targetBreaker(targetURL).record(err, 0)
 		log.Printf("Failed to send file '%s' to /upload: %s", args.File, err)
-		ch <- CopyFailure{args.Path, err.Error(), reader.Stat().Size()}
+		return UploadResponse{}, err
 	}
 	defer resp.Body.Close()
+	targetBreaker(targetURL).record(nil, resp.StatusCode)
 
+	if holder := resp.Header.Get(lockedByHeader); resp.StatusCode == http.StatusConflict && holder != "" {
+		msg := fmt.Sprintf("/upload refused file '%s', %s is writing it", args.File, holder)
+		log.Println(msg)
+		return UploadResponse{}, fmt.Errorf("%w: %w", errPathLocked, &fastcopy.StatusError{StatusCode: resp.StatusCode, Msg: msg})
+	}
+	if resp.StatusCode == http.StatusConflict && resumeFrom > 0 {
+		// the target's partial file doesn't match the source after all and was discarded
+		log.Printf("Target rejected resuming '%s' at %d bytes, sending it whole", args.File, resumeFrom)
+		resp.Body.Close()
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			return UploadResponse{}, err
+		}
+		opts.Resume = false
+		return sendToUpload(reader, targetURL, args, opts)
+	}
 	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
 		msg := fmt.Sprintf("/upload returned non-OK status for file '%s': %d", args.File, resp.StatusCode)
+		if peerMsg := peerErrorMessage(body); peerMsg != "" {
+			msg += ": " + peerMsg
+		}
 		log.Println(msg)
-		ch <- CopyFailure{args.Path, msg, reader.Stat().Size()}
+		return UploadResponse{}, &fastcopy.StatusError{StatusCode: resp.StatusCode, Msg: msg}
+	}
+	var res UploadResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return UploadResponse{}, fmt.Errorf("/upload returned an unreadable response for file '%s': %w", args.File, err)
 	}
 	log.Printf("File '%s' successfully to copied to target!", args.File)
+	return res, nil
 }
 
 // Uploads the incoming []byte to the hdfs path provided by
-// query param 'to' and file provided by param 'fileName'
+// query param 'to' and file provided by param 'fileName'.
+// With param 'resumeFrom' the body is appended to the partial file of an interrupted upload,
+// with param 'attempt' it's a speculative second attempt written into a partial file of its own.
+// If the sender provides a Digest or Content-MD5 header (or Digest trailer),
+// the written file is verified against it and removed, or quarantined, on mismatch.
+// Files of the formats in param 'validate' have their structure checked too.
+// A file in a write-once dir is never replaced, see writeonce.go
 func handleUpload(w http.ResponseWriter, r *http.Request) {
 	fileName := r.URL.Query().Get("fileName")
 	to := r.URL.Query().Get("to")
 	if to == "" || fileName == "" {
-		http.Error(w, "'to', 'fileName', 'dir' query params must be provided.", http.StatusBadRequest)
+		writeError(w, "'to', 'fileName', 'dir' query params must be provided.", http.StatusBadRequest)
+		return
+	}
+	path, err := uploadPath(to, fileName)
+	if err != nil {
+		writeConfineError(w, err)
 		return
 	}
-	log.Printf("Writing %s to target: %s\n", fileName, to)
+	if r.URL.Query().Get("probe") == "true" {
+		handleProbe(w, to)
+		return
+	}
+	if !checkProtocol(w, r) {
+		return
+	}
+	origin := uploadOrigin(r)
+	if origin != nil {
+		log.Printf("Writing %s to target: %s, sent by %s\n", fileName, to, origin)
+	} else {
+		log.Printf("Writing %s to target: %s\n", fileName, to)
+	}
 
-	data := r.Body
-	res, err := WriteHDFS(to, fileName, data)
-	defer data.Close()
+	resumeFrom, err := parseResumeFrom(r.URL.Query())
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	attempt, err := parseAttempt(r.URL.Query())
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
+	partial := partialPath(path)
+	if attempt > 0 {
+		partial = speculativePath(path, attempt)
+	}
+	unlock, err := lockWrite(path, origin, attempt)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("Error occurred writing to HDFS: %s", err)
+		writeLockedError(w, err)
+		log.Printf("Rejected upload: %s", err)
+		return
+	}
+	defer unlock()
+	if err := checkWriteOnce(GetHdfsClient(), path); err != nil {
+		writeWriteOnceError(w, err)
 		return
 	}
+	session := startUploadSession(path, partial, resumeFrom, origin)
+	r.Body = session.track(r.Body)
+
+	data, dec, ok := openUploadBody(w, r)
+	if !ok {
+		session.finish(nil, false)
+		return
+	}
+	defer data.Close()
+	var res UploadResponse
+	if resumeFrom > 0 {
+		res, err = ResumeHDFS(to, fileName, data, resumeFrom, r.Header.Get(prefixDigestHeader))
+	} else if attempt > 0 {
+		res, err = writeSpeculative(to, fileName, data, attempt)
+	} else {
+		res, err = WriteHDFS(to, fileName, data)
+	}
+	session.finish(err, attempt == 0)
+	if !finishUpload(w, r, res, dec, filepath.Join(to, fileName), err) {
+		return
+	}
+	storeContentType(GetHdfsClient(), res.Path, r)
+	if r.URL.Query().Get("selftest") == "true" {
+		// a /selftest upload only checks the write path, don't leave the file behind
+		GetHdfsClient().Remove(res.Path)
+	} else {
+		recordReceived(origin, res)
+	}
 	json, _ := json.Marshal(res)
 	w.Write(json)
 }
 
-// Reads all files in a given directory provided by 'from'
-// and uploads them to the user provided path 'to'
-func handleCopy(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
-	from := r.URL.Query().Get("from")
-	to := r.URL.Query().Get("to")
-	targetURL := r.URL.Query().Get("targetURL")
-	if from == "" || to == "" {
-		http.Error(w, "'from', 'to', and 'targetURL' query params must be provided.'", http.StatusBadRequest)
-		return
+// returns the request body, decrypting it if the sender encrypted it.
+// writes an error response and returns false if the body can't be decrypted
+func openUploadBody(w http.ResponseWriter, r *http.Request) (io.ReadCloser, *decryptReader, bool) {
+	if r.Header.Get(encryptionHeader) == "" {
+		return r.Body, nil, true
 	}
+	dec, err := newDecryptReader(r.Body, r.Header)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		log.Printf("Rejected encrypted upload: %s", err)
+		return nil, nil, false
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{dec, r.Body}, dec, true
+}
 
-	client := GetHdfsClient()
-	fileInfos, err := client.ReadDir(from)
+// checks the outcome of writing an upload at path: decryption, write errors, digests and the formats to validate.
+// on failure the written file is removed or quarantined, an error response is written and false is returned
+func finishUpload(w http.ResponseWriter, r *http.Request, res UploadResponse, dec *decryptReader, path string, err error) bool {
+	if dec != nil && dec.Err() != nil {
+		writeError(w, withQuarantine(dec.Err().Error(), discardUpload(r, path, dec.Err().Error(), nil, res)), http.StatusUnprocessableEntity)
+		log.Printf("Rejected upload: %s", dec.Err())
+		return false
+	}
+	if errors.Is(err, errResumeConflict) {
+		writeError(w, err.Error(), http.StatusConflict)
+		log.Printf("Rejected resumed upload: %s", err)
+		return false
+	}
+	if errors.Is(err, errWriteOnce) {
+		writeWriteOnceError(w, err)
+		return false
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to list the hdfs dir %s", err), http.StatusInternalServerError)
-		return
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("Error occurred writing to HDFS: %s", err)
+		return false
+	}
+
+	expected := parseDigests(r.Header)
+	for alg, value := range parseDigests(r.Trailer) {
+		expected[alg] = value
+	}
+	if err := verifyDigests(expected, res); err != nil {
+		writeError(w, withQuarantine(err.Error(), discardUpload(r, path, err.Error(), expected, res)), http.StatusUnprocessableEntity)
+		log.Printf("Rejected upload: %s", err)
+		return false
+	}
+	if v := r.URL.Query().Get("validate"); v != "" {
+		formats, err := parseValidate(v)
+		if err == nil {
+			err = validateWritten(GetHdfsClient(), path, r.URL.Query().Get("fileName"), formats)
+		}
+		if err != nil {
+			writeError(w, withQuarantine(err.Error(), discardUpload(r, path, err.Error(), expected, res)), http.StatusUnprocessableEntity)
+			log.Printf("Rejected upload: %s", err)
+			return false
+		}
 	}
+	return true
+}
+
+// a file the target confirmed writing
+type CopiedFile struct {
+	Args     CopyArgs
+	Upload   UploadResponse
+	CopiedAt time.Time
+}
 
-	var (
-		totalBytesWritten int64
-		copyFailuresCh    = make(chan CopyFailure)
-		wg                sync.WaitGroup
-	)
+// transfers the tasks to the targets with a pool of opts.Workers workers and returns the copied, skipped and failed files.
+// a file is only copied once every target has it. progress is recorded on job if it isn't nil
+func runTransfers(open sourceOpener, targets []string, tasks []CopyArgs, opts CopyOptions, job *Job) ([]CopiedFile, []SkippedFile, []CopyFailure) {
+	// with adaptive concurrency 'workers' is the ceiling the limiter can ramp up to
+	var adaptive *aimdLimiter
+	if opts.Adaptive {
+		adaptive = newAIMDLimiter(opts.Workers)
+	}
+	byPath := make(map[string]CopyArgs, len(tasks))
+	files := make([]fastcopy.File, 0, len(tasks))
+	for _, args := range tasks {
+		byPath[args.Path] = args
+		files = append(files, fastcopy.File{Path: args.Path, Name: args.File, Size: args.Size})
+	}
+	// a fanned out copy checks each target's breaker as it sends to it, see breakerSink
+	var breaker *circuitBreaker
+	if len(targets) == 1 {
+		breaker = targetBreaker(targets[0])
+	}
+	engine := &fastcopy.Engine{
+		Source:          openerSource{job.track(open), byPath},
+		Sink:            targetsSink(targets, byPath, opts),
+		Workers:         opts.Workers,
+		Speculation:     speculation(opts),
+		Priority:        priorityLane(opts.Priority, byPath),
+		PriorityWorkers: opts.Priority.Workers,
+		Admit: func(file fastcopy.File) (func(error), error) {
+			args := byPath[file.Path]
+			if opts.Priority.enabled() && opts.Priority.matches(args) {
+				// the priority lane has its own workers, adaptive concurrency only limits the data files
+				return admitTransfer(args, breaker, nil, job)
+			}
+			return admitTransfer(args, breaker, adaptive, job)
+		},
+	}
+	var to string
+	if len(tasks) > 0 {
+		to = tasks[0].To
+	}
+	result := runWithRetries(engine, &fastcopy.Job{To: to, Files: files}, opts.Retries, opts.RetryDelay, job)
 
+	copied := make([]CopiedFile, 0, len(result.Copied))
+	for _, c := range result.Copied {
+		args := byPath[c.File.Path]
+		job.logf("Copied %s (%d bytes)", args.Path, c.Result.Written)
+		copied = append(copied, CopiedFile{args, UploadResponse(c.Result), c.At})
+	}
+	skipped := make([]SkippedFile, 0)
 	copyFailures := make([]CopyFailure, 0)
-	go func() {
-		for failure := range copyFailuresCh {
-			copyFailures = append(copyFailures, failure)
+	for _, f := range result.Failed {
+		args := byPath[f.File.Path]
+		if errors.Is(f.Err, errSourceChanged) {
+			job.logf("Warning: skipping %s: %s", args.Path, f.Err)
+			skipped = append(skipped, SkippedFile{args.Path, f.Err.Error()})
+			continue
 		}
-	}()
+		job.logf("Failed to copy %s: %s", args.Path, f.Err)
+		failed, reason := failedTargets(targets, f.Err)
+		copyFailures = append(copyFailures, CopyFailure{Path: args.Path, Reason: reason, Size: args.Size, TargetUnavailable: errors.Is(f.Err, errTargetUnavailable), Targets: failed})
+	}
+	return copied, skipped, copyFailures
+}
+
+// waits until a transfer may start: for the service to be resumed if paused, for adaptive concurrency, the source namenode's admission, the target's
+// circuit breaker unless it's nil and the server wide in-flight cap. returns the func to call with the transfer's outcome
+func admitTransfer(args CopyArgs, breaker *circuitBreaker, adaptive *aimdLimiter, job *Job) (func(error), error) {
+	waitWhilePaused()
+	var started time.Time
+	if adaptive != nil {
+		started = adaptive.acquire()
+	}
+	done := func(err error) {
+		if adaptive != nil {
+			adaptive.release(started, args.Size, err)
+		}
+		job.fileDone(args, err)
+	}
+	if gate := getNamenodeGate(); gate != nil {
+		gate.admit()
+	}
+	if breaker != nil {
+		release, err := breaker.allow()
+		if err != nil {
+			done(err)
+			return nil, err
+		}
+		finish := done
+		done = func(err error) {
+			release()
+			finish(err)
+		}
+	}
+	if limiter := getInflightLimiter(); limiter != nil {
+		acquired := limiter.acquire(args.Size)
+		release := done
+		done = func(err error) {
+			limiter.release(acquired)
+			release(err)
+		}
+	}
+	return done, nil
+}
+
+// adapts a sourceOpener to the copy engine
+type openerSource struct {
+	open   sourceOpener
+	byPath map[string]CopyArgs
+}
+
+func (s openerSource) List(dir string) ([]fastcopy.File, error) {
+	return nil, errors.New("openerSource can't list, tasks are planned by /copy")
+}
+
+func (s openerSource) Open(file fastcopy.File) (io.ReadCloser, error) {
+	return s.open(s.byPath[file.Path])
+}
+
+// sends files to the target with the job's transport and transfer options
+type uploadSink struct {
+	targetURL string
+	byPath    map[string]CopyArgs
+	opts      CopyOptions
+}
+
+func (s uploadSink) Write(to string, file fastcopy.File, r io.Reader) (fastcopy.WriteResult, error) {
+	args := s.byPath[file.Path]
+	args.Attempt = file.Attempt
+	res, err := send(r, s.targetURL, args, s.opts)
+	return fastcopy.WriteResult(res), err
+}
 
+// plans copying the listed files of readFrom into writeTo, leaving out the files the options skip.
+// returns the tasks, the skipped files and the bytes to copy
+func planTasks(fileInfos []os.FileInfo, readFrom string, writeTo string, opts CopyOptions) ([]CopyArgs, []SkippedFile, int64) {
+	var bytes int64
+	tasks := make([]CopyArgs, 0, len(fileInfos))
+	skipped := make([]SkippedFile, 0)
 	for _, fileInfo := range fileInfos {
+		if reason := skipReason(fileInfo.Name(), fileInfo.IsDir(), opts); reason != "" {
+			skipped = append(skipped, SkippedFile{filepath.Join(readFrom, fileInfo.Name()), reason})
+			continue
+		}
 		if fileInfo.IsDir() {
 			continue
 		}
-		args := CopyArgs{from, fileInfo.Name(), filepath.Join(from, fileInfo.Name()), to}
-		totalBytesWritten += fileInfo.Size()
-		log.Printf("Reading from path: %s\n", args.Path)
-		reader, err := client.Open(args.Path)
+		if opts.WriteSuccess && fileInfo.Name() == SuccessMarker {
+			continue // written last, once everything else is verified
+		}
+		tasks = append(tasks, CopyArgs{From: readFrom, File: fileInfo.Name(), Path: filepath.Join(readFrom, fileInfo.Name()), To: writeTo, Size: fileInfo.Size(), ModTime: fileInfo.ModTime()})
+		bytes += fileInfo.Size()
+	}
+	return tasks, skipped, bytes
+}
+
+// Reads all files in a given directory provided by 'from'
+// and uploads them to the user provided path 'to'
+func handleCopy(w http.ResponseWriter, r *http.Request) {
+	if refuseDraining(w) {
+		return
+	}
+	if status, err := applyDataset(r); err != nil {
+		writeError(w, err.Error(), status)
+		return
+	}
+	if status, err := applyTemplate(r); err != nil {
+		writeError(w, err.Error(), status)
+		return
+	}
+	if status, err := applyPlan(r); err != nil {
+		writeError(w, err.Error(), status)
+		return
+	}
+	if r.URL.Query().Get("yarn") != "" {
+		if isJSONRequest(r) {
+			writeError(w, "'yarn' copies a single 'from' dir given as a query param", http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("jobKey") != "" {
+			writeError(w, "'jobKey' isn't supported with 'yarn'", http.StatusBadRequest)
+			return
+		}
+		handleYarnCopy(w, r)
+		return
+	}
+	interval, err := parseHeartbeat(r.URL.Query())
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	run := runCopy
+	if r.URL.Query().Get("jobKey") != "" {
+		keyed, submitted, status, err := claimJobKey(r)
 		if err != nil {
-			log.Printf("Failed to read file %s\n", args.File)
-			copyFailuresCh <- CopyFailure{args.Path, err.Error(), fileInfo.Size()}
+			writeError(w, err.Error(), status)
+			return
+		}
+		if submitted {
+			run = func(r *http.Request) (resp CopyResponse, status int, err error) {
+				// a copy panicking completes as failed, freeing the key
+				defer func() { keyed.complete(resp, status, err) }()
+				return runCopy(r)
+			}
+		} else {
+			w.Header().Set(replayedHeader, "true")
+			run = func(*http.Request) (CopyResponse, int, error) { return keyed.wait() }
+		}
+	}
+	var hb *heartbeat
+	if interval > 0 {
+		q := r.URL.Query()
+		if q.Get("jobId") == "" {
+			q.Set("jobId", newJobID())
+			r.URL.RawQuery = q.Encode()
+		}
+		w.Header().Set(jobIDHeader, q.Get("jobId"))
+		hb = startHeartbeat(w, interval)
+	}
+	resp, status, err := run(r)
+	if hb != nil && hb.finish() {
+		if err != nil {
+			writeLateError(w, err.Error(), status, errorDetails(err)...)
 			return
 		}
-		defer reader.Close()
-		wg.Add(1)
-		go sendToUpload(reader, targetURL, args, &wg, copyFailuresCh)
+		json, _ := json.MarshalIndent(resp, "", "  ")
+		w.Write(json)
+		return
+	}
+	if err != nil {
+		writeError(w, err.Error(), status, errorDetails(err)...)
+		return
+	}
+	w.Header().Set(jobIDHeader, resp.JobID)
+	json, _ := json.MarshalIndent(resp, "", "  ")
+	if resp.State != StateSucceeded {
+		writeReport(w, json, http.StatusInternalServerError)
+		return
+	}
+	w.Write(json)
+}
+
+// runs the copy described by the query params of r, and its JSON body for several source dirs. errors are
+// returned with the http status to fail with when no file could be transferred, otherwise the outcome is in
+// the response's state
+func runCopy(r *http.Request) (CopyResponse, int, error) {
+	start := time.Now()
+	to, targets, sources, err := parseCopySources(r)
+	if err != nil {
+		return CopyResponse{}, http.StatusBadRequest, err
+	}
+	targetURL := targets[0]
+	from := joinSources(sources)
+	opts, err := parseCopyOptions(r)
+	if err != nil {
+		return CopyResponse{}, http.StatusBadRequest, err
+	}
+	labels, err := parseLabels(r.URL.Query()["label"])
+	if err != nil {
+		return CopyResponse{}, http.StatusBadRequest, err
+	}
+	if len(targets) > 1 {
+		if err := fanoutIncompatible(opts); err != nil {
+			return CopyResponse{}, http.StatusBadRequest, err
+		}
+	}
+	sources, skipped, err := resolveSourceCollisions(sources, to, opts.Collisions)
+	if err != nil {
+		return CopyResponse{}, http.StatusBadRequest, err
+	}
+	jobID := r.URL.Query().Get("jobId")
+	if jobID == "" {
+		jobID = newJobID()
+	}
+	if opts.Lock {
+		release, err := acquireJobLocks(copyLocks(jobID, sources, to, targets))
+		if err != nil {
+			return CopyResponse{}, http.StatusConflict, err
+		}
+		defer release()
+	}
+
+	// a staging=true copy writes into a sibling of 'to' and swaps it in once complete
+	writeTo := to
+	if opts.Staging {
+		writeTo = stagingPath(to, newJobID())
+	}
+	for _, target := range targets {
+		if err := precheckTarget(target, writeTo, opts.Precheck); err != nil {
+			log.Println(err)
+			return CopyResponse{}, http.StatusBadGateway, err
+		}
+	}
+	// the options are adapted to every target, a fanned out copy gets what all of them support
+	var adaptations []string
+	for _, target := range targets {
+		adapted, err := adaptToPeer(&opts, target, peerCapabilities(target))
+		adaptations = append(adaptations, adapted...)
+		if err != nil {
+			return CopyResponse{}, http.StatusPreconditionFailed, err
+		}
+	}
+	for _, a := range adaptations {
+		log.Println(a)
+	}
+
+	client, releaseClient, err := getClientPool().acquire()
+	if err != nil {
+		return CopyResponse{}, http.StatusServiceUnavailable, err
+	}
+	defer releaseClient()
+	for i := range sources {
+		src := &sources[i]
+		src.readFrom, src.writeTo = src.from, writeTo
+		if src.name != "" {
+			src.writeTo = filepath.Join(writeTo, src.name)
+		}
+		if opts.UseSnapshot {
+			src.snapshot, src.readFrom, err = prepareSnapshot(client, src.from, opts)
+			if err != nil {
+				log.Println(err)
+				return CopyResponse{}, http.StatusInternalServerError, err
+			}
+			if opts.DeleteSnapshot {
+				defer releaseSnapshot(client, src.from, src.snapshot)
+			}
+		}
+	}
+	plan, status, err := planCopy(client, sources, from, targetURL, opts)
+	if err != nil {
+		return CopyResponse{}, status, err
+	}
+	tasks, emptyDirs, totalBytesWritten, filesRequested := plan.tasks, plan.emptyDirs, plan.bytes, plan.filesRequested
+	skipped = append(skipped, plan.skipped...)
+	filesSampled, notTaken, cutOff := plan.filesSampled, plan.notTaken, plan.cutOff
+	filesDeduped, bytesDeduped := plan.filesDeduped, plan.bytesDeduped
+	// a contentStore copy sends only the content the store lacks, see contentstore.go
+	var content contentPlan
+	if opts.ContentStore != "" {
+		content, err = planContentStore(client, targetURL, opts.ContentStore, tasks, opts.Workers)
+		if err != nil {
+			log.Println(err)
+			return CopyResponse{}, http.StatusInternalServerError, err
+		}
+		tasks, totalBytesWritten = content.tasks, content.bytes
+		filesDeduped, bytesDeduped = filesDeduped+content.filesDeduped, bytesDeduped+content.bytesDeduped
+		notTaken += content.filesDeduped
+	}
+
+	job, err := startJob(jobID, from, to, strings.Join(targets, ","), labels, tasks)
+	if err != nil {
+		return CopyResponse{}, http.StatusConflict, err
+	}
+	job.setSLA(opts.SLA)
+	opts.Origin = jobOrigin(job.id, labels, opts.Origin.SubmittedBy)
+	froms := make([]string, 0, len(sources))
+	for _, src := range sources {
+		froms = append(froms, src.from)
+	}
+	policy := getApprovalPolicy()
+	if reasons := policy.reasons(len(tasks), totalBytesWritten, froms, to); len(reasons) > 0 {
+		if err := job.awaitApproval(r.Context(), reasons, opts.Origin.SubmittedBy, policy.timeout); err != nil {
+			job.logf("%s", err)
+			job.finish(CopyResponse{JobID: job.id, Labels: labels, From: from, To: to, State: StateRejected})
+			return CopyResponse{}, http.StatusForbidden, err
+		}
+	}
+	datanodesBefore := datanodeSnapshot()
+	open := cachedSource(hdfsSource(client, opts), opts)
+	copied, skippedWhileCopying, copyFailures := runTransfers(open, targets, tasks, opts, job)
+	skipped = append(skipped, skippedWhileCopying...)
+	for _, f := range skippedWhileCopying {
+		for i := range tasks {
+			if tasks[i].Path == f.Path {
+				totalBytesWritten -= tasks[i].Size
+				tasks = append(tasks[:i], tasks[i+1:]...)
+				break
+			}
+		}
+	}
+	if opts.ContentStore != "" {
+		var failures []CopyFailure
+		copied, failures = content.checkCopied(targetURL, copied, job)
+		copyFailures = append(copyFailures, failures...)
+	}
+	// files read from a snapshot can't change under the copy
+	var warnings []CopyWarning
+	if !opts.UseSnapshot {
+		var changed []CopyArgs
+		changed, warnings = changedSources(client, copied)
+		if opts.RecopyChanged && len(changed) > 0 {
+			var failures []CopyFailure
+			copied, warnings, failures = recopyChanged(open, client, targetURL, copied, changed, warnings, opts, job)
+			copyFailures = append(copyFailures, failures...)
+			for _, args := range changed {
+				for i := range tasks {
+					if tasks[i].Path == args.Path {
+						totalBytesWritten += args.Size - tasks[i].Size
+						tasks[i] = args
+						break
+					}
+				}
+			}
+		}
+		for _, w := range warnings {
+			job.logf("Warning: %s: %s", w.Path, w.Detail)
+		}
+	}
+	if cache := getDedupCache(); cache != nil && !opts.Staging {
+		if err := cache.record(targetURL, copied); err != nil {
+			job.logf("Failed to remember the delivered files in %s: %s", cache.path, err)
+		}
+	}
+	var dirsCreated int
+	if opts.CopyEmptyDirs {
+		var failures []CopyFailure
+		dirsCreated, failures = createEmptyDirs(targetURL, emptyDirs, job)
+		copyFailures = append(copyFailures, failures...)
+	}
+	if opts.Manifest {
+		for _, src := range sources {
+			for _, target := range targets {
+				if err := writeManifest(target, src.writeTo, copiedUnder(copied, src.writeTo), opts); err != nil {
+					job.logf("Failed to write manifest to %s on %s: %s", src.writeTo, target, err)
+					copyFailures = addFailure(copyFailures, CopyFailure{Path: filepath.Join(src.writeTo, ManifestFileName), Reason: targetReason(targets, target, err), Targets: failedOn(targets, target)})
+				}
+			}
+		}
+	}
+	if opts.ContentStore != "" {
+		for _, src := range sources {
+			if err := content.writeManifest(targetURL, src.writeTo, copied, opts); err != nil {
+				job.logf("Failed to write the content manifest to %s: %s", src.writeTo, err)
+				copyFailures = append(copyFailures, CopyFailure{Path: filepath.Join(src.writeTo, ContentManifestFileName), Reason: err.Error()})
+			}
+		}
+	}
+	if opts.TTL > 0 {
+		for _, target := range targets {
+			if err := registerExpiration(target, to, opts.TTL, job.id); err != nil {
+				job.logf("Failed to register the ttl of %s on %s: %s", to, target, err)
+				copyFailures = addFailure(copyFailures, CopyFailure{Path: to, Reason: targetReason(targets, target, fmt.Errorf("cannot register its ttl: %w", err)), Targets: failedOn(targets, target)})
+			}
+		}
+	}
+	var receipts []DeliveryReceipt
+	if opts.Receipt {
+		for _, target := range targets {
+			receipt, err := requestReceipt(target, job.id, copied)
+			if err != nil {
+				job.logf("No delivery receipt from %s: %s", target, err)
+				copyFailures = addFailure(copyFailures, CopyFailure{Path: to, Reason: targetReason(targets, target, fmt.Errorf("no delivery receipt: %w", err)), Targets: failedOn(targets, target)})
+				continue
+			}
+			receipts = append(receipts, receipt)
+		}
 	}
-	wg.Wait()
 
 	for _, f := range copyFailures {
 		totalBytesWritten -= f.Size
 	}
 
+	var reconciled *bool
+	var discrepancies []string
+	reconciledDirs := make(map[string]bool)
+	reconciledTargets := make(map[string]bool)
+	if opts.Reconcile {
+		allOK := true
+		for _, target := range targets {
+			reconciledTargets[target] = true
+		}
+		for _, src := range sources {
+			reconciledDirs[src.writeTo] = true
+			for _, dir := range destDirs(tasks, src.writeTo) {
+				for _, target := range targets {
+					ok, d := reconcileWithPeer(target, dir, tasksInto(tasks, dir))
+					reconciledDirs[src.writeTo], allOK = reconciledDirs[src.writeTo] && ok, allOK && ok
+					reconciledTargets[target] = reconciledTargets[target] && ok
+					for _, discrepancy := range d {
+						if src.name != "" || dir != src.writeTo {
+							discrepancy = dir + ": " + discrepancy
+						}
+						if len(targets) > 1 {
+							discrepancy = target + ": " + discrepancy
+						}
+						discrepancies = append(discrepancies, discrepancy)
+						job.logf("Reconciliation: %s", discrepancy)
+					}
+				}
+			}
+		}
+		reconciled = &allOK
+	}
+
+	var verification *VerifyResult
+	if opts.VerifySample > 0 {
+		res := verifySample(client, targetURL, copied, opts.VerifySample, opts.Workers)
+		verification = &res
+		job.logf("Verified %d of %d copied files (%.1f%% of bytes), %d mismatches", res.FilesVerified, res.FilesCopied, res.Coverage, len(res.Mismatches))
+		for _, m := range res.Mismatches {
+			job.logf("Verification: %s: %s", m.Path, m.Reason)
+			if m.QuarantinedAs != "" {
+				job.logf("Quarantined %s as %s", m.Path, m.QuarantinedAs)
+			}
+		}
+	}
+
+	state := StateSucceeded
+	if len(copyFailures) > 0 || (reconciled != nil && !*reconciled) || (verification != nil && len(verification.Mismatches) > 0) {
+		state = StateFailed
+	}
+	for _, f := range copyFailures {
+		if f.TargetUnavailable {
+			state = StateTargetUnavailable
+			break
+		}
+	}
+	if opts.WriteSuccess && state == StateSucceeded {
+		for _, src := range sources {
+			for _, target := range targets {
+				if err := writeSuccessMarker(target, src.writeTo, opts); err != nil {
+					job.logf("Failed to write %s to %s on %s: %s", SuccessMarker, src.writeTo, target, err)
+					copyFailures = addFailure(copyFailures, CopyFailure{Path: filepath.Join(src.writeTo, SuccessMarker), Reason: targetReason(targets, target, err), Targets: failedOn(targets, target)})
+					state = StateFailed
+				}
+			}
+		}
+	}
+	var staging, previous string
+	if opts.Staging {
+		staging = writeTo
+		if state == StateSucceeded {
+			swap, err := requestSwap(targetURL, writeTo, to)
+			if err != nil {
+				job.logf("Failed to swap %s into %s: %s", writeTo, to, err)
+				copyFailures = append(copyFailures, CopyFailure{Path: to, Reason: err.Error()})
+				state = StateFailed
+			} else {
+				previous = swap.Previous
+				job.logf("Swapped %s into %s, previous version moved to '%s'", writeTo, to, previous)
+			}
+		} else {
+			job.logf("Leaving %s in place for inspection, %s is unchanged", writeTo, to)
+		}
+	}
+
+	var partitions []HivePartition
+	if opts.HiveTable != "" && state == StateSucceeded {
+		for _, src := range sources {
+			partitions = append(partitions, copiedPartitions(tasks, src.writeTo, writeTo, to)...)
+		}
+		if len(partitions) > 0 {
+			partitions = registerPartitions(getWebhcatSettings(), opts.HiveDatabase, opts.HiveTable, partitions, opts.HiveRepair, job)
+		}
+		for _, p := range partitions {
+			if p.Error != "" {
+				copyFailures = append(copyFailures, CopyFailure{Path: p.Location, Reason: p.Error})
+				state = StateFailed
+			}
+		}
+	}
+
+	var snapshot string
+	var perSource []SourceResult
+	if sources[0].name == "" {
+		snapshot = sources[0].snapshot
+	} else {
+		perSource = sourceResults(sources, tasks, copied, skipped, copyFailures, reconciledDirs)
+	}
 	elapsed := time.Since(start).Seconds()
 	resp := CopyResponse{
+		JobID:          job.id,
+		Labels:         labels,
 		From:           from,
 		To:             to,
 		Written:        totalBytesWritten,
-		FilesRequested: int64(len(fileInfos)),
-		FilesCopied:    int64(len(fileInfos) - len(copyFailures)),
+		FilesRequested: int64(filesRequested),
+		FilesCopied:    int64(filesRequested - len(copyFailures) - len(skipped) - notTaken),
 		CopyFailures:   copyFailures,
+		FilesSkipped:   int64(len(skipped)),
+		Skipped:        skipped,
+		Snapshot:       snapshot,
+		Staging:        staging,
+		Previous:       previous,
+		FilesSampled:   int64(filesSampled),
+		DirsCreated:    int64(dirsCreated),
+		CutOff:         cutOff,
+		FilesDeduped:   int64(filesDeduped),
+		BytesDeduped:   bytesDeduped,
+		Warnings:       warnings,
+		Adaptations:    adaptations,
+		Datanodes:      datanodesSince(datanodesBefore),
+		HivePartitions: partitions,
+		State:          state,
+		Reconciled:     reconciled,
+		Discrepancies:  discrepancies,
+		Verification:   verification,
+		Receipts:       receipts,
+		Sources:        perSource,
+		Targets:        targetResults(targets, tasks, copyFailures, reconciledTargets),
 		Throughput:     (float64(totalBytesWritten) * 8 / elapsed) / 1000000, // conversion to mbps
 		ElapsedSecs:    elapsed,
 	}
+	resp.Egress = reportedEgress(targets, resp)
+	job.finish(resp)
 	json, _ := json.MarshalIndent(resp, "", "  ")
 	log.Println(string(json))
-	if len(copyFailuresCh) > 0 {
-		http.Error(w, string(json), http.StatusInternalServerError)
-		return
+	if state == StateSucceeded {
+		job.logf("Copied %d files successfully.", resp.FilesCopied)
 	}
-	log.Printf("Copied %d files successfully.", resp.FilesCopied)
-	w.Write(json)
+	return resp, http.StatusOK, nil
 }
 
 func main() {
-	defer HdfsClient.Close()
+	params := url.Values{}
+	oneshot := flag.Bool("oneshot", false, "perform a single copy described by the flags and exit instead of serving")
+	from := flag.String("from", "", "oneshot: the hdfs dir to copy")
+	to := flag.String("to", "", "oneshot: the dir to copy into on the target cluster")
+	targetURL := flag.String("targetURL", "", "oneshot: the target fastcopy's /upload url")
+	flag.Var(paramsFlag(params), "param", "oneshot: a /copy query param as name=value, repeatable, e.g. -param manifest=true")
+	flag.Parse()
 
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("{\"status\":\"200 OK\"}")) })
-	http.HandleFunc("/copy", handleCopy)
-	http.HandleFunc("/upload", handleUpload)
-	log.Println("fastcopy server listening on :8080...")
+	if err := setupLogging(); err != nil {
+		log.Fatalf("invalid logging configuration: %s", err)
+	}
+	if err := validateStartup(); err != nil {
+		log.Fatalf("invalid configuration, refusing to start:\n%s", err)
+	}
+	if *oneshot {
+		params.Set("from", *from)
+		params.Set("to", *to)
+		params.Set("targetURL", *targetURL)
+		code := runOneshot(params, os.Stdout)
+		getClientPool().retireAll()
+		GetHdfsClient().Close()
+		os.Exit(code)
+	}
+	defer func() {
+		getClientPool().retireAll()
+		GetHdfsClient().Close()
+	}()
+	if limiter := getBandwidthLimiter(); limiter != nil {
+		log.Printf("bandwidth schedule active, current limit: %.0f Mbps (0 = unlimited)", limiter.currentMbps())
+	}
+	if limiter := getInflightLimiter(); limiter != nil {
+		log.Printf("in-flight transfers capped at %d bytes", limiter.max)
+	}
+	if interval, _ := keytabPollInterval(); os.Getenv("KRB_ENABLED") == "true" && interval > 0 {
+		reload := func() error { _, err := reloadCredentials(); return err }
+		path, _ := keytabPath()
+		go watchKeytab(path, interval, reload, nil)
+		log.Printf("watching keytab %s for rotation every %s", path, interval)
+	}
+	go runReaper(getRetentionSettings().interval, nil)
+	if gate := getNamenodeGate(); gate != nil {
+		log.Printf("namenode admission control active, polling %s", os.Getenv("FASTCOPY_NAMENODE_JMX"))
+	}
+
+	addr := os.Getenv("FASTCOPY_ADDR")
+	if addr == "" {
+		addr = DefaultAddr
+	}
+	listeners, err := listen(addr)
+	if err != nil {
+		log.Fatalf("failed to listen on %s: %s", addr, err)
+	}
 
 	srv := &http.Server{
-		Addr:         ":8080",
+		Handler:      newRouter(os.Getenv("FASTCOPY_BASE_PATH")),
 		ReadTimeout:  2 * time.Minute,
-		WriteTimeout: 15 * time.Minute,
+		WriteTimeout: serverWriteTimeout,
 		IdleTimeout:  5 * time.Minute,
 	}
 
-	err := srv.ListenAndServe()
-	if err != nil {
+	drained := make(chan error, 1)
+	go func() { drained <- drainOn(srv, drainSignals(), getDrainSettings().timeout) }()
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		log.Printf("fastcopy server listening on %s %s...", l.Addr().Network(), l.Addr())
+		go func(l net.Listener) { errs <- srv.Serve(l) }(l)
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalf("failed to start http server: %s", err)
 	}
+	if err := <-drained; err != nil {
+		log.Print(err)
+	}
 }
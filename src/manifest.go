@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// written to the destination dir at the end of a copy with manifest=true
+	ManifestFileName = "_MANIFEST.tsv"
+	// Hadoop's marker for complete job output
+	SuccessMarker = "_SUCCESS"
+)
+
+// renders the manifest: a header line, then one tab separated line per copied file with
+// its path relative to the destination dir, size, hex sha256 as computed by the receiver and copy time.
+// a dataset can be verified with e.g.
+//
+//	tail -n +2 _MANIFEST.tsv | awk -F'\t' '{print $3 "  " $1}' | sha256sum -c
+func renderManifest(copied []CopiedFile) []byte {
+	sorted := append([]CopiedFile{}, copied...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Args.File < sorted[j].Args.File })
+
+	var buf bytes.Buffer
+	buf.WriteString("path\tsize\tsha256\ttimestamp\n")
+	for _, f := range sorted {
+		sum, _ := base64.StdEncoding.DecodeString(f.Upload.SHA256)
+		fmt.Fprintf(&buf, "%s\t%d\t%s\t%s\n", f.Args.File, f.Upload.Written, hex.EncodeToString(sum), f.CopiedAt.UTC().Format(time.RFC3339))
+	}
+	return buf.Bytes()
+}
+
+// uploads the manifest of the copied files into 'to' on the target
+func writeManifest(targetURL string, to string, copied []CopiedFile, opts CopyOptions) error {
+	manifest := renderManifest(copied)
+	args := CopyArgs{File: ManifestFileName, Path: ManifestFileName, To: to, Size: int64(len(manifest))}
+	opts.Delta = false
+	_, err := send(bytes.NewReader(manifest), targetURL, args, opts)
+	return err
+}
+
+// uploads an empty _SUCCESS marker into 'to' on the target
+func writeSuccessMarker(targetURL string, to string, opts CopyOptions) error {
+	args := CopyArgs{File: SuccessMarker, Path: SuccessMarker, To: to}
+	opts.Delta = false
+	_, err := send(bytes.NewReader(nil), targetURL, args, opts)
+	return err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRenderManifest(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 30, 0, 0, time.FixedZone("CET", 3600))
+	copied := []CopiedFile{
+		{Args: CopyArgs{File: "sub/b.parquet"}, Upload: UploadResponse{Written: 2048, SHA256: "Aas="}, CopiedAt: at},
+		{Args: CopyArgs{File: "a.parquet"}, Upload: UploadResponse{Written: 0, SHA256: "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}, CopiedAt: at.Add(time.Second)},
+	}
+	expected := "path\tsize\tsha256\ttimestamp\n" +
+		"a.parquet\t0\te3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\t2024-03-01T11:30:01Z\n" +
+		"sub/b.parquet\t2048\t01ab\t2024-03-01T11:30:00Z\n"
+	if manifest := string(renderManifest(copied)); manifest != expected {
+		t.Errorf("expected the manifest\n%s\ngot\n%s", expected, manifest)
+	}
+	if manifest := string(renderManifest(nil)); manifest != "path\tsize\tsha256\ttimestamp\n" {
+		t.Errorf("expected only the header for no files, got %q", manifest)
+	}
+}
+
+func TestRequireSuccess(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{"/job/part-00000": "data"})
+	peer := httptest.NewServer(apiMux())
+	defer peer.Close()
+
+	query := url.Values{"from": {"/job"}, "to": {"/backup"}, "targetURL": {peer.URL + "/upload"}, "requireSuccess": {"true"}}
+	rec := httptest.NewRecorder()
+	handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+	if rec.Code != http.StatusPreconditionFailed || !strings.Contains(rec.Body.String(), SuccessMarker) {
+		t.Errorf("expected incomplete job output to be refused, got %d %s", rec.Code, rec.Body)
+	}
+	if _, ok := fs.get("/backup/part-00000"); ok {
+		t.Error("expected nothing to be copied")
+	}
+}
+
+func TestWriteSuccessMarkerLast(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{"/job/part-00000": "aaaa", "/job/part-00001": "bbbb", "/job/" + SuccessMarker: ""})
+	api := apiMux()
+	var mu sync.Mutex
+	var calls []string
+	checksumsDown := false
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/upload" || r.URL.Path == "/checksum" {
+			mu.Lock()
+			calls = append(calls, r.URL.Path+" "+r.URL.Query().Get("fileName")+r.URL.Query().Get("path"))
+			down := checksumsDown && r.URL.Path == "/checksum"
+			mu.Unlock()
+			if down {
+				writeError(w, "checksums are down", http.StatusInternalServerError)
+				return
+			}
+		}
+		api.ServeHTTP(w, r)
+	}))
+	defer peer.Close()
+
+	query := url.Values{"from": {"/job"}, "to": {"/backup"}, "targetURL": {peer.URL + "/upload"}, "writeSuccess": {"true"}, "verifySample": {"100"}}
+	rec := httptest.NewRecorder()
+	handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the copy to succeed, got %d %s", rec.Code, rec.Body)
+	}
+	var uploads, checksums int
+	for i, call := range calls {
+		switch {
+		case call == "/upload "+SuccessMarker:
+			if i != len(calls)-1 {
+				t.Errorf("expected the marker to be written last, got %v", calls)
+			}
+		case strings.HasPrefix(call, "/upload"):
+			uploads++
+		default:
+			checksums++
+		}
+	}
+	if uploads != 2 || checksums != 2 || calls[len(calls)-1] != "/upload "+SuccessMarker {
+		t.Errorf("expected both files copied and verified, the source's marker left out, then the marker written, got %v", calls)
+	}
+	if _, ok := fs.get("/backup/" + SuccessMarker); !ok {
+		t.Error("expected the marker in the destination")
+	}
+
+	// a copy failing verification writes no marker
+	fs.Remove("/backup/" + SuccessMarker)
+	mu.Lock()
+	checksumsDown = true
+	mu.Unlock()
+	rec = httptest.NewRecorder()
+	handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+	if _, ok := fs.get("/backup/" + SuccessMarker); ok || rec.Code == http.StatusOK {
+		t.Errorf("expected no marker for an unverified copy, got %d %s", rec.Code, rec.Body)
+	}
+}
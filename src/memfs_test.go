@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/colinmarc/hdfs/v2"
+)
+
+// an in-memory FileSystem for tests
+type memFS struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	dirs  map[string]bool
+	links map[string]string // symlinks and their targets, only listed
+	modes map[string]os.FileMode
+	attrs map[string]map[string]string // xattrs of files
+}
+
+func newMemFS() *memFS {
+	return &memFS{files: make(map[string][]byte), dirs: map[string]bool{"/": true}, links: make(map[string]string), modes: make(map[string]os.FileMode), attrs: make(map[string]map[string]string)}
+}
+
+// installs a fresh memFS as the global hdfs client for the duration of the test
+func useMemFS(t *testing.T) *memFS {
+	fs := newMemFS()
+	prev := HdfsClient
+	HdfsClient = fs
+	clientPoolOnce.Do(func() {})
+	prevPool := clientPoolInst
+	clientPoolInst = newClientPool(1, func() (FileSystem, error) { return fs, nil })
+	t.Cleanup(func() { HdfsClient, clientPoolInst = prev, prevPool })
+	return fs
+}
+
+func notExist(op string, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+type memFileInfo struct {
+	name  string
+	size  int64
+	isDir bool
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return fi.isDir }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+func (fi memFileInfo) Mode() os.FileMode {
+	if fi.isDir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// a listed symlink, described like the hdfs client does
+type memLinkInfo struct {
+	memFileInfo
+	target string
+}
+
+func (fi memLinkInfo) Sys() interface{} { return &hdfs.FileStatus{Symlink: []byte(fi.target)} }
+
+// a dir or file whose permissions were changed with Chmod
+type memModeInfo struct {
+	memFileInfo
+	mode os.FileMode
+}
+
+func (fi memModeInfo) Mode() os.FileMode { return fi.memFileInfo.Mode()&^os.ModePerm | fi.mode }
+
+type memReader struct {
+	*bytes.Reader
+	info memFileInfo
+}
+
+func (r memReader) Close() error      { return nil }
+func (r memReader) Stat() os.FileInfo { return r.info }
+
+type memWriter struct {
+	fs   *memFS
+	name string
+	buf  bytes.Buffer
+}
+
+func (w *memWriter) Write(p []byte) (int, error) { return w.buf.Write(p) }
+
+func (w *memWriter) Close() error {
+	w.fs.mu.Lock()
+	defer w.fs.mu.Unlock()
+	w.fs.files[w.name] = w.buf.Bytes()
+	return nil
+}
+
+func (fs *memFS) Open(name string) (HdfsReader, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	data, ok := fs.files[path.Clean(name)]
+	if !ok {
+		return nil, notExist("open", name)
+	}
+	return memReader{bytes.NewReader(data), memFileInfo{path.Base(name), int64(len(data)), false}}, nil
+}
+
+func (fs *memFS) Create(name string) (io.WriteCloser, error) {
+	name = path.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.files[name]; ok {
+		return nil, &os.PathError{Op: "create", Path: name, Err: os.ErrExist}
+	}
+	if !fs.dirs[path.Dir(name)] {
+		return nil, notExist("create", name)
+	}
+	fs.files[name] = nil
+	return &memWriter{fs: fs, name: name}, nil
+}
+
+func (fs *memFS) Append(name string) (io.WriteCloser, error) {
+	name = path.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	data, ok := fs.files[name]
+	if !ok {
+		return nil, notExist("append", name)
+	}
+	w := &memWriter{fs: fs, name: name}
+	w.buf.Write(data)
+	return w, nil
+}
+
+func (fs *memFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	dirname = path.Clean(dirname)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if !fs.dirs[dirname] {
+		return nil, notExist("readdir", dirname)
+	}
+	var infos []os.FileInfo
+	for name, data := range fs.files {
+		if path.Dir(name) == dirname {
+			infos = append(infos, memFileInfo{path.Base(name), int64(len(data)), false})
+		}
+	}
+	for dir := range fs.dirs {
+		if dir != dirname && path.Dir(dir) == dirname {
+			infos = append(infos, memFileInfo{path.Base(dir), 0, true})
+		}
+	}
+	for link, target := range fs.links {
+		if path.Dir(link) == dirname {
+			infos = append(infos, memLinkInfo{memFileInfo{path.Base(link), 0, false}, target})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (fs *memFS) ReadFile(filename string) ([]byte, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	data, ok := fs.files[path.Clean(filename)]
+	if !ok {
+		return nil, notExist("open", filename)
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (fs *memFS) Stat(name string) (os.FileInfo, error) {
+	name = path.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if data, ok := fs.files[name]; ok {
+		return memFileInfo{path.Base(name), int64(len(data)), false}, nil
+	}
+	if fs.dirs[name] {
+		if mode, ok := fs.modes[name]; ok {
+			return memModeInfo{memFileInfo{path.Base(name), 0, true}, mode}, nil
+		}
+		return memFileInfo{path.Base(name), 0, true}, nil
+	}
+	return nil, notExist("stat", name)
+}
+
+func (fs *memFS) Chmod(name string, perm os.FileMode) error {
+	name = path.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.files[name]; !ok && !fs.dirs[name] {
+		return notExist("chmod", name)
+	}
+	fs.modes[name] = perm
+	return nil
+}
+
+func (fs *memFS) ListXAttrs(name string) (map[string]string, error) {
+	name = path.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.files[name]; !ok {
+		return nil, notExist("list xattrs", name)
+	}
+	attrs := make(map[string]string, len(fs.attrs[name]))
+	for k, v := range fs.attrs[name] {
+		attrs[k] = v
+	}
+	return attrs, nil
+}
+
+func (fs *memFS) SetXAttr(name, key, value string) error {
+	name = path.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.files[name]; !ok {
+		return notExist("set xattr", name)
+	}
+	if fs.attrs[name] == nil {
+		fs.attrs[name] = make(map[string]string)
+	}
+	fs.attrs[name][key] = value
+	return nil
+}
+
+func (fs *memFS) MkdirAll(dirname string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for dir := path.Clean(dirname); !fs.dirs[dir]; dir = path.Dir(dir) {
+		fs.dirs[dir] = true
+	}
+	return nil
+}
+
+func (fs *memFS) Remove(name string) error {
+	name = path.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.files[name]; ok {
+		delete(fs.files, name)
+		delete(fs.attrs, name)
+		return nil
+	}
+	if fs.dirs[name] {
+		delete(fs.dirs, name)
+		return nil
+	}
+	return notExist("remove", name)
+}
+
+func (fs *memFS) Rename(oldpath, newpath string) error {
+	oldpath, newpath = path.Clean(oldpath), path.Clean(newpath)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.dirs[oldpath] {
+		// like hdfs, a dir is moved with everything below it and never over an existing path
+		if _, ok := fs.files[newpath]; ok || fs.dirs[newpath] {
+			return &os.PathError{Op: "rename", Path: newpath, Err: os.ErrExist}
+		}
+		for dir := range fs.dirs {
+			if dir == oldpath || strings.HasPrefix(dir, oldpath+"/") {
+				delete(fs.dirs, dir)
+				fs.dirs[newpath+strings.TrimPrefix(dir, oldpath)] = true
+			}
+		}
+		for file, data := range fs.files {
+			if strings.HasPrefix(file, oldpath+"/") {
+				delete(fs.files, file)
+				fs.files[newpath+strings.TrimPrefix(file, oldpath)] = data
+			}
+		}
+		return nil
+	}
+	data, ok := fs.files[oldpath]
+	if !ok {
+		return notExist("rename", oldpath)
+	}
+	delete(fs.files, oldpath)
+	fs.files[newpath] = data
+	fs.attrs[newpath] = fs.attrs[oldpath]
+	delete(fs.attrs, oldpath)
+	return nil
+}
+
+// copies the files directly in dir into dir/.snapshot/name
+func (fs *memFS) CreateSnapshot(dir, name string) (string, error) {
+	snapshot := snapshotPath(dir, name)
+	fs.MkdirAll(snapshot, 0755)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for file, data := range fs.files {
+		if path.Dir(file) == path.Clean(dir) {
+			fs.files[path.Join(snapshot, path.Base(file))] = data
+		}
+	}
+	return snapshot, nil
+}
+
+func (fs *memFS) DeleteSnapshot(dir, name string) error {
+	prefix := snapshotPath(dir, name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for file := range fs.files {
+		if strings.HasPrefix(file, prefix+"/") {
+			delete(fs.files, file)
+		}
+	}
+	delete(fs.dirs, prefix)
+	return nil
+}
+
+func (fs *memFS) Close() error { return nil }
+
+// writes files with the given contents, creating their dirs
+func (fs *memFS) put(files map[string]string) {
+	for name, data := range files {
+		fs.MkdirAll(path.Dir(name), 0755)
+		fs.mu.Lock()
+		fs.files[path.Clean(name)] = []byte(data)
+		fs.mu.Unlock()
+	}
+}
+
+func (fs *memFS) symlink(name string, target string) {
+	fs.MkdirAll(path.Dir(name), 0755)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.links[path.Clean(name)] = target
+}
+
+func (fs *memFS) get(name string) (string, bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	data, ok := fs.files[path.Clean(name)]
+	return string(data), ok
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+)
+
+// uploads tell the receiver where they come from: the job sending them, the cluster it runs on
+// (FASTCOPY_CLUSTER), who submitted it ('submittedBy', by default the identity this server reads hdfs as) and the
+// job's labels, so a receiver shared by several teams can log, authorize and account for inbound data per job and
+// tenant. the receiver logs the origin of each upload and lists it under /uploads. FASTCOPY_USER_AGENT replaces
+// the default User-Agent of uploads, e.g. to tell apart the deployments sending to a receiver
+
+const (
+	jobIDHeader         = "X-Fastcopy-Job-Id"
+	sourceClusterHeader = "X-Fastcopy-Source-Cluster"
+	submittedByHeader   = "X-Fastcopy-Submitted-By"
+	labelHeader         = "X-Fastcopy-Label" // one key=value per label
+)
+
+// the User-Agent of uploads unless FASTCOPY_USER_AGENT is set
+var defaultUserAgent = "fastcopy/" + APIVersion
+
+// where an upload comes from
+type UploadOrigin struct {
+	JobID         string            `json:"jobId,omitempty"`
+	SourceCluster string            `json:"sourceCluster,omitempty"`
+	SubmittedBy   string            `json:"submittedBy,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	UserAgent     string            `json:"userAgent,omitempty"`
+}
+
+func (o UploadOrigin) String() string {
+	return fmt.Sprintf("job %s from %s submitted by %s (%s), labels [%s]", o.JobID, o.SourceCluster, o.SubmittedBy, o.UserAgent, formatLabels(o.Labels))
+}
+
+type requestMetadata struct {
+	userAgent string
+	cluster   string
+}
+
+var (
+	metadata     requestMetadata
+	metadataOnce sync.Once
+)
+
+// reads FASTCOPY_USER_AGENT and FASTCOPY_CLUSTER
+func loadRequestMetadata() (requestMetadata, error) {
+	m := requestMetadata{userAgent: defaultUserAgent, cluster: os.Getenv("FASTCOPY_CLUSTER")}
+	if v := os.Getenv("FASTCOPY_USER_AGENT"); v != "" {
+		m.userAgent = v
+	}
+	for name, v := range map[string]string{"FASTCOPY_USER_AGENT": m.userAgent, "FASTCOPY_CLUSTER": m.cluster} {
+		if !validHeaderValue(v) {
+			return requestMetadata{}, fmt.Errorf("invalid %s '%s', it can't contain control characters", name, v)
+		}
+	}
+	return m, nil
+}
+
+// lazy loads the metadata sent with uploads
+func getRequestMetadata() requestMetadata {
+	metadataOnce.Do(func() {
+		m, err := loadRequestMetadata()
+		if err != nil {
+			log.Fatal(err)
+		}
+		metadata = m
+	})
+	return metadata
+}
+
+func validHeaderValue(v string) bool {
+	return strings.IndexFunc(v, func(r rune) bool { return r < ' ' || r == 0x7f }) < 0
+}
+
+// the identity this server reads hdfs as
+func localIdentity() string {
+	if os.Getenv("KRB_ENABLED") == "true" {
+		return os.Getenv("KRB_USER") + "@" + os.Getenv("KRB_REALM")
+	}
+	if name := os.Getenv("HADOOP_USER_NAME"); name != "" {
+		return name
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return ""
+}
+
+// the origin of the uploads of a job, submitted by the caller naming itself in 'submittedBy'
+func jobOrigin(jobID string, labels map[string]string, submittedBy string) UploadOrigin {
+	if submittedBy == "" {
+		submittedBy = localIdentity()
+	}
+	m := getRequestMetadata()
+	return UploadOrigin{JobID: jobID, SourceCluster: m.cluster, SubmittedBy: submittedBy, Labels: labels, UserAgent: m.userAgent}
+}
+
+// checks 'submittedBy' can be sent in a header
+func checkSubmittedBy(v string) error {
+	if !validHeaderValue(v) {
+		return fmt.Errorf("'submittedBy' can't contain control characters")
+	}
+	return nil
+}
+
+// sets the headers telling the receiver where an upload comes from
+func setOriginHeaders(header http.Header, origin UploadOrigin) {
+	header.Set("User-Agent", getRequestMetadata().userAgent)
+	for k, v := range map[string]string{jobIDHeader: origin.JobID, sourceClusterHeader: origin.SourceCluster, submittedByHeader: origin.SubmittedBy} {
+		if v != "" {
+			header.Set(k, v)
+		}
+	}
+	for _, k := range sortedKeys(origin.Labels) {
+		header.Add(labelHeader, k+"="+origin.Labels[k])
+	}
+}
+
+// where the upload r comes from, nil if the sender didn't say
+func uploadOrigin(r *http.Request) *UploadOrigin {
+	o := UploadOrigin{
+		JobID:         r.Header.Get(jobIDHeader),
+		SourceCluster: r.Header.Get(sourceClusterHeader),
+		SubmittedBy:   r.Header.Get(submittedByHeader),
+		UserAgent:     r.UserAgent(),
+	}
+	if o.JobID == "" && o.SourceCluster == "" && o.SubmittedBy == "" {
+		return nil
+	}
+	if labels, err := parseLabels(r.Header.Values(labelHeader)); err == nil && len(labels) > 0 {
+		o.Labels = labels
+	}
+	return &o
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func useRequestMetadata(t *testing.T, m requestMetadata) {
+	metadataOnce.Do(func() {})
+	prev := metadata
+	metadata = m
+	t.Cleanup(func() { metadata = prev })
+}
+
+func TestUploadOrigin(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{"/data/a": "aaaa"})
+	useRequestMetadata(t, requestMetadata{userAgent: "fastcopy-prod/3", cluster: "dc1"})
+	var origins []*UploadOrigin
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/upload" {
+			origins = append(origins, uploadOrigin(r))
+		}
+		apiMux().ServeHTTP(w, r)
+	}))
+	defer peer.Close()
+
+	query := url.Values{"from": {"/data"}, "to": {"/backup"}, "targetURL": {peer.URL + "/upload"}, "precheck": {"none"},
+		"jobId": {"nightly-1"}, "submittedBy": {"etl@CORP"}, "label": {"team=data", "dataset=events"}}
+	rec := httptest.NewRecorder()
+	handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("copy failed: %d %s", rec.Code, rec.Body)
+	}
+	expected := &UploadOrigin{JobID: "nightly-1", SourceCluster: "dc1", SubmittedBy: "etl@CORP", UserAgent: "fastcopy-prod/3",
+		Labels: map[string]string{"team": "data", "dataset": "events"}}
+	if len(origins) != 1 || !reflect.DeepEqual(origins[0], expected) {
+		t.Errorf("expected the upload to come from %+v, got %+v", expected, origins)
+	}
+
+	if o := uploadOrigin(httptest.NewRequest("POST", "/upload", nil)); o != nil {
+		t.Errorf("expected no origin from a sender not naming one, got %+v", o)
+	}
+	rec = httptest.NewRecorder()
+	handleCopy(rec, httptest.NewRequest("POST", "/copy?"+url.Values{"from": {"/data"}, "to": {"/backup"}, "targetURL": {peer.URL + "/upload"}, "label": {"team=a\nb"}}.Encode(), nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected a label that can't be sent in a header to be refused, got %d", rec.Code)
+	}
+}
+
+func TestLoadRequestMetadata(t *testing.T) {
+	t.Setenv("FASTCOPY_USER_AGENT", "")
+	t.Setenv("FASTCOPY_CLUSTER", "dc1")
+	m, err := loadRequestMetadata()
+	if err != nil || m.userAgent != defaultUserAgent || m.cluster != "dc1" {
+		t.Errorf("unexpected metadata %+v %v", m, err)
+	}
+	t.Setenv("FASTCOPY_USER_AGENT", "fastcopy\r\nX-Injected: 1")
+	if _, err := loadRequestMetadata(); err == nil {
+		t.Error("expected a user agent with a line break to be refused")
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// how far back the failure ratios look, so an alert rule can compare them with a threshold as they are
+const failureWindow = time.Hour
+
+// the files and bytes of finished copies, and whether they failed
+type copyOutcome struct {
+	at          time.Time
+	state       string
+	files       int64
+	filesFailed int64
+	bytes       int64
+	bytesFailed int64
+}
+
+// the outcomes of the copies finished since the start, and within failureWindow
+type copyOutcomes struct {
+	mu     sync.Mutex
+	total  copyOutcome
+	states map[string]int64 // jobs finished by state
+	recent []copyOutcome    // oldest first
+}
+
+var outcomes = &copyOutcomes{states: make(map[string]int64)}
+
+func (o copyOutcome) failed() bool {
+	return o.state == StateFailed || o.state == StateTargetUnavailable
+}
+
+// records the outcome of a finished copy
+func (c *copyOutcomes) record(resp CopyResponse, at time.Time) {
+	o := copyOutcome{at: at, state: resp.State, files: resp.FilesCopied, bytes: resp.Written}
+	for _, f := range resp.CopyFailures {
+		o.filesFailed++
+		o.bytesFailed += f.Size
+	}
+	o.files += o.filesFailed
+	o.bytes += o.bytesFailed
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.total.files += o.files
+	c.total.filesFailed += o.filesFailed
+	c.total.bytes += o.bytes
+	c.total.bytesFailed += o.bytesFailed
+	c.states[o.state]++
+	c.recent = append(c.recent, o)
+	c.prune(at)
+}
+
+// drops the outcomes older than failureWindow
+func (c *copyOutcomes) prune(now time.Time) {
+	i := 0
+	for i < len(c.recent) && now.Sub(c.recent[i].at) > failureWindow {
+		i++
+	}
+	c.recent = c.recent[i:]
+}
+
+// the outcomes within failureWindow summed up, with the number of copies finished and failed
+func (c *copyOutcomes) window(now time.Time) (copyOutcome, int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.prune(now)
+	var sum copyOutcome
+	var failed int
+	for _, o := range c.recent {
+		sum.files += o.files
+		sum.filesFailed += o.filesFailed
+		sum.bytes += o.bytes
+		sum.bytesFailed += o.bytesFailed
+		if o.failed() {
+			failed++
+		}
+	}
+	return sum, len(c.recent), failed
+}
+
+// part of total as a ratio, 0 of nothing
+func ratio(part int64, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) / float64(total)
+}
+
+// Serves job gauges and alert counters in the Prometheus text format
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	jobsMu.Lock()
+	list := make([]*Job, 0, len(jobs))
+	for _, job := range jobs {
+		list = append(list, job)
+	}
+	jobsMu.Unlock()
+
+	byState := make(map[string]int)
+	for _, state := range jobStates {
+		byState[state] = 0
+	}
+	var stalled, breached int
+	for _, job := range list {
+		job.mu.Lock()
+		byState[job.state]++
+		if job.state == StateRunning {
+			if job.alerted[AlertStalled] {
+				stalled++
+			}
+			if job.slaBreached() {
+				breached++
+			}
+		}
+		job.mu.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP fastcopy_jobs Jobs kept by this instance by state.")
+	fmt.Fprintln(w, "# TYPE fastcopy_jobs gauge")
+	for _, state := range sortedKeys(byState) {
+		fmt.Fprintf(w, "fastcopy_jobs{state=%q} %d\n", state, byState[state])
+	}
+	fmt.Fprintln(w, "# HELP fastcopy_jobs_stalled Running jobs that moved no bytes for their stall timeout.")
+	fmt.Fprintln(w, "# TYPE fastcopy_jobs_stalled gauge")
+	fmt.Fprintf(w, "fastcopy_jobs_stalled %d\n", stalled)
+	fmt.Fprintln(w, "# HELP fastcopy_jobs_sla_breached Running jobs past their expected duration or below their minimum throughput.")
+	fmt.Fprintln(w, "# TYPE fastcopy_jobs_sla_breached gauge")
+	fmt.Fprintf(w, "fastcopy_jobs_sla_breached %d\n", breached)
+
+	alertCountsMu.Lock()
+	counts := make(map[string]int, len(alertCounts))
+	for _, kind := range []string{AlertStalled, AlertOverdue, AlertSlow} {
+		counts[kind] = int(alertCounts[kind])
+	}
+	alertCountsMu.Unlock()
+	fmt.Fprintln(w, "# HELP fastcopy_job_alerts_total Alerts raised on jobs by kind.")
+	fmt.Fprintln(w, "# TYPE fastcopy_job_alerts_total counter")
+	for _, kind := range sortedKeys(counts) {
+		fmt.Fprintf(w, "fastcopy_job_alerts_total{kind=%q} %d\n", kind, counts[kind])
+	}
+
+	if cache := getSourceCache(); cache != nil {
+		hits, misses, bytes := cache.stats()
+		fmt.Fprintln(w, "# HELP fastcopy_source_cache_requests_total Reads of small source files by whether the source cache had them.")
+		fmt.Fprintln(w, "# TYPE fastcopy_source_cache_requests_total counter")
+		fmt.Fprintf(w, "fastcopy_source_cache_requests_total{result=\"hit\"} %d\n", hits)
+		fmt.Fprintf(w, "fastcopy_source_cache_requests_total{result=\"miss\"} %d\n", misses)
+		fmt.Fprintln(w, "# HELP fastcopy_source_cache_bytes Bytes of small source files held by the source cache.")
+		fmt.Fprintln(w, "# TYPE fastcopy_source_cache_bytes gauge")
+		fmt.Fprintf(w, "fastcopy_source_cache_bytes %d\n", bytes)
+	}
+
+	if limits := sortedTargetLimits(); len(limits) > 0 {
+		fmt.Fprintln(w, "# HELP fastcopy_target_streams_in_use Streams in flight to a host limited by FASTCOPY_TARGET_LIMITS.")
+		fmt.Fprintln(w, "# TYPE fastcopy_target_streams_in_use gauge")
+		for _, l := range limits {
+			fmt.Fprintf(w, "fastcopy_target_streams_in_use{host=%q} %d\n", l.host, l.inUse())
+		}
+	}
+
+	writeFailureMetrics(w, time.Now())
+	writeRPCMetrics(w)
+	writeDatanodeMetrics(w)
+}
+
+// writes the files, bytes and jobs of finished copies as counters, and the failed share of the last
+// failureWindow as gauges, for alert rules without recording rules
+func writeFailureMetrics(w http.ResponseWriter, now time.Time) {
+	recent, finished, failed := outcomes.window(now)
+	outcomes.mu.Lock()
+	total := outcomes.total
+	states := make(map[string]int64, len(outcomes.states))
+	for state, n := range outcomes.states {
+		states[state] = n
+	}
+	outcomes.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP fastcopy_files_total Files of finished copies by result.")
+	fmt.Fprintln(w, "# TYPE fastcopy_files_total counter")
+	fmt.Fprintf(w, "fastcopy_files_total{result=\"copied\"} %d\n", total.files-total.filesFailed)
+	fmt.Fprintf(w, "fastcopy_files_total{result=\"failed\"} %d\n", total.filesFailed)
+	fmt.Fprintln(w, "# HELP fastcopy_bytes_total Bytes of finished copies by result.")
+	fmt.Fprintln(w, "# TYPE fastcopy_bytes_total counter")
+	fmt.Fprintf(w, "fastcopy_bytes_total{result=\"copied\"} %d\n", total.bytes-total.bytesFailed)
+	fmt.Fprintf(w, "fastcopy_bytes_total{result=\"failed\"} %d\n", total.bytesFailed)
+	fmt.Fprintln(w, "# HELP fastcopy_jobs_finished_total Copies finished by state.")
+	fmt.Fprintln(w, "# TYPE fastcopy_jobs_finished_total counter")
+	for _, state := range sortedKeys(states) {
+		fmt.Fprintf(w, "fastcopy_jobs_finished_total{state=%q} %d\n", state, states[state])
+	}
+
+	fmt.Fprintln(w, "# HELP fastcopy_file_failure_ratio Failed files of the files of the copies finished in the last hour.")
+	fmt.Fprintln(w, "# TYPE fastcopy_file_failure_ratio gauge")
+	fmt.Fprintf(w, "fastcopy_file_failure_ratio %g\n", ratio(recent.filesFailed, recent.files))
+	fmt.Fprintln(w, "# HELP fastcopy_byte_failure_ratio Bytes of failed files of the bytes of the copies finished in the last hour.")
+	fmt.Fprintln(w, "# TYPE fastcopy_byte_failure_ratio gauge")
+	fmt.Fprintf(w, "fastcopy_byte_failure_ratio %g\n", ratio(recent.bytesFailed, recent.bytes))
+	fmt.Fprintln(w, "# HELP fastcopy_jobs_failed_last_hour Copies finished failed in the last hour.")
+	fmt.Fprintln(w, "# TYPE fastcopy_jobs_failed_last_hour gauge")
+	fmt.Fprintf(w, "fastcopy_jobs_failed_last_hour %d\n", failed)
+	fmt.Fprintln(w, "# HELP fastcopy_job_failure_ratio Failed copies of the copies finished in the last hour.")
+	fmt.Fprintln(w, "# TYPE fastcopy_job_failure_ratio gauge")
+	fmt.Fprintf(w, "fastcopy_job_failure_ratio %g\n", ratio(int64(failed), int64(finished)))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	job, err := startJob("test-metrics", "/src", "/dst", "http://peer/upload", nil, []CopyArgs{{Path: "/src/a", Size: 1000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer job.finish(CopyResponse{State: StateSucceeded})
+	job.setSLA(JobSLA{ExpectedDuration: time.Minute, StallTimeout: time.Minute})
+	now := job.startedAt.Add(2 * time.Minute)
+	job.now = func() time.Time { return now }
+	job.checkSLA()
+
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE fastcopy_jobs gauge",
+		`fastcopy_jobs{state="target_unavailable"} `,
+		"# TYPE fastcopy_job_alerts_total counter",
+		`fastcopy_job_alerts_total{kind="overdue"} `,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in\n%s", want, body)
+		}
+	}
+	for _, zero := range []string{"fastcopy_jobs_stalled 0\n", "fastcopy_jobs_sla_breached 0\n", `fastcopy_jobs{state="running"} 0`} {
+		if strings.Contains(body, zero) {
+			t.Errorf("expected the stalled and overdue running job to count, got %q in\n%s", zero, body)
+		}
+	}
+}
+
+func TestFailureRatioMetrics(t *testing.T) {
+	prev := outcomes
+	outcomes = &copyOutcomes{states: make(map[string]int64)}
+	t.Cleanup(func() { outcomes = prev })
+	now := time.Now()
+	outcomes.record(CopyResponse{State: StateSucceeded, FilesCopied: 90, Written: 900}, now.Add(-2*time.Hour))
+	outcomes.record(CopyResponse{State: StateSucceeded, FilesCopied: 3, Written: 300}, now.Add(-time.Minute))
+	outcomes.record(CopyResponse{State: StateFailed, FilesCopied: 0, Written: 0, CopyFailures: []CopyFailure{{Path: "/src/a", Size: 100}}}, now)
+
+	rec := httptest.NewRecorder()
+	writeFailureMetrics(rec, now)
+	body := rec.Body.String()
+	for _, want := range []string{
+		`fastcopy_files_total{result="copied"} 93`,
+		`fastcopy_files_total{result="failed"} 1`,
+		`fastcopy_bytes_total{result="failed"} 100`,
+		`fastcopy_jobs_finished_total{state="succeeded"} 2`,
+		"# TYPE fastcopy_file_failure_ratio gauge",
+		"fastcopy_file_failure_ratio 0.25\n",
+		"fastcopy_byte_failure_ratio 0.25\n",
+		"fastcopy_jobs_failed_last_hour 1\n",
+		"fastcopy_job_failure_ratio 0.5\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in\n%s", want, body)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	writeFailureMetrics(rec, now.Add(2*time.Hour))
+	if !strings.Contains(rec.Body.String(), "fastcopy_file_failure_ratio 0\n") || !strings.Contains(rec.Body.String(), "fastcopy_jobs_failed_last_hour 0\n") {
+		t.Errorf("expected the ratios to recover once the failures are over an hour old, got\n%s", rec.Body)
+	}
+}
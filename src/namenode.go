@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// admission states of the namenode gate
+const (
+	admitOpen   = "open"   // transfers start right away
+	admitSlow   = "slow"   // the rpc queue is long, transfers start with a delay
+	admitPaused = "paused" // safe mode or an overloaded rpc queue, no new transfers start
+)
+
+const (
+	defaultNamenodePoll      = 15 * time.Second
+	defaultSlowQueueLength   = 100
+	defaultPausedQueueLength = 1000
+	slowAdmissionDelay       = time.Second
+	namenodeRpcBean          = "Hadoop:service=NameNode,name=RpcActivityForPort"
+	namenodeInfoBean         = "Hadoop:service=NameNode,name=NameNodeInfo"
+)
+
+// pauses or slows the start of new transfers while the source namenode is in safe mode or its
+// rpc call queue is long, so fastcopy backs off instead of adding to the load. shared by every job
+type namenodeGate struct {
+	mu          sync.Mutex
+	cond        *sync.Cond
+	state       string
+	reason      string
+	slowQueue   int
+	pausedQueue int
+}
+
+func newNamenodeGate(slowQueue int, pausedQueue int) *namenodeGate {
+	g := &namenodeGate{state: admitOpen, slowQueue: slowQueue, pausedQueue: pausedQueue}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// applies a namenode load sample
+func (g *namenodeGate) update(queueLength int, safeMode bool) {
+	state, reason := admitOpen, ""
+	switch {
+	case safeMode:
+		state, reason = admitPaused, "namenode is in safe mode"
+	case queueLength >= g.pausedQueue:
+		state, reason = admitPaused, fmt.Sprintf("namenode rpc call queue is %d long", queueLength)
+	case queueLength >= g.slowQueue:
+		state, reason = admitSlow, fmt.Sprintf("namenode rpc call queue is %d long", queueLength)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if state != g.state {
+		if state == admitOpen {
+			log.Printf("namenode recovered, resuming transfers")
+		} else {
+			log.Printf("namenode admission %s: %s", state, reason)
+		}
+	}
+	g.state, g.reason = state, reason
+	g.cond.Broadcast()
+}
+
+// blocks while the gate is paused and delays the caller while it is slow
+func (g *namenodeGate) admit() {
+	g.mu.Lock()
+	for g.state == admitPaused {
+		g.cond.Wait()
+	}
+	slow := g.state == admitSlow
+	g.mu.Unlock()
+	if slow {
+		time.Sleep(slowAdmissionDelay)
+	}
+}
+
+func (g *namenodeGate) current() (string, string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.state, g.reason
+}
+
+// extracts the rpc call queue length and safe mode from the namenode's /jmx response
+func parseNamenodeJMX(r io.Reader) (int, bool, error) {
+	var jmx struct {
+		Beans []map[string]interface{} `json:"beans"`
+	}
+	if err := json.NewDecoder(r).Decode(&jmx); err != nil {
+		return 0, false, fmt.Errorf("unreadable namenode jmx: %w", err)
+	}
+	queueLength, safeMode, found := 0, false, false
+	for _, bean := range jmx.Beans {
+		name, _ := bean["name"].(string)
+		switch {
+		case strings.HasPrefix(name, namenodeRpcBean):
+			if v, ok := bean["CallQueueLength"].(float64); ok && int(v) > queueLength {
+				queueLength = int(v)
+			}
+			found = true
+		case name == namenodeInfoBean:
+			mode, _ := bean["Safemode"].(string)
+			safeMode = mode != ""
+			found = true
+		}
+	}
+	if !found {
+		return 0, false, fmt.Errorf("namenode jmx has neither %s* nor %s beans", namenodeRpcBean, namenodeInfoBean)
+	}
+	return queueLength, safeMode, nil
+}
+
+// polls the namenode's jmx and feeds the gate until the process exits. on errors the gate keeps its state
+func pollNamenode(g *namenodeGate, jmxURL string, interval time.Duration) {
+	for {
+		resp, err := httpClient.Get(jmxURL)
+		if err != nil {
+			log.Printf("Failed to poll namenode jmx %s: %s", jmxURL, err)
+		} else {
+			queueLength, safeMode, err := parseNamenodeJMX(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				log.Printf("Failed to poll namenode jmx %s: %s", jmxURL, err)
+			} else {
+				g.update(queueLength, safeMode)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+type namenodeGateSettings struct {
+	jmxURL      string
+	interval    time.Duration
+	slowQueue   int
+	pausedQueue int
+}
+
+// loads the namenode gate settings from env FASTCOPY_NAMENODE_JMX (the namenode's http /jmx url),
+// FASTCOPY_NAMENODE_POLL, FASTCOPY_NAMENODE_SLOW_QUEUE and FASTCOPY_NAMENODE_PAUSE_QUEUE
+func loadNamenodeGateSettings() (namenodeGateSettings, error) {
+	s := namenodeGateSettings{os.Getenv("FASTCOPY_NAMENODE_JMX"), defaultNamenodePoll, defaultSlowQueueLength, defaultPausedQueueLength}
+	if v := os.Getenv("FASTCOPY_NAMENODE_POLL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return s, fmt.Errorf("invalid FASTCOPY_NAMENODE_POLL '%s', expected a duration like 15s", v)
+		}
+		s.interval = d
+	}
+	if v := os.Getenv("FASTCOPY_NAMENODE_SLOW_QUEUE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return s, fmt.Errorf("invalid FASTCOPY_NAMENODE_SLOW_QUEUE '%s', expected a positive integer", v)
+		}
+		s.slowQueue = n
+	}
+	if v := os.Getenv("FASTCOPY_NAMENODE_PAUSE_QUEUE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < s.slowQueue {
+			return s, fmt.Errorf("invalid FASTCOPY_NAMENODE_PAUSE_QUEUE '%s', expected an integer of at least the slow queue length %d", v, s.slowQueue)
+		}
+		s.pausedQueue = n
+	}
+	return s, nil
+}
+
+var (
+	nnGate     *namenodeGate
+	nnGateOnce sync.Once
+)
+
+// lazy loads the global namenode gate and starts polling. returns nil if FASTCOPY_NAMENODE_JMX isn't configured
+func getNamenodeGate() *namenodeGate {
+	nnGateOnce.Do(func() {
+		settings, err := loadNamenodeGateSettings()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if settings.jmxURL == "" {
+			return
+		}
+		nnGate = newNamenodeGate(settings.slowQueue, settings.pausedQueue)
+		go pollNamenode(nnGate, settings.jmxURL, settings.interval)
+	})
+	return nnGate
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseNamenodeJMX(t *testing.T) {
+	jmx := `{"beans": [
+		{"name": "Hadoop:service=NameNode,name=RpcActivityForPort8020", "CallQueueLength": 12},
+		{"name": "Hadoop:service=NameNode,name=RpcActivityForPort8022", "CallQueueLength": 340},
+		{"name": "Hadoop:service=NameNode,name=NameNodeInfo", "Safemode": ""}
+	]}`
+	queueLength, safeMode, err := parseNamenodeJMX(strings.NewReader(jmx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queueLength != 340 || safeMode {
+		t.Errorf("expected the longest queue 340 outside safe mode, got %d %v", queueLength, safeMode)
+	}
+
+	jmx = `{"beans": [{"name": "Hadoop:service=NameNode,name=NameNodeInfo", "Safemode": "Safe mode is ON."}]}`
+	if _, safeMode, _ := parseNamenodeJMX(strings.NewReader(jmx)); !safeMode {
+		t.Error("expected safe mode to be detected")
+	}
+	if _, _, err := parseNamenodeJMX(strings.NewReader(`{"beans": []}`)); err == nil {
+		t.Error("expected jmx without namenode beans to be rejected")
+	}
+}
+
+func TestNamenodeGate(t *testing.T) {
+	g := newNamenodeGate(100, 1000)
+	g.update(150, false)
+	if state, _ := g.current(); state != admitSlow {
+		t.Errorf("expected a long queue to slow admission, got %s", state)
+	}
+	g.update(10, true)
+	if state, _ := g.current(); state != admitPaused {
+		t.Errorf("expected safe mode to pause admission, got %s", state)
+	}
+
+	admitted := make(chan struct{})
+	go func() {
+		g.admit()
+		close(admitted)
+	}()
+	select {
+	case <-admitted:
+		t.Fatal("expected admission to block while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	g.update(10, false)
+	select {
+	case <-admitted:
+	case <-time.After(time.Second):
+		t.Fatal("expected admission to resume once the namenode recovered")
+	}
+}
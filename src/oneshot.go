@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// exit codes of --oneshot
+const (
+	ExitSucceeded = 0
+	ExitPartial   = 1 // some files were copied but others failed, or the copy didn't reconcile
+	ExitFailed    = 2 // nothing was copied
+)
+
+// a repeatable name=value flag collecting /copy query params
+type paramsFlag url.Values
+
+func (p paramsFlag) String() string { return url.Values(p).Encode() }
+
+func (p paramsFlag) Set(v string) error {
+	name, value, ok := strings.Cut(v, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expected name=value, got '%s'", v)
+	}
+	url.Values(p).Add(name, value)
+	return nil
+}
+
+// runs a single copy described by /copy query params, writes its response to out and returns the process exit code
+func runOneshot(params url.Values, out io.Writer) int {
+	if params.Get("yarn") != "" {
+		log.Printf("copy failed: 'yarn' copies are submitted to a running server, not run with -oneshot")
+		return ExitFailed
+	}
+	r, err := http.NewRequest(http.MethodPost, "/copy?"+params.Encode(), nil)
+	if err != nil {
+		log.Printf("copy failed: %s", err)
+		return ExitFailed
+	}
+	resp, _, err := runCopy(r)
+	if err != nil {
+		log.Printf("copy failed: %s", err)
+		return ExitFailed
+	}
+	json, _ := json.MarshalIndent(resp, "", "  ")
+	fmt.Fprintln(out, string(json))
+	return exitCode(resp)
+}
+
+func exitCode(resp CopyResponse) int {
+	switch {
+	case resp.State == StateSucceeded:
+		return ExitSucceeded
+	case resp.FilesCopied > 0:
+		return ExitPartial
+	default:
+		return ExitFailed
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestParamsFlag(t *testing.T) {
+	params := url.Values{}
+	p := paramsFlag(params)
+	for _, v := range []string{"manifest=true", "label=team=data", "label=env=prod"} {
+		if err := p.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if params.Get("manifest") != "true" || len(params["label"]) != 2 || params["label"][0] != "team=data" {
+		t.Errorf("unexpected params %v", params)
+	}
+	for _, v := range []string{"manifest", "=true"} {
+		if err := p.Set(v); err == nil {
+			t.Errorf("expected '%s' to be rejected", v)
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	cases := []struct {
+		resp CopyResponse
+		want int
+	}{
+		{CopyResponse{State: StateSucceeded, FilesCopied: 3}, ExitSucceeded},
+		{CopyResponse{State: StateSucceeded}, ExitSucceeded},
+		{CopyResponse{State: StateFailed, FilesCopied: 2}, ExitPartial},
+		{CopyResponse{State: StateTargetUnavailable, FilesCopied: 1}, ExitPartial},
+		{CopyResponse{State: StateFailed}, ExitFailed},
+		{CopyResponse{State: StateTargetUnavailable}, ExitFailed},
+	}
+	for _, c := range cases {
+		if got := exitCode(c.resp); got != c.want {
+			t.Errorf("exitCode(%+v) = %d, expected %d", c.resp, got, c.want)
+		}
+	}
+}
+
+func TestRunOneshot(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{"/src/part-00000": "hello"})
+
+	peer := http.NewServeMux()
+	peer.HandleFunc("/ready", handleReady)
+	peer.HandleFunc("/ls", handleLs)
+	peer.HandleFunc("/upload", handleUpload)
+	server := httptest.NewServer(peer)
+	defer server.Close()
+
+	var out bytes.Buffer
+	params := url.Values{"from": {"/src"}, "to": {"/dst"}, "targetURL": {server.URL + "/upload"}}
+	if code := runOneshot(params, &out); code != ExitSucceeded {
+		t.Fatalf("expected exit code %d, got %d: %s", ExitSucceeded, code, out.String())
+	}
+	var resp CopyResponse
+	if err := json.Unmarshal(out.Bytes(), &resp); err != nil || resp.FilesCopied != 1 {
+		t.Errorf("expected the copy response on stdout, got %q: %v", out.String(), err)
+	}
+	if dst, _ := fs.get("/dst/part-00000"); dst != "hello" {
+		t.Error("expected part-00000 to be copied")
+	}
+
+	params.Set("from", "/missing")
+	if code := runOneshot(params, &out); code != ExitFailed {
+		t.Errorf("expected copying a missing dir to exit %d, got %d", ExitFailed, code)
+	}
+	params.Set("workers", "zero")
+	if code := runOneshot(params, &out); code != ExitFailed {
+		t.Errorf("expected invalid options to exit %d, got %d", ExitFailed, code)
+	}
+}
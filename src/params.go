@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// requests are checked before they reach their handler: required params must be given, paths must be absolute
+// HDFS paths without .. segments and peers http(s) URLs. a request failing the checks is answered 400 with a
+// violation per field in the error's details, so a client knows what to fix instead of the copy failing later
+
+// the query params holding absolute HDFS paths, wherever they're given
+var pathParams = []string{"from", "to", "path", "dir", "contentStore"}
+
+// the query params holding paths relative to another param, e.g. an upload's fileName below 'to'
+var relativePathParams = []string{"fileName"}
+
+// the query params addressing a peer
+var urlParams = []string{"targetURL"}
+
+// a field of a request failing validation
+type FieldViolation struct {
+	Field       string `json:"field"`
+	Description string `json:"description"`
+}
+
+// the violations of a request, answered 400
+type ValidationError struct {
+	Violations []FieldViolation
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		msgs = append(msgs, fmt.Sprintf("'%s' %s", v.Field, v.Description))
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e *ValidationError) add(field string, description string) {
+	e.Violations = append(e.Violations, FieldViolation{Field: field, Description: description})
+}
+
+// nil without violations, so it can be returned as an error
+func (e *ValidationError) err() error {
+	if len(e.Violations) == 0 {
+		return nil
+	}
+	return e
+}
+
+// why p isn't an absolute HDFS path, "" if it is
+func checkHdfsPath(p string) string {
+	switch {
+	case !strings.HasPrefix(p, "/"):
+		return fmt.Sprintf("must be an absolute path, got '%s'", p)
+	case hasDotDot(p):
+		return fmt.Sprintf("must not contain '..', got '%s'", p)
+	}
+	return ""
+}
+
+// why p isn't a path below another, "" if it is
+func checkRelativePath(p string) string {
+	switch {
+	case strings.HasPrefix(p, "/"):
+		return fmt.Sprintf("must be a relative path, got '%s'", p)
+	case hasDotDot(p) || path.Clean(p) == ".":
+		return fmt.Sprintf("must name a file below its dir, got '%s'", p)
+	}
+	return ""
+}
+
+func hasDotDot(p string) bool {
+	for _, segment := range strings.Split(p, "/") {
+		if segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// why u can't address a peer, "" if it can
+func checkPeerURL(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Sprintf("must be an http(s) URL like http://peer:8080/v1/upload, got '%s'", u)
+	}
+	return ""
+}
+
+// checks the shapes of the params in q and that the required ones are given
+func validateParams(q url.Values, required ...string) error {
+	var verr ValidationError
+	for _, name := range required {
+		if q.Get(name) == "" {
+			verr.add(name, "must be provided")
+		}
+	}
+	check := func(names []string, check func(string) string) {
+		for _, name := range names {
+			for _, v := range q[name] {
+				if v == "" {
+					continue
+				}
+				if desc := check(v); desc != "" {
+					verr.add(name, desc)
+				}
+			}
+		}
+	}
+	check(pathParams, checkHdfsPath)
+	check(relativePathParams, checkRelativePath)
+	check(urlParams, checkPeerURL)
+	return verr.err()
+}
+
+// checks the dirs and targets of a /copy given as a JSON body
+func validateCopyRequest(froms []string, to string, targets []string) error {
+	var verr ValidationError
+	for _, from := range froms {
+		if desc := checkHdfsPath(from); desc != "" {
+			verr.add("from", desc)
+		}
+	}
+	if desc := checkHdfsPath(to); desc != "" {
+		verr.add("to", desc)
+	}
+	if len(targets) == 0 {
+		verr.add("targetURL", "must be provided")
+	}
+	for _, target := range targets {
+		if desc := checkPeerURL(target); desc != "" {
+			verr.add("targetURL", desc)
+		}
+	}
+	return verr.err()
+}
+
+// the violations of err for the details of its error response
+func errorDetails(err error) []interface{} {
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		return nil
+	}
+	details := make([]interface{}, 0, len(verr.Violations))
+	for _, v := range verr.Violations {
+		details = append(details, v)
+	}
+	return details
+}
+
+// validates the query params of requests before h sees them
+func validated(h http.HandlerFunc, required ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := validateParams(r.URL.Query(), required...); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest, errorDetails(err)...)
+			return
+		}
+		h(w, r)
+	}
+}
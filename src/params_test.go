@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestValidateParams(t *testing.T) {
+	for query, fields := range map[string][]string{
+		"from=/data&to=/backup&targetURL=http://peer:8080/v1/upload": nil,
+		"from=/data&to=/backup":                                         {"targetURL"},
+		"from=data&to=/backup/../etc&targetURL=peer:8080":               {"from", "to", "targetURL"},
+		"from=/data&to=/backup&targetURL=ftp://peer/upload":             {"targetURL"},
+		"from=/data&to=/backup&targetURL=http://a/upload&fileName=../a": {"fileName"},
+		"from=/data&to=/backup&targetURL=http://a/upload&fileName=/a":   {"fileName"},
+	} {
+		q, _ := url.ParseQuery(query)
+		err := validateParams(q, "from", "to", "targetURL")
+		var got []string
+		for _, d := range errorDetails(err) {
+			got = append(got, d.(FieldViolation).Field)
+		}
+		if strings.Join(got, ",") != strings.Join(fields, ",") {
+			t.Errorf("%s: expected violations of %v, got %v (%v)", query, fields, got, err)
+		}
+	}
+	if err := validateParams(url.Values{"fileName": {"sub/part-00000"}}); err != nil {
+		t.Errorf("expected a file in a subdir to be valid, got %v", err)
+	}
+}
+
+func TestValidatedRequests(t *testing.T) {
+	useMemFS(t)
+	server := httptest.NewServer(apiMux())
+	defer server.Close()
+
+	violations := func(resp *http.Response) []FieldViolation {
+		defer resp.Body.Close()
+		var envelope struct {
+			Error struct {
+				Code    string           `json:"code"`
+				Details []FieldViolation `json:"details"`
+			} `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&envelope)
+		if resp.StatusCode != http.StatusBadRequest || envelope.Error.Code != "INVALID_ARGUMENT" {
+			t.Errorf("expected a 400 INVALID_ARGUMENT, got %d %s", resp.StatusCode, envelope.Error.Code)
+		}
+		return envelope.Error.Details
+	}
+
+	// a copy without a target used to get as far as sending the files
+	resp, err := http.Post(server.URL+"/copy?from=/data&to=/backup", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := violations(resp); len(v) != 1 || v[0].Field != "targetURL" || v[0].Description != "must be provided" {
+		t.Errorf("unexpected violations %+v", v)
+	}
+
+	resp, err = http.Post(server.URL+"/upload?to=/backup&fileName=../../etc/passwd", "", strings.NewReader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := violations(resp); len(v) != 1 || v[0].Field != "fileName" {
+		t.Errorf("unexpected violations %+v", v)
+	}
+
+	resp, err = http.Post(server.URL+"/copy", "application/json", strings.NewReader(`{"from": ["data/a"], "to": "/dst", "targetURL": "http://peer/upload"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := violations(resp); len(v) != 1 || v[0].Field != "from" {
+		t.Errorf("unexpected violations %+v", v)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// operators quiesce fastcopy for cluster maintenance with POST /admin/pause: no new file transfer starts, in
+// any job, until POST /admin/resume, while the transfers already running finish. the jobs stay running, their
+// remaining files wait and are sent once resumed. an optional 'reason' is logged and shown by GET /admin/pause.
+// a paused service isn't a stalled job, no stall alert is raised for it
+
+// whether the service is paused, and since when
+type PauseState struct {
+	Paused bool       `json:"paused"`
+	Since  *time.Time `json:"since,omitempty"`
+	Reason string     `json:"reason,omitempty"`
+}
+
+var (
+	pause     PauseState
+	pauseMu   sync.Mutex
+	resumedCh = make(chan struct{}) // closed on resume and replaced when paused
+)
+
+// pauses dispatching transfers, returning false if the service was paused already
+func pauseTransfers(reason string) bool {
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+	if pause.Paused {
+		return false
+	}
+	now := time.Now()
+	pause = PauseState{Paused: true, Since: &now, Reason: reason}
+	resumedCh = make(chan struct{})
+	return true
+}
+
+// resumes dispatching transfers, returning false if the service wasn't paused
+func resumeTransfers() bool {
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+	if !pause.Paused {
+		return false
+	}
+	pause = PauseState{}
+	close(resumedCh)
+	return true
+}
+
+func pauseState() PauseState {
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+	return pause
+}
+
+// blocks while the service is paused
+func waitWhilePaused() {
+	for {
+		pauseMu.Lock()
+		paused, resumed := pause.Paused, resumedCh
+		pauseMu.Unlock()
+		if !paused {
+			return
+		}
+		<-resumed
+	}
+}
+
+// POST /admin/pause pauses dispatching file transfers, POST /admin/resume resumes it. GET on either returns
+// whether the service is paused
+func handlePause(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if r.URL.Path == "/admin/resume" {
+			if resumeTransfers() {
+				log.Print("Resumed dispatching transfers")
+			}
+		} else if reason := r.URL.Query().Get("reason"); pauseTransfers(reason) {
+			log.Printf("Paused dispatching transfers, running ones finish: %s", reason)
+		}
+	default:
+		writeError(w, "use GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+	json, _ := json.Marshal(pauseState())
+	w.Write(json)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPauseHoldsNewTransfers(t *testing.T) {
+	t.Cleanup(func() { resumeTransfers() })
+	rec := httptest.NewRecorder()
+	handlePause(rec, httptest.NewRequest("POST", "/admin/pause?reason=namenode+upgrade", nil))
+	var state PauseState
+	json.Unmarshal(rec.Body.Bytes(), &state)
+	if rec.Code != http.StatusOK || !state.Paused || state.Reason != "namenode upgrade" || state.Since == nil {
+		t.Fatalf("expected the service to be paused, got %d %s", rec.Code, rec.Body)
+	}
+
+	admitted := make(chan struct{})
+	go func() {
+		done, err := admitTransfer(CopyArgs{Path: "/src/a.txt", Size: 5}, nil, nil, nil)
+		if err == nil {
+			done(nil)
+		}
+		close(admitted)
+	}()
+	select {
+	case <-admitted:
+		t.Fatal("expected no transfer to start while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	rec = httptest.NewRecorder()
+	handlePause(rec, httptest.NewRequest("POST", "/admin/resume", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"paused":false}` {
+		t.Errorf("expected the service to be resumed, got %d %s", rec.Code, rec.Body)
+	}
+	select {
+	case <-admitted:
+	case <-time.After(time.Second):
+		t.Fatal("expected the waiting transfer to start once resumed")
+	}
+}
+
+func TestPauseMethods(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handlePause(rec, httptest.NewRequest("DELETE", "/admin/pause", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected DELETE to be refused, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	handlePause(rec, httptest.NewRequest("GET", "/admin/pause", nil))
+	if rec.Body.String() != `{"paused":false}` {
+		t.Errorf("expected GET to only report the state, got %s", rec.Body)
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// POST /plan takes the params and body of a /copy and only plans it: the dirs are listed and filtered, the
+// files sampled, deduplicated, cut off at maxBytes, put in a lane and ordered as the copy would. the plan lists
+// every file with its size and modification time, so it can be reviewed and approved before anything moves.
+// posted verbatim to /copy as its JSON body it copies exactly the planned files in the planned order, each only
+// while it still has the size and modification time it was planned with, otherwise it's skipped as changed
+
+// a file a plan copies
+type PlannedFile struct {
+	Path    string    `json:"path"`
+	From    string    `json:"from"` // the 'from' dir it's listed under
+	To      string    `json:"to"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Lane    string    `json:"lane,omitempty"` // "priority" when copied by the priority lane
+	order   int       // its place in the plan
+}
+
+// the files of a size range in a plan
+type SizeBucket struct {
+	Below int64 `json:"belowBytes,omitempty"` // files of at least the previous bucket's size and below this, 0 for no bound
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// the upper bounds of the size buckets of a plan
+var planSizeBuckets = []int64{1 << 20, 128 << 20, 1 << 30}
+
+// the answer of /plan, and a /copy body copying it
+type CopyPlan struct {
+	From         []string         `json:"from,omitempty"` // for several 'from' dirs, a single one is in the params
+	To           string           `json:"to,omitempty"`
+	TargetURLs   []string         `json:"targetURLs,omitempty"`
+	Params       url.Values       `json:"params"`
+	Shard        string           `json:"shard,omitempty"`
+	FilesListed  int              `json:"filesListed"`
+	FilesPlanned int              `json:"filesPlanned"`
+	BytesPlanned int64            `json:"bytesPlanned"`
+	FilesSampled int              `json:"filesSampled,omitempty"`
+	FilesDeduped int              `json:"filesDeduped,omitempty"`
+	CutOff       *CutOff          `json:"cutOff,omitempty"`
+	SizeBuckets  []SizeBucket     `json:"sizeBuckets"`
+	Egress       []EgressEstimate `json:"egress,omitempty"` // the estimated cost to each priced target, see egress.go
+	Files        []PlannedFile    `json:"files"`
+	Skipped      []SkippedFile    `json:"skipped"`
+	PlannedAt    time.Time        `json:"plannedAt"`
+}
+
+// the params of a copy left out of a plan's: 'dataset' and 'template' are applied already, the rest identify a
+// single submission
+var planIgnoredParams = []string{"dataset", "template", "jobId", "jobKey", "heartbeat"}
+
+// assigns the planned files to the sources listing them. files is nil when not copying a plan
+func withPlannedFiles(sources []copySource, files []PlannedFile) ([]copySource, error) {
+	if files == nil {
+		return sources, nil
+	}
+	for i := range sources {
+		sources[i].planned = make(map[string]PlannedFile)
+	}
+	for n, f := range files {
+		f.order = n
+		i := 0
+		for i < len(sources) && sources[i].from != f.From {
+			i++
+		}
+		if i == len(sources) {
+			return nil, fmt.Errorf("planned file %s is from %s, which the copy doesn't read", f.Path, f.From)
+		}
+		sources[i].planned[f.Path] = f
+	}
+	return sources, nil
+}
+
+// a planned copy
+type copyPlan struct {
+	tasks          []CopyArgs
+	skipped        []SkippedFile
+	emptyDirs      []EmptyDir
+	bytes          int64
+	filesRequested int
+	filesSampled   int
+	notTaken       int // files listed but left to other copies
+	filesDeduped   int
+	bytesDeduped   int64
+	cutOff         *CutOff
+}
+
+// lists the sources and plans the copy of their files by opts, or of the files of the plan they're given. returns
+// the http status to fail with
+func planCopy(client FileSystem, sources []copySource, from string, targetURL string, opts CopyOptions) (copyPlan, int, error) {
+	var plan copyPlan
+	for i := range sources {
+		src := &sources[i]
+		if opts.RequireSuccess {
+			if _, err := client.Stat(filepath.Join(src.readFrom, SuccessMarker)); err != nil {
+				return plan, http.StatusPreconditionFailed, fmt.Errorf("%s has no %s marker, refusing to copy incomplete job output: %s", src.from, SuccessMarker, err)
+			}
+		}
+		tree, err := planTree(client, src.readFrom, src.writeTo, opts)
+		if err != nil {
+			return plan, http.StatusInternalServerError, err
+		}
+		src.listed = tree.listed
+		plan.filesRequested += tree.listed
+		plan.tasks, plan.skipped, plan.bytes = append(plan.tasks, tree.tasks...), append(plan.skipped, tree.skipped...), plan.bytes+tree.bytes
+		plan.emptyDirs = append(plan.emptyDirs, tree.emptyDirs...)
+	}
+	var reserved []string
+	if opts.Manifest {
+		for _, src := range sources {
+			reserved = append(reserved, filepath.Join(src.writeTo, ManifestFileName))
+		}
+	}
+	tasks, collided, err := resolveCollisions(plan.tasks, reserved, opts.Collisions)
+	if err != nil {
+		return plan, http.StatusBadRequest, err
+	}
+	plan.tasks = tasks
+	if len(collided) > 0 {
+		plan.skipped = append(plan.skipped, collided...)
+		plan.sumBytes()
+	}
+	if sources[0].planned != nil {
+		plan.takePlanned(sources)
+		return plan, http.StatusOK, nil
+	}
+	// files listed but left to other copies: delivered before, not sampled, or before resumeAfter or after the
+	// cut-off of maxBytes
+	if opts.ResumeAfter != "" {
+		planned := len(plan.tasks)
+		plan.tasks = resumeTasks(plan.tasks, opts.ResumeAfter)
+		plan.notTaken += planned - len(plan.tasks)
+		log.Printf("Resuming after %s, %d files in %s were taken on before", opts.ResumeAfter, planned-len(plan.tasks), from)
+	}
+	if opts.Dedup {
+		plan.tasks, plan.filesDeduped, plan.bytesDeduped = getDedupCache().filter(targetURL, plan.tasks)
+		plan.notTaken += plan.filesDeduped
+		log.Printf("Leaving out %d files (%d bytes) of %s already delivered to %s", plan.filesDeduped, plan.bytesDeduped, from, targetURL)
+	}
+	if opts.Sample > 0 || opts.SamplePercent > 0 {
+		planned := len(plan.tasks)
+		plan.tasks = sampleTasks(plan.tasks, opts.Sample, opts.SamplePercent)
+		plan.filesSampled = len(plan.tasks)
+		plan.notTaken += planned - len(plan.tasks)
+		log.Printf("Sampling %d of %d files in %s", plan.filesSampled, planned, from)
+	}
+	if opts.MaxBytes > 0 {
+		plan.tasks, plan.cutOff = limitTasks(plan.tasks, opts.MaxBytes)
+		if plan.cutOff != nil {
+			plan.notTaken += int(plan.cutOff.FilesDeferred)
+			log.Printf("Copying %d files of %s up to maxBytes %d, %d files (%d bytes) from %s on are left", len(plan.tasks), from, opts.MaxBytes, plan.cutOff.FilesDeferred, plan.cutOff.BytesDeferred, plan.cutOff.ResumeAfter)
+		}
+	}
+	if plan.notTaken > 0 {
+		plan.sumBytes()
+	}
+	scheduleTasks(plan.tasks, opts.Scheduling)
+	return plan, http.StatusOK, nil
+}
+
+func (p *copyPlan) sumBytes() {
+	p.bytes = 0
+	for _, t := range p.tasks {
+		p.bytes += t.Size
+	}
+}
+
+// keeps the listed files of the plan the sources were given, in its order. a planned file changed or gone since
+// is skipped, a file listed but not planned is left out
+func (p *copyPlan) takePlanned(sources []copySource) {
+	order := make(map[string]int)
+	var kept []CopyArgs
+	for _, src := range sources {
+		listed := make(map[string]bool)
+		for _, t := range p.tasks {
+			if t.To != src.writeTo && !within(t.To, src.writeTo) {
+				continue
+			}
+			listed[t.Path] = true
+			f, ok := src.planned[t.Path]
+			switch {
+			case !ok:
+				p.notTaken++
+			case f.Size != t.Size || !f.ModTime.Equal(t.ModTime):
+				p.skipped = append(p.skipped, SkippedFile{t.Path, "changed since it was planned"})
+			default:
+				kept = append(kept, t)
+				order[t.Path] = f.order
+			}
+		}
+		for _, path := range sortedKeys(src.planned) {
+			if !listed[path] {
+				p.skipped = append(p.skipped, SkippedFile{path, "gone since it was planned"})
+			}
+		}
+	}
+	sort.SliceStable(kept, func(i, j int) bool { return order[kept[i].Path] < order[kept[j].Path] })
+	p.tasks = kept
+	p.sumBytes()
+}
+
+// merges the params of a plan posted to /copy into its query. the caller may add params, not change the plan's.
+// returns the http status to fail with
+func applyPlan(r *http.Request) (int, error) {
+	if !isJSONRequest(r) {
+		return http.StatusOK, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxCopyRequestBytes+1))
+	r.Body.Close()
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("cannot read the copy request body: %w", err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	var plan struct {
+		Params url.Values `json:"params"`
+	}
+	if json.Unmarshal(body, &plan) != nil || len(plan.Params) == 0 {
+		return http.StatusOK, nil // parseCopySources tells what's wrong with the body
+	}
+	q := r.URL.Query()
+	for k, v := range plan.Params {
+		if given, ok := q[k]; ok && !equalValues(given, v) {
+			return http.StatusBadRequest, fmt.Errorf("'%s' is %v in the plan, it can't be changed", k, v)
+		}
+		q[k] = v
+	}
+	r.URL.RawQuery = q.Encode()
+	return http.StatusOK, nil
+}
+
+func equalValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// the plan of the copy to answer /plan with
+func exportPlan(r *http.Request, to string, targets []string, sources []copySource, plan copyPlan, opts CopyOptions) CopyPlan {
+	params := r.URL.Query()
+	for _, p := range planIgnoredParams {
+		params.Del(p)
+	}
+	out := CopyPlan{
+		Params:       params,
+		FilesPlanned: len(plan.tasks),
+		BytesPlanned: plan.bytes,
+		FilesListed:  plan.filesRequested,
+		FilesSampled: plan.filesSampled,
+		FilesDeduped: plan.filesDeduped,
+		CutOff:       plan.cutOff,
+		Files:        make([]PlannedFile, 0, len(plan.tasks)),
+		Skipped:      plan.skipped,
+		PlannedAt:    time.Now(),
+	}
+	if sources[0].name != "" {
+		params.Del("to")
+		params.Del("targetURL")
+		for _, src := range sources {
+			out.From = append(out.From, src.from)
+		}
+		out.To, out.TargetURLs = to, targets
+	}
+	if opts.Shard.Count > 1 {
+		out.Shard = opts.Shard.String()
+	}
+	for _, below := range append(planSizeBuckets, 0) {
+		out.SizeBuckets = append(out.SizeBuckets, SizeBucket{Below: below})
+	}
+	for _, t := range plan.tasks {
+		f := PlannedFile{Path: t.Path, To: t.To, Size: t.Size, ModTime: t.ModTime}
+		for _, src := range sources {
+			if t.To == src.writeTo || within(t.To, src.writeTo) {
+				f.From = src.from
+			}
+		}
+		if opts.Priority.enabled() && opts.Priority.matches(t) {
+			f.Lane = "priority"
+		}
+		out.Files = append(out.Files, f)
+		i := sort.Search(len(planSizeBuckets), func(i int) bool { return t.Size < planSizeBuckets[i] })
+		out.SizeBuckets[i].Files++
+		out.SizeBuckets[i].Bytes += t.Size
+	}
+	out.Egress = estimateEgress(targets, func(string) (int64, int64) { return int64(len(plan.tasks)), plan.bytes })
+	return out
+}
+
+// POST /plan plans the copy described like a /copy without copying anything
+func handlePlan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if status, err := applyDataset(r); err != nil {
+		writeError(w, err.Error(), status)
+		return
+	}
+	if status, err := applyTemplate(r); err != nil {
+		writeError(w, err.Error(), status)
+		return
+	}
+	to, targets, sources, err := parseCopySources(r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest, errorDetails(err)...)
+		return
+	}
+	opts, err := parseCopyOptions(r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest, errorDetails(err)...)
+		return
+	}
+	sources, skipped, err := resolveSourceCollisions(sources, to, opts.Collisions)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	client, releaseClient, err := getClientPool().acquire()
+	if err != nil {
+		writeError(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer releaseClient()
+	// a plan lists the live dirs, a copy from a snapshot takes its snapshot when it runs
+	for i := range sources {
+		src := &sources[i]
+		src.readFrom, src.writeTo = src.from, to
+		if src.name != "" {
+			src.writeTo = filepath.Join(to, src.name)
+		}
+	}
+	plan, status, err := planCopy(client, sources, joinSources(sources), targets[0], opts)
+	if err != nil {
+		writeError(w, err.Error(), status)
+		return
+	}
+	plan.skipped = append(skipped, plan.skipped...)
+	json, _ := json.MarshalIndent(exportPlan(r, to, targets, sources, plan, opts), "", "  ")
+	w.Write(json)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPlanThenCopyIt(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{"/src/a.txt": "hello", "/src/b.txt": "world", "/src/.hidden": "x"})
+	peer := httptest.NewServer(apiMux())
+	defer peer.Close()
+
+	query := url.Values{"from": {"/src"}, "to": {"/dst"}, "targetURL": {peer.URL + "/upload"}, "skipHidden": {"true"}, "scheduling": {"largest-first"}}
+	rec := httptest.NewRecorder()
+	handlePlan(rec, httptest.NewRequest("POST", "/plan?"+query.Encode(), nil))
+	var plan CopyPlan
+	json.Unmarshal(rec.Body.Bytes(), &plan)
+	if rec.Code != http.StatusOK || plan.FilesPlanned != 2 || plan.BytesPlanned != 10 || plan.FilesListed != 3 || len(plan.Skipped) != 1 {
+		t.Fatalf("unexpected plan %d %s", rec.Code, rec.Body)
+	}
+	if plan.SizeBuckets[0].Files != 2 || plan.Params.Get("skipHidden") != "true" || plan.Files[0].From != "/src" {
+		t.Errorf("expected the files bucketed and the params kept, got %s", rec.Body)
+	}
+	if _, ok := fs.get("/dst/a.txt"); ok {
+		t.Fatal("expected planning not to copy")
+	}
+
+	fs.put(map[string]string{"/src/b.txt": "changed!", "/src/c.txt": "new"})
+	body, _ := json.Marshal(plan)
+	r := httptest.NewRequest("POST", "/copy", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	handleCopy(rec, r)
+	var resp CopyResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusOK || resp.FilesCopied != 1 || !strings.Contains(rec.Body.String(), "changed since it was planned") {
+		t.Fatalf("expected only the unchanged planned file copied, got %d %s", rec.Code, rec.Body)
+	}
+	if _, ok := fs.get("/dst/a.txt"); !ok {
+		t.Error("expected the planned file to be copied")
+	}
+	if _, ok := fs.get("/dst/c.txt"); ok {
+		t.Error("expected a file not in the plan to be left out")
+	}
+
+	r = httptest.NewRequest("POST", "/copy?skipHidden=false", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	handleCopy(rec, r)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected changing the plan's params to be refused, got %d", rec.Code)
+	}
+}
+
+func TestPlanSeveralSources(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{"/data/a/1.txt": "one", "/data/b/2.txt": "two"})
+	peer := httptest.NewServer(apiMux())
+	defer peer.Close()
+
+	r := httptest.NewRequest("POST", "/plan?targetURL="+url.QueryEscape(peer.URL+"/upload"), strings.NewReader(`{"from": ["/data/a", "/data/b"], "to": "/dst"}`))
+	r.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handlePlan(rec, r)
+	var plan CopyPlan
+	json.Unmarshal(rec.Body.Bytes(), &plan)
+	if rec.Code != http.StatusOK || len(plan.From) != 2 || plan.To != "/dst" || len(plan.TargetURLs) != 1 || plan.Params.Has("targetURL") {
+		t.Fatalf("unexpected plan %d %s", rec.Code, rec.Body)
+	}
+
+	body, _ := json.Marshal(plan)
+	r = httptest.NewRequest("POST", "/copy", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	handleCopy(rec, r)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the plan to be copied, got %d %s", rec.Code, rec.Body)
+	}
+	if _, ok := fs.get("/dst/b/2.txt"); !ok {
+		t.Error("expected each 'from' dir copied into 'to'")
+	}
+}
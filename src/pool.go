@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// copies lease their hdfs client from a pool of FASTCOPY_HDFS_CLIENTS connections instead of sharing the global
+// one, so a job stuck on a slow or broken namenode connection doesn't hold up the others. a client is health
+// checked when leased if it wasn't recently and replaced when the check fails, and a replaced or retired client is
+// closed once the last job leasing it releases it
+
+// the pool size unless FASTCOPY_HDFS_CLIENTS says otherwise
+const DefaultHdfsClients = 4
+
+// how long a client's last successful health check is trusted
+var clientHealthInterval = 30 * time.Second
+
+type pooledClient struct {
+	FileSystem
+	refs    int       // jobs leasing it
+	retired bool      // closed once refs drops to 0
+	checked time.Time // last successful health check
+}
+
+type clientPool struct {
+	mu      sync.Mutex
+	size    int
+	connect func() (FileSystem, error)
+	clients []*pooledClient
+	dialing int        // slots reserved by leases connecting outside the lock
+	dialed  *sync.Cond // signaled when one of them is done
+}
+
+var (
+	clientPoolInst *clientPool
+	clientPoolOnce sync.Once
+)
+
+func newClientPool(size int, connect func() (FileSystem, error)) *clientPool {
+	p := &clientPool{size: size, connect: connect}
+	p.dialed = sync.NewCond(&p.mu)
+	return p
+}
+
+// parses FASTCOPY_HDFS_CLIENTS
+func loadHdfsClients() (int, error) {
+	v := os.Getenv("FASTCOPY_HDFS_CLIENTS")
+	if v == "" {
+		return DefaultHdfsClients, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid FASTCOPY_HDFS_CLIENTS '%s', expected a positive integer", v)
+	}
+	return n, nil
+}
+
+// lazy loads the pool of hdfs clients copies lease
+func getClientPool() *clientPool {
+	clientPoolOnce.Do(func() {
+		size, err := loadHdfsClients()
+		if err != nil {
+			log.Fatal(err)
+		}
+		clientPoolInst = newClientPool(size, newHdfsClient)
+	})
+	return clientPoolInst
+}
+
+// leases a client, connecting a new one while the pool isn't full and otherwise sharing the least leased one.
+// a client not checked for clientHealthInterval is checked first and replaced if the namenode doesn't answer.
+// release must be called once the client isn't used anymore
+func (p *clientPool) acquire() (FileSystem, func(), error) {
+	c, err := p.lease()
+	if err != nil {
+		return nil, nil, err
+	}
+	if time.Since(c.checked) > clientHealthInterval {
+		if _, err := c.Stat("/"); err != nil {
+			log.Printf("hdfs client failed its health check, reconnecting: %s", err)
+			p.retire(c)
+			p.release(c)
+			if c, err = p.lease(); err != nil {
+				return nil, nil, err
+			}
+		}
+		p.mu.Lock()
+		c.checked = time.Now()
+		p.mu.Unlock()
+	}
+	return c.FileSystem, func() { p.release(c) }, nil
+}
+
+// connecting isn't done under the lock, a slow namenode would hold up every lease and release: a free slot is
+// reserved, then connected outside it. while every slot is reserved and none connected yet, a lease waits
+func (p *clientPool) lease() (*pooledClient, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.clients) == 0 && p.dialing >= p.size {
+		p.dialed.Wait()
+	}
+	if len(p.clients)+p.dialing < p.size {
+		p.dialing++
+		p.mu.Unlock()
+		client, err := p.connect()
+		p.mu.Lock()
+		p.dialing--
+		p.dialed.Broadcast()
+		if err != nil {
+			return nil, err
+		}
+		// a fresh connection counts as checked
+		c := &pooledClient{FileSystem: client, checked: time.Now()}
+		p.clients = append(p.clients, c)
+		c.refs++
+		return c, nil
+	}
+	least := p.clients[0]
+	for _, c := range p.clients[1:] {
+		if c.refs < least.refs {
+			least = c
+		}
+	}
+	least.refs++
+	return least, nil
+}
+
+func (p *clientPool) release(c *pooledClient) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c.refs--
+	if c.retired && c.refs == 0 {
+		closeClient(c)
+	}
+}
+
+// takes the client out of the pool, it's closed once released by every job leasing it
+func (p *clientPool) retire(c *pooledClient) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, other := range p.clients {
+		if other == c {
+			p.clients = append(p.clients[:i], p.clients[i+1:]...)
+			break
+		}
+	}
+	c.retired = true
+	if c.refs == 0 {
+		closeClient(c)
+	}
+}
+
+// retires every client, e.g. after new credentials were loaded, so later leases connect anew
+func (p *clientPool) retireAll() {
+	p.mu.Lock()
+	clients := append([]*pooledClient(nil), p.clients...)
+	p.mu.Unlock()
+	for _, c := range clients {
+		p.retire(c)
+	}
+}
+
+// the clients in the pool and how many jobs lease them, for tests and logs
+func (p *clientPool) leases() []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	refs := make([]int, 0, len(p.clients))
+	for _, c := range p.clients {
+		refs = append(refs, c.refs)
+	}
+	return refs
+}
+
+func closeClient(c *pooledClient) {
+	if err := c.Close(); err != nil {
+		log.Printf("failed to close a retired hdfs client: %s", err)
+	}
+}
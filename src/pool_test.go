@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// a client that counts its closes and fails its health check once broken
+type fakePoolClient struct {
+	*memFS
+	broken bool
+	closed int
+}
+
+func (c *fakePoolClient) Stat(name string) (os.FileInfo, error) {
+	if c.broken {
+		return nil, errors.New("connection reset by peer")
+	}
+	return c.memFS.Stat(name)
+}
+
+func (c *fakePoolClient) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestClientPool(t *testing.T) {
+	var connected []*fakePoolClient
+	pool := newClientPool(2, func() (FileSystem, error) {
+		c := &fakePoolClient{memFS: newMemFS()}
+		connected = append(connected, c)
+		return c, nil
+	})
+
+	a, releaseA, _ := pool.acquire()
+	b, releaseB, _ := pool.acquire()
+	c, releaseC, _ := pool.acquire()
+	if len(connected) != 2 || a == b || c != a {
+		t.Fatalf("expected 2 clients with the third job sharing the first, got %d", len(connected))
+	}
+	releaseB()
+	if d, releaseD, _ := pool.acquire(); d != b {
+		t.Errorf("expected the least leased client")
+	} else {
+		releaseD()
+	}
+
+	pool.retireAll()
+	if connected[0].closed != 0 || connected[1].closed != 1 {
+		t.Errorf("expected only the unleased client to be closed when retired, got %d and %d closes", connected[0].closed, connected[1].closed)
+	}
+	releaseA()
+	releaseC()
+	if connected[0].closed != 1 {
+		t.Errorf("expected the retired client to be closed once released by both jobs, got %d closes", connected[0].closed)
+	}
+
+	// a client failing its health check is replaced by a new connection
+	connected = nil
+	pool = newClientPool(1, pool.connect)
+	e, releaseE, _ := pool.acquire()
+	releaseE()
+	connected[0].broken = true
+	defer func(interval time.Duration) { clientHealthInterval = interval }(clientHealthInterval)
+	clientHealthInterval = 0
+	f, releaseF, err := pool.acquire()
+	if err != nil || f == e || connected[0].closed != 1 {
+		t.Errorf("expected the broken client to be closed and replaced, got %v and %d closes", err, connected[0].closed)
+	}
+	releaseF()
+	if leases := pool.leases(); len(leases) != 1 || leases[0] != 0 {
+		t.Errorf("expected one unleased client left in the pool, got %v", leases)
+	}
+}
+
+func TestClientPoolConnectsOutsideTheLock(t *testing.T) {
+	dialing, proceed := make(chan struct{}), make(chan struct{})
+	slow := false
+	pool := newClientPool(2, func() (FileSystem, error) {
+		if slow {
+			dialing <- struct{}{}
+			<-proceed
+		}
+		return &fakePoolClient{memFS: newMemFS()}, nil
+	})
+	_, release, _ := pool.acquire()
+
+	slow = true
+	leased := make(chan FileSystem)
+	go func() {
+		c, _, _ := pool.acquire()
+		leased <- c
+	}()
+	<-dialing
+	// the pool isn't held up while the second client connects
+	release()
+	if leases := pool.leases(); len(leases) != 1 || leases[0] != 0 {
+		t.Errorf("expected the first client released, got %v", leases)
+	}
+	close(proceed)
+	if c := <-leased; c == nil || len(pool.leases()) != 2 {
+		t.Errorf("expected the second client added to the pool, got %v", pool.leases())
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// values for /copy's 'precheck' param
+const (
+	PrecheckReady  = "ready"  // GET the target's /ready (default)
+	PrecheckUpload = "upload" // also probe that the destination dir is writable
+	PrecheckNone   = "none"
+)
+
+// Reports whether this instance can serve uploads, i.e. hdfs is reachable
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	if refuseDraining(w) {
+		return
+	}
+	if _, err := GetHdfsClient().Stat("/"); err != nil {
+		writeError(w, fmt.Sprintf("hdfs unavailable: %s", err), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("{\"status\":\"ready\"}"))
+}
+
+// checks a probe file can be created in 'to' and removes it again
+func probeWritable(to string) error {
+	client := GetHdfsClient()
+	if err := client.MkdirAll(to, os.FileMode(0755)); err != nil {
+		return fmt.Errorf("cannot create %s: %w", to, err)
+	}
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	path := filepath.Join(to, ".fastcopy-probe-"+hex.EncodeToString(suffix))
+	file, err := client.Create(path)
+	if err != nil {
+		return fmt.Errorf("cannot write to %s: %w", to, err)
+	}
+	file.Close()
+	return client.Remove(path)
+}
+
+// checks the target is reachable, ready and (for PrecheckUpload) can write to 'to' before any transfer is scheduled.
+// returns an error describing what to fix
+func precheckTarget(targetURL string, to string, mode string) error {
+	if mode == PrecheckNone {
+		return nil
+	}
+	readyURL := peerURL(targetURL, "/ready", nil)
+	resp, err := httpClient.Get(readyURL)
+	if err != nil {
+		return fmt.Errorf("target precheck failed, cannot connect to %s: %s. check targetURL and network connectivity to the target", readyURL, err)
+	}
+	if err := precheckStatus(resp, readyURL); err != nil {
+		return err
+	}
+	if mode != PrecheckUpload {
+		return nil
+	}
+
+	probeURL := targetURL + "?" + url.Values{"to": {to}, "fileName": {".fastcopy-probe"}, "probe": {"true"}}.Encode()
+	resp, err = httpClient.Post(probeURL, "application/octet-stream", bytes.NewReader(nil))
+	if err != nil {
+		return fmt.Errorf("target precheck failed, cannot connect to %s: %s", targetURL, err)
+	}
+	return precheckStatus(resp, targetURL)
+}
+
+func precheckStatus(resp *http.Response, endpoint string) error {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("target precheck failed, %s rejected our credentials (%d): %s", endpoint, resp.StatusCode, peerErrorMessage(body))
+	case http.StatusNotFound:
+		return fmt.Errorf("target precheck failed, %s returned 404. check targetURL points at a fastcopy /upload endpoint, or pass precheck=none for older peers", endpoint)
+	default:
+		return fmt.Errorf("target precheck failed, %s returned %d: %s", endpoint, resp.StatusCode, peerErrorMessage(body))
+	}
+}
+
+func validPrecheck(mode string) bool {
+	return mode == "" || mode == PrecheckReady || mode == PrecheckUpload || mode == PrecheckNone
+}
+
+// handles an /upload with probe=true: only checks the destination is writable
+func handleProbe(w http.ResponseWriter, to string) {
+	if err := probeWritable(to); err != nil {
+		log.Printf("Write probe of %s failed: %s", to, err)
+		writeError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	w.Write([]byte("{\"status\":\"writable\"}"))
+}
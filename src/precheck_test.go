@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrecheckTarget(t *testing.T) {
+	ready := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ready" {
+			http.NotFound(w, r)
+			return
+		}
+		if !ready {
+			http.Error(w, "hdfs unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	if err := precheckTarget(server.URL+"/upload", "/tmp/out", PrecheckReady); err != nil {
+		t.Errorf("expected ready target to pass, got %s", err)
+	}
+	ready = false
+	if err := precheckTarget(server.URL+"/upload", "/tmp/out", ""); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("expected unready target to fail with its status, got %v", err)
+	}
+	if err := precheckTarget(server.URL+"/upload", "/tmp/out", PrecheckNone); err != nil {
+		t.Errorf("expected precheck=none to skip the check, got %s", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// uploads carry the sender's protocol version and the features the receiver must support to write them as
+// sent, e.g. an encrypted upload needs a receiver holding the keys. a receiver lacking one refuses the upload
+// with 412 naming it, rather than writing ciphertext or a half applied patch, and the sender fails the file with
+// that message. a sender newer than the receiver is accepted as long as it requires nothing the receiver lacks,
+// and a sender predating the header is taken to be version 1
+
+const (
+	ProtocolVersion = 2
+
+	versionHeader  = "X-Fastcopy-Version"
+	requiresHeader = "X-Fastcopy-Requires"
+)
+
+// the features the receiver needs to write an upload as sent
+func requiredFeatures(opts CopyOptions, resumeFrom int64, attempt int, patch bool) []string {
+	var required []string
+	if opts.Encrypt {
+		required = append(required, FeatureEncryption)
+	}
+	if resumeFrom > 0 {
+		required = append(required, FeatureResume)
+	}
+	if attempt > 0 {
+		required = append(required, FeatureSpeculation)
+	}
+	if patch {
+		required = append(required, FeatureDelta)
+	}
+	return required
+}
+
+// sets the protocol headers of an upload needing the required features
+func setProtocolHeaders(header http.Header, required []string) {
+	header.Set(versionHeader, strconv.Itoa(ProtocolVersion))
+	if len(required) > 0 {
+		header.Set(requiresHeader, strings.Join(required, ","))
+	}
+}
+
+// checks the protocol headers of an upload, writing the error response and returning false if it can't be
+// written as sent
+func checkProtocol(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set(versionHeader, strconv.Itoa(ProtocolVersion))
+	version := 1
+	if v := r.Header.Get(versionHeader); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, fmt.Sprintf("invalid %s header '%s', expected a positive integer", versionHeader, v), http.StatusBadRequest)
+			return false
+		}
+		version = n
+	}
+	local := localCapabilities()
+	var missing []string
+	for _, feature := range strings.Split(r.Header.Get(requiresHeader), ",") {
+		if feature = strings.TrimSpace(feature); feature != "" && !local.supports(feature) {
+			missing = append(missing, feature)
+		}
+	}
+	if len(missing) > 0 {
+		msg := fmt.Sprintf("this receiver doesn't support %s, which the upload of protocol version %d requires", strings.Join(missing, ", "), version)
+		writeError(w, msg, http.StatusPreconditionFailed)
+		log.Printf("Rejected upload: %s", msg)
+		return false
+	}
+	if version > ProtocolVersion {
+		log.Printf("Accepting an upload of protocol version %d, newer than this receiver's %d, it requires nothing this receiver lacks", version, ProtocolVersion)
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestUploadProtocol(t *testing.T) {
+	fs := useMemFS(t)
+	t.Setenv("FASTCOPY_ENCRYPTION_KEY", "")
+	t.Setenv("FASTCOPY_ENCRYPTION_KEYS", "")
+	upload := func(version, requires string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/upload?to=/dst&fileName=a.txt", strings.NewReader("hello"))
+		if version != "" {
+			req.Header.Set(versionHeader, version)
+		}
+		if requires != "" {
+			req.Header.Set(requiresHeader, requires)
+		}
+		rec := httptest.NewRecorder()
+		handleUpload(rec, req)
+		return rec
+	}
+
+	rec := upload("2", FeatureEncryption)
+	if rec.Code != http.StatusPreconditionFailed || !strings.Contains(rec.Body.String(), "doesn't support encryption") {
+		t.Errorf("expected an upload needing encryption to be refused, got %d %s", rec.Code, rec.Body)
+	}
+	if _, ok := fs.get("/dst/a.txt"); ok {
+		t.Error("expected nothing to be written")
+	}
+	if rec := upload("two", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected a malformed version to be refused, got %d", rec.Code)
+	}
+	for _, version := range []string{"", "1", "9"} {
+		rec := upload(version, FeatureResume)
+		if rec.Code != http.StatusOK || rec.Header().Get(versionHeader) != strconv.Itoa(ProtocolVersion) {
+			t.Errorf("version %q: expected the upload to be written, got %d %s", version, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestSendSurfacesRefusal(t *testing.T) {
+	useMemFS(t)
+	t.Setenv("FASTCOPY_ENCRYPTION_KEY", "")
+	t.Setenv("FASTCOPY_ENCRYPTION_KEYS", "")
+	var requires string
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requires = r.Header.Get(requiresHeader)
+		r.Header.Set(requiresHeader, FeatureEncryption) // as if the upload were encrypted
+		handleUpload(w, r)
+	}))
+	defer peer.Close()
+
+	_, err := sendToUpload(strings.NewReader("hello"), peer.URL+"/upload", CopyArgs{File: "a.txt", To: "/dst", Size: 5}, CopyOptions{})
+	if err == nil || !strings.Contains(err.Error(), "412: this receiver doesn't support encryption") {
+		t.Errorf("expected the receiver's refusal in the error, got %v", err)
+	}
+	if requires != "" {
+		t.Errorf("expected a plain upload to require nothing, got %q", requires)
+	}
+}
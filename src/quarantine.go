@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// with FASTCOPY_QUARANTINE_DIR set, a copy failing its checks is neither deleted nor left in place: it's moved
+// below that dir, keeping its path under a dir named after the time, next to a <name>.quarantine.json describing
+// where it came from and what was expected, so flaky links can be debugged from the bytes that actually arrived
+
+const (
+	quarantineSuffix = ".quarantine.json"  // of the sidecar describing a quarantined file
+	sourceHeader     = "X-Fastcopy-Source" // the source path of an upload, recorded if it's quarantined
+)
+
+// the sidecar of a quarantined file, also returned by /quarantine
+type QuarantinedFile struct {
+	Path          string            `json:"path"` // where the copy was written
+	QuarantinedAs string            `json:"quarantinedAs"`
+	Source        string            `json:"source,omitempty"`
+	Reason        string            `json:"reason"`
+	Expected      map[string]string `json:"expected,omitempty"` // by check, e.g. sha-256, md5 or size
+	Actual        map[string]string `json:"actual,omitempty"`
+	QuarantinedAt time.Time         `json:"quarantinedAt"`
+}
+
+var (
+	quarantineDir     string
+	quarantineDirOnce sync.Once
+)
+
+// reads FASTCOPY_QUARANTINE_DIR, empty when bad copies are removed instead
+func loadQuarantineDir() (string, error) {
+	dir := os.Getenv("FASTCOPY_QUARANTINE_DIR")
+	if dir == "" {
+		return "", nil
+	}
+	if !path.IsAbs(dir) {
+		return "", fmt.Errorf("invalid FASTCOPY_QUARANTINE_DIR '%s', expected an absolute hdfs path", dir)
+	}
+	return path.Clean(dir), nil
+}
+
+// lazy loads the quarantine dir
+func getQuarantineDir() string {
+	quarantineDirOnce.Do(func() {
+		dir, err := loadQuarantineDir()
+		if err != nil {
+			log.Fatal(err)
+		}
+		quarantineDir = dir
+	})
+	return quarantineDir
+}
+
+// moves q.Path into dir and writes its sidecar next to it, returning q completed with where it went.
+// QuarantinedAs stays empty if the file couldn't be moved. q.Path is cleaned as an absolute path first, so a ..
+// in it can't place the file outside dir
+func quarantineFile(client FileSystem, dir string, q QuarantinedFile) (QuarantinedFile, error) {
+	q.QuarantinedAt = time.Now().UTC()
+	dest := filepath.Join(dir, q.QuarantinedAt.Format("20060102T150405.000000000Z"), filepath.Clean("/"+q.Path))
+	if err := client.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return q, err
+	}
+	if err := client.Rename(q.Path, dest); err != nil {
+		return q, err
+	}
+	q.QuarantinedAs = dest
+	sidecar, _ := json.MarshalIndent(q, "", "  ")
+	w, err := client.Create(q.QuarantinedAs + quarantineSuffix)
+	if err != nil {
+		return q, fmt.Errorf("quarantined as %s but cannot write its sidecar: %w", q.QuarantinedAs, err)
+	}
+	if _, err := w.Write(sidecar); err != nil {
+		w.Close()
+		return q, fmt.Errorf("quarantined as %s but cannot write its sidecar: %w", q.QuarantinedAs, err)
+	}
+	return q, w.Close()
+}
+
+// gets rid of a rejected upload at path, quarantining it when a quarantine dir is configured and removing it
+// otherwise. returns where it was quarantined, empty when it was removed
+func discardUpload(r *http.Request, path string, reason string, expected map[string]string, res UploadResponse) string {
+	client := GetHdfsClient()
+	dir := getQuarantineDir()
+	if dir == "" {
+		client.Remove(path)
+		return ""
+	}
+	actual := map[string]string{"size": strconv.FormatInt(res.Written, 10), "md5": res.MD5, "sha-256": res.SHA256}
+	if res.Path == "" {
+		actual = nil // the write never completed
+	}
+	q, err := quarantineFile(client, dir, QuarantinedFile{Path: path, Source: r.Header.Get(sourceHeader), Reason: reason, Expected: expected, Actual: actual})
+	if err != nil && q.QuarantinedAs == "" {
+		log.Printf("Failed to quarantine %s, removing it: %s", path, err)
+		client.Remove(path)
+		return ""
+	}
+	if err != nil {
+		log.Print(err)
+	}
+	log.Printf("Quarantined %s as %s", path, q.QuarantinedAs)
+	return q.QuarantinedAs
+}
+
+// appends where a rejected upload was quarantined to its error message
+func withQuarantine(msg string, quarantinedAs string) string {
+	if quarantinedAs == "" {
+		return msg
+	}
+	return msg + ", quarantined as " + quarantinedAs
+}
+
+// Moves the hdfs file named by the JSON body's 'path' into FASTCOPY_QUARANTINE_DIR along with a sidecar of the
+// body, answers 501 when no quarantine dir is configured. 'path' is confined like the target of an upload
+func handleQuarantine(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "POST a JSON body with 'path', 'reason' and optionally 'source', 'expected' and 'actual'.", http.StatusMethodNotAllowed)
+		return
+	}
+	var q QuarantinedFile
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil || q.Path == "" || q.Reason == "" {
+		writeError(w, "a JSON body with 'path' and 'reason' must be provided.", http.StatusBadRequest)
+		return
+	}
+	if err := confinePath("path", q.Path); err != nil {
+		writeConfineError(w, err)
+		return
+	}
+	dir := getQuarantineDir()
+	if dir == "" {
+		writeError(w, "FASTCOPY_QUARANTINE_DIR is not set", http.StatusNotImplemented)
+		return
+	}
+	client := GetHdfsClient()
+	if _, err := client.Stat(q.Path); errors.Is(err, os.ErrNotExist) {
+		writeError(w, fmt.Sprintf("%s does not exist", q.Path), http.StatusNotFound)
+		return
+	}
+	q, err := quarantineFile(client, dir, q)
+	if err != nil && q.QuarantinedAs == "" {
+		writeError(w, fmt.Sprintf("Failed to quarantine %s: %s", q.Path, err), http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+	}
+	log.Printf("Quarantined %s as %s: %s", q.Path, q.QuarantinedAs, q.Reason)
+	json, _ := json.MarshalIndent(q, "", "  ")
+	w.Write(json)
+}
+
+// asks the peer to quarantine a copy. returns where it went, empty without an error when the peer has no
+// quarantine dir configured
+func requestQuarantine(targetURL string, q QuarantinedFile) (string, error) {
+	body, _ := json.Marshal(q)
+	resp, err := httpClient.Post(peerURL(targetURL, "/quarantine", nil), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotImplemented {
+		return "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("/quarantine returned non-OK status %d: %s", resp.StatusCode, peerErrorMessage(msg))
+	}
+	var done QuarantinedFile
+	err = json.NewDecoder(resp.Body).Decode(&done)
+	return done.QuarantinedAs, err
+}
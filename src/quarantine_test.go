@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// quarantines bad copies below dir for the duration of the test, no quarantine when dir is empty
+func useQuarantineDir(t *testing.T, dir string) {
+	quarantineDirOnce.Do(func() {})
+	prev := quarantineDir
+	quarantineDir = dir
+	t.Cleanup(func() { quarantineDir = prev })
+}
+
+// reads the sidecar of the file quarantined as path
+func readSidecar(t *testing.T, fs *memFS, path string) QuarantinedFile {
+	data, ok := fs.get(path + quarantineSuffix)
+	if !ok {
+		t.Fatalf("expected a sidecar next to %s", path)
+	}
+	var q QuarantinedFile
+	if err := json.Unmarshal([]byte(data), &q); err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestVerifyQuarantinesMismatches(t *testing.T) {
+	fs := useMemFS(t)
+	useQuarantineDir(t, "/quarantine")
+	fs.put(map[string]string{"/src/a": "aaaa", "/dst/a": "aXaa"})
+	server := checksumPeer(t)
+	copied := []CopiedFile{{Args: CopyArgs{From: "/src", File: "a", Path: "/src/a", To: "/dst", Size: 4}}}
+
+	res := verifySample(fs, server.URL+"/upload", copied, 100, 1)
+	if len(res.Mismatches) != 1 {
+		t.Fatalf("expected the corrupted copy to mismatch, got %+v", res)
+	}
+	m := res.Mismatches[0]
+	if !strings.HasPrefix(m.QuarantinedAs, "/quarantine/") || !strings.HasSuffix(m.QuarantinedAs, "/dst/a") {
+		t.Fatalf("expected the copy to be quarantined below /quarantine, got %+v", m)
+	}
+	if _, ok := fs.get("/dst/a"); ok {
+		t.Error("expected the corrupted copy to be moved out of the destination")
+	}
+	if data, _ := fs.get(m.QuarantinedAs); data != "aXaa" {
+		t.Errorf("expected the quarantined file to keep the bytes that arrived, got '%s'", data)
+	}
+	q := readSidecar(t, fs, m.QuarantinedAs)
+	if q.Path != "/dst/a" || q.Source != "/src/a" || q.Expected["sha-256"] != m.SourceSHA256 || q.Actual["sha-256"] != m.TargetSHA256 || q.QuarantinedAt.IsZero() {
+		t.Errorf("unexpected sidecar %+v", q)
+	}
+
+	// without a quarantine dir the copy stays where it is
+	useQuarantineDir(t, "")
+	fs.put(map[string]string{"/dst/a": "aXaa"})
+	res = verifySample(fs, server.URL+"/upload", copied, 100, 1)
+	if len(res.Mismatches) != 1 || res.Mismatches[0].QuarantinedAs != "" || strings.Contains(res.Mismatches[0].Reason, "quarantine") {
+		t.Errorf("expected the mismatch without quarantine, got %+v", res.Mismatches)
+	}
+	if _, ok := fs.get("/dst/a"); !ok {
+		t.Error("expected the copy to be left in place")
+	}
+}
+
+func TestUploadQuarantinesDigestMismatch(t *testing.T) {
+	fs := useMemFS(t)
+	useQuarantineDir(t, "/quarantine")
+	req := httptest.NewRequest("POST", "/upload?to=/dst&fileName=part-00000", strings.NewReader("hello"))
+	req.Header.Set("Digest", "sha-256=bm90IHRoZSBkaWdlc3Q=")
+	req.Header.Set(sourceHeader, "/src/part-00000")
+	rec := httptest.NewRecorder()
+	handleUpload(rec, req)
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), "quarantined as /quarantine/") {
+		t.Fatalf("expected the upload to be rejected and quarantined, got %d: %s", rec.Code, rec.Body)
+	}
+	if _, ok := fs.get("/dst/part-00000"); ok {
+		t.Error("expected the rejected upload to be moved out of the destination")
+	}
+	msg := peerErrorMessage(rec.Body.Bytes())
+	quarantinedAs := msg[strings.Index(msg, "/quarantine/"):]
+	q := readSidecar(t, fs, quarantinedAs)
+	if q.Source != "/src/part-00000" || q.Expected["sha-256"] != "bm90IHRoZSBkaWdlc3Q=" || q.Actual["size"] != "5" || !strings.Contains(q.Reason, "digest mismatch") {
+		t.Errorf("unexpected sidecar %+v", q)
+	}
+}
+
+func TestHandleQuarantine(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{"/dst/a": "a"})
+	for body, status := range map[string]int{`{"path":"/dst/a"}`: 400, `{"path":"/dst/a","reason":"bad"}`: 501} {
+		rec := httptest.NewRecorder()
+		handleQuarantine(rec, httptest.NewRequest("POST", "/quarantine", strings.NewReader(body)))
+		if rec.Code != status {
+			t.Errorf("%s: expected %d, got %d", body, status, rec.Code)
+		}
+	}
+	useQuarantineDir(t, "/quarantine")
+	rec := httptest.NewRecorder()
+	handleQuarantine(rec, httptest.NewRequest("POST", "/quarantine", strings.NewReader(`{"path":"/dst/missing","reason":"bad"}`)))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected a missing file to answer 404, got %d", rec.Code)
+	}
+	for _, p := range []string{"dst/a", "/dst/../../etc/passwd"} {
+		rec := httptest.NewRecorder()
+		handleQuarantine(rec, httptest.NewRequest("POST", "/quarantine", strings.NewReader(`{"path":"`+p+`","reason":"bad"}`)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("expected %s to be refused, got %d", p, rec.Code)
+		}
+	}
+	q, err := quarantineFile(fs, "/quarantine", QuarantinedFile{Path: "/../dst/a", Reason: "bad"})
+	if err != nil || !strings.HasPrefix(q.QuarantinedAs, "/quarantine/") || !strings.HasSuffix(q.QuarantinedAs, "/dst/a") {
+		t.Errorf("expected the file quarantined below /quarantine, got %+v, %v", q, err)
+	}
+}
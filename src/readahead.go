@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/briansterle/cluster-fastcopy/pkg/fastcopy"
+)
+
+// how far each transfer reads ahead of its upload unless FASTCOPY_READ_AHEAD is set
+const defaultReadAhead = 4 * fastcopy.DefaultPrefetchChunkSize
+
+var (
+	readAheadChunks int
+	readAheadOnce   sync.Once
+)
+
+// parses FASTCOPY_READ_AHEAD, e.g. 16M, into chunks of fastcopy.DefaultPrefetchChunkSize. 0 reads synchronously
+func loadReadAhead() (int, error) {
+	size := int64(defaultReadAhead)
+	if spec := os.Getenv("FASTCOPY_READ_AHEAD"); spec != "" {
+		n, err := parseByteSize(spec)
+		if err != nil {
+			return 0, fmt.Errorf("invalid FASTCOPY_READ_AHEAD '%s'", spec)
+		}
+		size = n
+	}
+	chunks := int(size / fastcopy.DefaultPrefetchChunkSize)
+	if size > 0 && chunks == 0 {
+		chunks = 1
+	}
+	return chunks, nil
+}
+
+// lazy loads how many chunks each transfer reads from hdfs ahead of the upload
+func getReadAhead() int {
+	readAheadOnce.Do(func() {
+		chunks, err := loadReadAhead()
+		if err != nil {
+			log.Fatal(err)
+		}
+		readAheadChunks = chunks
+	})
+	return readAheadChunks
+}
@@ -0,0 +1,16 @@
+package main
+
+import "testing"
+
+func TestLoadReadAhead(t *testing.T) {
+	for spec, want := range map[string]int{"": 4, "16M": 16, "0": 0, "512K": 1, "1G": 1024} {
+		t.Setenv("FASTCOPY_READ_AHEAD", spec)
+		if got, err := loadReadAhead(); err != nil || got != want {
+			t.Errorf("FASTCOPY_READ_AHEAD=%s: expected %d chunks, got %d %v", spec, want, got, err)
+		}
+	}
+	t.Setenv("FASTCOPY_READ_AHEAD", "lots")
+	if _, err := loadReadAhead(); err == nil {
+		t.Error("expected an invalid size to be rejected")
+	}
+}
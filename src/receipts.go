@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a receiver remembers the files it wrote for each job, with the sha256 it computed writing them. with
+// FASTCOPY_RECEIPT_KEY set it signs a delivery receipt of them with that ed25519 key when asked through
+// POST /receipts?jobId=, as a copy with receipt=true does once done, keeping the receipt in its response.
+// the signature covers the receipt's JSON without 'signature', as served, and can be checked with the public
+// key in the receipt, which GET /receipts/key serves for auditors to pin
+
+// how many jobs the files received are remembered for, the oldest are forgotten first
+const maxReceivedJobs = 1000
+
+// a file written for a job, as the receiver computed it
+type ReceivedFile struct {
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256"`
+	ReceivedAt time.Time `json:"receivedAt"`
+}
+
+type DeliveryReceipt struct {
+	JobID      string         `json:"jobId"`
+	Receiver   string         `json:"receiver"` // the receiver's host name
+	Files      []ReceivedFile `json:"files"`
+	TotalBytes int64          `json:"totalBytes"`
+	IssuedAt   time.Time      `json:"issuedAt"`
+	PublicKey  string         `json:"publicKey"` // base64 ed25519
+	KeyID      string         `json:"keyId"`     // the first 16 hex digits of the public key's sha256
+	Signature  string         `json:"signature,omitempty"`
+}
+
+var (
+	received      = make(map[string]map[string]ReceivedFile) // by job, then path
+	receivedOrder []string
+	receivedMu    sync.Mutex
+)
+
+var (
+	receiptKey     ed25519.PrivateKey
+	receiptKeyOnce sync.Once
+)
+
+// reads FASTCOPY_RECEIPT_KEY, the base64 32 byte seed of an ed25519 key. nil when it isn't set
+func loadReceiptKey() (ed25519.PrivateKey, error) {
+	v, err := secretEnv("FASTCOPY_RECEIPT_KEY")
+	if err != nil || v == "" {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid FASTCOPY_RECEIPT_KEY, expected the base64 of a %d byte ed25519 seed", ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// lazy loads the key receipts are signed with, nil when receipts aren't signed
+func getReceiptKey() ed25519.PrivateKey {
+	receiptKeyOnce.Do(func() {
+		key, err := loadReceiptKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+		receiptKey = key
+	})
+	return receiptKey
+}
+
+func receiptKeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// remembers the file written for the job of origin. uploads without a job aren't remembered
+func recordReceived(origin *UploadOrigin, res UploadResponse) {
+	if origin == nil || origin.JobID == "" {
+		return
+	}
+	receivedMu.Lock()
+	defer receivedMu.Unlock()
+	files, ok := received[origin.JobID]
+	if !ok {
+		files = make(map[string]ReceivedFile)
+		received[origin.JobID] = files
+		receivedOrder = append(receivedOrder, origin.JobID)
+		for len(receivedOrder) > maxReceivedJobs {
+			delete(received, receivedOrder[0])
+			receivedOrder = receivedOrder[1:]
+		}
+	}
+	files[res.Path] = ReceivedFile{Path: res.Path, Size: res.Written, SHA256: res.SHA256, ReceivedAt: time.Now().UTC()}
+}
+
+// the payload a receipt's signature covers
+func receiptPayload(receipt DeliveryReceipt) []byte {
+	receipt.Signature = ""
+	payload, _ := json.Marshal(receipt)
+	return payload
+}
+
+// the signed receipt of the files written for the job
+func issueReceipt(jobID string, key ed25519.PrivateKey, now time.Time) DeliveryReceipt {
+	receivedMu.Lock()
+	files := make([]ReceivedFile, 0, len(received[jobID]))
+	for _, f := range received[jobID] {
+		files = append(files, f)
+	}
+	receivedMu.Unlock()
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+	host, _ := os.Hostname()
+	pub := key.Public().(ed25519.PublicKey)
+	receipt := DeliveryReceipt{JobID: jobID, Receiver: host, Files: files, IssuedAt: now.UTC(), PublicKey: base64.StdEncoding.EncodeToString(pub), KeyID: receiptKeyID(pub)}
+	for _, f := range files {
+		receipt.TotalBytes += f.Size
+	}
+	receipt.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, receiptPayload(receipt)))
+	return receipt
+}
+
+// checks the receipt is signed by its public key
+func verifyReceipt(receipt DeliveryReceipt) error {
+	pub, err := base64.StdEncoding.DecodeString(receipt.PublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return errors.New("the receipt's public key isn't a base64 ed25519 key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(receipt.Signature)
+	if err != nil || !ed25519.Verify(pub, receiptPayload(receipt), sig) {
+		return errors.New("the receipt's signature doesn't match its content")
+	}
+	return nil
+}
+
+// POST /receipts?jobId= answers the signed receipt of the files written for the job, 501 without a receipt key.
+// GET /receipts/key answers the public key receipts are signed with
+func handleReceipts(w http.ResponseWriter, r *http.Request) {
+	key := getReceiptKey()
+	if key == nil {
+		writeError(w, "this receiver doesn't sign receipts, FASTCOPY_RECEIPT_KEY isn't set", http.StatusNotImplemented)
+		return
+	}
+	if strings.Trim(strings.TrimPrefix(r.URL.Path, "/receipts"), "/") == "key" {
+		pub := key.Public().(ed25519.PublicKey)
+		json, _ := json.Marshal(map[string]string{"publicKey": base64.StdEncoding.EncodeToString(pub), "keyId": receiptKeyID(pub)})
+		w.Write(json)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	jobID := r.URL.Query().Get("jobId")
+	if jobID == "" {
+		writeError(w, "'jobId' query param must be provided.", http.StatusBadRequest)
+		return
+	}
+	receipt := issueReceipt(jobID, key, time.Now())
+	log.Printf("Issued the receipt of job %s: %d files, %d bytes", jobID, len(receipt.Files), receipt.TotalBytes)
+	json, _ := json.Marshal(receipt)
+	w.Write(json)
+}
+
+// asks the peer for the receipt of the job and checks it's signed and covers every copied file with the sha256
+// the upload answered
+func requestReceipt(targetURL string, jobID string, copied []CopiedFile) (DeliveryReceipt, error) {
+	var receipt DeliveryReceipt
+	resp, err := httpClient.Post(peerURL(targetURL, "/receipts", url.Values{"jobId": {jobID}}), "application/octet-stream", nil)
+	if err != nil {
+		return receipt, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return receipt, fmt.Errorf("/receipts returned non-OK status %d: %s", resp.StatusCode, peerErrorMessage(msg))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&receipt); err != nil {
+		return receipt, err
+	}
+	if err := verifyReceipt(receipt); err != nil {
+		return receipt, err
+	}
+	files := make(map[string]ReceivedFile, len(receipt.Files))
+	for _, f := range receipt.Files {
+		files[f.Path] = f
+	}
+	for _, c := range copied {
+		dest := filepath.Join(c.Args.To, c.Args.File)
+		if f, ok := files[dest]; !ok || f.SHA256 != c.Upload.SHA256 {
+			return receipt, fmt.Errorf("the receipt doesn't attest %s as copied", dest)
+		}
+	}
+	return receipt, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func useReceiptKey(t *testing.T, key ed25519.PrivateKey) {
+	receiptKeyOnce.Do(func() {})
+	prev := receiptKey
+	receiptKey = key
+	t.Cleanup(func() { receiptKey = prev })
+}
+
+func TestCopyWithReceipt(t *testing.T) {
+	fs := useMemFS(t)
+	useReceiptKey(t, ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)))
+	fs.put(map[string]string{"/src/a.txt": "hello", "/src/b.txt": "world!"})
+	peer := httptest.NewServer(apiMux())
+	defer peer.Close()
+
+	query := url.Values{"from": {"/src"}, "to": {"/dst"}, "targetURL": {peer.URL + "/upload"}, "receipt": {"true"}}
+	rec := httptest.NewRecorder()
+	handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+	var resp CopyResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusOK || resp.State != StateSucceeded || len(resp.Receipts) != 1 {
+		t.Fatalf("expected a copy with a receipt, got %d %s", rec.Code, rec.Body)
+	}
+	receipt := resp.Receipts[0]
+	if receipt.JobID != resp.JobID || len(receipt.Files) != 2 || receipt.TotalBytes != 11 || receipt.Files[0].Path != "/dst/a.txt" {
+		t.Errorf("unexpected receipt %+v", receipt)
+	}
+	if err := verifyReceipt(receipt); err != nil {
+		t.Errorf("expected the receipt to verify, got %s", err)
+	}
+	if status := getJob(resp.JobID).status(); status.Result == nil || len(status.Result.Receipts) != 1 {
+		t.Error("expected the receipt kept with the job")
+	}
+
+	receipt.Files[1].SHA256 = receipt.Files[0].SHA256
+	if err := verifyReceipt(receipt); err == nil {
+		t.Error("expected a tampered receipt to fail verification")
+	}
+
+	rec = httptest.NewRecorder()
+	handleReceipts(rec, httptest.NewRequest("GET", "/receipts/key", nil))
+	var key map[string]string
+	json.Unmarshal(rec.Body.Bytes(), &key)
+	if key["publicKey"] != receipt.PublicKey || key["keyId"] != receipt.KeyID {
+		t.Errorf("expected the receipts' public key, got %s", rec.Body)
+	}
+}
+
+func TestReceiptNeedsKey(t *testing.T) {
+	fs := useMemFS(t)
+	useReceiptKey(t, nil)
+	fs.put(map[string]string{"/src/a.txt": "hello"})
+	peer := httptest.NewServer(apiMux())
+	defer peer.Close()
+
+	query := url.Values{"from": {"/src"}, "to": {"/dst"}, "targetURL": {peer.URL + "/upload"}, "receipt": {"true"}}
+	rec := httptest.NewRecorder()
+	handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+	var resp CopyResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if resp.State != StateFailed || len(resp.CopyFailures) != 1 || resp.CopyFailures[0].Path != "/dst" {
+		t.Errorf("expected a copy without a receipt to fail, got %d %s", rec.Code, rec.Body)
+	}
+
+	t.Setenv("FASTCOPY_RECEIPT_KEY", base64.StdEncoding.EncodeToString([]byte("short")))
+	if _, err := loadReceiptKey(); err == nil {
+		t.Error("expected a malformed key to be rejected")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+type LsEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	IsDir   bool      `json:"isDir"`
+	// the type the file was copied with, listed with contentTypes=true
+	ContentType string `json:"contentType,omitempty"`
+}
+
+// Lists the hdfs directory provided by query param 'path', with param 'contentTypes' the files' content types too
+func handleLs(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeError(w, "'path' query param must be provided.", http.StatusBadRequest)
+		return
+	}
+	fileInfos, err := GetHdfsClient().ReadDir(path)
+	if errors.Is(err, os.ErrNotExist) {
+		writeError(w, fmt.Sprintf("%s does not exist", path), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, fmt.Sprintf("Failed to list the hdfs dir %s", err), http.StatusInternalServerError)
+		return
+	}
+	withTypes := r.URL.Query().Get("contentTypes") == "true"
+	entries := make([]LsEntry, 0, len(fileInfos))
+	for _, fi := range fileInfos {
+		entry := LsEntry{Name: fi.Name(), Size: fi.Size(), ModTime: fi.ModTime(), IsDir: fi.IsDir()}
+		if withTypes && !fi.IsDir() {
+			entry.ContentType = storedContentType(GetHdfsClient(), filepath.Join(path, fi.Name()))
+		}
+		entries = append(entries, entry)
+	}
+	json, _ := json.Marshal(entries)
+	w.Write(json)
+}
+
+// the peer has no /ls to list a directory with
+var errNoListing = errors.New("the target has no /ls")
+
+// lists a directory on the peer via its /ls. a missing directory, answered with a JSON error, is an empty
+// listing, while the plain 404 of a peer without /ls fails with errNoListing
+func listPeer(targetURL string, path string) ([]LsEntry, error) {
+	resp, err := httpClient.Get(peerURL(targetURL, "/ls", url.Values{"path": {path}}))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		var envelope errorEnvelope
+		if resp.StatusCode == http.StatusNotFound {
+			if json.Unmarshal(msg, &envelope) == nil && envelope.Error.Code != "" {
+				return []LsEntry{}, nil
+			}
+			return nil, errNoListing
+		}
+		return nil, fmt.Errorf("/ls returned non-OK status %d: %s", resp.StatusCode, peerErrorMessage(msg))
+	}
+	entries := make([]LsEntry, 0)
+	err = json.NewDecoder(resp.Body).Decode(&entries)
+	return entries, err
+}
+
+// compares the planned files against the destination listing and describes every difference in
+// names, sizes, file count and total bytes. files in the destination that aren't part of the plan are ignored
+func reconcile(plan []CopyArgs, listing []LsEntry) []string {
+	dest := make(map[string]LsEntry, len(listing))
+	for _, e := range listing {
+		dest[e.Name] = e
+	}
+	discrepancies := make([]string, 0)
+	var planned, found, plannedBytes, foundBytes int64
+	for _, args := range plan {
+		planned++
+		plannedBytes += args.Size
+		e, ok := dest[args.File]
+		switch {
+		case !ok:
+			discrepancies = append(discrepancies, fmt.Sprintf("%s is missing from the destination", args.File))
+		case e.IsDir:
+			discrepancies = append(discrepancies, fmt.Sprintf("%s is a directory in the destination", args.File))
+		default:
+			found++
+			foundBytes += e.Size
+			if e.Size != args.Size {
+				discrepancies = append(discrepancies, fmt.Sprintf("%s has %d bytes in the destination, expected %d", args.File, e.Size, args.Size))
+			}
+		}
+	}
+	sort.Strings(discrepancies)
+	if found != planned {
+		discrepancies = append(discrepancies, fmt.Sprintf("destination has %d of %d planned files", found, planned))
+	}
+	if foundBytes != plannedBytes {
+		discrepancies = append(discrepancies, fmt.Sprintf("destination has %d of %d planned bytes", foundBytes, plannedBytes))
+	}
+	return discrepancies
+}
+
+// lists the destination and reconciles it against the plan
+func reconcileWithPeer(targetURL string, to string, plan []CopyArgs) (bool, []string) {
+	listing, err := listPeer(targetURL, to)
+	if errors.Is(err, errNoListing) {
+		// only known now for a target predating /capabilities, the others are adapted before the copy
+		log.Printf("Not reconciling %s on %s: %s", to, targetURL, err)
+		return true, nil
+	}
+	if err != nil {
+		return false, []string{fmt.Sprintf("failed to list the destination %s: %s", to, err)}
+	}
+	discrepancies := reconcile(plan, listing)
+	return len(discrepancies) == 0, discrepancies
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReconcile(t *testing.T) {
+	plan := []CopyArgs{
+		{File: "a.parquet", Size: 10},
+		{File: "b.parquet", Size: 20},
+		{File: "c.parquet", Size: 30},
+	}
+	listing := []LsEntry{
+		{Name: "a.parquet", Size: 10},
+		{Name: "b.parquet", Size: 5},
+		{Name: "unrelated.txt", Size: 99},
+	}
+	discrepancies := reconcile(plan, listing)
+	expected := []string{
+		"b.parquet has 5 bytes in the destination, expected 20",
+		"c.parquet is missing from the destination",
+		"destination has 2 of 3 planned files",
+		"destination has 15 of 60 planned bytes",
+	}
+	if len(discrepancies) != len(expected) {
+		t.Fatalf("expected %d discrepancies, got %v", len(expected), discrepancies)
+	}
+	for i := range expected {
+		if discrepancies[i] != expected[i] {
+			t.Errorf("expected %q, got %q", expected[i], discrepancies[i])
+		}
+	}
+
+	if d := reconcile(plan[:1], listing); len(d) != 0 {
+		t.Errorf("expected matching destination to reconcile, got %v", d)
+	}
+}
+
+func TestListPeerTellsMissingDirFromMissingEndpoint(t *testing.T) {
+	useMemFS(t)
+	peer := httptest.NewServer(apiMux())
+	defer peer.Close()
+	if entries, err := listPeer(peer.URL+"/upload", "/missing"); err != nil || len(entries) != 0 {
+		t.Errorf("expected a missing dir to list empty, got %v %v", entries, err)
+	}
+	legacy := httptest.NewServer(http.NotFoundHandler())
+	defer legacy.Close()
+	if _, err := listPeer(legacy.URL+"/upload", "/missing"); !errors.Is(err, errNoListing) {
+		t.Errorf("expected a peer without /ls to be told apart, got %v", err)
+	}
+	if ok, d := reconcileWithPeer(legacy.URL+"/upload", "/dst", []CopyArgs{{File: "a", Size: 1}}); !ok || len(d) != 0 {
+		t.Errorf("expected a peer without /ls not to be reconciled, got %v", d)
+	}
+	opts := CopyOptions{Reconcile: true}
+	if adapted, _ := adaptToPeer(&opts, "http://old/upload", &Capabilities{Features: []string{FeatureResume}}); opts.Reconcile || len(adapted) != 1 {
+		t.Errorf("expected reconcile turned off for a peer not advertising ls, got %v", adapted)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// a namenode restart or a network blip breaks the client's connection for good, so every later call fails with
+// the same error. reconnectingFS dials a new client when a call fails on the connection itself and retries it up to
+// FASTCOPY_HDFS_RETRIES times, letting long jobs ride out namenode failovers. only idempotent calls are retried
+// blindly: a create, rename or remove may have reached the namenode before the connection broke, so its target is
+// checked first and the call is retried only if it didn't take effect. reads of an already open file aren't
+// retried here, the transfer retries cover those
+
+type reconnectingFS struct {
+	mu      sync.Mutex
+	client  FileSystem
+	dial    func() (FileSystem, error)
+	retries int           // how often a call failing on the connection is retried on a new one
+	backoff time.Duration // the wait before the first reconnect, doubled for each later one
+}
+
+func newReconnectingFS(dial func() (FileSystem, error), retries int, backoff time.Duration) (FileSystem, error) {
+	client, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	return &reconnectingFS{client: client, dial: dial, retries: retries, backoff: backoff}, nil
+}
+
+func (fs *reconnectingFS) current() FileSystem {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.client
+}
+
+// replaces the broken client, unless a concurrent call already did
+func (fs *reconnectingFS) reconnect(broken FileSystem) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.client != broken {
+		return nil
+	}
+	client, err := fs.dial()
+	if err != nil {
+		return err
+	}
+	broken.Close()
+	fs.client = client
+	return nil
+}
+
+// whether err means the connection to the namenode is gone rather than the call being refused
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// what a call that failed on the connection left behind on the namenode
+type callOutcome int
+
+const (
+	callNotDone callOutcome = iota // it didn't take effect and can be retried
+	callDone                       // it took effect, it succeeded
+	callUnknown                    // retrying it could do it twice, it fails
+)
+
+// runs call on the current client, reconnecting and retrying while it fails on the connection. a call that isn't
+// idempotent passes outcome, which is asked on the new client whether it took effect before it's retried
+func withReconnect[T any](fs *reconnectingFS, name string, call func(FileSystem) (T, error), outcome func(FileSystem) callOutcome) (T, error) {
+	backoff := fs.backoff
+	for attempt := 0; ; attempt++ {
+		client := fs.current()
+		v, err := call(client)
+		if err == nil || !isConnectionError(err) || attempt >= fs.retries {
+			return v, err
+		}
+		log.Printf("hdfs connection lost during %s, reconnecting (attempt %d/%d): %s", name, attempt+1, fs.retries, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if err := fs.reconnect(client); err != nil {
+			log.Printf("failed to reconnect to hdfs: %s", err)
+		}
+		if outcome == nil {
+			continue
+		}
+		switch outcome(fs.current()) {
+		case callDone:
+			log.Printf("the %s took effect before the hdfs connection was lost", name)
+			var zero T
+			return zero, nil
+		case callUnknown:
+			return v, err
+		}
+	}
+}
+
+// for calls returning only an error
+func withReconnectErr(fs *reconnectingFS, name string, call func(FileSystem) error, outcome func(FileSystem) callOutcome) error {
+	_, err := withReconnect(fs, name, func(c FileSystem) (struct{}, error) { return struct{}{}, call(c) }, outcome)
+	return err
+}
+
+// for calls that are never retried, the client is only replaced for the later ones
+func notRetried(FileSystem) callOutcome {
+	return callUnknown
+}
+
+// a create is retried only if its file doesn't exist yet
+func created(name string) func(FileSystem) callOutcome {
+	return func(c FileSystem) callOutcome {
+		if _, err := c.Stat(name); errors.Is(err, os.ErrNotExist) {
+			return callNotDone
+		}
+		return callUnknown
+	}
+}
+
+// a rename took effect if oldpath is gone and newpath exists, and is retried if oldpath is still there
+func renamed(oldpath, newpath string) func(FileSystem) callOutcome {
+	return func(c FileSystem) callOutcome {
+		_, err := c.Stat(oldpath)
+		if err == nil {
+			return callNotDone
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return callUnknown
+		}
+		if _, err := c.Stat(newpath); err == nil {
+			return callDone
+		}
+		return callUnknown
+	}
+}
+
+// a remove took effect if the file is gone, and is retried if it's still there
+func removed(name string) func(FileSystem) callOutcome {
+	return func(c FileSystem) callOutcome {
+		_, err := c.Stat(name)
+		switch {
+		case err == nil:
+			return callNotDone
+		case errors.Is(err, os.ErrNotExist):
+			return callDone
+		}
+		return callUnknown
+	}
+}
+
+func (fs *reconnectingFS) Open(name string) (HdfsReader, error) {
+	return withReconnect(fs, "open", func(c FileSystem) (HdfsReader, error) { return c.Open(name) }, nil)
+}
+
+func (fs *reconnectingFS) Create(name string) (io.WriteCloser, error) {
+	return withReconnect(fs, "create", func(c FileSystem) (io.WriteCloser, error) { return c.Create(name) }, created(name))
+}
+
+func (fs *reconnectingFS) Append(name string) (io.WriteCloser, error) {
+	return withReconnect(fs, "append", func(c FileSystem) (io.WriteCloser, error) { return c.Append(name) }, notRetried)
+}
+
+func (fs *reconnectingFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return withReconnect(fs, "readdir", func(c FileSystem) ([]os.FileInfo, error) { return c.ReadDir(dirname) }, nil)
+}
+
+func (fs *reconnectingFS) ReadFile(filename string) ([]byte, error) {
+	return withReconnect(fs, "read", func(c FileSystem) ([]byte, error) { return c.ReadFile(filename) }, nil)
+}
+
+func (fs *reconnectingFS) Stat(name string) (os.FileInfo, error) {
+	return withReconnect(fs, "stat", func(c FileSystem) (os.FileInfo, error) { return c.Stat(name) }, nil)
+}
+
+func (fs *reconnectingFS) MkdirAll(dirname string, perm os.FileMode) error {
+	return withReconnectErr(fs, "mkdir", func(c FileSystem) error { return c.MkdirAll(dirname, perm) }, nil)
+}
+
+func (fs *reconnectingFS) Chmod(name string, perm os.FileMode) error {
+	return withReconnectErr(fs, "chmod", func(c FileSystem) error { return c.Chmod(name, perm) }, nil)
+}
+
+func (fs *reconnectingFS) ListXAttrs(name string) (map[string]string, error) {
+	return withReconnect(fs, "list xattrs", func(c FileSystem) (map[string]string, error) { return c.ListXAttrs(name) }, nil)
+}
+
+func (fs *reconnectingFS) SetXAttr(name, key, value string) error {
+	return withReconnectErr(fs, "set xattr", func(c FileSystem) error { return c.SetXAttr(name, key, value) }, nil)
+}
+
+func (fs *reconnectingFS) Remove(name string) error {
+	return withReconnectErr(fs, "remove", func(c FileSystem) error { return c.Remove(name) }, removed(name))
+}
+
+func (fs *reconnectingFS) Rename(oldpath, newpath string) error {
+	return withReconnectErr(fs, "rename", func(c FileSystem) error { return c.Rename(oldpath, newpath) }, renamed(oldpath, newpath))
+}
+
+func (fs *reconnectingFS) CreateSnapshot(dir, name string) (string, error) {
+	return withReconnect(fs, "snapshot", func(c FileSystem) (string, error) { return c.CreateSnapshot(dir, name) }, notRetried)
+}
+
+func (fs *reconnectingFS) DeleteSnapshot(dir, name string) error {
+	return withReconnectErr(fs, "delete snapshot", func(c FileSystem) error { return c.DeleteSnapshot(dir, name) }, notRetried)
+}
+
+func (fs *reconnectingFS) Close() error {
+	return fs.current().Close()
+}
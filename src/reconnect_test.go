@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// a client whose calls fail on the connection once dropped
+type droppingClient struct {
+	*memFS
+	dropped bool
+	closed  bool
+	calls   int // the writes reaching the namenode
+}
+
+func (c *droppingClient) Stat(name string) (os.FileInfo, error) {
+	if c.dropped {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: syscall.ECONNRESET}
+	}
+	return c.memFS.Stat(name)
+}
+
+// renames, then loses the connection before answering
+func (c *droppingClient) Rename(oldpath, newpath string) error {
+	c.calls++
+	if err := c.memFS.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	return &os.PathError{Op: "rename", Path: oldpath, Err: syscall.ECONNRESET}
+}
+
+func (c *droppingClient) Create(name string) (io.WriteCloser, error) {
+	if c.dropped {
+		return nil, &os.PathError{Op: "create", Path: name, Err: syscall.ECONNRESET}
+	}
+	return c.memFS.Create(name)
+}
+
+func (c *droppingClient) Append(name string) (io.WriteCloser, error) {
+	if c.dropped {
+		return nil, &os.PathError{Op: "append", Path: name, Err: syscall.ECONNRESET}
+	}
+	return c.memFS.Append(name)
+}
+
+func (c *droppingClient) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestReconnectingFS(t *testing.T) {
+	backing := newMemFS()
+	backing.put(map[string]string{"/data/a": "abc"})
+	var dialed []*droppingClient
+	client, err := newReconnectingFS(func() (FileSystem, error) {
+		c := &droppingClient{memFS: backing}
+		dialed = append(dialed, c)
+		return c, nil
+	}, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dialed[0].dropped = true
+	if fi, err := client.Stat("/data/a"); err != nil || fi.Size() != 3 {
+		t.Fatalf("expected the stat to succeed on a new connection, got %v", err)
+	}
+	if len(dialed) != 2 || !dialed[0].closed {
+		t.Errorf("expected the dropped client to be closed and replaced, got %d dials", len(dialed))
+	}
+
+	if _, err := client.Stat("/data/missing"); !errors.Is(err, os.ErrNotExist) || len(dialed) != 2 {
+		t.Errorf("expected a missing file not to reconnect, got %v after %d dials", err, len(dialed))
+	}
+
+	// a rename that reached the namenode succeeds without being done twice
+	if err := client.Rename("/data/a", "/data/b"); err != nil || dialed[1].calls+dialed[2].calls != 1 {
+		t.Errorf("expected the rename to succeed once, got %v", err)
+	}
+	if _, ok := backing.get("/data/b"); !ok {
+		t.Error("expected the file to be renamed")
+	}
+	// a create that didn't is retried
+	dialed[len(dialed)-1].dropped = true
+	w, err := client.Create("/data/c")
+	if err != nil {
+		t.Fatalf("expected the create to be retried, got %v", err)
+	}
+	w.Close()
+	// an append may have, and isn't
+	dialed[len(dialed)-1].dropped = true
+	if _, err := client.Append("/data/b"); !errors.Is(err, syscall.ECONNRESET) || len(dialed) != 5 {
+		t.Errorf("expected the append to fail without a retry, got %v after %d dials", err, len(dialed))
+	}
+
+	// a namenode that stays down fails the call once the retries are used up
+	down := func() (FileSystem, error) { return &droppingClient{memFS: backing, dropped: true}, nil }
+	client, _ = newReconnectingFS(down, 3, 0)
+	if _, err := client.Stat("/data/a"); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("expected the connection error once the reconnects are exhausted, got %v", err)
+	}
+}
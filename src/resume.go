@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+)
+
+// uploads are written into a hidden partial file next to the destination and renamed over it once complete, so a
+// transfer cut off half way leaves its bytes behind. with resume=true the sender asks the target how much of the
+// file it already has, checks that prefix against the source by its sha-256 and only sends the rest, which the
+// target appends once it checked the prefix too. a prefix that doesn't match is discarded and the file sent whole
+
+// the header carrying the base64 sha-256 of the source's first resumeFrom bytes
+const prefixDigestHeader = "X-Fastcopy-Prefix-Sha256"
+
+// the partial file an upload resumes doesn't hold the prefix the sender resumed from
+var errResumeConflict = errors.New("the partial file doesn't match the source")
+
+// the hidden sibling of the file at path an upload is written into
+func partialPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".fastcopy-partial")
+}
+
+// a partial file left behind by an interrupted upload
+type PartialUpload struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// the source of a file that can be resumed: hashed in place and read from an offset
+type resumableSource interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+}
+
+// the reader opened for a file, if it can be resumed
+func asResumable(r io.Reader) (resumableSource, bool) {
+	if p, ok := r.(*progressReader); ok {
+		r = p.ReadCloser
+	}
+	s, ok := r.(resumableSource)
+	return s, ok
+}
+
+// GET /partial?to=&fileName= reports how much of the file an interrupted upload left, 404 if none
+func handlePartial(w http.ResponseWriter, r *http.Request) {
+	fileName := r.URL.Query().Get("fileName")
+	to := r.URL.Query().Get("to")
+	if to == "" || fileName == "" {
+		writeError(w, "'to' and 'fileName' query params must be provided.", http.StatusBadRequest)
+		return
+	}
+	path, err := uploadPath(to, fileName)
+	if err != nil {
+		writeConfineError(w, err)
+		return
+	}
+	path = partialPath(path)
+	info, err := GetHdfsClient().Stat(path)
+	if err != nil {
+		writeError(w, fmt.Sprintf("no partial upload of %s: %s", fileName, err), http.StatusNotFound)
+		return
+	}
+	json, _ := json.Marshal(PartialUpload{path, info.Size()})
+	w.Write(json)
+}
+
+// asks the target for the partial file of args and checks it against the source's prefix. returns the offset to
+// resume from, with the digests of the prefix to continue from, or 0 to send the whole file
+func resumePoint(src resumableSource, targetURL string, args CopyArgs) (int64, *fileDigests) {
+	resp, err := httpClient.Get(peerURL(targetURL, "/partial", url.Values{"to": {args.To}, "fileName": {args.File}}))
+	if err != nil {
+		log.Printf("Failed to ask the target for a partial upload of '%s': %s", args.File, err)
+		return 0, nil
+	}
+	defer resp.Body.Close()
+	var partial PartialUpload
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&partial) != nil {
+		return 0, nil
+	}
+	if partial.Size <= 0 || partial.Size >= args.Size {
+		return 0, nil
+	}
+	digests := newFileDigests()
+	if _, err := io.Copy(digests, io.NewSectionReader(src, 0, partial.Size)); err != nil {
+		log.Printf("Failed to read the first %d bytes of '%s' to resume: %s", partial.Size, args.Path, err)
+		return 0, nil
+	}
+	if _, err := src.Seek(partial.Size, io.SeekStart); err != nil {
+		log.Printf("Failed to seek '%s' to resume: %s", args.Path, err)
+		return 0, nil
+	}
+	log.Printf("Resuming '%s' at %d of %d bytes", args.File, partial.Size, args.Size)
+	return partial.Size, digests
+}
+
+// appends data to the partial file of to/fileName left by an interrupted upload, once its first 'offset' bytes
+// are checked against the sender's prefix digest, and renames it into place. fails with errResumeConflict, and
+// removes the partial file, if they don't match
+func ResumeHDFS(to string, fileName string, data io.ReadCloser, offset int64, prefixSHA256 string) (UploadResponse, error) {
+	client := GetHdfsClient()
+	path := filepath.Join(to, fileName)
+	partial := partialPath(path)
+	existing, err := client.Open(partial)
+	if err != nil {
+		return UploadResponse{}, fmt.Errorf("%w: %s", errResumeConflict, err)
+	}
+	digests := newFileDigests()
+	n, err := io.Copy(digests, existing)
+	existing.Close()
+	if err != nil {
+		return UploadResponse{}, fmt.Errorf("Error reading partial file %s %s", partial, err)
+	}
+	if n != offset || digests.SHA256() != prefixSHA256 {
+		client.Remove(partial)
+		return UploadResponse{}, fmt.Errorf("%w: %s has %d bytes, expected %d bytes with sha-256 %s", errResumeConflict, partial, n, offset, prefixSHA256)
+	}
+	file, err := client.Append(partial)
+	if err != nil {
+		return UploadResponse{}, fmt.Errorf("Error appending to file in hdfs %s", err)
+	}
+	return writePartial(client, file, partial, digests, offset, data, path)
+}
+
+// parses the resumeFrom param of an upload, 0 if it's a new one
+func parseResumeFrom(q url.Values) (int64, error) {
+	v := q.Get("resumeFrom")
+	if v == "" {
+		return 0, nil
+	}
+	offset, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || offset < 1 {
+		return 0, fmt.Errorf("'resumeFrom' must be a positive integer, got '%s'", v)
+	}
+	return offset, nil
+}
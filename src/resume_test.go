@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+)
+
+func TestWriteHDFSLeavesPartial(t *testing.T) {
+	fs := useMemFS(t)
+	body := io.MultiReader(strings.NewReader("first half"), iotest.ErrReader(errors.New("connection reset")))
+	if _, err := WriteHDFS("/dst", "a.txt", io.NopCloser(body)); err == nil {
+		t.Fatal("expected the interrupted upload to fail")
+	}
+	if partial, ok := fs.get("/dst/.a.txt.fastcopy-partial"); !ok || partial != "first half" {
+		t.Errorf("expected the partial file to keep the bytes received, got %q", partial)
+	}
+	if _, ok := fs.get("/dst/a.txt"); ok {
+		t.Error("expected nothing at the destination until the upload completes")
+	}
+}
+
+func TestCopyResumesPartialUpload(t *testing.T) {
+	fs := useMemFS(t)
+	content := strings.Repeat("0123456789", 100)
+	fs.put(map[string]string{"/src/part-00000": content})
+	var mu sync.Mutex
+	var resumedFrom []string
+	peer := http.NewServeMux()
+	peer.HandleFunc("/ready", handleReady)
+	peer.HandleFunc("/ls", handleLs)
+	peer.HandleFunc("/partial", handlePartial)
+	peer.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		resumedFrom = append(resumedFrom, r.URL.Query().Get("resumeFrom"))
+		mu.Unlock()
+		handleUpload(w, r)
+	})
+	server := httptest.NewServer(peer)
+	defer server.Close()
+	copy := func() int {
+		rec := httptest.NewRecorder()
+		query := url.Values{"from": {"/src"}, "to": {"/dst"}, "targetURL": {server.URL + "/upload"}, "resume": {"true"}}
+		handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+		return rec.Code
+	}
+
+	fs.MkdirAll("/dst", 0755)
+	fs.put(map[string]string{"/dst/.part-00000.fastcopy-partial": content[:400]})
+	if status := copy(); status != http.StatusOK || len(resumedFrom) != 1 || resumedFrom[0] != "400" {
+		t.Fatalf("expected the upload to resume at 400 bytes, got %d and %v", status, resumedFrom)
+	}
+	if written, _ := fs.get("/dst/part-00000"); written != content {
+		t.Errorf("expected the resumed file to match the source, got %d bytes", len(written))
+	}
+	if _, ok := fs.get("/dst/.part-00000.fastcopy-partial"); ok {
+		t.Error("expected the partial file to be moved into place")
+	}
+
+	// a partial file that differs from the source is rejected by the target and the file sent whole
+	resumedFrom = nil
+	fs.put(map[string]string{"/dst/.part-00000.fastcopy-partial": strings.Repeat("x", 400)})
+	if status := copy(); status != http.StatusOK || len(resumedFrom) != 2 || resumedFrom[0] != "400" || resumedFrom[1] != "" {
+		t.Errorf("expected the mismatching partial file to be sent whole, got %d and %v", status, resumedFrom)
+	}
+	if written, _ := fs.get("/dst/part-00000"); written != content {
+		t.Errorf("expected the file to match the source, got %d bytes", len(written))
+	}
+}
+
+func TestResumeHDFSRejectsMismatchingPrefix(t *testing.T) {
+	fs := useMemFS(t)
+	fs.MkdirAll("/dst", 0755)
+	fs.put(map[string]string{"/dst/.a.txt.fastcopy-partial": "abc"})
+	digests := newFileDigests()
+	digests.Write([]byte("abd"))
+	_, err := ResumeHDFS("/dst", "a.txt", io.NopCloser(strings.NewReader("def")), 3, digests.SHA256())
+	if !errors.Is(err, errResumeConflict) {
+		t.Errorf("expected a resume conflict, got %v", err)
+	}
+	if _, ok := fs.get("/dst/.a.txt.fastcopy-partial"); ok {
+		t.Error("expected the mismatching partial file to be removed")
+	}
+}
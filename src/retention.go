@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// a copy with ttl=<duration> registers its destination dir with each target, whose reaper deletes it, or moves it
+// into FASTCOPY_TRASH_DIR, once the ttl has run out, e.g. to clean up staging areas. the registered dirs are kept
+// in FASTCOPY_EXPIRATIONS across restarts, and listed by GET /expirations
+
+// a delivered dir and when it expires
+type Expiration struct {
+	Path         string    `json:"path"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+	RegisteredAt time.Time `json:"registeredAt"`
+	JobID        string    `json:"jobId,omitempty"`
+}
+
+// how often the reaper looks for expired dirs unless FASTCOPY_REAP_INTERVAL says otherwise
+const DefaultReapInterval = time.Minute
+
+type retentionSettings struct {
+	trashDir string // expired dirs are moved below it, deleted when it isn't set
+	interval time.Duration
+}
+
+var (
+	retention     retentionSettings
+	retentionOnce sync.Once
+)
+
+// reads FASTCOPY_TRASH_DIR and FASTCOPY_REAP_INTERVAL
+func loadRetentionSettings() (retentionSettings, error) {
+	s := retentionSettings{trashDir: os.Getenv("FASTCOPY_TRASH_DIR"), interval: DefaultReapInterval}
+	if s.trashDir != "" {
+		if !path.IsAbs(s.trashDir) || hasDotDot(s.trashDir) {
+			return s, fmt.Errorf("invalid FASTCOPY_TRASH_DIR '%s', expected an absolute hdfs path", s.trashDir)
+		}
+		s.trashDir = path.Clean(s.trashDir)
+	}
+	if v := os.Getenv("FASTCOPY_REAP_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return s, fmt.Errorf("invalid FASTCOPY_REAP_INTERVAL '%s', expected a duration like 1m", v)
+		}
+		s.interval = d
+	}
+	return s, nil
+}
+
+// lazy loads the retention settings
+func getRetentionSettings() retentionSettings {
+	retentionOnce.Do(func() {
+		s, err := loadRetentionSettings()
+		if err != nil {
+			log.Fatal(err)
+		}
+		retention = s
+	})
+	return retention
+}
+
+type expirationStore struct {
+	mu          sync.Mutex
+	path        string // empty when the expirations only live in memory
+	expirations map[string]Expiration
+}
+
+var (
+	expirations     *expirationStore
+	expirationsOnce sync.Once
+)
+
+// reads the expirations kept in FASTCOPY_EXPIRATIONS, if it's set
+func loadExpirations() (*expirationStore, error) {
+	s := &expirationStore{path: os.Getenv("FASTCOPY_EXPIRATIONS"), expirations: make(map[string]Expiration)}
+	if s.path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+			return nil, fmt.Errorf("cannot create the dir of FASTCOPY_EXPIRATIONS: %w", err)
+		}
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read FASTCOPY_EXPIRATIONS: %w", err)
+	}
+	var list []Expiration
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("invalid FASTCOPY_EXPIRATIONS %s: %w", s.path, err)
+	}
+	for _, e := range list {
+		s.expirations[e.Path] = e
+	}
+	return s, nil
+}
+
+// lazy loads the expirations
+func getExpirations() *expirationStore {
+	expirationsOnce.Do(func() {
+		s, err := loadExpirations()
+		if err != nil {
+			log.Fatal(err)
+		}
+		expirations = s
+	})
+	return expirations
+}
+
+func (s *expirationStore) get(p string) (Expiration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.expirations[p]
+	return e, ok
+}
+
+// the expirations due before 'before', soonest first. a zero 'before' lists all of them
+func (s *expirationStore) list(before time.Time) []Expiration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Expiration, 0, len(s.expirations))
+	for _, e := range s.expirations {
+		if before.IsZero() || e.ExpiresAt.Before(before) {
+			list = append(list, e)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].ExpiresAt.Equal(list[j].ExpiresAt) {
+			return list[i].ExpiresAt.Before(list[j].ExpiresAt)
+		}
+		return list[i].Path < list[j].Path
+	})
+	return list
+}
+
+// adds or replaces the expiration of dir p, nil cancels it. the file is rewritten before the change is visible
+func (s *expirationStore) set(p string, e *Expiration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, existed := s.expirations[p]
+	if e == nil {
+		delete(s.expirations, p)
+	} else {
+		s.expirations[p] = *e
+	}
+	if err := s.save(); err != nil {
+		if existed {
+			s.expirations[p] = prev
+		} else {
+			delete(s.expirations, p)
+		}
+		return err
+	}
+	return nil
+}
+
+// writes the expirations to the file, if there is one
+func (s *expirationStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	list := make([]Expiration, 0, len(s.expirations))
+	for _, p := range sortedKeys(s.expirations) {
+		list = append(list, s.expirations[p])
+	}
+	data, _ := json.MarshalIndent(list, "", "  ")
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("cannot save FASTCOPY_EXPIRATIONS: %w", err)
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// deletes, or trashes, every dir whose ttl ran out by now. one that can't be is tried again on the next round
+func reapExpired(client FileSystem, now time.Time) {
+	store := getExpirations()
+	trashDir := getRetentionSettings().trashDir
+	for _, e := range store.list(now) {
+		trashedAs, err := expire(client, e.Path, trashDir, now)
+		if err != nil {
+			log.Printf("Failed to expire %s, trying again on the next round: %s", e.Path, err)
+			continue
+		}
+		if err := store.set(e.Path, nil); err != nil {
+			log.Printf("Expired %s but cannot forget it: %s", e.Path, err)
+		}
+		if trashedAs != "" {
+			log.Printf("Expired %s, moved to %s", e.Path, trashedAs)
+		} else {
+			log.Printf("Expired %s, deleted", e.Path)
+		}
+	}
+}
+
+// moves dir p to <trash dir>/<time>/<p>, or deletes it without a trash dir. returns where it was moved to.
+// a dir already gone is expired too
+func expire(client FileSystem, p string, trashDir string, now time.Time) (string, error) {
+	if _, err := client.Stat(p); errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if trashDir == "" {
+		return "", removeTree(client, p)
+	}
+	dest := filepath.Join(trashDir, now.UTC().Format("20060102T150405Z"), p)
+	if err := client.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+	return dest, client.Rename(p, dest)
+}
+
+// removes p and, if it's a dir, everything below it
+func removeTree(client FileSystem, p string) error {
+	info, err := client.Stat(p)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		entries, err := client.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := removeTree(client, filepath.Join(p, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return client.Remove(p)
+}
+
+// reaps the expired dirs every interval until stop is closed
+func runReaper(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		reapExpired(GetHdfsClient(), time.Now())
+	}
+}
+
+// GET /expirations lists the registered dirs soonest first, with within=<duration> only those expiring by then.
+// POST /expirations?path=&ttl= registers dir 'path' to expire after ttl, replacing an earlier registration, and
+// DELETE /expirations?path= cancels it. a dir in, or holding, a write-once dir can't expire
+func handleExpirations(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	store := getExpirations()
+	switch r.Method {
+	case http.MethodGet:
+		var before time.Time
+		if v := q.Get("within"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				writeError(w, fmt.Sprintf("'within' must be a duration like 24h, got '%s'", v), http.StatusBadRequest)
+				return
+			}
+			before = time.Now().Add(d)
+		}
+		json, _ := json.MarshalIndent(store.list(before), "", "  ")
+		w.Write(json)
+	case http.MethodPost:
+		p := q.Get("path")
+		if err := confinePath("path", p); err != nil {
+			writeConfineError(w, err)
+			return
+		}
+		p = path.Clean(p)
+		ttl, err := time.ParseDuration(q.Get("ttl"))
+		if err != nil || ttl <= 0 {
+			writeError(w, fmt.Sprintf("'ttl' must be a positive duration like 72h, got '%s'", q.Get("ttl")), http.StatusBadRequest)
+			return
+		}
+		for _, dir := range getWriteOnce() {
+			if p == dir || within(p, dir) || within(dir, p) {
+				writeError(w, fmt.Sprintf("%s can't expire, %s %s", p, dir, errWriteOnce), http.StatusConflict)
+				return
+			}
+		}
+		now := time.Now().UTC()
+		e := Expiration{Path: p, ExpiresAt: now.Add(ttl), RegisteredAt: now, JobID: q.Get("jobId")}
+		if err := store.set(p, &e); err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("%s expires at %s", p, e.ExpiresAt.Format(time.RFC3339))
+		json, _ := json.Marshal(e)
+		w.Write(json)
+	case http.MethodDelete:
+		p := path.Clean(q.Get("path"))
+		if _, ok := store.get(p); !ok || q.Get("path") == "" {
+			writeError(w, fmt.Sprintf("%s has no expiration", q.Get("path")), http.StatusNotFound)
+			return
+		}
+		if err := store.set(p, nil); err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, "use GET, POST or DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+// registers dir 'to' on the peer to expire after ttl
+func registerExpiration(targetURL string, to string, ttl time.Duration, jobID string) error {
+	params := url.Values{"path": {to}, "ttl": {ttl.String()}, "jobId": {jobID}}
+	resp, err := httpClient.Post(peerURL(targetURL, "/expirations", params), "application/octet-stream", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("/expirations returned non-OK status %d: %s", resp.StatusCode, peerErrorMessage(msg))
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func useRetention(t *testing.T, trashDir string) *expirationStore {
+	retentionOnce.Do(func() {})
+	expirationsOnce.Do(func() {})
+	prev, prevStore := retention, expirations
+	retention = retentionSettings{trashDir: trashDir, interval: DefaultReapInterval}
+	t.Setenv("FASTCOPY_EXPIRATIONS", filepath.Join(t.TempDir(), "expirations.json"))
+	s, err := loadExpirations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expirations = s
+	t.Cleanup(func() { retention, expirations = prev, prevStore })
+	return s
+}
+
+func TestCopyWithTTLExpires(t *testing.T) {
+	fs := useMemFS(t)
+	store := useRetention(t, "")
+	fs.put(map[string]string{"/src/a.txt": "hello", "/src/sub/b.txt": "world"})
+	peer := httptest.NewServer(apiMux())
+	defer peer.Close()
+
+	query := url.Values{"from": {"/src"}, "to": {"/staging/run-1"}, "targetURL": {peer.URL + "/upload"}, "recursive": {"true"}, "ttl": {"2h"}}
+	rec := httptest.NewRecorder()
+	handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("copy failed: %d %s", rec.Code, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	handleExpirations(rec, httptest.NewRequest("GET", "/expirations?within=3h", nil))
+	var upcoming []Expiration
+	json.Unmarshal(rec.Body.Bytes(), &upcoming)
+	if len(upcoming) != 1 || upcoming[0].Path != "/staging/run-1" || upcoming[0].JobID == "" {
+		t.Fatalf("expected the destination to expire within 3h, got %s", rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	handleExpirations(rec, httptest.NewRequest("GET", "/expirations?within=1h", nil))
+	if rec.Body.String() != "[]" {
+		t.Errorf("expected nothing to expire within 1h, got %s", rec.Body)
+	}
+	reloaded, _ := loadExpirations()
+	if _, ok := reloaded.get("/staging/run-1"); !ok {
+		t.Error("expected the expiration kept across restarts")
+	}
+
+	reapExpired(fs, time.Now().Add(time.Hour))
+	if _, ok := fs.get("/staging/run-1/a.txt"); !ok {
+		t.Fatal("expected nothing reaped before the ttl ran out")
+	}
+	reapExpired(fs, time.Now().Add(3*time.Hour))
+	for _, p := range []string{"/staging/run-1/a.txt", "/staging/run-1/sub/b.txt"} {
+		if _, ok := fs.get(p); ok {
+			t.Errorf("expected %s deleted once expired", p)
+		}
+	}
+	if len(store.list(time.Time{})) != 0 {
+		t.Error("expected the expired dir forgotten")
+	}
+}
+
+func TestExpireIntoTrash(t *testing.T) {
+	fs := useMemFS(t)
+	useRetention(t, "/trash")
+	useWriteOnce(t, "/archive")
+	fs.put(map[string]string{"/staging/run-2/a.txt": "hello"})
+
+	register := func(query string) int {
+		rec := httptest.NewRecorder()
+		handleExpirations(rec, httptest.NewRequest("POST", "/expirations?"+query, nil))
+		return rec.Code
+	}
+	for query, status := range map[string]int{
+		"path=/staging/run-2&ttl=1h": http.StatusOK,
+		"path=/staging/run-3&ttl=0s": http.StatusBadRequest,
+		"path=staging&ttl=1h":        http.StatusBadRequest,
+		"path=/archive/2024&ttl=1h":  http.StatusConflict,
+		"path=/&ttl=1h":              http.StatusConflict,
+	} {
+		if code := register(query); code != status {
+			t.Errorf("%s: expected %d, got %d", query, status, code)
+		}
+	}
+
+	now := time.Now().Add(2 * time.Hour)
+	reapExpired(fs, now)
+	trashed := filepath.Join("/trash", now.UTC().Format("20060102T150405Z"), "/staging/run-2/a.txt")
+	if data, ok := fs.get(trashed); !ok || data != "hello" {
+		t.Errorf("expected the expired dir moved to %s", trashed)
+	}
+
+	rec := httptest.NewRecorder()
+	handleExpirations(rec, httptest.NewRequest("DELETE", "/expirations?path=/staging/run-2", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected an expired dir to have no expiration left, got %d", rec.Code)
+	}
+}
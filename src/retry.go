@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/briansterle/cluster-fastcopy/pkg/fastcopy"
+)
+
+// a peer restarting mid-job answers 502, 503 or 504 for a while, or its breaker opens, and a file another job is
+// writing at the target is refused until it's done. the files failing that way are queued and sent again once the
+// main pass is done, after 'retryDelay', doubling for each of the 'retries' rounds. every other failure, other 4xx
+// answers above all, is final
+
+const (
+	DefaultRetries    = 2
+	DefaultRetryDelay = 10 * time.Second
+)
+
+// whether the file failing with err may succeed if sent again later. a fanned out file is retried when every
+// target it failed on may recover
+func retriable(err error) bool {
+	if errors.Is(err, errPathLocked) || errors.Is(err, errReusedConnClosed) {
+		return true
+	}
+	var tee *fastcopy.TeeError
+	if errors.As(err, &tee) {
+		for _, err := range tee.Errs {
+			if err != nil && !retriable(err) {
+				return false
+			}
+		}
+		return true
+	}
+	var statusErr *fastcopy.StatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	return errors.Is(err, errTargetUnavailable)
+}
+
+// parses 'retries' and 'retryDelay'
+func parseRetries(q url.Values) (int, time.Duration, error) {
+	retries, delay := DefaultRetries, DefaultRetryDelay
+	if v := q.Get("retries"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("'retries' must be a non-negative integer, got '%s'", v)
+		}
+		retries = n
+	}
+	if v := q.Get("retryDelay"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return 0, 0, fmt.Errorf("'retryDelay' must be a duration like 30s, got '%s'", v)
+		}
+		delay = d
+	}
+	return retries, delay, nil
+}
+
+// runs the engine over the files, then over the ones failing retriably for up to retries more rounds
+func runWithRetries(engine *fastcopy.Engine, job *fastcopy.Job, retries int, delay time.Duration, progress *Job) fastcopy.Result {
+	result := engine.Run(job)
+	for round := 1; round <= retries; round++ {
+		var retry []fastcopy.File
+		failed := result.Failed[:0]
+		for _, f := range result.Failed {
+			if retriable(f.Err) {
+				retry = append(retry, f.File)
+			} else {
+				failed = append(failed, f)
+			}
+		}
+		if len(retry) == 0 {
+			break
+		}
+		progress.logf("Retrying %d files in %s, the target answered them with a transient error (round %d of %d)", len(retry), delay, round, retries)
+		time.Sleep(delay)
+		progress.retrying(len(retry))
+		again := engine.Run(&fastcopy.Job{From: job.From, To: job.To, Files: retry})
+		result = fastcopy.Result{Copied: append(result.Copied, again.Copied...), Failed: append(failed, again.Failed...)}
+		delay *= 2
+	}
+	return result
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func TestRetryTransientFailures(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{"/data/a": "aaaa", "/data/b": "bbbb", "/data/c": "cccc"})
+	// the peer restarts: it answers 503 for the first three uploads and refuses c for good
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	var uploads int
+	api := apiMux()
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/upload" {
+			mu.Lock()
+			uploads++
+			n := uploads
+			attempts[r.URL.Query().Get("fileName")]++
+			mu.Unlock()
+			if r.URL.Query().Get("fileName") == "c" {
+				writeError(w, "not allowed", http.StatusForbidden)
+				return
+			}
+			if n <= 3 {
+				writeError(w, "restarting", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		api.ServeHTTP(w, r)
+	}))
+	defer peer.Close()
+
+	query := url.Values{"from": {"/data"}, "to": {"/backup"}, "targetURL": {peer.URL + "/upload"}, "precheck": {"none"}, "reconcile": {"false"}, "retryDelay": {"1ms"}, "workers": {"1"}}
+	rec := httptest.NewRecorder()
+	handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+	var resp CopyResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp.FilesCopied != 2 || len(resp.CopyFailures) != 1 || resp.CopyFailures[0].Path != "/data/c" {
+		t.Fatalf("expected a and b to be copied on retry and c to fail, got %+v", resp)
+	}
+	if attempts["c"] != 1 {
+		t.Errorf("expected the refused file to be sent once, got %d", attempts["c"])
+	}
+	if data, _ := fs.get("/backup/a"); data != "aaaa" {
+		t.Errorf("expected a to be copied, got %q", data)
+	}
+	if status := getJob(resp.JobID).status(); status.FilesDone != 3 || status.FilesFailed != 1 {
+		t.Errorf("expected the job to count each file once, got %d done and %d failed", status.FilesDone, status.FilesFailed)
+	}
+
+	q, _ := url.ParseQuery("retries=-1")
+	if _, _, err := parseRetries(q); err == nil {
+		t.Error("expected negative retries to be rejected")
+	}
+}
@@ -0,0 +1,20 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+// SO_REUSEPORT, missing from the frozen syscall package on linux
+const soReusePort = 0xf
+
+// sets SO_REUSEPORT on a socket before it's bound
+func reusePort(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// the api version served under <base path>/v1/
+const APIVersion = "v1"
+
+// the api's routes, relative to <base path>/<version>. the control-plane ones gzip their responses, see compress.go,
+// and query params are validated before reaching the handlers, see params.go. /copy validates its own, after
+// applying its template
+func apiMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("{\"status\":\"200 OK\"}")) })
+	mux.HandleFunc("/ready", handleReady)
+	mux.HandleFunc("/capabilities", handleCapabilities)
+	mux.HandleFunc("/ls", gzipResponses(validated(handleLs, "path")))
+	mux.HandleFunc("/copy", gzipResponses(handleCopy))
+	mux.HandleFunc("/plan", gzipResponses(handlePlan))
+	mux.HandleFunc("/verify", gzipResponses(handleVerify))
+	mux.HandleFunc("/download", validated(handleDownload, "path"))
+	mux.HandleFunc("/upload", validated(handleUpload, "to", "fileName"))
+	mux.HandleFunc("/partial", validated(handlePartial, "to", "fileName"))
+	mux.HandleFunc("/uploads", gzipResponses(handleUploads))
+	mux.HandleFunc("/uploads/", gzipResponses(handleUploads))
+	mux.HandleFunc("/bench", validated(handleBench, "to", "targetURL"))
+	mux.HandleFunc("/selftest", validated(handleSelfTest, "targetURL"))
+	mux.HandleFunc("/config", gzipResponses(handleConfig))
+	mux.HandleFunc("/jobs", gzipResponses(handleJobs))
+	mux.HandleFunc("/jobs/", gzipResponses(handleJobs))
+	mux.HandleFunc("/templates", gzipResponses(handleTemplates))
+	mux.HandleFunc("/templates/", gzipResponses(handleTemplates))
+	mux.HandleFunc("/datasets", gzipResponses(handleDatasets))
+	mux.HandleFunc("/datasets/", gzipResponses(handleDatasets))
+	mux.HandleFunc("/signature", validated(handleSignature, "path", "blockSize"))
+	mux.HandleFunc("/patch", validated(handlePatch, "to", "fileName", "blockSize"))
+	mux.HandleFunc("/swap", validated(handleSwap, "from", "to"))
+	mux.HandleFunc("/mkdir", validated(handleMkdir, "path", "mode"))
+	mux.HandleFunc("/checksum", validated(handleChecksum, "path"))
+	mux.HandleFunc("/quarantine", validated(handleQuarantine))
+	mux.HandleFunc("/expirations", gzipResponses(handleExpirations))
+	mux.HandleFunc("/receipts", gzipResponses(handleReceipts))
+	mux.HandleFunc("/receipts/", gzipResponses(handleReceipts))
+	mux.HandleFunc("/metrics", gzipResponses(handleMetrics))
+	mux.HandleFunc("/admin/reload-credentials", handleReloadCredentials)
+	mux.HandleFunc("/admin/locks", handleLocks)
+	mux.HandleFunc("/admin/locks/", handleLocks)
+	mux.HandleFunc("/admin/pause", handlePause)
+	mux.HandleFunc("/admin/resume", handlePause)
+	return mux
+}
+
+// serves the api under basePath (e.g. /fastcopy, FASTCOPY_BASE_PATH) at /v1/ and, for callers predating
+// versioning, at the unversioned paths, which answer the same but point to their /v1 successor
+func newRouter(basePath string) http.Handler {
+	basePath = strings.TrimSuffix("/"+strings.Trim(basePath, "/"), "/")
+	versioned := basePath + "/" + APIVersion
+	api := apiMux()
+
+	router := http.NewServeMux()
+	router.Handle(versioned+"/", http.StripPrefix(versioned, api))
+	router.Handle(basePath+"/", http.StripPrefix(basePath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+versioned+r.URL.Path+">; rel=\"successor-version\"")
+		api.ServeHTTP(w, r)
+	})))
+	return router
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	cases := []struct {
+		basePath   string
+		path       string
+		status     int
+		deprecated bool
+	}{
+		{"", "/v1/health", http.StatusOK, false},
+		{"", "/health", http.StatusOK, true},
+		{"", "/v1/jobs/missing", http.StatusNotFound, false},
+		{"", "/v1/nope", http.StatusNotFound, false},
+		{"/fastcopy", "/fastcopy/v1/health", http.StatusOK, false},
+		{"fastcopy/", "/fastcopy/v1/health", http.StatusOK, false},
+		{"/fastcopy", "/fastcopy/health", http.StatusOK, true},
+		{"/fastcopy", "/health", http.StatusNotFound, false},
+		{"/fastcopy", "/v1/health", http.StatusNotFound, false},
+		{"/", "/v1/health", http.StatusOK, false},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		newRouter(c.basePath).ServeHTTP(rec, httptest.NewRequest("GET", c.path, nil))
+		if rec.Code != c.status {
+			t.Errorf("%s under '%s': expected %d, got %d", c.path, c.basePath, c.status, rec.Code)
+		}
+		if deprecated := rec.Header().Get("Deprecation") == "true"; deprecated != c.deprecated {
+			t.Errorf("%s under '%s': expected deprecated %v", c.path, c.basePath, c.deprecated)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	newRouter("/fastcopy").ServeHTTP(rec, httptest.NewRequest("GET", "/fastcopy/health", nil))
+	if link := rec.Header().Get("Link"); link != "</fastcopy/v1/health>; rel=\"successor-version\"" {
+		t.Errorf("expected a link to the versioned path, got %s", link)
+	}
+}
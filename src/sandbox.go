@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+)
+
+// the writes a peer asks for, uploads, patches, partial uploads, dirs, swaps, quarantines and expirations, are
+// checked before they reach hdfs: 'to' must be an absolute path and 'fileName' a name below it, without .. either
+// way, so a caller can't write outside the dir it names. with FASTCOPY_UPLOAD_ROOT set they're further confined
+// below that dir, keeping a receiver shared with other tenants from being asked to write into e.g.
+// /user/hive/warehouse
+
+var (
+	uploadRoot     string
+	uploadRootOnce sync.Once
+)
+
+// a write asked for outside FASTCOPY_UPLOAD_ROOT
+var errOutsideRoot = errors.New("outside the upload root")
+
+// reads FASTCOPY_UPLOAD_ROOT, empty when writes may go anywhere
+func loadUploadRoot() (string, error) {
+	dir := os.Getenv("FASTCOPY_UPLOAD_ROOT")
+	if dir == "" {
+		return "", nil
+	}
+	if !path.IsAbs(dir) || hasDotDot(dir) {
+		return "", fmt.Errorf("invalid FASTCOPY_UPLOAD_ROOT '%s', expected an absolute hdfs path", dir)
+	}
+	return path.Clean(dir), nil
+}
+
+// lazy loads the dir writes are confined to
+func getUploadRoot() string {
+	uploadRootOnce.Do(func() {
+		dir, err := loadUploadRoot()
+		if err != nil {
+			log.Fatal(err)
+		}
+		uploadRoot = dir
+	})
+	return uploadRoot
+}
+
+// checks that p, an absolute path, may be written to
+func confinePath(field string, p string) error {
+	if desc := checkHdfsPath(p); desc != "" {
+		return &ValidationError{[]FieldViolation{{Field: field, Description: desc}}}
+	}
+	root := getUploadRoot()
+	if root != "" && path.Clean(p) != root && !within(path.Clean(p), root) {
+		return fmt.Errorf("'%s' %s is %w %s", field, p, errOutsideRoot, root)
+	}
+	return nil
+}
+
+// the path fileName is written to in 'to', if it may be
+func uploadPath(to string, fileName string) (string, error) {
+	if err := confinePath("to", to); err != nil {
+		return "", err
+	}
+	if desc := checkRelativePath(fileName); fileName == "" || desc != "" {
+		if fileName == "" {
+			desc = "must be provided"
+		}
+		return "", &ValidationError{[]FieldViolation{{Field: "fileName", Description: desc}}}
+	}
+	return path.Join(to, fileName), nil
+}
+
+// answers a write refused by confinePath or uploadPath, 403 outside the root and 400 otherwise
+func writeConfineError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errOutsideRoot) {
+		writeError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	writeError(w, err.Error(), http.StatusBadRequest, errorDetails(err)...)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func useUploadRoot(t *testing.T, dir string) {
+	uploadRootOnce.Do(func() {})
+	prev := uploadRoot
+	uploadRoot = dir
+	t.Cleanup(func() { uploadRoot = prev })
+}
+
+func TestUploadSandbox(t *testing.T) {
+	fs := useMemFS(t)
+	useUploadRoot(t, "/data/incoming")
+	upload := func(query string) int {
+		rec := httptest.NewRecorder()
+		handleUpload(rec, httptest.NewRequest("POST", "/upload?"+query, strings.NewReader("hello")))
+		return rec.Code
+	}
+	for query, status := range map[string]int{
+		"to=/data/incoming/events&fileName=part-00000":          http.StatusOK,
+		"to=/user/hive/warehouse&fileName=part-00000":           http.StatusForbidden,
+		"to=/data/incoming-other&fileName=part-00000":           http.StatusForbidden,
+		"to=/data/incoming/events&fileName=../../../etc/x":      http.StatusBadRequest,
+		"to=/data/incoming/../../user/hive&fileName=part-00000": http.StatusBadRequest,
+		"to=/data/incoming/events&fileName=/user/hive/x":        http.StatusBadRequest,
+		"to=data/incoming&fileName=part-00000":                  http.StatusBadRequest,
+	} {
+		if code := upload(query); code != status {
+			t.Errorf("%s: expected %d, got %d", query, status, code)
+		}
+	}
+	if _, ok := fs.get("/data/incoming/events/part-00000"); !ok {
+		t.Error("expected the upload below the root to be written")
+	}
+	if _, ok := fs.get("/user/hive/warehouse/part-00000"); ok {
+		t.Error("expected nothing to be written outside the root")
+	}
+
+	rec := httptest.NewRecorder()
+	handleMkdir(rec, httptest.NewRequest("POST", "/mkdir?path=/tmp/elsewhere&mode=755", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected a dir outside the root to be refused, got %d", rec.Code)
+	}
+
+	t.Setenv("FASTCOPY_UPLOAD_ROOT", "incoming")
+	if _, err := loadUploadRoot(); err == nil {
+		t.Error("expected a relative upload root to be rejected")
+	}
+}
+
+func TestSendEscapesNames(t *testing.T) {
+	fs := useMemFS(t)
+	peer := httptest.NewServer(apiMux())
+	defer peer.Close()
+	for _, name := range []string{"a+b", "c&to=x", "d#e", "f%20g", "h i"} {
+		args := CopyArgs{File: name, To: "/dst/x y+z", Size: 5}
+		if _, err := sendToUpload(strings.NewReader("hello"), peer.URL+"/upload", args, CopyOptions{Validate: []string{"parquet"}}); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if data, ok := fs.get("/dst/x y+z/" + name); !ok || data != "hello" {
+			t.Errorf("expected %q to be written under its own name", name)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+)
+
+// file dispatch orders for /copy's 'scheduling' param
+const (
+	ScheduleDirectory     = "directory"      // the order the namenode lists the directory in
+	ScheduleLargestFirst  = "largest-first"  // start big files early so one doesn't run alone at the end
+	ScheduleSmallestFirst = "smallest-first" // get many small files (and metadata) across quickly
+	ScheduleShuffle       = "shuffle"        // random order, spreads load over datanodes
+)
+
+var schedulingStrategies = []string{ScheduleDirectory, ScheduleLargestFirst, ScheduleSmallestFirst, ScheduleShuffle}
+
+func validScheduling(strategy string) bool {
+	if strategy == "" {
+		return true
+	}
+	for _, s := range schedulingStrategies {
+		if s == strategy {
+			return true
+		}
+	}
+	return false
+}
+
+// orders the tasks in place according to the scheduling strategy
+func scheduleTasks(tasks []CopyArgs, strategy string) {
+	switch strategy {
+	case ScheduleLargestFirst:
+		sort.SliceStable(tasks, func(i, j int) bool { return tasks[i].Size > tasks[j].Size })
+	case ScheduleSmallestFirst:
+		sort.SliceStable(tasks, func(i, j int) bool { return tasks[i].Size < tasks[j].Size })
+	case ScheduleShuffle:
+		rand.Shuffle(len(tasks), func(i, j int) { tasks[i], tasks[j] = tasks[j], tasks[i] })
+	}
+}
+
+// picks a random subset of the tasks for a sample=N or samplePercent=P canary copy, keeping their listing order.
+// n <= 0 and percent <= 0 mean no sampling
+func sampleTasks(tasks []CopyArgs, n int, percent float64) []CopyArgs {
+	if percent > 0 {
+		n = int(math.Ceil(float64(len(tasks)) * percent / 100))
+	}
+	if n <= 0 || n >= len(tasks) {
+		return tasks
+	}
+	picked := rand.Perm(len(tasks))[:n]
+	sort.Ints(picked)
+	sample := make([]CopyArgs, 0, n)
+	for _, i := range picked {
+		sample = append(sample, tasks[i])
+	}
+	return sample
+}
+
+// where a maxBytes copy stopped. a copy of the same 'from' with resumeAfter=ResumeAfter continues there
+type CutOff struct {
+	ResumeAfter   string `json:"resumeAfter"` // the last file in path order this copy took on
+	FilesDeferred int64  `json:"filesDeferred"`
+	BytesDeferred int64  `json:"bytesDeferred"`
+}
+
+// leaves out the files up to and including 'after' in path order, taken on by the copy that stopped there
+func resumeTasks(tasks []CopyArgs, after string) []CopyArgs {
+	if after == "" {
+		return tasks
+	}
+	kept := make([]CopyArgs, 0, len(tasks))
+	for _, t := range tasks {
+		if t.Path > after {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+// cuts the tasks of a maxBytes copy: in path order, files are taken on until maxBytes is reached, so the last
+// one may go past it. returns the files taken on, in their planned order, and where the copy stops, nil if
+// everything fits
+func limitTasks(tasks []CopyArgs, maxBytes int64) ([]CopyArgs, *CutOff) {
+	byPath := append([]CopyArgs(nil), tasks...)
+	sort.SliceStable(byPath, func(i, j int) bool { return byPath[i].Path < byPath[j].Path })
+	var taken int64
+	var cutOff *CutOff
+	for i, t := range byPath {
+		if taken >= maxBytes {
+			if cutOff == nil {
+				cutOff = &CutOff{ResumeAfter: byPath[i-1].Path}
+			}
+			cutOff.FilesDeferred++
+			cutOff.BytesDeferred += t.Size
+			continue
+		}
+		taken += t.Size
+	}
+	if cutOff == nil {
+		return tasks, nil
+	}
+	kept := make([]CopyArgs, 0, len(tasks)-int(cutOff.FilesDeferred))
+	for _, t := range tasks {
+		if t.Path <= cutOff.ResumeAfter {
+			kept = append(kept, t)
+		}
+	}
+	return kept, cutOff
+}
+
+// one of 'Count' disjoint parts of a directory, for copies split across several workers with shard=i/n.
+// the zero value is the whole directory
+type Shard struct {
+	Index int
+	Count int
+}
+
+// parses a shard given as i/n, 0 <= i < n
+func parseShard(v string) (Shard, error) {
+	var shard Shard
+	if _, err := fmt.Sscanf(v, "%d/%d", &shard.Index, &shard.Count); err != nil || shard.Count < 1 || shard.Index < 0 || shard.Index >= shard.Count {
+		return Shard{}, fmt.Errorf("'shard' must be i/n with 0 <= i < n, got '%s'", v)
+	}
+	return shard, nil
+}
+
+func (s Shard) String() string {
+	return fmt.Sprintf("%d/%d", s.Index, s.Count)
+}
+
+// whether the file belongs to the shard. files are assigned by a hash of their name so every worker
+// listing the same directory agrees on the split
+func (s Shard) contains(name string) bool {
+	if s.Count <= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32()%uint32(s.Count)) == s.Index
+}
+
+// the entries of a directory listing in the shard
+func shardFiles(infos []os.FileInfo, shard Shard) []os.FileInfo {
+	if shard.Count <= 1 {
+		return infos
+	}
+	kept := make([]os.FileInfo, 0, len(infos)/shard.Count+1)
+	for _, info := range infos {
+		if shard.contains(info.Name()) {
+			kept = append(kept, info)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestScheduleTasks(t *testing.T) {
+	listing := []CopyArgs{{File: "b", Size: 20}, {File: "a", Size: 10}, {File: "d", Size: 30}, {File: "c", Size: 10}}
+	for strategy, expected := range map[string]string{
+		"":                    "badc",
+		ScheduleDirectory:     "badc",
+		ScheduleLargestFirst:  "dbac", // ties keep the listing order
+		ScheduleSmallestFirst: "acbd",
+	} {
+		tasks := append([]CopyArgs(nil), listing...)
+		scheduleTasks(tasks, strategy)
+		order := ""
+		for _, task := range tasks {
+			order += task.File
+		}
+		if order != expected {
+			t.Errorf("%q: expected %s, got %s", strategy, expected, order)
+		}
+	}
+
+	tasks := append([]CopyArgs(nil), listing...)
+	scheduleTasks(tasks, ScheduleShuffle)
+	seen := make(map[string]bool)
+	for _, task := range tasks {
+		seen[task.File] = true
+	}
+	if len(tasks) != len(listing) || len(seen) != len(listing) {
+		t.Errorf("expected shuffle to keep every task once, got %v", tasks)
+	}
+}
+
+func TestSampleTasks(t *testing.T) {
+	tasks := make([]CopyArgs, 10)
+	for i := range tasks {
+		tasks[i] = CopyArgs{File: fmt.Sprintf("part-%05d", i), Size: int64(i)}
+	}
+	sample := sampleTasks(tasks, 3, 0)
+	if len(sample) != 3 {
+		t.Fatalf("expected 3 sampled tasks, got %d", len(sample))
+	}
+	for i := 1; i < len(sample); i++ {
+		if sample[i-1].File >= sample[i].File {
+			t.Errorf("expected sample to keep listing order, got %v", sample)
+		}
+	}
+	if sample := sampleTasks(tasks, 0, 25); len(sample) != 3 {
+		t.Errorf("expected 25%% of 10 files to round up to 3, got %d", len(sample))
+	}
+	if sample := sampleTasks(tasks, 20, 0); len(sample) != len(tasks) {
+		t.Errorf("expected a sample larger than the dir to copy everything, got %d", len(sample))
+	}
+	if sample := sampleTasks(tasks, 0, 0); len(sample) != len(tasks) {
+		t.Errorf("expected no sampling by default, got %d", len(sample))
+	}
+}
+
+func TestShards(t *testing.T) {
+	for _, v := range []string{"", "2/2", "-1/2", "1/0", "one/two"} {
+		if _, err := parseShard(v); err == nil {
+			t.Errorf("expected shard '%s' to be rejected", v)
+		}
+	}
+	shards := make([]Shard, 4)
+	for i := range shards {
+		shard, err := parseShard(fmt.Sprintf("%d/4", i))
+		if err != nil || shard.String() != fmt.Sprintf("%d/4", i) {
+			t.Fatalf("unexpected shard %v %v", shard, err)
+		}
+		shards[i] = shard
+	}
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("part-%05d", i)
+		in := 0
+		for _, shard := range shards {
+			if shard.contains(name) {
+				in++
+			}
+		}
+		if in != 1 {
+			t.Errorf("expected %s in exactly one shard, found in %d", name, in)
+		}
+		if !(Shard{}).contains(name) {
+			t.Errorf("expected the whole directory to contain %s", name)
+		}
+	}
+}
+
+func TestLimitTasks(t *testing.T) {
+	tasks := []CopyArgs{{Path: "/src/c", Size: 40}, {Path: "/src/a", Size: 40}, {Path: "/src/d", Size: 10}, {Path: "/src/b", Size: 40}}
+	kept, cutOff := limitTasks(tasks, 50)
+	if len(kept) != 2 || kept[0].Path != "/src/a" || kept[1].Path != "/src/b" {
+		t.Errorf("expected a and b to be taken on, got %+v", kept)
+	}
+	if cutOff == nil || cutOff.ResumeAfter != "/src/b" || cutOff.FilesDeferred != 2 || cutOff.BytesDeferred != 50 {
+		t.Errorf("unexpected cut-off %+v", cutOff)
+	}
+	rest := resumeTasks(tasks, cutOff.ResumeAfter)
+	if len(rest) != 2 || rest[0].Path != "/src/c" || rest[1].Path != "/src/d" {
+		t.Errorf("expected the follow-up to take on c and d, got %+v", rest)
+	}
+	if kept, cutOff := limitTasks(rest, 50); len(kept) != 2 || cutOff != nil {
+		t.Errorf("expected everything to fit, got %+v %+v", kept, cutOff)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Settings holding secrets (encryption keys, the keytab location, the alert webhook) can reference a secret
+// store instead of holding the value, so it doesn't sit in the environment of the copy hosts:
+//
+//	jceks://file/etc/fastcopy/creds.jceks#alias        a hadoop credential provider keystore, local
+//	jceks://hdfs@namenode:8020/creds.jceks#alias       or on the local cluster
+//	vault:secret/data/fastcopy#field                   a field of a vault kv secret (v1 or v2)
+//
+// keystores are opened with HADOOP_CREDSTORE_PASSWORD (default "none", like hadoop), vault is read from
+// VAULT_ADDR with VAULT_TOKEN, and VAULT_NAMESPACE if set
+
+var (
+	resolvedSecrets   = make(map[string]string)
+	resolvedSecretsMu sync.Mutex
+)
+
+// the value of the env var, resolved if it references a secret store
+func secretEnv(name string) (string, error) {
+	v, err := secretValue(os.Getenv(name))
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve %s: %w", name, err)
+	}
+	return v, nil
+}
+
+// v, or the secret it references. resolved values are cached until forgetSecrets
+func secretValue(v string) (string, error) {
+	if !isSecretRef(v) {
+		return v, nil
+	}
+	resolvedSecretsMu.Lock()
+	defer resolvedSecretsMu.Unlock()
+	if secret, ok := resolvedSecrets[v]; ok {
+		return secret, nil
+	}
+	secret, err := resolveSecret(v)
+	if err != nil {
+		return "", err
+	}
+	resolvedSecrets[v] = secret
+	return secret, nil
+}
+
+// drops the cached secrets so they're read from their stores again, e.g. after a rotation
+func forgetSecrets() {
+	resolvedSecretsMu.Lock()
+	defer resolvedSecretsMu.Unlock()
+	resolvedSecrets = make(map[string]string)
+}
+
+func isSecretRef(v string) bool {
+	return strings.HasPrefix(v, "jceks://") || strings.HasPrefix(v, "vault:")
+}
+
+func resolveSecret(ref string) (string, error) {
+	location, key, ok := strings.Cut(ref, "#")
+	if !ok || key == "" {
+		return "", fmt.Errorf("secret reference '%s' names no alias or field after '#'", ref)
+	}
+	if path, ok := strings.CutPrefix(location, "vault:"); ok {
+		return vaultSecret(path, key)
+	}
+	return credentialProviderSecret(location, key)
+}
+
+// reads an alias from a hadoop credential provider, jceks://file/<path> or jceks://hdfs@<namenode>/<path>
+func credentialProviderSecret(provider string, alias string) (string, error) {
+	u, err := url.Parse(provider)
+	if err != nil {
+		return "", err
+	}
+	var data []byte
+	switch {
+	case u.Host == "file":
+		data, err = os.ReadFile(u.Path)
+	case strings.HasPrefix(u.Host, "hdfs"):
+		data, err = GetHdfsClient().ReadFile(u.Path)
+	default:
+		return "", fmt.Errorf("unsupported credential provider '%s', expected jceks://file/... or jceks://hdfs@.../", provider)
+	}
+	if err != nil {
+		return "", err
+	}
+	password := os.Getenv("HADOOP_CREDSTORE_PASSWORD")
+	if password == "" {
+		password = defaultCredstorePassword
+	}
+	secrets, err := readJCEKS(data, password)
+	if err != nil {
+		return "", err
+	}
+	secret, ok := secrets[strings.ToLower(alias)] // java keystores lower case their aliases
+	if !ok {
+		return "", fmt.Errorf("%s has no alias '%s'", provider, alias)
+	}
+	return string(secret), nil
+}
+
+// reads a field of a vault kv secret, e.g. secret/data/fastcopy for a kv v2 mount named secret
+func vaultSecret(path string, field string) (string, error) {
+	addr := strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/")
+	if addr == "" {
+		return "", fmt.Errorf("vault secret '%s' referenced but VAULT_ADDR isn't set", path)
+	}
+	req, err := http.NewRequest(http.MethodGet, addr+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("vault returned non-OK status %d for %s: %s", resp.StatusCode, path, msg)
+	}
+	var secret struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", err
+	}
+	fields := secret.Data
+	if nested, ok := fields["data"]; ok && fields["metadata"] != nil { // kv v2 nests the secret
+		fields = nil
+		if err := json.Unmarshal(nested, &fields); err != nil {
+			return "", err
+		}
+	}
+	raw, ok := fields[field]
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no field '%s'", path, field)
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return "", fmt.Errorf("vault secret %s field '%s' isn't a string", path, field)
+	}
+	return value, nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writes java serialization streams the way ObjectOutputStream does, for the classes a JCEKS keystore uses
+type javaWriter struct {
+	bytes.Buffer
+	handles map[string]int
+}
+
+func (w *javaWriter) utf(s string) {
+	binary.Write(w, binary.BigEndian, uint16(len(s)))
+	w.WriteString(s)
+}
+
+func (w *javaWriter) handle(key string) {
+	w.handles[key] = len(w.handles)
+}
+
+// a string, or a reference if it was written before
+func (w *javaWriter) str(s string) {
+	if h, ok := w.handles["string "+s]; ok {
+		w.WriteByte(tcReference)
+		binary.Write(w, binary.BigEndian, uint32(javaBaseHandle+h))
+		return
+	}
+	w.WriteByte(tcString)
+	w.utf(s)
+	w.handle("string " + s)
+}
+
+// a class descriptor with object fields only, "L" or "[" prefixed type and name pairs
+func (w *javaWriter) classDesc(name string, fields [][2]string, super func()) {
+	if h, ok := w.handles["class "+name]; ok {
+		w.WriteByte(tcReference)
+		binary.Write(w, binary.BigEndian, uint32(javaBaseHandle+h))
+		return
+	}
+	w.WriteByte(tcClassDesc)
+	w.utf(name)
+	binary.Write(w, binary.BigEndian, int64(0x1234))
+	w.handle("class " + name)
+	w.WriteByte(0x02) // SC_SERIALIZABLE
+	binary.Write(w, binary.BigEndian, uint16(len(fields)))
+	for _, f := range fields {
+		w.WriteByte(f[0][0])
+		w.utf(f[1])
+		w.str(f[0])
+	}
+	w.WriteByte(tcEndBlockData)
+	if super == nil {
+		w.WriteByte(tcNull)
+	} else {
+		super()
+	}
+}
+
+func (w *javaWriter) byteArray(b []byte) {
+	w.WriteByte(tcArray)
+	w.classDesc("[B", nil, nil)
+	w.handle(fmt.Sprintf("array %d", len(w.handles)))
+	binary.Write(w, binary.BigEndian, uint32(len(b)))
+	w.Write(b)
+}
+
+func newJavaWriter() *javaWriter {
+	w := &javaWriter{handles: make(map[string]int)}
+	binary.Write(w, binary.BigEndian, uint16(javaStreamMagic))
+	binary.Write(w, binary.BigEndian, uint16(javaStreamVersion))
+	return w
+}
+
+// builds a JCEKS keystore holding the secrets like `hadoop credential create` does
+func makeJCEKS(t *testing.T, secrets map[string]string, password string) []byte {
+	var ks bytes.Buffer
+	binary.Write(&ks, binary.BigEndian, []uint32{jceksMagic, 2, uint32(len(secrets))})
+	for alias, secret := range secrets {
+		spec := newJavaWriter()
+		spec.WriteByte(tcObject)
+		spec.classDesc("javax.crypto.spec.SecretKeySpec", [][2]string{{"Ljava/lang/String;", "algorithm"}, {"[B", "key"}}, nil)
+		spec.handle("object")
+		spec.str("AES")
+		spec.byteArray([]byte(secret))
+
+		salt := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+		params, _ := asn1.Marshal(struct {
+			Salt       []byte
+			Iterations int
+		}{salt, 1000})
+		sealed := newJavaWriter()
+		sealed.WriteByte(tcObject)
+		sealed.classDesc("com.sun.crypto.provider.SealedObjectForKeyProtector", nil, func() {
+			sealed.classDesc("javax.crypto.SealedObject", [][2]string{{"[B", "encodedParams"}, {"[B", "encryptedContent"}, {"Ljava/lang/String;", "paramsAlg"}, {"Ljava/lang/String;", "sealAlg"}}, nil)
+		})
+		sealed.handle("object")
+		sealed.byteArray(params)
+		sealed.byteArray(encryptPBEWithMD5AndTripleDES(spec.Bytes(), password, salt, 1000))
+		sealed.str("PBEWithMD5AndTripleDES")
+		sealed.str("PBEWithMD5AndTripleDES")
+
+		binary.Write(&ks, binary.BigEndian, uint32(jceksSecretKey))
+		binary.Write(&ks, binary.BigEndian, uint16(len(alias)))
+		ks.WriteString(alias)
+		binary.Write(&ks, binary.BigEndian, int64(1700000000000))
+		ks.Write(sealed.Bytes())
+	}
+	h := sha1.New()
+	for _, c := range password {
+		h.Write([]byte{byte(c >> 8), byte(c)})
+	}
+	h.Write([]byte(jceksIntegritySalt))
+	h.Write(ks.Bytes())
+	return append(ks.Bytes(), h.Sum(nil)...)
+}
+
+func encryptPBEWithMD5AndTripleDES(data []byte, password string, salt []byte, iterations int) []byte {
+	var derived []byte
+	for i := 0; i < 2; i++ {
+		digest := salt[i*4 : i*4+4]
+		for j := 0; j < iterations; j++ {
+			sum := md5.Sum(append(append([]byte(nil), digest...), password...))
+			digest = sum[:]
+		}
+		derived = append(derived, digest...)
+	}
+	pad := des.BlockSize - len(data)%des.BlockSize
+	data = append(append([]byte(nil), data...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	block, _ := des.NewTripleDESCipher(derived[:24])
+	out := make([]byte, len(data))
+	cipher.NewCBCEncrypter(block, derived[24:]).CryptBlocks(out, data)
+	return out
+}
+
+func TestReadJCEKS(t *testing.T) {
+	data := makeJCEKS(t, map[string]string{"fastcopy.encryption.key": "c2VjcmV0", "webhook": "https://hooks.example.com/abc"}, "none")
+	secrets, err := readJCEKS(data, "none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secrets["fastcopy.encryption.key"]) != "c2VjcmV0" || string(secrets["webhook"]) != "https://hooks.example.com/abc" {
+		t.Errorf("unexpected secrets %q", secrets)
+	}
+	if _, err := readJCEKS(data, "wrong"); err == nil || !strings.Contains(err.Error(), "password") {
+		t.Errorf("expected a wrong password to be reported, got %v", err)
+	}
+}
+
+func TestSecretEnvFromCredentialProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "creds.jceks")
+	if err := os.WriteFile(path, makeJCEKS(t, map[string]string{"keytab": "/etc/security/fastcopy.keytab"}, "changeit"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(forgetSecrets)
+	t.Setenv("HADOOP_CREDSTORE_PASSWORD", "changeit")
+	t.Setenv("KRB_KEYTAB", "jceks://file"+path+"#KEYTAB")
+	if v, err := secretEnv("KRB_KEYTAB"); err != nil || v != "/etc/security/fastcopy.keytab" {
+		t.Errorf("expected the keytab path from the keystore, got '%s' %v", v, err)
+	}
+	t.Setenv("KRB_KEYTAB", "jceks://file"+path+"#missing")
+	if _, err := secretEnv("KRB_KEYTAB"); err == nil || !strings.Contains(err.Error(), "KRB_KEYTAB") {
+		t.Errorf("expected a missing alias to be reported, got %v", err)
+	}
+	t.Setenv("KRB_KEYTAB", "/etc/plain.keytab")
+	if v, _ := secretEnv("KRB_KEYTAB"); v != "/etc/plain.keytab" {
+		t.Errorf("expected plain values to be used as is, got %s", v)
+	}
+}
+
+func TestSecretEnvFromVault(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/fastcopy":
+			w.Write([]byte(`{"data": {"data": {"webhook": "https://hooks.example.com/abc"}, "metadata": {"version": 3}}}`))
+		case "/v1/kv/fastcopy":
+			w.Write([]byte(`{"data": {"webhook": "https://hooks.example.com/v1"}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer vault.Close()
+	t.Cleanup(forgetSecrets)
+	t.Setenv("VAULT_ADDR", vault.URL)
+	t.Setenv("VAULT_TOKEN", "s.token")
+	for ref, want := range map[string]string{"vault:secret/data/fastcopy#webhook": "https://hooks.example.com/abc", "vault:kv/fastcopy#webhook": "https://hooks.example.com/v1"} {
+		t.Setenv("FASTCOPY_ALERT_WEBHOOK", ref)
+		if v, err := secretEnv("FASTCOPY_ALERT_WEBHOOK"); err != nil || v != want {
+			t.Errorf("%s: expected %s, got '%s' %v", ref, want, v, err)
+		}
+	}
+	t.Setenv("FASTCOPY_ALERT_WEBHOOK", "vault:secret/data/fastcopy#other")
+	if _, err := secretEnv("FASTCOPY_ALERT_WEBHOOK"); err == nil {
+		t.Error("expected a missing field to be reported")
+	}
+	forgetSecrets()
+	t.Setenv("VAULT_TOKEN", "s.expired")
+	t.Setenv("FASTCOPY_ALERT_WEBHOOK", "vault:secret/data/fastcopy#webhook")
+	if _, err := secretEnv("FASTCOPY_ALERT_WEBHOOK"); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("expected vault's refusal to be reported, got %v", err)
+	}
+}
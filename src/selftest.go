@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"time"
+)
+
+// stages of /selftest, in the order they run
+const (
+	StageHdfsWrite     = "hdfs_write"      // write a scratch file to the local cluster and read it back
+	StageNetwork       = "network"         // reach the peer
+	StagePeerAuth      = "peer_auth"       // the peer accepts our credentials
+	StagePeerHdfsWrite = "peer_hdfs_write" // the peer writes the file to its cluster
+	StageChecksum      = "checksum"        // the peer wrote the same bytes we sent
+	StageCleanup       = "cleanup"         // the local scratch file is removed again
+)
+
+const (
+	DefaultSelfTestDir  = "/tmp/fastcopy-selftest"
+	selfTestPayloadSize = 64 << 10
+)
+
+type SelfTestStage struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Skipped bool   `json:"skipped,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type SelfTestResponse struct {
+	Passed      bool            `json:"passed"`
+	Stages      []SelfTestStage `json:"stages"`
+	ElapsedSecs float64         `json:"elapsedSecs"`
+}
+
+// records the outcome of each stage, skipping the remaining stages after the first failure
+type selfTest struct {
+	stages []SelfTestStage
+	failed bool
+}
+
+// runs a stage unless an earlier one failed. returns whether it passed
+func (st *selfTest) run(name string, stage func() error) bool {
+	if st.failed {
+		st.stages = append(st.stages, SelfTestStage{Name: name, Skipped: true})
+		return false
+	}
+	if err := stage(); err != nil {
+		log.Printf("selftest stage %s failed: %s", name, err)
+		st.stages = append(st.stages, SelfTestStage{Name: name, Error: err.Error()})
+		st.failed = true
+		return false
+	}
+	st.stages = append(st.stages, SelfTestStage{Name: name, Passed: true})
+	return true
+}
+
+// sends data to the peer's /upload with selftest=true, so the peer removes the file once it's verified,
+// and records the network, peer auth, peer hdfs write and checksum stages
+func selfTestPeer(st *selfTest, targetURL string, to string, fileName string, data []byte, sha256 string) {
+	var resp *http.Response
+	st.run(StageNetwork, func() error {
+		var err error
+		uploadURL := targetURL + "?" + url.Values{"to": {to}, "fileName": {fileName}, "selftest": {"true"}}.Encode()
+		resp, err = httpClient.Post(uploadURL, "application/octet-stream", bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("cannot connect to %s: %w", targetURL, err)
+		}
+		return nil
+	})
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	st.run(StagePeerAuth, func() error {
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			return fmt.Errorf("%s rejected our credentials (%d)", targetURL, resp.StatusCode)
+		}
+		return nil
+	})
+	var res UploadResponse
+	st.run(StagePeerHdfsWrite, func() error {
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			return fmt.Errorf("%s returned %d: %s", targetURL, resp.StatusCode, peerErrorMessage(body))
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			return fmt.Errorf("%s returned an unreadable response: %w", targetURL, err)
+		}
+		return nil
+	})
+	st.run(StageChecksum, func() error {
+		if res.SHA256 != sha256 {
+			return fmt.Errorf("peer wrote sha256 %s, sent %s", res.SHA256, sha256)
+		}
+		return nil
+	})
+}
+
+// Validates the whole pipeline against 'targetURL': writes a small random file to the scratch dir 'dir'
+// (default /tmp/fastcopy-selftest) on the local cluster, copies it to the peer, verifies the peer's checksum
+// and cleans up on both sides. responds with the pass/fail of each stage
+func handleSelfTest(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	targetURL := r.URL.Query().Get("targetURL")
+	if targetURL == "" {
+		writeError(w, "'targetURL' query param must be provided.", http.StatusBadRequest)
+		return
+	}
+	dir := r.URL.Query().Get("dir")
+	if dir == "" {
+		dir = DefaultSelfTestDir
+	}
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	fileName := ".fastcopy-selftest-" + hex.EncodeToString(suffix)
+	path := filepath.Join(dir, fileName)
+
+	st := &selfTest{}
+	var data []byte
+	var written UploadResponse
+	wroteLocal := st.run(StageHdfsWrite, func() error {
+		var err error
+		written, err = WriteHDFS(dir, fileName, &RandomReadCloser{size: selfTestPayloadSize})
+		if err != nil {
+			return err
+		}
+		if data, err = GetHdfsClient().ReadFile(path); err != nil {
+			return fmt.Errorf("cannot read back %s: %w", path, err)
+		}
+		digests := newFileDigests()
+		digests.Write(data)
+		if digests.SHA256() != written.SHA256 {
+			return errors.New("read back different bytes than were written")
+		}
+		return nil
+	})
+	selfTestPeer(st, targetURL, dir, fileName, data, written.SHA256)
+	// clean up whatever was written, even after a failed stage
+	st.failed = false
+	st.run(StageCleanup, func() error {
+		if !wroteLocal {
+			return nil
+		}
+		return GetHdfsClient().Remove(path)
+	})
+
+	resp := SelfTestResponse{Passed: true, Stages: st.stages, ElapsedSecs: time.Since(start).Seconds()}
+	for _, s := range st.stages {
+		resp.Passed = resp.Passed && s.Passed
+	}
+	json, _ := json.MarshalIndent(resp, "", "  ")
+	log.Println(string(json))
+	if !resp.Passed {
+		writeReport(w, json, http.StatusInternalServerError)
+		return
+	}
+	w.Write(json)
+}
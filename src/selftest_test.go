@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSelfTestPeer(t *testing.T) {
+	data := []byte("fastcopy selftest")
+	digests := newFileDigests()
+	digests.Write(data)
+
+	cases := []struct {
+		name    string
+		handler http.HandlerFunc
+		failed  string
+	}{
+		{"healthy peer", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("selftest") != "true" {
+				t.Error("expected selftest upload to ask the peer to clean up")
+			}
+			json.NewEncoder(w).Encode(UploadResponse{SHA256: digests.SHA256()})
+		}, ""},
+		{"bad credentials", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+		}, StagePeerAuth},
+		{"peer hdfs down", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "namenode unreachable", http.StatusInternalServerError)
+		}, StagePeerHdfsWrite},
+		{"corrupted write", func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(UploadResponse{SHA256: "bogus"})
+		}, StageChecksum},
+	}
+	for _, c := range cases {
+		peer := httptest.NewServer(c.handler)
+		st := &selfTest{}
+		selfTestPeer(st, peer.URL+"/upload", "/tmp/selftest", "probe", data, digests.SHA256())
+		peer.Close()
+
+		failed := ""
+		for i, s := range st.stages {
+			if !s.Passed && !s.Skipped {
+				failed = s.Name
+				for _, rest := range st.stages[i+1:] {
+					if !rest.Skipped {
+						t.Errorf("%s: expected %s to be skipped after %s failed", c.name, rest.Name, s.Name)
+					}
+				}
+				break
+			}
+		}
+		if failed != c.failed {
+			t.Errorf("%s: expected failed stage %q, got %q in %+v", c.name, c.failed, failed, st.stages)
+		}
+	}
+
+	st := &selfTest{}
+	selfTestPeer(st, "http://127.0.0.1:1/upload", "/tmp/selftest", "probe", data, digests.SHA256())
+	if st.stages[0].Name != StageNetwork || st.stages[0].Passed {
+		t.Errorf("expected unreachable peer to fail the network stage, got %+v", st.stages)
+	}
+}
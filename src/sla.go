@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// kinds of alerts the watchdog raises on running jobs
+const (
+	AlertStalled = "stalled" // no bytes moved for the job's stall timeout
+	AlertOverdue = "overdue" // still running past the job's expected duration
+	AlertSlow    = "slow"    // average throughput below the job's minimum
+)
+
+const (
+	// how long a job may move no bytes before it's reported stalled, unless it sets stallTimeout
+	defaultStallTimeout = 5 * time.Minute
+	// a job's average throughput is only held against its minimum once it ran this long
+	slowGracePeriod = time.Minute
+)
+
+// the expectations a /copy declares with expectedDuration, minThroughput and stallTimeout
+type JobSLA struct {
+	ExpectedDuration time.Duration
+	MinThroughput    float64 // Mbps
+	StallTimeout     time.Duration
+}
+
+type JobAlert struct {
+	At      time.Time `json:"at"`
+	Kind    string    `json:"kind"`
+	Message string    `json:"message"`
+}
+
+// the body POSTed to FASTCOPY_ALERT_WEBHOOK for every alert
+type AlertNotification struct {
+	JobID     string            `json:"jobId"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	From      string            `json:"from"`
+	To        string            `json:"to"`
+	TargetURL string            `json:"targetURL"`
+	JobAlert
+}
+
+var (
+	alertCounts   = make(map[string]int64)
+	alertCountsMu sync.Mutex
+)
+
+func parseSLA(q url.Values) (JobSLA, error) {
+	sla := JobSLA{StallTimeout: defaultStallTimeout}
+	if v := q.Get("expectedDuration"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return sla, fmt.Errorf("'expectedDuration' must be a duration like 2h, got '%s'", v)
+		}
+		sla.ExpectedDuration = d
+	}
+	if v := q.Get("minThroughput"); v != "" {
+		mbps, err := parseMbps(v)
+		if err != nil || mbps == 0 {
+			return sla, fmt.Errorf("'minThroughput' must be a bandwidth like 200Mbps, got '%s'", v)
+		}
+		sla.MinThroughput = mbps
+	}
+	if v := q.Get("stallTimeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return sla, fmt.Errorf("'stallTimeout' must be a duration like 10m, got '%s'", v)
+		}
+		sla.StallTimeout = d
+	}
+	return sla, nil
+}
+
+// checks a running job against its SLA and raises every alert once. a stalled alert is raised again
+// if the job stalls again after moving bytes
+func (j *Job) checkSLA() {
+	j.mu.Lock()
+	if j.state != StateRunning {
+		j.mu.Unlock()
+		return
+	}
+	now := j.now()
+	elapsed := now.Sub(j.startedAt)
+	var raised []JobAlert
+	raise := func(kind string, format string, v ...interface{}) {
+		if !j.alerted[kind] {
+			j.alerted[kind] = true
+			raised = append(raised, JobAlert{now, kind, fmt.Sprintf(format, v...)})
+		}
+	}
+	stallTimeout := j.sla.StallTimeout
+	if stallTimeout == 0 {
+		stallTimeout = defaultStallTimeout
+	}
+	if idle := now.Sub(j.lastProgress); idle >= stallTimeout && !pauseState().Paused {
+		raise(AlertStalled, "no bytes moved for %s, %d of %d bytes done", idle.Round(time.Second), j.bytesRead, j.bytesPlanned)
+	} else {
+		delete(j.alerted, AlertStalled)
+	}
+	if d := j.sla.ExpectedDuration; d > 0 && elapsed > d {
+		raise(AlertOverdue, "running for %s, expected to finish within %s", elapsed.Round(time.Second), d)
+	}
+	if min := j.sla.MinThroughput; min > 0 && elapsed >= slowGracePeriod {
+		if avg := mbps(j.bytesRead, elapsed.Seconds()); avg < min {
+			raise(AlertSlow, "average throughput %.1f Mbps is below the minimum of %.1f Mbps", avg, min)
+		}
+	}
+	j.alerts = append(j.alerts, raised...)
+	notification := AlertNotification{JobID: j.id, Labels: j.labels, From: j.from, To: j.to, TargetURL: j.targetURL}
+	j.mu.Unlock()
+
+	for _, alert := range raised {
+		j.logf("alert %s: %s", alert.Kind, alert.Message)
+		alertCountsMu.Lock()
+		alertCounts[alert.Kind]++
+		alertCountsMu.Unlock()
+		notification.JobAlert = alert
+		go notifyAlert(notification)
+	}
+}
+
+// whether the job ran over its expected duration or below its minimum throughput. j.mu must be held
+func (j *Job) slaBreached() bool {
+	return j.alerted[AlertOverdue] || j.alerted[AlertSlow]
+}
+
+// POSTs the alert to FASTCOPY_ALERT_WEBHOOK if it's set
+func notifyAlert(n AlertNotification) {
+	webhook, err := secretEnv("FASTCOPY_ALERT_WEBHOOK")
+	if err != nil {
+		log.Printf("failed to send alert: %s", err)
+		return
+	}
+	if webhook == "" {
+		return
+	}
+	body, _ := json.Marshal(n)
+	resp, err := httpClient.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("failed to send the %s alert of job %s to %s: %s", n.Kind, n.JobID, os.Getenv("FASTCOPY_ALERT_WEBHOOK"), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("alert webhook %s answered the %s alert of job %s with %s", os.Getenv("FASTCOPY_ALERT_WEBHOOK"), n.Kind, n.JobID, resp.Status)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseSLA(t *testing.T) {
+	sla, err := parseSLA(url.Values{"expectedDuration": {"2h"}, "minThroughput": {"200Mbps"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sla.ExpectedDuration != 2*time.Hour || sla.MinThroughput != 200 || sla.StallTimeout != defaultStallTimeout {
+		t.Errorf("unexpected sla %+v", sla)
+	}
+	for _, bad := range []url.Values{
+		{"expectedDuration": {"soon"}},
+		{"expectedDuration": {"-1h"}},
+		{"minThroughput": {"fast"}},
+		{"minThroughput": {"unlimited"}},
+		{"stallTimeout": {"0s"}},
+	} {
+		if _, err := parseSLA(bad); err == nil {
+			t.Errorf("expected %v to be rejected", bad)
+		}
+	}
+}
+
+func TestJobSLAWatchdog(t *testing.T) {
+	notifications := make(chan AlertNotification, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n AlertNotification
+		json.NewDecoder(r.Body).Decode(&n)
+		notifications <- n
+	}))
+	defer webhook.Close()
+	t.Setenv("FASTCOPY_ALERT_WEBHOOK", webhook.URL)
+
+	tasks := []CopyArgs{{Path: "/src/a", Size: 100000000}}
+	job, err := startJob("test-sla", "/src", "/dst", "http://peer/upload", map[string]string{"team": "analytics"}, tasks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer job.finish(CopyResponse{State: StateSucceeded})
+	job.setSLA(JobSLA{ExpectedDuration: 10 * time.Minute, MinThroughput: 10, StallTimeout: 2 * time.Minute})
+	now := job.startedAt
+	job.now = func() time.Time { return now }
+
+	// 8 Mbps for 2 minutes, slower than the minimum but moving
+	for i := 0; i < 120; i++ {
+		now = now.Add(time.Second)
+		job.progress(tasks[0], 1000000)
+	}
+	job.checkSLA()
+	if s := job.status(); len(s.Alerts) != 1 || s.Alerts[0].Kind != AlertSlow || !s.SLABreached {
+		t.Fatalf("expected a slow alert, got %+v", s.Alerts)
+	}
+	select {
+	case n := <-notifications:
+		if n.JobID != "test-sla" || n.Kind != AlertSlow || n.Labels["team"] != "analytics" {
+			t.Errorf("unexpected notification %+v", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the alert to be sent to the webhook")
+	}
+
+	now = now.Add(3 * time.Minute)
+	job.checkSLA()
+	job.checkSLA()
+	if s := job.status(); len(s.Alerts) != 2 || s.Alerts[1].Kind != AlertStalled {
+		t.Fatalf("expected a single stalled alert, got %+v", s.Alerts)
+	}
+
+	// moving again and stalling again alerts again
+	now = now.Add(time.Second)
+	job.progress(tasks[0], 1000000)
+	job.checkSLA()
+	now = now.Add(6 * time.Minute)
+	job.checkSLA()
+	s := job.status()
+	kinds := ""
+	for _, a := range s.Alerts {
+		kinds += a.Kind + " "
+	}
+	if kinds != "slow stalled stalled overdue " {
+		t.Errorf("unexpected alerts %s", kinds)
+	}
+}
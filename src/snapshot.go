@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// hdfs exposes the snapshots of a snapshottable dir under this child
+const snapshotDir = ".snapshot"
+
+// returns the read-only path of the snapshot 'name' of 'dir'
+func snapshotPath(dir string, name string) string {
+	return filepath.Join(dir, snapshotDir, name)
+}
+
+// names snapshots created by /copy so they're recognisable and unique per job
+func newSnapshotName(now time.Time) string {
+	return "fastcopy-" + now.UTC().Format("20060102T150405.000000000Z")
+}
+
+// resolves the snapshot to read 'from' out of with useSnapshot=true: the existing snapshot opts.SnapshotName,
+// or a new one created now. returns the snapshot name and the path to list and read files from
+func prepareSnapshot(client FileSystem, from string, opts CopyOptions) (string, string, error) {
+	if opts.SnapshotName != "" {
+		path := snapshotPath(from, opts.SnapshotName)
+		if _, err := client.Stat(path); err != nil {
+			return "", "", fmt.Errorf("snapshot %s of %s not found: %w", opts.SnapshotName, from, err)
+		}
+		return opts.SnapshotName, path, nil
+	}
+	name := newSnapshotName(time.Now())
+	path, err := client.CreateSnapshot(from, name)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to snapshot %s, an admin may need to run 'hdfs dfsadmin -allowSnapshot %s': %w", from, from, err)
+	}
+	log.Printf("Created snapshot %s of %s", name, from)
+	if path == "" {
+		path = snapshotPath(from, name)
+	}
+	return name, path, nil
+}
+
+// deletes a snapshot once its copy finished, logging rather than failing the copy if it can't
+func releaseSnapshot(client FileSystem, from string, name string) {
+	if err := client.DeleteSnapshot(from, name); err != nil {
+		log.Printf("Failed to delete snapshot %s of %s: %s", name, from, err)
+		return
+	}
+	log.Printf("Deleted snapshot %s of %s", name, from)
+}
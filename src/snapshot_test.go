@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSnapshotPath(t *testing.T) {
+	if p := snapshotPath("/data/events/", "nightly"); p != "/data/events/.snapshot/nightly" {
+		t.Errorf("unexpected snapshot path %s", p)
+	}
+	now := time.Date(2024, 3, 1, 12, 30, 0, 5, time.UTC)
+	if name := newSnapshotName(now); name != "fastcopy-20240301T123000.000000005Z" {
+		t.Errorf("unexpected snapshot name %s", name)
+	}
+}
+
+func TestParseSnapshotOptions(t *testing.T) {
+	opts, err := parseCopyOptions(httptest.NewRequest("POST", "/copy?snapshotName=nightly", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.UseSnapshot {
+		t.Error("expected snapshotName to imply useSnapshot")
+	}
+	if _, err := parseCopyOptions(httptest.NewRequest("POST", "/copy?deleteSnapshot=true", nil)); err == nil {
+		t.Error("expected deleteSnapshot without useSnapshot to be rejected")
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// copies scheduled every few minutes send the same small reference files, e.g. dimension tables and schemas, over
+// and over. with FASTCOPY_SOURCE_CACHE set, files of at most FASTCOPY_SOURCE_CACHE_MAX_FILE are kept in memory,
+// least recently used evicted first, and sent from there while their path, mtime and length match the listing
+
+// the largest file cached unless FASTCOPY_SOURCE_CACHE_MAX_FILE is set
+const defaultSourceCacheMaxFile = 1 << 20
+
+// a version of a source file
+type sourceCacheKey struct {
+	path    string
+	modTime int64
+	size    int64
+}
+
+type sourceCacheEntry struct {
+	key  sourceCacheKey
+	data []byte
+}
+
+type sourceCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	maxFile  int64
+	bytes    int64
+	entries  map[sourceCacheKey]*list.Element
+	lru      *list.List // most recently used first
+	hits     int64
+	misses   int64
+}
+
+func newSourceCache(maxBytes int64, maxFile int64) *sourceCache {
+	return &sourceCache{maxBytes: maxBytes, maxFile: maxFile, entries: make(map[sourceCacheKey]*list.Element), lru: list.New()}
+}
+
+var (
+	sourceCacheInst *sourceCache
+	sourceCacheOnce sync.Once
+)
+
+// parses FASTCOPY_SOURCE_CACHE, e.g. 256M, and FASTCOPY_SOURCE_CACHE_MAX_FILE. nil if the cache is off
+func loadSourceCache() (*sourceCache, error) {
+	spec := os.Getenv("FASTCOPY_SOURCE_CACHE")
+	if spec == "" || spec == "0" {
+		return nil, nil
+	}
+	maxBytes, err := parseByteSize(spec)
+	if err != nil || maxBytes < 0 {
+		return nil, fmt.Errorf("invalid FASTCOPY_SOURCE_CACHE '%s', expected a size like 256M", spec)
+	}
+	maxFile := int64(defaultSourceCacheMaxFile)
+	if spec := os.Getenv("FASTCOPY_SOURCE_CACHE_MAX_FILE"); spec != "" {
+		if maxFile, err = parseByteSize(spec); err != nil || maxFile < 1 {
+			return nil, fmt.Errorf("invalid FASTCOPY_SOURCE_CACHE_MAX_FILE '%s', expected a size like 1M", spec)
+		}
+	}
+	if maxFile > maxBytes {
+		maxFile = maxBytes
+	}
+	return newSourceCache(maxBytes, maxFile), nil
+}
+
+// lazy loads the cache of small source files, nil if it's off
+func getSourceCache() *sourceCache {
+	sourceCacheOnce.Do(func() {
+		cache, err := loadSourceCache()
+		if err != nil {
+			log.Fatal(err)
+		}
+		sourceCacheInst = cache
+	})
+	return sourceCacheInst
+}
+
+func cacheKey(args CopyArgs) sourceCacheKey {
+	return sourceCacheKey{args.Path, args.ModTime.UnixNano(), args.Size}
+}
+
+// whether the file is small enough to be cached. files without an mtime can't be told apart from later versions
+func (c *sourceCache) cacheable(args CopyArgs) bool {
+	return args.Size <= c.maxFile && !args.ModTime.IsZero()
+}
+
+func (c *sourceCache) get(key sourceCacheKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(e)
+	return e.Value.(*sourceCacheEntry).data, true
+}
+
+// caches data as the version key of its file, replacing the older versions and evicting the least recently
+// used files to make room
+func (c *sourceCache) put(key sourceCacheKey, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for other, e := range c.entries {
+		if other.path == key.path {
+			c.remove(e)
+		}
+	}
+	for c.bytes+int64(len(data)) > c.maxBytes && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+	c.entries[key] = c.lru.PushFront(&sourceCacheEntry{key, data})
+	c.bytes += int64(len(data))
+}
+
+// guarded by mu
+func (c *sourceCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*sourceCacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= int64(len(entry.data))
+}
+
+// the file's data, from the cache or read from the source. it's cached if it still has the listed length,
+// otherwise the rest of it is read on from the source
+func (c *sourceCache) open(args CopyArgs, open sourceOpener) (io.ReadCloser, error) {
+	key := cacheKey(args)
+	if data, ok := c.get(key); ok {
+		log.Printf("Reading %s from the source cache", args.Path)
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	reader, err := open(args)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(reader, args.Size+1))
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	if int64(len(data)) != args.Size {
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), reader), reader}, nil
+	}
+	reader.Close()
+	c.put(key, data)
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// the hits and misses so far and the bytes cached
+func (c *sourceCache) stats() (int64, int64, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses, c.bytes
+}
+
+// reads the small files through the cache if it's on
+func cachedSource(open sourceOpener, opts CopyOptions) sourceOpener {
+	cache := getSourceCache()
+	if cache == nil || opts.Resume {
+		// resuming seeks the source's own reader
+		return open
+	}
+	return func(args CopyArgs) (io.ReadCloser, error) {
+		if !cache.cacheable(args) {
+			return open(args)
+		}
+		return cache.open(args, open)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSourceCache(t *testing.T) {
+	files := map[string]string{"/ref/a": "aaaa", "/ref/b": "bbbb", "/ref/c": "cccc"}
+	var opens int
+	open := func(args CopyArgs) (io.ReadCloser, error) {
+		opens++
+		return io.NopCloser(strings.NewReader(files[args.Path])), nil
+	}
+	listed := time.Now()
+	args := func(path string) CopyArgs {
+		return CopyArgs{Path: path, Size: int64(len(files[path])), ModTime: listed}
+	}
+	read := func(c *sourceCache, args CopyArgs) string {
+		r, err := c.open(args, open)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		data, _ := io.ReadAll(r)
+		return string(data)
+	}
+
+	cache := newSourceCache(8, 4)
+	for i := 0; i < 3; i++ {
+		if data := read(cache, args("/ref/a")); data != "aaaa" {
+			t.Fatalf("expected aaaa, got %q", data)
+		}
+	}
+	if hits, misses, bytes := cache.stats(); opens != 1 || hits != 2 || misses != 1 || bytes != 4 {
+		t.Errorf("expected a to be read from the source once, got %d opens, %d hits, %d misses, %d bytes", opens, hits, misses, bytes)
+	}
+
+	// a and b fill the cache, c evicts the least recently used
+	read(cache, args("/ref/b"))
+	read(cache, args("/ref/a"))
+	read(cache, args("/ref/c"))
+	opens = 0
+	read(cache, args("/ref/a"))
+	read(cache, args("/ref/b"))
+	if opens != 1 {
+		t.Errorf("expected only b to be evicted, got %d opens", opens)
+	}
+
+	// a new version of a file replaces the cached one
+	files["/ref/a"] = "AAAA"
+	changed := args("/ref/a")
+	changed.ModTime = listed.Add(time.Minute)
+	if data := read(cache, changed); data != "AAAA" {
+		t.Errorf("expected the new version, got %q", data)
+	}
+	if _, ok := cache.entries[cacheKey(args("/ref/a"))]; ok {
+		t.Error("expected the old version to be dropped")
+	}
+
+	// a file that grew since listing is read whole and not cached
+	stale := args("/ref/b")
+	stale.Size = 2
+	if data := read(cache, stale); data != "bbbb" {
+		t.Errorf("expected the whole file, got %q", data)
+	}
+	if _, ok := cache.entries[cacheKey(stale)]; ok {
+		t.Error("expected a file not matching its listing not to be cached")
+	}
+}
+
+func TestLoadSourceCache(t *testing.T) {
+	t.Setenv("FASTCOPY_SOURCE_CACHE", "")
+	if cache, err := loadSourceCache(); cache != nil || err != nil {
+		t.Errorf("expected the cache to be off by default, got %v %v", cache, err)
+	}
+	t.Setenv("FASTCOPY_SOURCE_CACHE", "64M")
+	if cache, err := loadSourceCache(); err != nil || cache.maxBytes != 64<<20 || cache.maxFile != defaultSourceCacheMaxFile {
+		t.Errorf("unexpected cache %+v %v", cache, err)
+	}
+	t.Setenv("FASTCOPY_SOURCE_CACHE_MAX_FILE", "lots")
+	if _, err := loadSourceCache(); err == nil {
+		t.Error("expected an invalid max file size to be rejected")
+	}
+}
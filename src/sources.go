@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// a /copy of several directories at once is described by a JSON body, the options stay query params.
+// every 'from' dir is copied into 'to'/<name of the dir>
+type CopyRequest struct {
+	From       []string `json:"from"`
+	To         string   `json:"to"`
+	TargetURL  string   `json:"targetURL"`
+	TargetURLs []string `json:"targetURLs,omitempty"` // more targets to fan out to, see fanout.go
+	// the files of a plan from /plan, copied instead of the listed ones, see plan.go. a plan of a single 'from'
+	// has it and 'to' in its params
+	Files []PlannedFile `json:"files,omitempty"`
+}
+
+// the largest JSON body accepted by /copy
+const maxCopyRequestBytes = 1 << 20
+
+// a directory read by a /copy
+type copySource struct {
+	from     string
+	name     string // the dir under 'to' it's copied into, "" for a single 'from' copied into 'to' itself
+	readFrom string // 'from', or its snapshot
+	writeTo  string
+	snapshot string
+	listed   int
+	planned  map[string]PlannedFile // by path, the files planned by /plan, nil when not copying a plan
+}
+
+// the outcome of one 'from' dir of a multi-source copy
+type SourceResult struct {
+	From           string `json:"from"`
+	To             string `json:"to"`
+	Snapshot       string `json:"snapshot,omitempty"`
+	Written        int64  `json:"written"`
+	FilesRequested int64  `json:"filesRequested"`
+	FilesCopied    int64  `json:"filesCopied"`
+	FilesFailed    int64  `json:"filesFailed"`
+	FilesSkipped   int64  `json:"filesSkipped"`
+	Reconciled     *bool  `json:"reconciled,omitempty"`
+	State          string `json:"state"`
+}
+
+func isJSONRequest(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/json"
+}
+
+// reads 'to', the targets and the source dirs of a /copy from its query params, or from its JSON body.
+// 'targetURL' may be repeated to fan out to several targets
+func parseCopySources(r *http.Request) (string, []string, []copySource, error) {
+	q := r.URL.Query()
+	var req CopyRequest
+	if isJSONRequest(r) {
+		if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxCopyRequestBytes)).Decode(&req); err != nil {
+			return "", nil, nil, fmt.Errorf("invalid copy request body: %w", err)
+		}
+	}
+	if !isJSONRequest(r) || (len(req.From) == 0 && req.Files != nil) {
+		if err := validateParams(q, "from", "to", "targetURL"); err != nil {
+			return "", nil, nil, err
+		}
+		targets, err := copyTargets(q["targetURL"])
+		if err != nil {
+			return "", nil, nil, err
+		}
+		sources, err := withPlannedFiles([]copySource{{from: q.Get("from")}}, req.Files)
+		return q.Get("to"), targets, sources, err
+	}
+	if req.To == "" {
+		req.To = q.Get("to")
+	}
+	targets := req.TargetURLs
+	if req.TargetURL != "" {
+		targets = append([]string{req.TargetURL}, targets...)
+	}
+	if len(targets) == 0 {
+		targets = q["targetURL"]
+	}
+	if len(req.From) == 0 || req.To == "" {
+		return "", nil, nil, errors.New("the copy request body must list 'from' dirs and give 'to'")
+	}
+	// 'from' dirs sharing a name are resolved by the collisions policy, see collisions.go
+	sources := make([]copySource, 0, len(req.From))
+	for _, from := range req.From {
+		name := filepath.Base(filepath.Clean(from))
+		if from == "" || name == "/" || name == "." {
+			return "", nil, nil, fmt.Errorf("'%s' can't be copied under 'to', name a directory", from)
+		}
+		sources = append(sources, copySource{from: from, name: name})
+	}
+	if err := validateCopyRequest(req.From, req.To, targets); err != nil {
+		return "", nil, nil, err
+	}
+	targets, err := copyTargets(targets)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	sources, err = withPlannedFiles(sources, req.Files)
+	return req.To, targets, sources, err
+}
+
+// the source dirs as one string, for logs and the job
+func joinSources(sources []copySource) string {
+	froms := make([]string, 0, len(sources))
+	for _, src := range sources {
+		froms = append(froms, src.from)
+	}
+	return strings.Join(froms, ",")
+}
+
+// whether path is in dir or below
+func within(path string, dir string) bool {
+	return strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// the tasks writing into dir
+func tasksInto(tasks []CopyArgs, dir string) []CopyArgs {
+	var into []CopyArgs
+	for _, t := range tasks {
+		if t.To == dir {
+			into = append(into, t)
+		}
+	}
+	return into
+}
+
+// breaks the outcome of a multi-source copy down by source dir
+func sourceResults(sources []copySource, tasks []CopyArgs, copied []CopiedFile, skipped []SkippedFile, failures []CopyFailure, reconciled map[string]bool) []SourceResult {
+	results := make([]SourceResult, 0, len(sources))
+	for _, src := range sources {
+		res := SourceResult{From: src.from, To: src.writeTo, Snapshot: src.snapshot, FilesRequested: int64(src.listed), State: StateSucceeded}
+		for _, t := range tasks {
+			if t.To == src.writeTo || within(t.To, src.writeTo) {
+				res.Written += t.Size
+			}
+		}
+		res.FilesCopied = int64(len(copiedUnder(copied, src.writeTo)))
+		for _, f := range failures {
+			if within(f.Path, src.readFrom) || within(f.Path, src.writeTo) {
+				res.FilesFailed++
+				res.Written -= f.Size
+				res.State = StateFailed
+				if f.TargetUnavailable {
+					res.State = StateTargetUnavailable
+				}
+			}
+		}
+		for _, s := range skipped {
+			if within(s.Path, src.readFrom) {
+				res.FilesSkipped++
+			}
+		}
+		if ok, checked := reconciled[src.writeTo]; checked {
+			res.Reconciled = &ok
+			if !ok && res.State == StateSucceeded {
+				res.State = StateFailed
+			}
+		}
+		results = append(results, res)
+	}
+	return results
+}
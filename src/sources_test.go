@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseCopySources(t *testing.T) {
+	for body, expected := range map[string]string{
+		`{"from": [], "to": "/dst"}`:    "must list 'from'",
+		`{"from": ["/"], "to": "/dst"}`: "name a directory",
+		`{"from": "/data/a"}`:           "invalid copy request body",
+	} {
+		r := httptest.NewRequest("POST", "/copy", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		if _, _, _, err := parseCopySources(r); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: expected an error mentioning %s, got %v", body, expected, err)
+		}
+	}
+
+	r := httptest.NewRequest("POST", "/copy?targetURL=http://t/upload", strings.NewReader(`{"from": ["/data/a/", "/data/b"], "to": "/dst"}`))
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	to, targets, sources, err := parseCopySources(r)
+	if err != nil || to != "/dst" || len(targets) != 1 || targets[0] != "http://t/upload" || len(sources) != 2 || sources[0].name != "a" || sources[1].name != "b" {
+		t.Errorf("unexpected sources %s %v %+v %v", to, targets, sources, err)
+	}
+}
+
+func TestCopyMultipleSources(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{
+		"/data/events/part-00000": "hello",
+		"/data/events/part-00001": "world!",
+		"/data/users/part-00000":  "abc",
+		"/data/users/.hidden":     "x",
+	})
+
+	peer := http.NewServeMux()
+	peer.HandleFunc("/ready", handleReady)
+	peer.HandleFunc("/ls", handleLs)
+	peer.HandleFunc("/upload", handleUpload)
+	server := httptest.NewServer(peer)
+	defer server.Close()
+
+	body, _ := json.Marshal(CopyRequest{From: []string{"/data/events", "/data/users"}, To: "/backup", TargetURL: server.URL + "/upload"})
+	query := url.Values{"manifest": {"true"}, "skipHidden": {"true"}}
+	r := httptest.NewRequest("POST", "/copy?"+query.Encode(), strings.NewReader(string(body)))
+	r.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handleCopy(rec, r)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var resp CopyResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.State != StateSucceeded || resp.FilesCopied != 3 || resp.FilesSkipped != 1 || resp.Written != 14 || len(resp.Sources) != 2 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	events, users := resp.Sources[0], resp.Sources[1]
+	if events.To != "/backup/events" || events.FilesCopied != 2 || events.Written != 11 || events.Reconciled == nil || !*events.Reconciled {
+		t.Errorf("unexpected result for events %+v", events)
+	}
+	if users.To != "/backup/users" || users.FilesCopied != 1 || users.FilesSkipped != 1 || users.State != StateSucceeded {
+		t.Errorf("unexpected result for users %+v", users)
+	}
+	for _, path := range []string{"/backup/events/part-00001", "/backup/users/part-00000", "/backup/events/" + ManifestFileName, "/backup/users/" + ManifestFileName} {
+		if _, ok := fs.get(path); !ok {
+			t.Errorf("expected %s to be written", path)
+		}
+	}
+
+	r = httptest.NewRequest("POST", "/copy?yarn=2", strings.NewReader(string(body)))
+	r.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	handleCopy(rec, r)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected a multi-source yarn copy to be rejected, got %d", rec.Code)
+	}
+}
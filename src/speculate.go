@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/briansterle/cluster-fastcopy/pkg/fastcopy"
+)
+
+// with speculate=true a file still being sent once it took speculateFactor times as long as the median throughput
+// of the job's finished files predicts is sent a second time, and the first attempt to finish is kept. the target
+// writes the second attempt into a partial file of its own, so the two don't clash until one is renamed into place
+
+// a transfer is a straggler once it takes this many times the expected duration, unless speculateFactor says otherwise
+const DefaultSpeculationFactor = 3
+
+// transfers running for less are never speculated on
+const speculationMinElapsed = 30 * time.Second
+
+// files the job must have finished before the median throughput is trusted
+const speculationMinSamples = 5
+
+// the engine's speculation settings for the job, nil without speculate=true
+func speculation(opts CopyOptions) *fastcopy.Speculation {
+	if !opts.Speculate {
+		return nil
+	}
+	return &fastcopy.Speculation{Factor: opts.SpeculateFactor, MinElapsed: speculationMinElapsed, MinSamples: speculationMinSamples}
+}
+
+// parses the speculateFactor param
+func parseSpeculateFactor(q url.Values) (float64, error) {
+	v := q.Get("speculateFactor")
+	if v == "" {
+		return DefaultSpeculationFactor, nil
+	}
+	factor, err := strconv.ParseFloat(v, 64)
+	if err != nil || factor <= 1 {
+		return 0, fmt.Errorf("'speculateFactor' must be a number greater than 1, got '%s'", v)
+	}
+	return factor, nil
+}
+
+// the hidden sibling of the file at path a speculative attempt at an upload is written into
+func speculativePath(path string, attempt int) string {
+	return filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.fastcopy-attempt-%d", filepath.Base(path), attempt))
+}
+
+// parses the attempt param of an upload, 0 for the first attempt
+func parseAttempt(q url.Values) (int, error) {
+	v := q.Get("attempt")
+	if v == "" {
+		return 0, nil
+	}
+	attempt, err := strconv.Atoi(v)
+	if err != nil || attempt < 0 {
+		return 0, fmt.Errorf("'attempt' must be a non-negative integer, got '%s'", v)
+	}
+	return attempt, nil
+}
+
+// writes a speculative attempt at to/fileName. unlike the first attempt's partial file, a failed one isn't resumed
+// and is removed
+func writeSpeculative(to string, fileName string, data io.ReadCloser, attempt int) (UploadResponse, error) {
+	path := filepath.Join(to, fileName)
+	partial := speculativePath(path, attempt)
+	res, err := writeThrough(to, path, partial, data)
+	if err != nil {
+		GetHdfsClient().Remove(partial)
+	}
+	return res, err
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestSpeculativeUpload(t *testing.T) {
+	fs := useMemFS(t)
+	fs.MkdirAll("/dst", 0755)
+	fs.put(map[string]string{"/dst/.a.txt.fastcopy-partial": "the first attempt"})
+
+	rec := httptest.NewRecorder()
+	handleUpload(rec, httptest.NewRequest("POST", "/upload?to=/dst&fileName=a.txt&attempt=1", strings.NewReader("hello")))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if written, _ := fs.get("/dst/a.txt"); written != "hello" {
+		t.Errorf("expected the speculative attempt to be moved into place, got %q", written)
+	}
+	if partial, _ := fs.get("/dst/.a.txt.fastcopy-partial"); partial != "the first attempt" {
+		t.Errorf("expected the first attempt's partial file to be left alone, got %q", partial)
+	}
+
+	body := io.MultiReader(strings.NewReader("hel"), iotest.ErrReader(errors.New("another attempt finished first")))
+	if _, err := writeSpeculative("/dst", "b.txt", io.NopCloser(body), 1); err == nil {
+		t.Fatal("expected the cancelled attempt to fail")
+	}
+	if _, ok := fs.get("/dst/.b.txt.fastcopy-attempt-1"); ok {
+		t.Error("expected the cancelled attempt's partial file to be removed")
+	}
+}
+
+func TestSpeculateOptions(t *testing.T) {
+	for query, ok := range map[string]bool{
+		"speculate=true":                     true,
+		"speculate=true&speculateFactor=1.5": true,
+		"speculate=true&speculateFactor=1":   false,
+		"speculate=true&resume=true":         false,
+		"speculate=true&delta=true":          false,
+	} {
+		opts, err := parseCopyOptions(httptest.NewRequest("POST", "/copy?"+query, nil))
+		if (err == nil) != ok {
+			t.Errorf("%s: expected ok=%v, got %v", query, ok, err)
+		}
+		if ok && speculation(opts) == nil {
+			t.Errorf("%s: expected speculation to be enabled", query)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// the result of swapping a staging=true copy into place
+type SwapResponse struct {
+	Path     string `json:"path"`
+	Previous string `json:"previous,omitempty"` // where the replaced version was moved aside to
+}
+
+// the hidden sibling of 'to' a staging=true copy writes into before it's swapped in
+func stagingPath(to string, id string) string {
+	to = filepath.Clean(to)
+	return filepath.Join(filepath.Dir(to), "."+filepath.Base(to)+".fastcopy-staging-"+id)
+}
+
+// the hidden sibling the version of 'to' replaced by a swap is moved aside to
+func previousPath(to string, now time.Time) string {
+	to = filepath.Clean(to)
+	return filepath.Join(filepath.Dir(to), "."+filepath.Base(to)+".fastcopy-previous-"+now.UTC().Format("20060102T150405Z"))
+}
+
+// moves 'to' aside if it exists and renames 'staging' over it, so readers see either the old or the new version.
+// returns where the old version went, "" if there was none
+func swapDir(client FileSystem, staging string, to string, now time.Time) (string, error) {
+	var previous string
+	if _, err := client.Stat(to); err == nil {
+		previous = previousPath(to, now)
+		if err := client.Rename(to, previous); err != nil {
+			return "", fmt.Errorf("cannot move %s aside: %w", to, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("cannot stat %s: %w", to, err)
+	}
+	if err := client.Rename(staging, to); err != nil {
+		if previous != "" {
+			client.Rename(previous, to) // put the old version back
+		}
+		return "", fmt.Errorf("cannot rename %s to %s: %w", staging, to, err)
+	}
+	return previous, nil
+}
+
+// Swaps the staging dir provided by 'from' into its destination 'to', moving the current 'to' aside
+func handleSwap(w http.ResponseWriter, r *http.Request) {
+	from := r.URL.Query().Get("from")
+	to := r.URL.Query().Get("to")
+	if from == "" || to == "" {
+		writeError(w, "'from' and 'to' query params must be provided.", http.StatusBadRequest)
+		return
+	}
+	if err := errors.Join(confinePath("from", from), confinePath("to", to)); err != nil {
+		writeConfineError(w, err)
+		return
+	}
+	// only staging dirs of 'to' may be swapped in, this is not a general rename
+	if prefix := stagingPath(to, ""); filepath.Clean(from) == prefix || !strings.HasPrefix(filepath.Clean(from), prefix) {
+		writeError(w, fmt.Sprintf("%s is not a staging dir of %s", from, to), http.StatusBadRequest)
+		return
+	}
+	if err := checkWriteOnceSwap(GetHdfsClient(), to); err != nil {
+		writeWriteOnceError(w, err)
+		return
+	}
+	previous, err := swapDir(GetHdfsClient(), from, to, time.Now())
+	if err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json, _ := json.Marshal(SwapResponse{Path: to, Previous: previous})
+	w.Write(json)
+}
+
+// asks the peer to swap the staging dir into 'to'
+func requestSwap(targetURL string, staging string, to string) (SwapResponse, error) {
+	var swap SwapResponse
+	resp, err := httpClient.Post(peerURL(targetURL, "/swap", url.Values{"from": {staging}, "to": {to}}), "application/octet-stream", nil)
+	if err != nil {
+		return swap, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode != http.StatusOK {
+		return swap, fmt.Errorf("swap failed with %s: %s", resp.Status, peerErrorMessage(body))
+	}
+	err = json.Unmarshal(body, &swap)
+	return swap, err
+}
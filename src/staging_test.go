@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestStagingPaths(t *testing.T) {
+	if got := stagingPath("/data/events/", "abc"); got != "/data/.events.fastcopy-staging-abc" {
+		t.Errorf("unexpected staging path %s", got)
+	}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	if got := previousPath("/data/events", now); got != "/data/.events.fastcopy-previous-20240301T120000Z" {
+		t.Errorf("unexpected previous path %s", got)
+	}
+}
+
+func TestSwapDir(t *testing.T) {
+	fs := useMemFS(t)
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	fs.put(map[string]string{"/data/.events.fastcopy-staging-a/part-00000": "v1"})
+	previous, err := swapDir(fs, "/data/.events.fastcopy-staging-a", "/data/events", now)
+	if err != nil || previous != "" {
+		t.Fatalf("expected a first swap without a previous version, got '%s' %v", previous, err)
+	}
+	if data, _ := fs.get("/data/events/part-00000"); data != "v1" {
+		t.Error("expected the staged files in place")
+	}
+
+	fs.put(map[string]string{"/data/.events.fastcopy-staging-b/part-00000": "v2"})
+	previous, err = swapDir(fs, "/data/.events.fastcopy-staging-b", "/data/events", now)
+	if err != nil || previous != previousPath("/data/events", now) {
+		t.Fatalf("expected the old version moved aside, got '%s' %v", previous, err)
+	}
+	if data, _ := fs.get("/data/events/part-00000"); data != "v2" {
+		t.Error("expected the new version in place")
+	}
+	if data, _ := fs.get(previous + "/part-00000"); data != "v1" {
+		t.Error("expected the old version kept aside")
+	}
+	if _, err := fs.Stat("/data/.events.fastcopy-staging-b"); err == nil {
+		t.Error("expected the staging dir to be gone")
+	}
+
+	if _, err := swapDir(fs, "/data/.events.fastcopy-staging-missing", "/data/events", now.Add(time.Hour)); err == nil {
+		t.Error("expected swapping in a missing staging dir to fail")
+	}
+	if data, _ := fs.get("/data/events/part-00000"); data != "v2" {
+		t.Error("expected a failed swap to put the current version back")
+	}
+}
+
+func TestHandleSwapOnlySwapsStagingDirs(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{"/data/other/part-00000": "x", "/data/.events.fastcopy-staging-a/part-00000": "y"})
+	for _, from := range []string{"/data/other", "/data/.events.fastcopy-staging-", "/elsewhere/.events.fastcopy-staging-a"} {
+		rec := httptest.NewRecorder()
+		handleSwap(rec, httptest.NewRequest("POST", "/swap?"+url.Values{"from": {from}, "to": {"/data/events"}}.Encode(), nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("expected swapping %s to be rejected, got %d", from, rec.Code)
+		}
+	}
+	rec := httptest.NewRecorder()
+	handleSwap(rec, httptest.NewRequest("POST", "/swap?"+url.Values{"from": {"/data/.events.fastcopy-staging-a"}, "to": {"/data/events"}}.Encode(), nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected the swap to succeed, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestCopyStaging(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{"/src/part-00000": "new", "/dst/part-00000": "old", "/dst/part-00001": "old"})
+
+	peer := http.NewServeMux()
+	peer.HandleFunc("/ready", handleReady)
+	peer.HandleFunc("/ls", handleLs)
+	peer.HandleFunc("/upload", handleUpload)
+	peer.HandleFunc("/swap", handleSwap)
+	server := httptest.NewServer(peer)
+	defer server.Close()
+
+	query := url.Values{"from": {"/src"}, "to": {"/dst"}, "targetURL": {server.URL + "/upload"}, "staging": {"true"}, "writeSuccess": {"true"}}
+	rec := httptest.NewRecorder()
+	handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var resp CopyResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Previous == "" || resp.Staging == "" {
+		t.Errorf("expected the staging dir and previous version in the response, got %+v", resp)
+	}
+	if data, _ := fs.get("/dst/part-00000"); data != "new" {
+		t.Error("expected the new version in place")
+	}
+	if _, ok := fs.get("/dst/part-00001"); ok {
+		t.Error("expected files only in the old version to be swapped out")
+	}
+	if _, ok := fs.get("/dst/" + SuccessMarker); !ok {
+		t.Error("expected the success marker to be swapped in with the files")
+	}
+	if data, _ := fs.get(resp.Previous + "/part-00001"); data != "old" {
+		t.Error("expected the old version kept aside")
+	}
+
+	query.Set("delta", "true")
+	rec = httptest.NewRecorder()
+	handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected staging with delta to be rejected, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/colinmarc/hdfs/v2/hadoopconf"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+)
+
+// checks the configuration from env without touching the cluster. returns every problem found, joined
+func validateConfig() error {
+	var problems []error
+	if os.Getenv("HDFS_NAMENODE") == "" {
+		problems = append(problems, validateHadoopConf()...)
+	}
+	if os.Getenv("KRB_ENABLED") == "true" {
+		problems = append(problems, validateKerberos()...)
+	}
+	if spec := os.Getenv("FASTCOPY_BANDWIDTH_SCHEDULE"); spec != "" {
+		if _, err := parseBandwidthSchedule(spec); err != nil {
+			problems = append(problems, fmt.Errorf("invalid FASTCOPY_BANDWIDTH_SCHEDULE: %w", err))
+		}
+	}
+	if spec := os.Getenv("FASTCOPY_MAX_INFLIGHT_BYTES"); spec != "" {
+		if max, err := parseByteSize(spec); err != nil || max == 0 {
+			problems = append(problems, fmt.Errorf("invalid FASTCOPY_MAX_INFLIGHT_BYTES '%s'", spec))
+		}
+	}
+	if v := os.Getenv("FASTCOPY_BREAKER_THRESHOLD"); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n < 1 {
+			problems = append(problems, fmt.Errorf("invalid FASTCOPY_BREAKER_THRESHOLD '%s', expected a positive integer", v))
+		}
+	}
+	if v := os.Getenv("FASTCOPY_BREAKER_COOLDOWN"); v != "" {
+		if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+			problems = append(problems, fmt.Errorf("invalid FASTCOPY_BREAKER_COOLDOWN '%s', expected a duration like 30s", v))
+		}
+	}
+	if v, err := secretEnv("FASTCOPY_ALERT_WEBHOOK"); err != nil {
+		problems = append(problems, err)
+	} else if v != "" {
+		if u, err := url.Parse(v); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Errorf("invalid FASTCOPY_ALERT_WEBHOOK '%s', expected an http(s) url", os.Getenv("FASTCOPY_ALERT_WEBHOOK")))
+		}
+	}
+	if _, err := keytabPollInterval(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := loadReadAhead(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := loadContentTypes(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := loadSourceCache(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := loadYarnSettings(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := loadLogSettings(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := loadDedupCache(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := loadHdfsClientSettings(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := loadIPPreference(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := loadDrainSettings(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := loadDatasets(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := loadApprovalPolicy(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := loadEgressRates(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := loadHdfsClients(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := loadTemplates(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := loadWebhcatSettings(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := loadQuarantineDir(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := loadTargetLimits(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := loadRequestMetadata(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := loadUploadRoot(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := loadWriteOnce(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := loadRetentionSettings(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := loadExpirations(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := loadReceiptKey(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := loadNamenodeGateSettings(); err != nil {
+		problems = append(problems, err)
+	}
+	if err := loadKeyring(); err != nil {
+		problems = append(problems, fmt.Errorf("invalid encryption keys: %w", err))
+	}
+	return errors.Join(problems...)
+}
+
+// the hadoop conf must name at least one namenode when HDFS_NAMENODE isn't set
+func validateHadoopConf() []error {
+	dir := os.Getenv("HADOOP_CONF_DIR")
+	if dir == "" && os.Getenv("HADOOP_HOME") == "" {
+		return []error{errors.New("neither HDFS_NAMENODE nor HADOOP_CONF_DIR is set, don't know which cluster to connect to")}
+	}
+	if dir != "" {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return []error{fmt.Errorf("HADOOP_CONF_DIR=%s is not a readable directory", dir)}
+		}
+	}
+	conf, err := hadoopconf.LoadFromEnvironment()
+	if err != nil {
+		return []error{fmt.Errorf("cannot parse the hadoop conf: %w", err)}
+	}
+	if len(conf.Namenodes()) == 0 {
+		return []error{errors.New("the hadoop conf has no namenodes, check fs.defaultFS in core-site.xml and dfs.namenode.rpc-address in hdfs-site.xml")}
+	}
+	return nil
+}
+
+// KRB_ENABLED=true needs a principal, a parseable keytab holding its keys and a krb5.conf or KRB_KDC
+func validateKerberos() []error {
+	var problems []error
+	user, realm := os.Getenv("KRB_USER"), os.Getenv("KRB_REALM")
+	if user == "" || realm == "" {
+		problems = append(problems, errors.New("KRB_ENABLED=true needs KRB_USER and KRB_REALM"))
+	}
+	if path, err := keytabPath(); err != nil {
+		problems = append(problems, err)
+	} else if path == "" {
+		problems = append(problems, errors.New("KRB_ENABLED=true needs KRB_KEYTAB"))
+	} else if kt, err := keytab.Load(path); err != nil {
+		problems = append(problems, fmt.Errorf("cannot read keytab KRB_KEYTAB=%s: %w", path, err))
+	} else if user != "" && realm != "" && !keytabHasPrincipal(kt, user+"@"+realm) {
+		problems = append(problems, fmt.Errorf("keytab %s has no key for %s@%s", path, user, realm))
+	}
+	if _, err := loadKrb5Conf(); err != nil {
+		problems = append(problems, err)
+	}
+	return problems
+}
+
+func keytabHasPrincipal(kt *keytab.Keytab, principal string) bool {
+	for _, e := range kt.Entries {
+		if e.Principal.String() == principal {
+			return true
+		}
+	}
+	return false
+}
+
+// kdc error codes and communication failures, with what usually causes them
+var kerberosHints = []struct{ match, hint string }{
+	{"KDC_ERR_C_PRINCIPAL_UNKNOWN", "the principal doesn't exist in the realm, check KRB_USER and KRB_REALM"},
+	{"KDC_ERR_PREAUTH_FAILED", "the keytab's key doesn't match the kdc's, the keytab may predate a password change or key rotation (kvno)"},
+	{"KDC_ERR_ETYPE_NOSUPP", "the keytab has no key of an encryption type the kdc accepts, check the keytab's enctypes against the kdc's"},
+	{"KDC_ERR_CLIENT_REVOKED", "the principal is disabled or locked on the kdc"},
+	{"KRB_AP_ERR_SKEW", "this host's clock is too far off the kdc's, check ntp"},
+	{"KDC_ERR_WRONG_REALM", "the kdc serves another realm, check KRB_REALM"},
+	{"communicat", "no kdc could be reached, check the realm's kdc entries in the kerberos config or KRB_KDC and the network path to port 88"},
+	{"error sending to", "no kdc could be reached, check the realm's kdc entries in the kerberos config or KRB_KDC and the network path to port 88"},
+	{"TCP connection", "no kdc could be reached, check the realm's kdc entries in the kerberos config or KRB_KDC and the network path to port 88"},
+}
+
+// the likely cause of a failed kerberos login, or "" if unknown
+func kerberosHint(err error) string {
+	for _, h := range kerberosHints {
+		if strings.Contains(err.Error(), h.match) {
+			return h.hint
+		}
+	}
+	return ""
+}
+
+// logs in to the kdc with KRB_USER and KRB_KEYTAB, an actual AS exchange, so credential mistakes surface at
+// startup rather than on the first request
+func verifyKerberos() error {
+	principal := os.Getenv("KRB_USER") + "@" + os.Getenv("KRB_REALM")
+	krb, err := makeKerberosClient()
+	if err != nil {
+		return err
+	}
+	defer krb.Destroy()
+	if err := krb.Login(); err != nil {
+		path, _ := keytabPath()
+		err = fmt.Errorf("kerberos login of %s with keytab %s failed: %w", principal, path, err)
+		if hint := kerberosHint(err); hint != "" {
+			err = fmt.Errorf("%w\nlikely cause: %s", err, hint)
+		}
+		return err
+	}
+	log.Printf("kerberos login of %s succeeded", principal)
+	return nil
+}
+
+// validates the configuration and checks the namenode is reachable. with KRB_ENABLED=true and
+// FASTCOPY_VERIFY_KERBEROS=true the credentials are first checked against the kdc
+func validateStartup() error {
+	if err := validateConfig(); err != nil {
+		return err
+	}
+	if os.Getenv("KRB_ENABLED") == "true" && os.Getenv("FASTCOPY_VERIFY_KERBEROS") == "true" {
+		if err := verifyKerberos(); err != nil {
+			return err
+		}
+	}
+	client, err := newHdfsClient()
+	if err != nil {
+		return err
+	}
+	if _, err := client.Stat("/"); err != nil {
+		client.Close()
+		return fmt.Errorf("namenode unreachable: %w", err)
+	}
+	swapHdfsClient(client)
+	return nil
+}
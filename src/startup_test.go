@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+)
+
+func TestValidateConfig(t *testing.T) {
+	t.Setenv("HDFS_NAMENODE", "")
+	t.Setenv("HADOOP_HOME", "")
+	t.Setenv("HADOOP_CONF_DIR", filepath.Join(t.TempDir(), "missing"))
+	t.Setenv("KRB_ENABLED", "true")
+	t.Setenv("KRB_USER", "fastcopy")
+	t.Setenv("KRB_REALM", "")
+	t.Setenv("KRB_KEYTAB", filepath.Join(t.TempDir(), "fastcopy.keytab"))
+	t.Setenv("FASTCOPY_MAX_INFLIGHT_BYTES", "lots")
+	t.Setenv("FASTCOPY_BREAKER_COOLDOWN", "30")
+
+	err := validateConfig()
+	if err == nil {
+		t.Fatal("expected invalid configuration to be rejected")
+	}
+	for _, expected := range []string{"HADOOP_CONF_DIR", "KRB_REALM", "cannot read keytab", "FASTCOPY_MAX_INFLIGHT_BYTES", "FASTCOPY_BREAKER_COOLDOWN"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected a problem mentioning %s, got:\n%s", expected, err)
+		}
+	}
+}
+
+func TestValidateConfigLocal(t *testing.T) {
+	t.Setenv("HDFS_NAMENODE", "localhost:9000")
+	t.Setenv("KRB_ENABLED", "")
+	for _, env := range []string{"FASTCOPY_BANDWIDTH_SCHEDULE", "FASTCOPY_MAX_INFLIGHT_BYTES", "FASTCOPY_BREAKER_THRESHOLD", "FASTCOPY_BREAKER_COOLDOWN"} {
+		t.Setenv(env, "")
+	}
+	if err := validateConfig(); err != nil {
+		t.Errorf("expected local namenode configuration to be valid, got %s", err)
+	}
+}
+
+func TestLoadKrb5Conf(t *testing.T) {
+	t.Setenv("KRB_REALM", "EXAMPLE.COM")
+	t.Setenv("KRB_KDC", "kdc1.example.com:88, kdc2.example.com")
+	conf, err := loadKrb5Conf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, kdcs, err := conf.GetKDCs("EXAMPLE.COM", true)
+	if err != nil || len(kdcs) != 2 || conf.LibDefaults.DefaultRealm != "EXAMPLE.COM" {
+		t.Errorf("expected the inline realm with 2 kdcs, got %v %v", kdcs, err)
+	}
+
+	t.Setenv("KRB_KDC", "")
+	path := filepath.Join(t.TempDir(), "krb5.conf")
+	t.Setenv("KRB5_CONFIG", path)
+	if _, err := loadKrb5Conf(); err == nil || !strings.Contains(err.Error(), path) {
+		t.Errorf("expected a missing KRB5_CONFIG to be reported, got %v", err)
+	}
+	if err := os.WriteFile(path, []byte(inlineKrb5Conf("OTHER.ORG", map[string][]string{"OTHER.ORG": {"kdc.other.org"}}, nil)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if conf, err := loadKrb5Conf(); err != nil || conf.LibDefaults.DefaultRealm != "OTHER.ORG" {
+		t.Errorf("expected the config from KRB5_CONFIG, got %v", err)
+	}
+}
+
+func TestLoadKrb5ConfWithTrustedRealms(t *testing.T) {
+	t.Setenv("KRB_REALM", "A.EXAMPLE.COM")
+	t.Setenv("KRB_KDC", "kdc.a.example.com")
+	t.Setenv("KRB_REALMS", "B.EXAMPLE.COM=kdc1.b.example.com:88|kdc2.b.example.com; C.EXAMPLE.COM=kdc.c.example.com")
+	t.Setenv("KRB_DOMAIN_REALMS", ".b.example.com=B.EXAMPLE.COM, nn1.c.example.com=C.EXAMPLE.COM")
+	conf, err := loadKrb5Conf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, kdcs, err := conf.GetKDCs("B.EXAMPLE.COM", true); err != nil || len(kdcs) != 2 {
+		t.Errorf("expected 2 kdcs for the trusted realm, got %v %v", kdcs, err)
+	}
+	for host, realm := range map[string]string{"nn1.b.example.com": "B.EXAMPLE.COM", "nn1.c.example.com": "C.EXAMPLE.COM", "nn2.c.example.com": "A.EXAMPLE.COM"} {
+		if got := conf.ResolveRealm(host); got != realm {
+			t.Errorf("expected %s in %s, got %s", host, realm, got)
+		}
+	}
+
+	t.Setenv("KRB_REALMS", "B.EXAMPLE.COM=")
+	if _, err := loadKrb5Conf(); err == nil || !strings.Contains(err.Error(), "KRB_REALMS") {
+		t.Errorf("expected a realm without kdcs to be rejected, got %v", err)
+	}
+	t.Setenv("KRB_REALMS", "")
+	t.Setenv("KRB_KDC", "")
+	if _, err := loadKrb5Conf(); err == nil || !strings.Contains(err.Error(), "need KRB_KDC") {
+		t.Errorf("expected domain mappings without an inline config to be rejected, got %v", err)
+	}
+}
+
+func TestVerifyKerberos(t *testing.T) {
+	kt := keytab.New()
+	if err := kt.AddEntry("fastcopy", "EXAMPLE.COM", "secret", time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := kt.Marshal()
+	path := filepath.Join(t.TempDir(), "fastcopy.keytab")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KRB_USER", "fastcopy")
+	t.Setenv("KRB_REALM", "EXAMPLE.COM")
+	t.Setenv("KRB_KEYTAB", path)
+	t.Setenv("KRB_KDC", "127.0.0.1:1")
+	err := verifyKerberos()
+	if err == nil {
+		t.Fatal("expected the login to fail without a kdc")
+	}
+	for _, expected := range []string{"fastcopy@EXAMPLE.COM", path, "no kdc could be reached"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected the error to mention %s, got:\n%s", expected, err)
+		}
+	}
+}
+
+func TestKerberosHint(t *testing.T) {
+	err := errors.New("KRB Error: (24) KDC_ERR_PREAUTH_FAILED Pre-authentication information was invalid")
+	if hint := kerberosHint(err); !strings.Contains(hint, "kvno") {
+		t.Errorf("unexpected hint '%s'", hint)
+	}
+	if hint := kerberosHint(errors.New("something else")); hint != "" {
+		t.Errorf("expected no hint, got '%s'", hint)
+	}
+}
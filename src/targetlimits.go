@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FASTCOPY_TARGET_LIMITS caps the throughput and the concurrent streams sent to a destination host across every
+// job of the server, e.g. dr-site-a=2Gbps/32,dr-site-b:8080=500Mbps. a limit names a host, or a host and port
+// to tell apart peers sharing a host; the throughput (or unlimited) comes first, the streams after the slash.
+// the limits apply on top of FASTCOPY_BANDWIDTH_SCHEDULE, which caps the sum of all targets
+
+// the ceilings of one destination host
+type targetLimit struct {
+	host      string
+	mbps      float64 // 0 means unlimited
+	streams   int     // 0 means unlimited
+	bandwidth *bandwidthLimiter
+	slots     chan struct{}
+}
+
+func newTargetLimit(host string, mbps float64, streams int) *targetLimit {
+	l := &targetLimit{host: host, mbps: mbps, streams: streams}
+	if mbps > 0 {
+		l.bandwidth = newBandwidthLimiter([]bandwidthWindow{{0, 24 * 60, mbps}})
+	}
+	if streams > 0 {
+		l.slots = make(chan struct{}, streams)
+	}
+	return l
+}
+
+// blocks until a stream to the host may start, the returned func ends it
+func (l *targetLimit) acquire() func() {
+	if l.slots == nil {
+		return func() {}
+	}
+	l.slots <- struct{}{}
+	return func() { <-l.slots }
+}
+
+// the streams to the host in flight
+func (l *targetLimit) inUse() int {
+	return len(l.slots)
+}
+
+var (
+	targetLimits     map[string]*targetLimit
+	targetLimitsOnce sync.Once
+)
+
+// parses FASTCOPY_TARGET_LIMITS into the limits by host
+func loadTargetLimits() (map[string]*targetLimit, error) {
+	limits := make(map[string]*targetLimit)
+	spec := os.Getenv("FASTCOPY_TARGET_LIMITS")
+	if spec == "" {
+		return limits, nil
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		host, limit, ok := strings.Cut(entry, "=")
+		if !ok || host == "" {
+			return nil, fmt.Errorf("invalid FASTCOPY_TARGET_LIMITS entry '%s', expected host=<N>Mbps/<streams>", entry)
+		}
+		rate, streamsSpec, hasStreams := strings.Cut(limit, "/")
+		mbps, err := parseMbps(rate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid FASTCOPY_TARGET_LIMITS entry '%s': %w", entry, err)
+		}
+		var streams int
+		if hasStreams {
+			if streams, err = strconv.Atoi(strings.TrimSpace(streamsSpec)); err != nil || streams < 1 {
+				return nil, fmt.Errorf("invalid FASTCOPY_TARGET_LIMITS entry '%s', streams must be a positive integer", entry)
+			}
+		}
+		host = strings.ToLower(host)
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = strings.Trim(host, "[]") // matched against the url's hostname, without brackets
+		}
+		if _, ok := limits[host]; ok {
+			return nil, fmt.Errorf("FASTCOPY_TARGET_LIMITS limits %s more than once", host)
+		}
+		limits[host] = newTargetLimit(host, mbps, streams)
+	}
+	return limits, nil
+}
+
+// lazy loads the limits by destination host
+func getTargetLimits() map[string]*targetLimit {
+	targetLimitsOnce.Do(func() {
+		limits, err := loadTargetLimits()
+		if err != nil {
+			log.Fatal(err)
+		}
+		targetLimits = limits
+	})
+	return targetLimits
+}
+
+// the limit of the host targetURL points to, the one naming its port first, nil if it has none
+func targetLimitFor(targetURL string) *targetLimit {
+	limits := getTargetLimits()
+	if len(limits) == 0 {
+		return nil
+	}
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return nil
+	}
+	if l, ok := limits[strings.ToLower(u.Host)]; ok {
+		return l
+	}
+	return limits[strings.ToLower(u.Hostname())]
+}
+
+// waits for a stream to the target's host, the returned func ends it
+func acquireTargetStream(targetURL string) func() {
+	if l := targetLimitFor(targetURL); l != nil {
+		return l.acquire()
+	}
+	return func() {}
+}
+
+// wraps a request body to the target so it's sent no faster than its host's limit
+func throttleTarget(r io.Reader, targetURL string) io.Reader {
+	if l := targetLimitFor(targetURL); l != nil && l.bandwidth != nil {
+		return &throttledReader{r, l.bandwidth}
+	}
+	return r
+}
+
+// the limited hosts in order, for /config and /metrics
+func sortedTargetLimits() []*targetLimit {
+	limits := getTargetLimits()
+	sorted := make([]*targetLimit, 0, len(limits))
+	for _, l := range limits {
+		sorted = append(sorted, l)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].host < sorted[j].host })
+	return sorted
+}
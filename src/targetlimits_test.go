@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func useTargetLimits(t *testing.T, spec string) {
+	t.Setenv("FASTCOPY_TARGET_LIMITS", spec)
+	limits, err := loadTargetLimits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetLimitsOnce.Do(func() {})
+	prev := targetLimits
+	targetLimits = limits
+	t.Cleanup(func() { targetLimits = prev })
+}
+
+func TestLoadTargetLimits(t *testing.T) {
+	useTargetLimits(t, "DR-Site-A=2Gbps/32, dr-site-b:8080=500Mbps, dr-site-b=unlimited/4")
+	if l := targetLimitFor("http://dr-site-a:8080/v1/upload"); l == nil || l.mbps != 2000 || l.streams != 32 {
+		t.Errorf("unexpected limit of dr-site-a %+v", l)
+	}
+	if l := targetLimitFor("http://dr-site-b:8080/upload"); l == nil || l.mbps != 500 || l.streams != 0 {
+		t.Errorf("expected the limit naming the port to win, got %+v", l)
+	}
+	if l := targetLimitFor("http://dr-site-b:9090/upload"); l == nil || l.streams != 4 {
+		t.Errorf("expected the limit of the host for another port, got %+v", l)
+	}
+	if l := targetLimitFor("http://elsewhere/upload"); l != nil {
+		t.Errorf("expected no limit for an unlisted host, got %+v", l)
+	}
+
+	for _, spec := range []string{"dr-site-a", "dr-site-a=fast", "dr-site-a=1Gbps/0", "a=1Gbps,a=2Gbps"} {
+		t.Setenv("FASTCOPY_TARGET_LIMITS", spec)
+		if _, err := loadTargetLimits(); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
+
+func TestTargetStreamLimit(t *testing.T) {
+	var inFlight, most int32
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+				break
+			}
+		}
+		io.Copy(io.Discard, r.Body)
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte(`{"path":"/dst/a","written":1}`))
+	}))
+	defer peer.Close()
+	useTargetLimits(t, strings.TrimPrefix(peer.URL, "http://")+"=unlimited/2")
+
+	// the streams of several jobs share the limit
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := send(strings.NewReader("a"), peer.URL+"/upload", CopyArgs{File: "a", To: "/dst", Size: 1}, CopyOptions{}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if most != 2 {
+		t.Errorf("expected at most 2 streams at once to the host, got %d", most)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// admins keep the params of transfers run often, e.g. their target, filters, throttles and verification, as
+// named templates under /templates, and callers copy with template=<name> plus a few params of their own.
+// with FASTCOPY_TEMPLATES set the templates are kept in that file across restarts
+
+// a reusable set of /copy params
+type CopyTemplate struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Params      map[string]string `json:"params"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Locked      []string          `json:"locked,omitempty"` // params callers can't override
+	UpdatedAt   time.Time         `json:"updatedAt"`
+}
+
+// params a template can't set, they identify a single job
+var templateForbiddenParams = []string{"template", "jobId", "label"}
+
+type templateStore struct {
+	mu        sync.Mutex
+	path      string // empty when the templates only live in memory
+	templates map[string]CopyTemplate
+}
+
+var (
+	templates     *templateStore
+	templatesOnce sync.Once
+)
+
+// reads the templates kept in FASTCOPY_TEMPLATES, if it's set
+func loadTemplates() (*templateStore, error) {
+	s := &templateStore{path: os.Getenv("FASTCOPY_TEMPLATES"), templates: make(map[string]CopyTemplate)}
+	if s.path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+			return nil, fmt.Errorf("cannot create the dir of FASTCOPY_TEMPLATES: %w", err)
+		}
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read FASTCOPY_TEMPLATES: %w", err)
+	}
+	var list []CopyTemplate
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("invalid FASTCOPY_TEMPLATES %s: %w", s.path, err)
+	}
+	for _, t := range list {
+		if err := validateTemplate(t); err != nil {
+			return nil, fmt.Errorf("invalid template in FASTCOPY_TEMPLATES: %w", err)
+		}
+		s.templates[t.Name] = t
+	}
+	return s, nil
+}
+
+// lazy loads the templates
+func getTemplates() *templateStore {
+	templatesOnce.Do(func() {
+		s, err := loadTemplates()
+		if err != nil {
+			log.Fatal(err)
+		}
+		templates = s
+	})
+	return templates
+}
+
+func (s *templateStore) get(name string) (CopyTemplate, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.templates[name]
+	return t, ok
+}
+
+// the templates sorted by name
+func (s *templateStore) list() []CopyTemplate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]CopyTemplate, 0, len(s.templates))
+	for _, name := range sortedKeys(s.templates) {
+		list = append(list, s.templates[name])
+	}
+	return list
+}
+
+// adds or replaces the template, nil deletes it. the file is rewritten before the change is visible
+func (s *templateStore) set(name string, t *CopyTemplate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, existed := s.templates[name]
+	if t == nil {
+		delete(s.templates, name)
+	} else {
+		s.templates[name] = *t
+	}
+	if err := s.save(); err != nil {
+		if existed {
+			s.templates[name] = prev
+		} else {
+			delete(s.templates, name)
+		}
+		return err
+	}
+	return nil
+}
+
+// writes the templates to the file, if there is one
+func (s *templateStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	list := make([]CopyTemplate, 0, len(s.templates))
+	for _, name := range sortedKeys(s.templates) {
+		list = append(list, s.templates[name])
+	}
+	data, _ := json.MarshalIndent(list, "", "  ")
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("cannot save FASTCOPY_TEMPLATES: %w", err)
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// checks the template's name and that its params make a valid copy
+func validateTemplate(t CopyTemplate) error {
+	if t.Name == "" || strings.ContainsAny(t.Name, "/?&= ") {
+		return fmt.Errorf("'%s' is not a valid template name", t.Name)
+	}
+	for _, p := range templateForbiddenParams {
+		if _, ok := t.Params[p]; ok {
+			return fmt.Errorf("template %s can't set '%s'", t.Name, p)
+		}
+	}
+	q := url.Values{}
+	for k, v := range t.Params {
+		q.Set(k, v)
+	}
+	for _, p := range t.Locked {
+		if _, ok := t.Params[p]; !ok {
+			return fmt.Errorf("template %s locks '%s' without setting it", t.Name, p)
+		}
+	}
+	if _, err := parseCopyOptions(&http.Request{URL: &url.URL{RawQuery: q.Encode()}}); err != nil {
+		return fmt.Errorf("template %s: %w", t.Name, err)
+	}
+	return nil
+}
+
+// merges the params of the template named by r's 'template' param into its query, the caller's own params taking
+// precedence over all but the template's locked ones. returns the http status to fail with
+func applyTemplate(r *http.Request) (int, error) {
+	q := r.URL.Query()
+	name := q.Get("template")
+	if name == "" {
+		return http.StatusOK, nil
+	}
+	t, ok := getTemplates().get(name)
+	if !ok {
+		return http.StatusNotFound, fmt.Errorf("template %s not found", name)
+	}
+	for _, p := range t.Locked {
+		if v, ok := q[p]; ok && (len(v) != 1 || v[0] != t.Params[p]) {
+			return http.StatusBadRequest, fmt.Errorf("'%s' is locked to '%s' by template %s", p, t.Params[p], name)
+		}
+		if isJSONRequest(r) && (p == "from" || p == "to" || p == "targetURL") {
+			return http.StatusBadRequest, fmt.Errorf("template %s locks '%s', give it as a query param instead of in the JSON body", name, p)
+		}
+	}
+	for k, v := range t.Params {
+		if _, ok := q[k]; !ok {
+			q.Set(k, v)
+		}
+	}
+	labels := []string{"template=" + name}
+	for _, k := range sortedKeys(t.Labels) {
+		labels = append(labels, k+"="+t.Labels[k])
+	}
+	q["label"] = append(labels, q["label"]...) // the caller's labels win
+	r.URL.RawQuery = q.Encode()
+	return http.StatusOK, nil
+}
+
+// GET /templates lists the templates, GET, PUT (with the template as JSON) and DELETE /templates/{name} read,
+// define and remove one
+func handleTemplates(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/templates"), "/")
+	store := getTemplates()
+	if name == "" {
+		if r.Method != http.MethodGet {
+			writeError(w, "use GET, or PUT and DELETE on /templates/{name}", http.StatusMethodNotAllowed)
+			return
+		}
+		json, _ := json.MarshalIndent(store.list(), "", "  ")
+		w.Write(json)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		t, ok := store.get(name)
+		if !ok {
+			writeError(w, fmt.Sprintf("template %s not found", name), http.StatusNotFound)
+			return
+		}
+		json, _ := json.MarshalIndent(t, "", "  ")
+		w.Write(json)
+	case http.MethodPut:
+		var t CopyTemplate
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&t); err != nil {
+			writeError(w, fmt.Sprintf("invalid template: %s", err), http.StatusBadRequest)
+			return
+		}
+		if t.Name != "" && t.Name != name {
+			writeError(w, fmt.Sprintf("the template's name '%s' doesn't match the path", t.Name), http.StatusBadRequest)
+			return
+		}
+		t.Name, t.UpdatedAt = name, time.Now().UTC()
+		if err := validateTemplate(t); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := store.set(name, &t); err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Template %s defined: %v", name, t.Params)
+		json, _ := json.MarshalIndent(t, "", "  ")
+		w.Write(json)
+	case http.MethodDelete:
+		if _, ok := store.get(name); !ok {
+			writeError(w, fmt.Sprintf("template %s not found", name), http.StatusNotFound)
+			return
+		}
+		if err := store.set(name, nil); err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Template %s deleted", name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, "use GET, PUT or DELETE", http.StatusMethodNotAllowed)
+	}
+}
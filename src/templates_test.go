@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// keeps templates in a file under the test's temp dir for the duration of the test
+func useTemplates(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "templates.json")
+	t.Setenv("FASTCOPY_TEMPLATES", path)
+	s, err := loadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	templatesOnce.Do(func() {})
+	prev := templates
+	templates = s
+	t.Cleanup(func() { templates = prev })
+	return path
+}
+
+func putTemplate(name string, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handleTemplates(rec, httptest.NewRequest(http.MethodPut, "/templates/"+name, strings.NewReader(body)))
+	return rec
+}
+
+func TestTemplates(t *testing.T) {
+	useTemplates(t)
+	for body, status := range map[string]int{
+		`{"params":{"verifySample":"200%"}}`:              400,
+		`{"params":{"jobId":"x"}}`:                        400,
+		`{"params":{"to":"/dst"},"locked":["targetURL"]}`: 400,
+		`{"name":"other","params":{}}`:                    400,
+		`{"params":{"to":"/dst","skipHidden":"true"}}`:    200,
+	} {
+		if rec := putTemplate("nightly", body); rec.Code != status {
+			t.Errorf("%s: expected %d, got %d: %s", body, status, rec.Code, rec.Body)
+		}
+	}
+	putTemplate("adhoc", `{"params":{}}`)
+
+	rec := httptest.NewRecorder()
+	handleTemplates(rec, httptest.NewRequest(http.MethodGet, "/templates", nil))
+	var list []CopyTemplate
+	json.NewDecoder(rec.Body).Decode(&list)
+	if len(list) != 2 || list[0].Name != "adhoc" || list[1].Params["skipHidden"] != "true" || list[1].UpdatedAt.IsZero() {
+		t.Errorf("unexpected templates %+v", list)
+	}
+
+	reloaded, err := loadTemplates()
+	if err != nil || len(reloaded.templates) != 2 {
+		t.Errorf("expected the templates to be kept in FASTCOPY_TEMPLATES, got %+v %v", reloaded, err)
+	}
+
+	for _, method := range []string{http.MethodDelete, http.MethodGet} {
+		rec := httptest.NewRecorder()
+		handleTemplates(rec, httptest.NewRequest(method, "/templates/adhoc", nil))
+		if status := map[string]int{http.MethodDelete: 204, http.MethodGet: 404}[method]; rec.Code != status {
+			t.Errorf("%s: expected %d, got %d", method, status, rec.Code)
+		}
+	}
+}
+
+func TestCopyWithTemplate(t *testing.T) {
+	fs := useMemFS(t)
+	useTemplates(t)
+	fs.put(map[string]string{"/src/part-00000": "hello", "/src/.hidden": "x"})
+	peer := http.NewServeMux()
+	peer.HandleFunc("/ready", handleReady)
+	peer.HandleFunc("/ls", handleLs)
+	peer.HandleFunc("/upload", handleUpload)
+	server := httptest.NewServer(peer)
+	defer server.Close()
+
+	template := `{"params":{"targetURL":"` + server.URL + `/upload","to":"/dst","skipHidden":"true"},"labels":{"team":"data"},"locked":["targetURL"]}`
+	if rec := putTemplate("mirror", template); rec.Code != http.StatusOK {
+		t.Fatalf("expected the template to be defined, got %d: %s", rec.Code, rec.Body)
+	}
+	copy := func(query url.Values) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+		return rec
+	}
+
+	rec := copy(url.Values{"template": {"mirror"}, "from": {"/src"}, "to": {"/other"}, "label": {"team=ops"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var resp CopyResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp.FilesCopied != 1 || resp.To != "/other" || resp.Labels["template"] != "mirror" || resp.Labels["team"] != "ops" {
+		t.Errorf("expected the template's params with the caller's overrides, got %+v", resp)
+	}
+
+	if rec := copy(url.Values{"template": {"mirror"}, "from": {"/src"}, "targetURL": {"http://elsewhere/upload"}}); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected overriding a locked param to be rejected, got %d", rec.Code)
+	}
+	if rec := copy(url.Values{"template": {"missing"}, "from": {"/src"}}); rec.Code != http.StatusNotFound {
+		t.Errorf("expected an unknown template to answer 404, got %d", rec.Code)
+	}
+}
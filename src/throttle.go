@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a time of day window with a bandwidth limit. windows may wrap past midnight (e.g. 20:00-08:00)
+type bandwidthWindow struct {
+	start int     // minutes since midnight, inclusive
+	end   int     // minutes since midnight, exclusive
+	mbps  float64 // 0 means unlimited
+}
+
+func (bw bandwidthWindow) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if bw.start <= bw.end {
+		return m >= bw.start && m < bw.end
+	}
+	return m >= bw.start || m < bw.end
+}
+
+// parses a schedule like "08:00-20:00=50Mbps,20:00-08:00=unlimited".
+// times are in the server's local time zone and the first matching window wins
+func parseBandwidthSchedule(spec string) ([]bandwidthWindow, error) {
+	windows := make([]bandwidthWindow, 0)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		span, limit, ok := strings.Cut(entry, "=")
+		from, until, ok2 := strings.Cut(span, "-")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("malformed bandwidth window %q, expected HH:MM-HH:MM=<N>Mbps", entry)
+		}
+		start, err := parseClock(from)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseClock(until)
+		if err != nil {
+			return nil, err
+		}
+		mbps, err := parseMbps(limit)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, bandwidthWindow{start, end, mbps})
+	}
+	return windows, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func parseMbps(s string) (float64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "unlimited" || s == "0" {
+		return 0, nil
+	}
+	multiplier := 1.0
+	if strings.HasSuffix(s, "gbps") {
+		s, multiplier = strings.TrimSuffix(s, "gbps"), 1000
+	}
+	mbps, err := strconv.ParseFloat(strings.TrimSuffix(s, "mbps"), 64)
+	if err != nil || mbps < 0 {
+		return 0, fmt.Errorf("invalid bandwidth %q, expected <N>Mbps, <N>Gbps or unlimited", s)
+	}
+	return mbps * multiplier, nil
+}
+
+// token bucket shared by every transfer of the server. the rate is looked up from the
+// schedule on every reservation, so a window starting or ending applies to running jobs too
+type bandwidthLimiter struct {
+	mu       sync.Mutex
+	schedule []bandwidthWindow
+	tokens   float64
+	last     time.Time
+	now      func() time.Time
+}
+
+func newBandwidthLimiter(schedule []bandwidthWindow) *bandwidthLimiter {
+	return &bandwidthLimiter{schedule: schedule, now: time.Now}
+}
+
+// the current limit in Mbps, 0 if unlimited
+func (l *bandwidthLimiter) currentMbps() float64 {
+	now := l.now()
+	for _, w := range l.schedule {
+		if w.contains(now) {
+			return w.mbps
+		}
+	}
+	return 0
+}
+
+// reserves n bytes and returns how long the caller has to wait before sending them
+func (l *bandwidthLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	mbps := l.currentMbps()
+	now := l.now()
+	if mbps == 0 {
+		l.last = time.Time{}
+		return 0
+	}
+	rate := mbps * 1000000 / 8 // bytes per second
+	burst := rate / 4
+	if l.last.IsZero() {
+		l.tokens = burst // start every limited window with a full bucket
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * rate
+	}
+	if l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / rate * float64(time.Second))
+}
+
+func (l *bandwidthLimiter) wait(n int) {
+	if d := l.reserve(n); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+type throttledReader struct {
+	r       io.Reader
+	limiter *bandwidthLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if n > 0 {
+		t.limiter.wait(n)
+	}
+	return n, err
+}
+
+var (
+	bandwidth     *bandwidthLimiter
+	bandwidthOnce sync.Once
+)
+
+// lazy loads the global bandwidth limiter from env FASTCOPY_BANDWIDTH_SCHEDULE. returns nil if no schedule is configured
+func getBandwidthLimiter() *bandwidthLimiter {
+	bandwidthOnce.Do(func() {
+		spec := os.Getenv("FASTCOPY_BANDWIDTH_SCHEDULE")
+		if spec == "" {
+			return
+		}
+		schedule, err := parseBandwidthSchedule(spec)
+		if err != nil {
+			log.Fatalf("invalid FASTCOPY_BANDWIDTH_SCHEDULE: %s", err)
+		}
+		bandwidth = newBandwidthLimiter(schedule)
+	})
+	return bandwidth
+}
+
+// wraps a request body so it's sent no faster than the bandwidth schedule allows
+func throttle(r io.Reader) io.Reader {
+	limiter := getBandwidthLimiter()
+	if limiter == nil {
+		return r
+	}
+	return &throttledReader{r, limiter}
+}
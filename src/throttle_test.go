@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBandwidthSchedule(t *testing.T) {
+	schedule, err := parseBandwidthSchedule("08:00-20:00=50Mbps, 20:00-08:00=unlimited")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := newBandwidthLimiter(schedule)
+
+	now := time.Date(2023, 6, 1, 9, 30, 0, 0, time.Local)
+	limiter.now = func() time.Time { return now }
+	if mbps := limiter.currentMbps(); mbps != 50 {
+		t.Errorf("expected 50 Mbps during business hours, got %f", mbps)
+	}
+	// 50 Mbps is 6.25MB/s with a 1/4s burst, so 2.5MB more than the burst takes 0.4s
+	if d := limiter.reserve(6250000/4 + 2500000); d < 390*time.Millisecond || d > 410*time.Millisecond {
+		t.Errorf("expected to wait ~400ms, got %s", d)
+	}
+
+	now = time.Date(2023, 6, 1, 23, 0, 0, 0, time.Local)
+	if d := limiter.reserve(100000000); d != 0 {
+		t.Errorf("expected no throttling overnight, got %s", d)
+	}
+
+	if _, err := parseBandwidthSchedule("8am-8pm=50Mbps"); err == nil {
+		t.Error("expected malformed schedule to be rejected")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// how file contents travel from this instance to the peer. transports are selected per job
+// with /copy's 'transport' param, and register themselves in init with registerTransport
+type Transport interface {
+	// sends the contents of reader as args.File into args.To on the peer at targetURL
+	Send(reader io.Reader, targetURL string, args CopyArgs, opts CopyOptions) (UploadResponse, error)
+}
+
+// the transport used when a job doesn't pick one
+const DefaultTransport = "http"
+
+var (
+	transports   = make(map[string]Transport)
+	transportsMu sync.RWMutex
+)
+
+func registerTransport(name string, t Transport) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	transports[name] = t
+}
+
+func transportNames() []string {
+	transportsMu.RLock()
+	defer transportsMu.RUnlock()
+	names := make([]string, 0, len(transports))
+	for name := range transports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// returns the transport named 'name', the default if empty
+func getTransport(name string) (Transport, error) {
+	if name == "" {
+		name = DefaultTransport
+	}
+	transportsMu.RLock()
+	defer transportsMu.RUnlock()
+	t, ok := transports[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown transport '%s'", name)
+	}
+	return t, nil
+}
+
+// sends files with the job's transport, once a stream to the target's host is free, see targetlimits.go
+func send(reader io.Reader, targetURL string, args CopyArgs, opts CopyOptions) (UploadResponse, error) {
+	t, err := getTransport(opts.Transport)
+	if err != nil {
+		return UploadResponse{}, err
+	}
+	defer acquireTargetStream(targetURL)()
+	return t.Send(reader, targetURL, args, opts)
+}
+
+// a POST of the whole file to the peer's /upload (or /patch for delta transfers)
+type httpTransport struct{}
+
+func (httpTransport) Send(reader io.Reader, targetURL string, args CopyArgs, opts CopyOptions) (UploadResponse, error) {
+	return sendToUpload(reader, targetURL, args, opts)
+}
+
+func init() {
+	registerTransport(DefaultTransport, httpTransport{})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// records what it was sent instead of talking to a peer
+type recordingTransport struct {
+	mu   sync.Mutex
+	sent map[string]int64
+}
+
+func (t *recordingTransport) Send(reader io.Reader, targetURL string, args CopyArgs, opts CopyOptions) (UploadResponse, error) {
+	n, err := io.Copy(io.Discard, reader)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sent[args.File] = n
+	return UploadResponse{Path: args.To + "/" + args.File, Written: n}, err
+}
+
+func TestTransportSelection(t *testing.T) {
+	recorder := &recordingTransport{sent: make(map[string]int64)}
+	registerTransport("recording", recorder)
+
+	opts, err := parseCopyOptions(httptest.NewRequest("POST", "/copy?transport=recording", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks := []CopyArgs{{File: "a", Path: "/src/a", To: "/dst", Size: 10}, {File: "b", Path: "/src/b", To: "/dst", Size: 20}}
+	copied, _, failures := runTransfers(syntheticSource, []string{"http://peer/upload"}, tasks, opts, nil)
+	if len(copied) != 2 || len(failures) != 0 {
+		t.Fatalf("expected both files to be copied, got %v failures", failures)
+	}
+	if recorder.sent["a"] != 10 || recorder.sent["b"] != 20 {
+		t.Errorf("expected the files to go through the selected transport, got %v", recorder.sent)
+	}
+
+	if _, err := parseCopyOptions(httptest.NewRequest("POST", "/copy?transport=carrier-pigeon", nil)); err == nil {
+		t.Error("expected an unknown transport to be rejected")
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/colinmarc/hdfs/v2"
+)
+
+// how a copy treats symlinks in 'from'. replicating them as links isn't offered, the hdfs client
+// can't create symlinks
+const (
+	SymlinksSkip   = "skip"   // default: listed in skipped with their target
+	SymlinksFollow = "follow" // copy the file or dir the link points to under the link's name
+)
+
+var symlinkPolicies = []string{SymlinksSkip, SymlinksFollow}
+
+// how many levels below 'from' a recursive copy descends unless 'maxDepth' says otherwise
+const DefaultMaxDepth = 32
+
+func validSymlinkPolicy(p string) bool {
+	return p == "" || contains(symlinkPolicies, p)
+}
+
+// the target of a listed symlink, ok is false if fi isn't one
+func symlinkTarget(fi os.FileInfo) (string, bool) {
+	status, ok := fi.Sys().(*hdfs.FileStatus)
+	if !ok || len(status.GetSymlink()) == 0 {
+		return "", false
+	}
+	return string(status.GetSymlink()), true
+}
+
+// the path a symlink in dir points to. targets may be relative to dir or fully qualified hdfs:// urls
+func resolveSymlink(dir string, target string) string {
+	if u, err := url.Parse(target); err == nil && u.Scheme != "" {
+		target = u.Path
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(dir, target)
+	}
+	return filepath.Clean(target)
+}
+
+// what planTree found to copy
+type treePlan struct {
+	tasks     []CopyArgs
+	skipped   []SkippedFile
+	emptyDirs []EmptyDir // with opts.CopyEmptyDirs
+	bytes     int64
+	listed    int // the entries listed, not counting the dirs descended into
+}
+
+// plans copying readFrom into writeTo: its files and, with opts.Recursive, the files of its subdirs down to
+// opts.MaxDepth levels, each into the same subdir of writeTo
+func planTree(client FileSystem, readFrom string, writeTo string, opts CopyOptions) (treePlan, error) {
+	w := treeWalk{client: client, opts: opts, visiting: make(map[string]bool)}
+	if err := w.walk(readFrom, writeTo, 0); err != nil {
+		return treePlan{}, err
+	}
+	return w.treePlan, nil
+}
+
+type treeWalk struct {
+	treePlan
+	client   FileSystem
+	opts     CopyOptions
+	visiting map[string]bool // the dirs from the root down to the one being listed, to catch symlink loops
+}
+
+func (w *treeWalk) walk(readFrom string, writeTo string, depth int) error {
+	fileInfos, err := w.client.ReadDir(readFrom)
+	if err != nil {
+		return fmt.Errorf("Failed to list the hdfs dir %s", err)
+	}
+	if len(fileInfos) == 0 && w.opts.CopyEmptyDirs {
+		info, err := w.client.Stat(readFrom)
+		if err != nil {
+			return err
+		}
+		w.emptyDirs = append(w.emptyDirs, EmptyDir{writeTo, info.Mode().Perm()})
+	}
+	if w.opts.Recursive {
+		fileInfos = shardTree(fileInfos, w.opts.Shard)
+	} else {
+		fileInfos = shardFiles(fileInfos, w.opts.Shard)
+	}
+	w.listed += len(fileInfos)
+
+	var files []os.FileInfo
+	var links []CopyArgs // followed links, Path is their target
+	var dirs []CopyArgs
+	for _, fi := range fileInfos {
+		path := filepath.Join(readFrom, fi.Name())
+		if reason := skipReason(fi.Name(), fi.IsDir(), w.opts); reason != "" {
+			w.skipped = append(w.skipped, SkippedFile{path, reason})
+			continue
+		}
+		if target, ok := symlinkTarget(fi); ok {
+			if w.opts.Symlinks != SymlinksFollow {
+				w.skipped = append(w.skipped, SkippedFile{path, "symlink to " + target})
+				continue
+			}
+			resolved := resolveSymlink(readFrom, target)
+			info, err := w.client.Stat(resolved)
+			if err != nil {
+				w.skipped = append(w.skipped, SkippedFile{path, "dangling symlink to " + target})
+				continue
+			}
+			if info.IsDir() {
+				dirs = append(dirs, CopyArgs{File: fi.Name(), Path: resolved})
+			} else {
+				links = append(links, CopyArgs{From: readFrom, File: fi.Name(), Path: resolved, To: writeTo, Size: info.Size(), ModTime: info.ModTime()})
+			}
+			continue
+		}
+		if fi.IsDir() {
+			if w.opts.Recursive {
+				dirs = append(dirs, CopyArgs{File: fi.Name(), Path: path})
+			}
+			continue
+		}
+		files = append(files, fi)
+	}
+
+	opts := w.opts
+	if depth > 0 {
+		opts.WriteSuccess = false // only the root's marker is written last, the subdirs' are copied along
+	}
+	tasks, _, bytes := planTasks(files, readFrom, writeTo, opts)
+	w.tasks, w.bytes = append(w.tasks, tasks...), w.bytes+bytes
+	for _, link := range links {
+		w.tasks, w.bytes = append(w.tasks, link), w.bytes+link.Size
+	}
+
+	if !w.opts.Recursive {
+		return nil
+	}
+	w.visiting[filepath.Clean(readFrom)] = true
+	defer delete(w.visiting, filepath.Clean(readFrom))
+	for _, dir := range dirs {
+		path := filepath.Join(readFrom, dir.File)
+		switch {
+		case w.visiting[dir.Path]:
+			w.skipped = append(w.skipped, SkippedFile{path, "symlink loop back to " + dir.Path})
+		case depth >= w.opts.MaxDepth:
+			w.skipped = append(w.skipped, SkippedFile{path, fmt.Sprintf("deeper than maxDepth %d", w.opts.MaxDepth)})
+		default:
+			w.listed-- // descended into, its entries are counted instead
+			if err := w.walk(dir.Path, filepath.Join(writeTo, dir.File), depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// shards the files of a listing, keeping every dir so the workers of a recursive copy all descend into them
+func shardTree(infos []os.FileInfo, shard Shard) []os.FileInfo {
+	if shard.Count <= 1 {
+		return infos
+	}
+	kept := make([]os.FileInfo, 0, len(infos)/shard.Count+1)
+	for _, info := range infos {
+		if info.IsDir() || shard.contains(info.Name()) {
+			kept = append(kept, info)
+		}
+	}
+	return kept
+}
+
+// the dirs under root the tasks write into, root first
+func destDirs(tasks []CopyArgs, root string) []string {
+	seen := map[string]bool{root: true}
+	dirs := []string{root}
+	for _, t := range tasks {
+		if !seen[t.To] && within(t.To, root) {
+			seen[t.To] = true
+			dirs = append(dirs, t.To)
+		}
+	}
+	sort.Strings(dirs[1:])
+	return dirs
+}
+
+// the copied files written into root or below, named by their path relative to root
+func copiedUnder(copied []CopiedFile, root string) []CopiedFile {
+	var under []CopiedFile
+	for _, c := range copied {
+		if c.Args.To == root {
+			under = append(under, c)
+		} else if within(c.Args.To, root) {
+			c.Args.File = strings.TrimPrefix(filepath.Join(c.Args.To, c.Args.File), strings.TrimSuffix(root, "/")+"/")
+			under = append(under, c)
+		}
+	}
+	return under
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func plannedPaths(tasks []CopyArgs) map[string]string {
+	paths := make(map[string]string)
+	for _, t := range tasks {
+		paths[t.To+"/"+t.File] = t.Path
+	}
+	return paths
+}
+
+func TestPlanTree(t *testing.T) {
+	fs := newMemFS()
+	fs.put(map[string]string{
+		"/src/a":         "1",
+		"/src/x/b":       "22",
+		"/src/x/y/c":     "333",
+		"/src/x/y/z/d":   "4444",
+		"/shared/lookup": "55555",
+		"/shared/dir/e":  "6",
+		"/src/a.tmp":     "",
+	})
+	fs.symlink("/src/lookup", "/shared/lookup")
+	fs.symlink("/src/shared", "hdfs://nn:8020/shared/dir")
+	fs.symlink("/src/x/loop", "..")
+	fs.symlink("/src/gone", "/nowhere")
+
+	plan, err := planTree(fs, "/src", "/dst", CopyOptions{})
+	if err != nil || len(plan.tasks) != 2 || len(plan.skipped) != 3 {
+		t.Fatalf("expected only the files of /src and its links skipped, got %+v %v", plan, err)
+	}
+
+	opts := CopyOptions{Recursive: true, MaxDepth: 2, Symlinks: SymlinksFollow}
+	plan, err = planTree(fs, "/src", "/dst", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := plannedPaths(plan.tasks)
+	want := map[string]string{
+		"/dst/a": "/src/a", "/dst/a.tmp": "/src/a.tmp", "/dst/lookup": "/shared/lookup", "/dst/shared/e": "/shared/dir/e",
+		"/dst/x/b": "/src/x/b", "/dst/x/y/c": "/src/x/y/c",
+	}
+	if len(paths) != len(want) {
+		t.Errorf("expected %d tasks, got %v", len(want), paths)
+	}
+	for dst, src := range want {
+		if paths[dst] != src {
+			t.Errorf("expected %s to be copied from %s, got %v", dst, src, paths)
+		}
+	}
+	reasons := make(map[string]string)
+	for _, s := range plan.skipped {
+		reasons[s.Path] = s.Reason
+	}
+	if !strings.Contains(reasons["/src/x/y/z"], "maxDepth 2") || !strings.Contains(reasons["/src/x/loop"], "loop") || !strings.Contains(reasons["/src/gone"], "dangling") {
+		t.Errorf("unexpected skipped files %v", reasons)
+	}
+	if plan.bytes != 1+0+5+1+2+3 || plan.listed != len(plan.tasks)+len(plan.skipped) {
+		t.Errorf("unexpected bytes %d or listed %d", plan.bytes, plan.listed)
+	}
+
+	opts.MaxDepth, opts.SkipInProgress = 0, true
+	plan, _ = planTree(fs, "/src", "/dst", opts)
+	if paths := plannedPaths(plan.tasks); len(paths) != 2 || paths["/dst/lookup"] == "" {
+		t.Errorf("expected maxDepth=0 to only copy the files of /src, got %v", paths)
+	}
+}
+
+func TestRecursiveCopy(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{
+		"/src/part-00000":              "hello",
+		"/src/dt=2024-06-01/part-0000": "abc",
+		"/src/dt=2024-06-02/part-0000": "defg",
+		"/src/dt=2024-06-02/_SUCCESS":  "",
+	})
+
+	peer := http.NewServeMux()
+	peer.HandleFunc("/ready", handleReady)
+	peer.HandleFunc("/ls", handleLs)
+	peer.HandleFunc("/upload", handleUpload)
+	server := httptest.NewServer(peer)
+	defer server.Close()
+
+	query := url.Values{"from": {"/src"}, "to": {"/dst"}, "targetURL": {server.URL + "/upload"}, "recursive": {"true"}, "manifest": {"true"}}
+	rec := httptest.NewRecorder()
+	handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var resp CopyResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp.FilesCopied != 4 || resp.Written != 12 || resp.Reconciled == nil || !*resp.Reconciled {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	if data, _ := fs.get("/dst/dt=2024-06-02/part-0000"); data != "defg" {
+		t.Errorf("expected the subdirs to be copied, got '%s'", data)
+	}
+	if manifest, _ := fs.get("/dst/" + ManifestFileName); !strings.Contains(manifest, "dt=2024-06-01/part-0000\t3\t") {
+		t.Errorf("expected the manifest to list the files by their path below 'to', got\n%s", manifest)
+	}
+
+	for _, param := range []string{"maxDepth=2", "recursive=true&maxDepth=-1", "symlinks=replicate"} {
+		rec := httptest.NewRecorder()
+		handleCopy(rec, httptest.NewRequest("POST", "/copy?from=/src&to=/dst&"+param, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("expected %s to be rejected, got %d", param, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// every upload this target receives is a session, listed under /uploads while its body is streaming in and, if
+// it's cut off, afterwards too: its partial file is kept for the sender to resume. DELETE /uploads/{id} aborts a
+// session still receiving and removes its partial file, so abandoned ones don't pile up in hdfs or in memory
+
+const (
+	SessionReceiving   = "receiving"
+	SessionInterrupted = "interrupted" // the partial file is kept to resume
+)
+
+// the upload was aborted through DELETE /uploads/{id}
+var errUploadAborted = errors.New("upload aborted")
+
+type UploadSession struct {
+	ID          string        `json:"id"`
+	Path        string        `json:"path"`
+	Partial     string        `json:"partial"`
+	State       string        `json:"state"`
+	StartedAt   time.Time     `json:"startedAt"`
+	Age         string        `json:"age"`
+	Received    int64         `json:"received"`              // body bytes received
+	ResumedFrom int64         `json:"resumedFrom,omitempty"` // bytes of the partial file the upload appends to
+	Error       string        `json:"error,omitempty"`       // why an interrupted upload failed
+	Origin      *UploadOrigin `json:"origin,omitempty"`      // the job sending it, see metadata.go
+}
+
+type uploadSession struct {
+	UploadSession
+	received atomic.Int64
+	aborted  atomic.Bool
+}
+
+var (
+	uploadSessions   = make(map[string]*uploadSession)
+	uploadSessionsMu sync.Mutex
+)
+
+// registers the upload of path from origin, written through partial. an interrupted session of the same partial
+// file is taken over
+func startUploadSession(path string, partial string, resumedFrom int64, origin *UploadOrigin) *uploadSession {
+	s := &uploadSession{UploadSession: UploadSession{ID: newJobID(), Path: path, Partial: partial, State: SessionReceiving, StartedAt: time.Now(), ResumedFrom: resumedFrom, Origin: origin}}
+	uploadSessionsMu.Lock()
+	defer uploadSessionsMu.Unlock()
+	for id, other := range uploadSessions {
+		if other.Partial == partial && other.State == SessionInterrupted {
+			delete(uploadSessions, id)
+		}
+	}
+	uploadSessions[s.ID] = s
+	return s
+}
+
+// wraps the upload's body to count what's received and fail once the session is aborted
+func (s *uploadSession) track(body io.ReadCloser) io.ReadCloser {
+	return &sessionReader{body, s}
+}
+
+type sessionReader struct {
+	io.ReadCloser
+	session *uploadSession
+}
+
+func (r *sessionReader) Read(p []byte) (int, error) {
+	if r.session.aborted.Load() {
+		return 0, errUploadAborted
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.session.received.Add(int64(n))
+	return n, err
+}
+
+// ends the session with the outcome of writing the upload: done once the file is in place, kept as interrupted
+// if its partial file is left to resume, removed with its partial file if it was aborted
+func (s *uploadSession) finish(err error, resumable bool) {
+	client := GetHdfsClient()
+	if s.aborted.Load() {
+		client.Remove(s.Partial)
+	}
+	_, statErr := client.Stat(s.Partial)
+	uploadSessionsMu.Lock()
+	defer uploadSessionsMu.Unlock()
+	if err == nil || !resumable || s.aborted.Load() || statErr != nil {
+		delete(uploadSessions, s.ID)
+		return
+	}
+	s.State, s.Error = SessionInterrupted, err.Error()
+}
+
+// the session as served, guarded by uploadSessionsMu
+func (s *uploadSession) snapshot(now time.Time) UploadSession {
+	info := s.UploadSession
+	info.Age = now.Sub(s.StartedAt).Round(time.Second).String()
+	info.Received = s.received.Load()
+	return info
+}
+
+// aborts the session: one still receiving fails its next read and removes its partial file once it stops, an
+// interrupted one has its partial file removed right away. false if there's no such session
+func abortUploadSession(id string) bool {
+	uploadSessionsMu.Lock()
+	s, ok := uploadSessions[id]
+	if ok {
+		s.aborted.Store(true)
+		if s.State == SessionInterrupted {
+			delete(uploadSessions, id)
+		} else {
+			s = nil // removes its partial file itself once it stops
+		}
+	}
+	uploadSessionsMu.Unlock()
+	if s != nil {
+		if err := GetHdfsClient().Remove(s.Partial); err != nil {
+			log.Printf("Failed to remove the partial file %s of upload %s: %s", s.Partial, id, err)
+		}
+	}
+	return ok
+}
+
+// GET /uploads lists the upload sessions, oldest first. DELETE /uploads/{id} aborts one
+func handleUploads(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/uploads"), "/")
+	if id == "" {
+		if r.Method != http.MethodGet {
+			writeError(w, "use GET, or DELETE on /uploads/{id}", http.StatusMethodNotAllowed)
+			return
+		}
+		now := time.Now()
+		uploadSessionsMu.Lock()
+		list := make([]UploadSession, 0, len(uploadSessions))
+		for _, s := range uploadSessions {
+			list = append(list, s.snapshot(now))
+		}
+		uploadSessionsMu.Unlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.Before(list[j].StartedAt) })
+		json, _ := json.MarshalIndent(list, "", "  ")
+		w.Write(json)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		writeError(w, "use DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+	if !abortUploadSession(id) {
+		writeError(w, fmt.Sprintf("upload %s not found", id), http.StatusNotFound)
+		return
+	}
+	log.Printf("Upload %s aborted", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// starts the test without the upload sessions of earlier tests
+func useUploadSessions(t *testing.T) {
+	uploadSessionsMu.Lock()
+	prev := uploadSessions
+	uploadSessions = make(map[string]*uploadSession)
+	uploadSessionsMu.Unlock()
+	t.Cleanup(func() { uploadSessions = prev })
+}
+
+func listUploads(t *testing.T) []UploadSession {
+	rec := httptest.NewRecorder()
+	handleUploads(rec, httptest.NewRequest(http.MethodGet, "/uploads", nil))
+	var list []UploadSession
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func deleteUpload(id string) int {
+	rec := httptest.NewRecorder()
+	handleUploads(rec, httptest.NewRequest(http.MethodDelete, "/uploads/"+id, nil))
+	return rec.Code
+}
+
+func TestInterruptedUploadSession(t *testing.T) {
+	fs := useMemFS(t)
+	useUploadSessions(t)
+	body := io.MultiReader(strings.NewReader("first half"), iotest.ErrReader(errors.New("connection reset")))
+	rec := httptest.NewRecorder()
+	handleUpload(rec, httptest.NewRequest("POST", "/upload?to=/dst&fileName=a.txt", body))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected the interrupted upload to fail, got %d", rec.Code)
+	}
+
+	list := listUploads(t)
+	if len(list) != 1 || list[0].State != SessionInterrupted || list[0].Received != 10 || list[0].Partial != "/dst/.a.txt.fastcopy-partial" {
+		t.Fatalf("expected the interrupted session to be listed, got %+v", list)
+	}
+	if status := deleteUpload(list[0].ID); status != http.StatusNoContent {
+		t.Errorf("expected the session to be deleted, got %d", status)
+	}
+	if _, ok := fs.get("/dst/.a.txt.fastcopy-partial"); ok {
+		t.Error("expected the partial file to be removed")
+	}
+	if list := listUploads(t); len(list) != 0 {
+		t.Errorf("expected no sessions left, got %+v", list)
+	}
+	if status := deleteUpload(list[0].ID); status != http.StatusNotFound {
+		t.Errorf("expected an unknown session to answer 404, got %d", status)
+	}
+
+	// a completed upload leaves no session behind
+	handleUpload(httptest.NewRecorder(), httptest.NewRequest("POST", "/upload?to=/dst&fileName=b.txt", strings.NewReader("done")))
+	if list := listUploads(t); len(list) != 0 {
+		t.Errorf("expected no sessions left, got %+v", list)
+	}
+}
+
+func TestAbortUploadSession(t *testing.T) {
+	fs := useMemFS(t)
+	useUploadSessions(t)
+	pr, pw := io.Pipe()
+	done := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		handleUpload(rec, httptest.NewRequest("POST", "/upload?to=/dst&fileName=a.txt", pr))
+		done <- rec.Code
+	}()
+	pw.Write([]byte("abc"))
+
+	var list []UploadSession
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if list = listUploads(t); len(list) == 1 && list[0].Received == 3 {
+			break
+		}
+	}
+	if len(list) != 1 || list[0].State != SessionReceiving {
+		t.Fatalf("expected the upload to be listed while receiving, got %+v", list)
+	}
+	if status := deleteUpload(list[0].ID); status != http.StatusNoContent {
+		t.Fatalf("expected the session to be aborted, got %d", status)
+	}
+	go pw.Write([]byte("def")) // unblocks the read in flight, the next one fails
+	if status := <-done; status != http.StatusInternalServerError {
+		t.Errorf("expected the aborted upload to fail, got %d", status)
+	}
+	pw.Close()
+	if _, ok := fs.get("/dst/.a.txt.fastcopy-partial"); ok {
+		t.Error("expected the aborted upload's partial file to be removed")
+	}
+	if list := listUploads(t); len(list) != 0 {
+		t.Errorf("expected no sessions left, got %+v", list)
+	}
+}
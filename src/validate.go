@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// with validate=<formats> the receiver checks the structure of each written file of those formats and rejects the
+// upload if it's corrupt, e.g. truncated, instead of leaving it for the jobs reading it to fail on days later
+
+// checks the structure of a file of some format
+type formatValidator struct {
+	suffix string // of the files in the format
+	check  func(r io.ReaderAt, size int64) error
+}
+
+var validators = map[string]formatValidator{
+	"parquet": {".parquet", validateParquet},
+	"orc":     {".orc", validateORC},
+	"avro":    {".avro", validateAvro},
+}
+
+// parses validate, a comma separated list of formats like parquet,orc
+func parseValidate(v string) ([]string, error) {
+	var formats []string
+	for _, format := range strings.Split(v, ",") {
+		format = strings.ToLower(strings.TrimSpace(format))
+		if _, ok := validators[format]; !ok {
+			return nil, fmt.Errorf("'validate' must be a comma separated list of %s, got '%s'", strings.Join(sortedKeys(validators), ", "), v)
+		}
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats, nil
+}
+
+// checks the file written at path, named fileName by the sender, if it's in one of the formats
+func validateWritten(client FileSystem, path string, fileName string, formats []string) error {
+	for _, format := range formats {
+		v := validators[format]
+		if !strings.HasSuffix(strings.ToLower(fileName), v.suffix) {
+			continue
+		}
+		reader, err := client.Open(path)
+		if err != nil {
+			return err
+		}
+		err = v.check(reader, reader.Stat().Size())
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("%s is not a valid %s file: %w", fileName, format, err)
+		}
+	}
+	return nil
+}
+
+// a parquet file starts with PAR1 and ends with its footer, the footer's length and PAR1, or PARE if the footer
+// is encrypted
+func validateParquet(r io.ReaderAt, size int64) error {
+	if size < 12 {
+		return fmt.Errorf("%d bytes is too short", size)
+	}
+	head := make([]byte, 4)
+	if _, err := r.ReadAt(head, 0); err != nil {
+		return err
+	}
+	if !bytes.Equal(head, []byte("PAR1")) {
+		return fmt.Errorf("starts with %q instead of PAR1", head)
+	}
+	tail := make([]byte, 8)
+	if _, err := r.ReadAt(tail, size-8); err != nil {
+		return err
+	}
+	if magic := tail[4:]; !bytes.Equal(magic, []byte("PAR1")) && !bytes.Equal(magic, []byte("PARE")) {
+		return fmt.Errorf("ends with %q instead of PAR1, the file is likely truncated", magic)
+	}
+	footer := int64(binary.LittleEndian.Uint32(tail[:4]))
+	if footer == 0 || footer > size-12 {
+		return fmt.Errorf("footer length %d doesn't fit in %d bytes", footer, size)
+	}
+	return nil
+}
+
+// an orc file starts with ORC and ends with its footer, a protobuf postscript and the postscript's length in
+// one byte. the postscript gives the lengths of the footer and the metadata before it
+func validateORC(r io.ReaderAt, size int64) error {
+	if size < 4 {
+		return fmt.Errorf("%d bytes is too short", size)
+	}
+	head := make([]byte, 3)
+	if _, err := r.ReadAt(head, 0); err != nil {
+		return err
+	}
+	if !bytes.Equal(head, []byte("ORC")) {
+		return fmt.Errorf("starts with %q instead of ORC", head)
+	}
+	last := make([]byte, 1)
+	if _, err := r.ReadAt(last, size-1); err != nil {
+		return err
+	}
+	psLen := int64(last[0])
+	if psLen == 0 || psLen > size-4 {
+		return fmt.Errorf("postscript length %d doesn't fit in %d bytes, the file is likely truncated", psLen, size)
+	}
+	ps := make([]byte, psLen)
+	if _, err := r.ReadAt(ps, size-1-psLen); err != nil {
+		return err
+	}
+	footer, metadata, magic, err := parseORCPostScript(ps)
+	if err != nil {
+		return fmt.Errorf("unreadable postscript, the file is likely truncated: %w", err)
+	}
+	if magic != "" && magic != "ORC" {
+		return fmt.Errorf("postscript magic %q instead of ORC", magic)
+	}
+	if footer == 0 || footer+metadata > uint64(size-4-psLen) {
+		return fmt.Errorf("footer of %d and metadata of %d bytes don't fit in %d bytes", footer, metadata, size)
+	}
+	return nil
+}
+
+// reads the footerLength (1), metadataLength (5) and magic (8000) fields of an orc postscript
+func parseORCPostScript(ps []byte) (footer uint64, metadata uint64, magic string, err error) {
+	for len(ps) > 0 {
+		key, n := binary.Uvarint(ps)
+		if n <= 0 {
+			return 0, 0, "", errors.New("bad field key")
+		}
+		ps = ps[n:]
+		switch key & 7 {
+		case 0: // varint
+			v, n := binary.Uvarint(ps)
+			if n <= 0 {
+				return 0, 0, "", errors.New("bad varint")
+			}
+			ps = ps[n:]
+			switch key >> 3 {
+			case 1:
+				footer = v
+			case 5:
+				metadata = v
+			}
+		case 2: // length delimited
+			l, n := binary.Uvarint(ps)
+			if n <= 0 || l > uint64(len(ps)-n) {
+				return 0, 0, "", errors.New("bad length")
+			}
+			if key>>3 == 8000 {
+				magic = string(ps[n : n+int(l)])
+			}
+			ps = ps[n+int(l):]
+		default:
+			return 0, 0, "", fmt.Errorf("unexpected wire type %d", key&7)
+		}
+	}
+	return footer, metadata, magic, nil
+}
+
+// an avro container file starts with Obj 1, its metadata, which must have the avro.schema, and a 16 byte sync
+// marker, followed by blocks of objects each ending with the sync marker. reads the whole file, so a block cut off
+// or corrupted in the middle is caught too
+func validateAvro(r io.ReaderAt, size int64) error {
+	br := bufio.NewReader(io.NewSectionReader(r, 0, size))
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return fmt.Errorf("%d bytes is too short", size)
+	}
+	if !bytes.Equal(head, []byte("Obj\x01")) {
+		return fmt.Errorf("starts with %q instead of Obj 1", head)
+	}
+	var hasSchema bool
+	for {
+		count, err := binary.ReadVarint(br)
+		if err != nil {
+			return fmt.Errorf("truncated metadata: %w", err)
+		}
+		if count == 0 {
+			break
+		}
+		if count < 0 {
+			count = -count
+			if _, err := binary.ReadVarint(br); err != nil { // the size of the entries in bytes
+				return fmt.Errorf("truncated metadata: %w", err)
+			}
+		}
+		for i := int64(0); i < count; i++ {
+			key, err := readAvroBytes(br, size)
+			if err != nil {
+				return fmt.Errorf("truncated metadata: %w", err)
+			}
+			if _, err := readAvroBytes(br, size); err != nil {
+				return fmt.Errorf("truncated metadata: %w", err)
+			}
+			hasSchema = hasSchema || string(key) == "avro.schema"
+		}
+	}
+	if !hasSchema {
+		return errors.New("the metadata has no avro.schema")
+	}
+	sync := make([]byte, 16)
+	if _, err := io.ReadFull(br, sync); err != nil {
+		return fmt.Errorf("truncated sync marker: %w", err)
+	}
+	marker := make([]byte, 16)
+	for block := 0; ; block++ {
+		objects, err := binary.ReadVarint(br)
+		if err == io.EOF {
+			return nil // the file ends after a block
+		}
+		if err != nil {
+			return fmt.Errorf("block %d truncated: %w", block, err)
+		}
+		length, err := binary.ReadVarint(br)
+		if err != nil || objects < 0 || length < 0 || length > size {
+			return fmt.Errorf("block %d has a corrupt header", block)
+		}
+		if _, err := br.Discard(int(length)); err != nil {
+			return fmt.Errorf("block %d of %d bytes truncated: %w", block, length, err)
+		}
+		if _, err := io.ReadFull(br, marker); err != nil {
+			return fmt.Errorf("block %d truncated before its sync marker: %w", block, err)
+		}
+		if !bytes.Equal(marker, sync) {
+			return fmt.Errorf("block %d doesn't end with the sync marker", block)
+		}
+	}
+}
+
+// reads avro bytes or a string, a long length followed by the data
+func readAvroBytes(br *bufio.Reader, size int64) ([]byte, error) {
+	l, err := binary.ReadVarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if l < 0 || l > size {
+		return nil, fmt.Errorf("bad length %d", l)
+	}
+	b := make([]byte, l)
+	_, err = io.ReadFull(br, b)
+	return b, err
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// a parquet file with a footer of n bytes
+func parquetFile(n int) string {
+	footer := strings.Repeat("f", n)
+	return "PAR1" + "data" + footer + string([]byte{byte(n), 0, 0, 0}) + "PAR1"
+}
+
+func TestValidateParquet(t *testing.T) {
+	valid := parquetFile(6)
+	for name, data := range map[string]string{"valid": valid, "encrypted footer": strings.TrimSuffix(valid, "PAR1") + "PARE"} {
+		if err := validateParquet(bytes.NewReader([]byte(data)), int64(len(data))); err != nil {
+			t.Errorf("%s: unexpected error %s", name, err)
+		}
+	}
+	for name, data := range map[string]string{
+		"too short":    "PAR1PAR1",
+		"no header":    "XXXX" + valid[4:],
+		"truncated":    valid[:len(valid)-3],
+		"empty footer": "PAR1data" + string([]byte{0, 0, 0, 0}) + "PAR1",
+		"long footer":  "PAR1data" + string([]byte{200, 0, 0, 0}) + "PAR1",
+	} {
+		if err := validateParquet(bytes.NewReader([]byte(data)), int64(len(data))); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// an orc file with a footer of 5 and metadata of 2 bytes
+func orcFile() string {
+	// footerLength 5, compression 0, metadataLength 2, magic ORC
+	ps := []byte{1 << 3, 5, 2 << 3, 0, 5 << 3, 2, 0x82, 0xf4, 0x03, 3, 'O', 'R', 'C'}
+	return "ORC" + "stripes" + "mm" + "fffff" + string(ps) + string([]byte{byte(len(ps))})
+}
+
+// an avro container file with the given blocks of data
+func avroFile(blocks ...string) string {
+	sync := "0123456789abcdef"
+	var b []byte
+	b = append(b, "Obj\x01"...)
+	b = binary.AppendVarint(b, 1)
+	for _, s := range []string{"avro.schema", `"string"`} {
+		b = binary.AppendVarint(b, int64(len(s)))
+		b = append(b, s...)
+	}
+	b = binary.AppendVarint(b, 0)
+	b = append(b, sync...)
+	for _, block := range blocks {
+		b = binary.AppendVarint(b, 1)
+		b = binary.AppendVarint(b, int64(len(block)))
+		b = append(b, block...)
+		b = append(b, sync...)
+	}
+	return string(b)
+}
+
+func TestValidateORCAndAvro(t *testing.T) {
+	orc, avro := orcFile(), avroFile("block one", "block two")
+	checks := map[string]func(r io.ReaderAt, size int64) error{"orc": validateORC, "avro": validateAvro}
+	for name, c := range map[string]struct {
+		format string
+		data   string
+		valid  bool
+	}{
+		"orc":                 {"orc", orc, true},
+		"orc truncated":       {"orc", orc[:len(orc)-4], false},
+		"orc without header":  {"orc", "XYZ" + orc[3:], false},
+		"orc short footer":    {"orc", "ORC" + orc[12:], false},
+		"avro":                {"avro", avro, true},
+		"avro without blocks": {"avro", avroFile(), true},
+		"avro truncated":      {"avro", avro[:len(avro)-5], false},
+		"avro torn block":     {"avro", avro[:len(avro)-20], false},
+		"avro corrupt marker": {"avro", avro[:len(avro)-1] + "X", false},
+		"avro without header": {"avro", "Obj\x02" + avro[4:], false},
+	} {
+		err := checks[c.format](bytes.NewReader([]byte(c.data)), int64(len(c.data)))
+		if c.valid && err != nil {
+			t.Errorf("%s: unexpected error %s", name, err)
+		} else if !c.valid && err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestParseValidate(t *testing.T) {
+	if formats, err := parseValidate(" Parquet "); err != nil || len(formats) != 1 || formats[0] != "parquet" {
+		t.Errorf("unexpected %v %v", formats, err)
+	}
+	if formats, err := parseValidate("orc,parquet,avro"); err != nil || strings.Join(formats, ",") != "avro,orc,parquet" {
+		t.Errorf("unexpected %v %v", formats, err)
+	}
+	if _, err := parseValidate("parquet,csv"); err == nil {
+		t.Error("expected an unknown format to be rejected")
+	}
+}
+
+func TestUploadValidatesParquet(t *testing.T) {
+	fs := useMemFS(t)
+	upload := func(fileName string, data string) int {
+		rec := httptest.NewRecorder()
+		handleUpload(rec, httptest.NewRequest("POST", "/upload?to=/dst&validate=parquet&fileName="+fileName, strings.NewReader(data)))
+		return rec.Code
+	}
+	if code := upload("part-00000.parquet", parquetFile(6)); code != http.StatusOK {
+		t.Errorf("expected a valid parquet file to be accepted, got %d", code)
+	}
+	if code := upload("part-00001.parquet", parquetFile(6)[:20]); code != http.StatusUnprocessableEntity {
+		t.Errorf("expected a truncated parquet file to be rejected, got %d", code)
+	}
+	if _, ok := fs.get("/dst/part-00001.parquet"); ok {
+		t.Error("expected the truncated parquet file to be removed")
+	}
+	if code := upload("part-00002.csv", "a,b"); code != http.StatusOK {
+		t.Errorf("expected files of other formats to be accepted, got %d", code)
+	}
+}
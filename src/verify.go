@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// the checksum of a file at rest, as served by /checksum
+type FileChecksum struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// the outcome of re-reading a sample of the copied files on both sides after a verifySample copy
+type VerifyResult struct {
+	FilesCopied   int              `json:"filesCopied"`
+	FilesVerified int              `json:"filesVerified"`
+	BytesVerified int64            `json:"bytesVerified"`
+	Coverage      float64          `json:"coveragePercent"` // of the copied bytes
+	Mismatches    []VerifyMismatch `json:"mismatches,omitempty"`
+	Against       string           `json:"against,omitempty"` // of a /verify job, what the target was checked against
+}
+
+type VerifyMismatch struct {
+	Path          string `json:"path"`
+	Reason        string `json:"reason"`
+	SourceSHA256  string `json:"sourceSha256,omitempty"`
+	TargetSHA256  string `json:"targetSha256,omitempty"`
+	QuarantinedAs string `json:"quarantinedAs,omitempty"` // on the target, when it has a quarantine dir
+}
+
+// parses verifySample, a percentage of the copied files like 5% or 5
+func parseVerifySample(v string) (float64, error) {
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(v, "%"), 64)
+	if err != nil || percent <= 0 || percent > 100 {
+		return 0, fmt.Errorf("'verifySample' must be a percentage in (0, 100], got '%s'", v)
+	}
+	return percent, nil
+}
+
+// reads the whole file to compute its sha256
+func fileChecksum(client FileSystem, path string) (FileChecksum, error) {
+	reader, err := client.Open(path)
+	if err != nil {
+		return FileChecksum{}, err
+	}
+	defer reader.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, reader)
+	if err != nil {
+		return FileChecksum{}, err
+	}
+	return FileChecksum{path, n, base64.StdEncoding.EncodeToString(h.Sum(nil))}, nil
+}
+
+// Returns the sha256 of the hdfs file provided by query param 'path', read back from hdfs
+func handleChecksum(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeError(w, "'path' query param must be provided.", http.StatusBadRequest)
+		return
+	}
+	sum, err := fileChecksum(GetHdfsClient(), path)
+	if errors.Is(err, os.ErrNotExist) {
+		writeError(w, fmt.Sprintf("%s does not exist", path), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, fmt.Sprintf("Failed to read %s: %s", path, err), http.StatusInternalServerError)
+		return
+	}
+	json, _ := json.Marshal(sum)
+	w.Write(json)
+}
+
+// fetches the checksum of a file on the peer via its /checksum
+func peerChecksum(targetURL string, path string) (FileChecksum, error) {
+	var sum FileChecksum
+	resp, err := httpClient.Get(peerURL(targetURL, "/checksum", url.Values{"path": {path}}))
+	if err != nil {
+		return sum, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return sum, fmt.Errorf("/checksum returned non-OK status %d: %s", resp.StatusCode, peerErrorMessage(msg))
+	}
+	err = json.NewDecoder(resp.Body).Decode(&sum)
+	return sum, err
+}
+
+// re-reads a random percent of the copied files from the source and, via its /checksum, the target and compares
+// their checksums, with up to 'workers' files verified at once
+func verifySample(client FileSystem, targetURL string, copied []CopiedFile, percent float64, workers int) VerifyResult {
+	res := VerifyResult{FilesCopied: len(copied)}
+	var bytesCopied int64
+	args := make([]CopyArgs, 0, len(copied))
+	for _, c := range copied {
+		args = append(args, c.Args)
+		bytesCopied += c.Args.Size
+	}
+	sample := sampleTasks(args, 0, percent)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	work := make(chan CopyArgs)
+	for i := 0; i < workers && i < len(sample); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for a := range work {
+				mismatch := verifyFile(client, targetURL, a)
+				mu.Lock()
+				res.FilesVerified++
+				res.BytesVerified += a.Size
+				if mismatch != nil {
+					res.Mismatches = append(res.Mismatches, *mismatch)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, a := range sample {
+		work <- a
+	}
+	close(work)
+	wg.Wait()
+
+	sort.Slice(res.Mismatches, func(i, j int) bool { return res.Mismatches[i].Path < res.Mismatches[j].Path })
+	if bytesCopied > 0 {
+		res.Coverage = float64(res.BytesVerified) * 100 / float64(bytesCopied)
+	} else if len(copied) > 0 {
+		res.Coverage = float64(res.FilesVerified) * 100 / float64(len(copied))
+	}
+	return res
+}
+
+// compares the source file with its copy, nil when they match. a copy that doesn't match is quarantined by the target
+func verifyFile(client FileSystem, targetURL string, a CopyArgs) *VerifyMismatch {
+	dest := filepath.Join(a.To, a.File)
+	src, err := fileChecksum(client, a.Path)
+	if err != nil {
+		return &VerifyMismatch{Path: dest, Reason: fmt.Sprintf("cannot read the source %s: %s", a.Path, err)}
+	}
+	dst, err := peerChecksum(targetURL, dest)
+	if err != nil {
+		return &VerifyMismatch{Path: dest, Reason: fmt.Sprintf("cannot read the copy: %s", err), SourceSHA256: src.SHA256}
+	}
+	if src.SHA256 == dst.SHA256 && src.Size == dst.Size {
+		return nil
+	}
+	mismatch := &VerifyMismatch{Path: dest, Reason: fmt.Sprintf("source has %d bytes, copy %d bytes with a different sha256", src.Size, dst.Size), SourceSHA256: src.SHA256, TargetSHA256: dst.SHA256}
+	q := QuarantinedFile{
+		Path:     dest,
+		Source:   a.Path,
+		Reason:   "verifySample: " + mismatch.Reason,
+		Expected: map[string]string{"size": strconv.FormatInt(src.Size, 10), "sha-256": src.SHA256},
+		Actual:   map[string]string{"size": strconv.FormatInt(dst.Size, 10), "sha-256": dst.SHA256},
+	}
+	quarantinedAs, err := requestQuarantine(targetURL, q)
+	if err != nil {
+		mismatch.Reason += fmt.Sprintf(", cannot quarantine the copy: %s", err)
+	}
+	mismatch.QuarantinedAs = quarantinedAs
+	return mismatch
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestParseVerifySample(t *testing.T) {
+	for v, want := range map[string]float64{"5%": 5, "0.5": 0.5, "100%": 100} {
+		if got, err := parseVerifySample(v); err != nil || got != want {
+			t.Errorf("parseVerifySample(%s) = %v %v, expected %v", v, got, err, want)
+		}
+	}
+	for _, v := range []string{"0%", "101%", "-1", "some", "%"} {
+		if _, err := parseVerifySample(v); err == nil {
+			t.Errorf("expected '%s' to be rejected", v)
+		}
+	}
+}
+
+func checksumPeer(t *testing.T) *httptest.Server {
+	peer := http.NewServeMux()
+	peer.HandleFunc("/ready", handleReady)
+	peer.HandleFunc("/ls", handleLs)
+	peer.HandleFunc("/upload", handleUpload)
+	peer.HandleFunc("/checksum", handleChecksum)
+	peer.HandleFunc("/quarantine", handleQuarantine)
+	server := httptest.NewServer(peer)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestVerifySample(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{
+		"/src/a": "aaaa", "/dst/a": "aaaa",
+		"/src/b": "bbbb", "/dst/b": "bXbb",
+		"/src/c": "cc",
+	})
+	server := checksumPeer(t)
+	copied := []CopiedFile{
+		{Args: CopyArgs{From: "/src", File: "a", Path: "/src/a", To: "/dst", Size: 4}},
+		{Args: CopyArgs{From: "/src", File: "b", Path: "/src/b", To: "/dst", Size: 4}},
+		{Args: CopyArgs{From: "/src", File: "c", Path: "/src/c", To: "/dst", Size: 2}},
+	}
+	res := verifySample(fs, server.URL+"/upload", copied, 100, 2)
+	if res.FilesCopied != 3 || res.FilesVerified != 3 || res.BytesVerified != 10 || res.Coverage != 100 {
+		t.Errorf("unexpected coverage %+v", res)
+	}
+	if len(res.Mismatches) != 2 || res.Mismatches[0].Path != "/dst/b" || res.Mismatches[1].Path != "/dst/c" {
+		t.Fatalf("expected the corrupted and the missing copy to mismatch, got %+v", res.Mismatches)
+	}
+	if res.Mismatches[0].SourceSHA256 == res.Mismatches[0].TargetSHA256 || res.Mismatches[0].TargetSHA256 == "" {
+		t.Errorf("expected both checksums of the corrupted copy, got %+v", res.Mismatches[0])
+	}
+
+	res = verifySample(fs, server.URL+"/upload", copied, 34, 2)
+	if res.FilesVerified != 2 || res.Coverage <= 0 || res.Coverage >= 100 {
+		t.Errorf("expected a partial sample, got %+v", res)
+	}
+}
+
+func TestCopyVerifySample(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{"/src/part-00000": "hello", "/src/part-00001": "world"})
+	server := checksumPeer(t)
+
+	query := url.Values{"from": {"/src"}, "to": {"/dst"}, "targetURL": {server.URL + "/upload"}, "verifySample": {"50%"}}
+	rec := httptest.NewRecorder()
+	handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var resp CopyResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if v := resp.Verification; v == nil || v.FilesVerified != 1 || v.FilesCopied != 2 || v.Coverage != 50 || len(v.Mismatches) != 0 {
+		t.Errorf("expected one of two files verified, got %+v", resp.Verification)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// what a /verify checks the target against
+const (
+	VerifyAgainstSource   = "source"   // re-reads both sides
+	VerifyAgainstManifest = "manifest" // re-reads the target and compares it with the _MANIFEST.tsv of its copy
+)
+
+// the type of the jobs run by /verify, copies have none
+const JobTypeVerify = "verify"
+
+// a file of the destination tree to check
+type verifyCheck struct {
+	args   CopyArgs // the copy that wrote it, Path is on the source or, against the manifest, on the target
+	sha256 string   // base64, from the manifest
+}
+
+func (j *Job) setKind(kind string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.kind = kind
+}
+
+// Re-checks an existing destination tree 'to' on 'targetURL', e.g. weeks after its copy for bit rot or out-of-band
+// changes, and answers with its divergence report: the files missing on the target, the ones only on the target
+// and the ones whose size or sha256 differ. With against=source (the default) the tree under 'from' is listed as
+// a copy would (recursive, filters) and both sides are re-read; with against=manifest only the target is re-read
+// and compared with the _MANIFEST.tsv its manifest=true copy wrote. Runs as a job of type verify, failed when
+// anything diverged
+func handleVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	against := q.Get("against")
+	if against == "" {
+		against = VerifyAgainstSource
+	}
+	required := []string{"to", "targetURL"}
+	switch against {
+	case VerifyAgainstSource:
+		required = append(required, "from")
+	case VerifyAgainstManifest:
+	default:
+		writeError(w, fmt.Sprintf("'against' must be %s or %s, got '%s'", VerifyAgainstSource, VerifyAgainstManifest, against), http.StatusBadRequest)
+		return
+	}
+	if err := validateParams(q, required...); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest, errorDetails(err)...)
+		return
+	}
+	opts, err := parseCopyOptions(r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest, errorDetails(err)...)
+		return
+	}
+	labels, err := parseLabels(q["label"])
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jobID := q.Get("jobId")
+	if jobID == "" {
+		jobID = newJobID()
+	}
+	resp, status, err := runVerify(jobID, q.Get("from"), q.Get("to"), q.Get("targetURL"), against, labels, opts)
+	if err != nil {
+		writeError(w, err.Error(), status)
+		return
+	}
+	w.Header().Set(jobIDHeader, jobID)
+	json, _ := json.Marshal(resp)
+	w.Write(json)
+}
+
+func runVerify(jobID string, from string, to string, targetURL string, against string, labels map[string]string, opts CopyOptions) (CopyResponse, int, error) {
+	start := time.Now()
+	var client FileSystem
+	var checks []verifyCheck
+	if against == VerifyAgainstSource {
+		c, releaseClient, err := getClientPool().acquire()
+		if err != nil {
+			return CopyResponse{}, http.StatusServiceUnavailable, err
+		}
+		defer releaseClient()
+		client = c
+		plan, err := planTree(client, from, to, opts)
+		if errors.Is(err, os.ErrNotExist) {
+			return CopyResponse{}, http.StatusNotFound, err
+		}
+		if err != nil {
+			return CopyResponse{}, http.StatusInternalServerError, err
+		}
+		for _, t := range plan.tasks {
+			checks = append(checks, verifyCheck{args: t})
+		}
+	} else {
+		var err error
+		checks, err = peerManifest(targetURL, to)
+		if err != nil {
+			return CopyResponse{}, http.StatusBadGateway, err
+		}
+	}
+
+	// the target's listing of every dir the tree has files in tells the missing and the extra files
+	tasks := make([]CopyArgs, 0, len(checks))
+	expected := make(map[string]bool, len(checks))
+	for _, c := range checks {
+		tasks = append(tasks, c.args)
+		expected[filepath.Join(c.args.To, c.args.File)] = true
+	}
+	present := make(map[string]bool)
+	var divergences []VerifyMismatch
+	for _, dir := range destDirs(tasks, to) {
+		entries, err := listPeer(targetURL, dir)
+		if err != nil {
+			return CopyResponse{}, http.StatusBadGateway, fmt.Errorf("cannot list %s on %s: %w", dir, targetURL, err)
+		}
+		for _, e := range entries {
+			path := filepath.Join(dir, e.Name)
+			if e.IsDir {
+				continue
+			}
+			present[path] = true
+			if !expected[path] && e.Name != ManifestFileName && e.Name != SuccessMarker {
+				divergences = append(divergences, VerifyMismatch{Path: path, Reason: fmt.Sprintf("only on the target, not in the %s", against)})
+			}
+		}
+	}
+
+	job, err := startJob(jobID, from, to, targetURL, labels, tasks)
+	if err != nil {
+		return CopyResponse{}, http.StatusConflict, err
+	}
+	job.setKind(JobTypeVerify)
+	job.logf("verifying %d files against the %s", len(checks), against)
+
+	res := VerifyResult{FilesCopied: len(checks), Against: against}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	work := make(chan verifyCheck)
+	for i := 0; i < opts.Workers && i < len(checks); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range work {
+				dest := filepath.Join(c.args.To, c.args.File)
+				var mismatch *VerifyMismatch
+				if present[dest] {
+					mismatch = c.verify(client, targetURL, against)
+				} else {
+					mismatch = &VerifyMismatch{Path: dest, Reason: "missing on the target"}
+				}
+				job.progress(c.args, int(c.args.Size))
+				var failed error
+				if mismatch != nil {
+					failed = errors.New(mismatch.Reason)
+					job.logf("%s: %s", mismatch.Path, mismatch.Reason)
+				}
+				job.fileDone(c.args, failed)
+				mu.Lock()
+				res.FilesVerified++
+				res.BytesVerified += c.args.Size
+				if mismatch != nil {
+					divergences = append(divergences, *mismatch)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, c := range checks {
+		work <- c
+	}
+	close(work)
+	wg.Wait()
+
+	sort.Slice(divergences, func(i, j int) bool { return divergences[i].Path < divergences[j].Path })
+	res.Mismatches = divergences
+	res.Coverage = 100
+	resp := CopyResponse{
+		JobID:          job.id,
+		Labels:         labels,
+		From:           from,
+		To:             to,
+		FilesRequested: int64(len(checks)),
+		State:          StateSucceeded,
+		Verification:   &res,
+		Throughput:     mbps(res.BytesVerified, time.Since(start).Seconds()),
+		ElapsedSecs:    time.Since(start).Seconds(),
+	}
+	if len(divergences) > 0 {
+		resp.State = StateFailed
+	}
+	job.finish(resp)
+	return resp, http.StatusOK, nil
+}
+
+// re-reads the file on the target via its /checksum and compares it with the source, or the manifest, nil when
+// they match
+func (c verifyCheck) verify(client FileSystem, targetURL string, against string) *VerifyMismatch {
+	dest := filepath.Join(c.args.To, c.args.File)
+	want := FileChecksum{Path: c.args.Path, Size: c.args.Size, SHA256: c.sha256}
+	if against == VerifyAgainstSource {
+		var err error
+		want, err = fileChecksum(client, c.args.Path)
+		if errors.Is(err, os.ErrNotExist) {
+			return &VerifyMismatch{Path: dest, Reason: fmt.Sprintf("the source %s was deleted while verifying", c.args.Path)}
+		}
+		if err != nil {
+			return &VerifyMismatch{Path: dest, Reason: fmt.Sprintf("cannot read the source %s: %s", c.args.Path, err)}
+		}
+	}
+	got, err := peerChecksum(targetURL, dest)
+	if err != nil {
+		return &VerifyMismatch{Path: dest, Reason: fmt.Sprintf("cannot read the target: %s", err), SourceSHA256: want.SHA256}
+	}
+	if got.Size == want.Size && got.SHA256 == want.SHA256 {
+		return nil
+	}
+	reason := fmt.Sprintf("the %s has %d bytes, the target %d bytes", against, want.Size, got.Size)
+	if got.Size == want.Size {
+		reason = fmt.Sprintf("the %s and the target have %d bytes but different sha256s", against, got.Size)
+	}
+	return &VerifyMismatch{Path: dest, Reason: reason, SourceSHA256: want.SHA256, TargetSHA256: got.SHA256}
+}
+
+// reads the _MANIFEST.tsv in 'to' on the target, see renderManifest, into the files to check
+func peerManifest(targetURL string, to string) ([]verifyCheck, error) {
+	path := filepath.Join(to, ManifestFileName)
+	resp, err := httpClient.Get(peerURL(targetURL, "/download", url.Values{"path": {path}}))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("cannot read %s on %s, /download returned non-OK status %d: %s", path, targetURL, resp.StatusCode, peerErrorMessage(msg))
+	}
+	var checks []verifyCheck
+	scanner := bufio.NewScanner(resp.Body)
+	for line := 0; scanner.Scan(); line++ {
+		if line == 0 || scanner.Text() == "" {
+			continue
+		}
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%s line %d: want path, size and sha256, got '%s'", path, line+1, scanner.Text())
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: invalid size '%s'", path, line+1, fields[1])
+		}
+		sum, err := hex.DecodeString(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: invalid sha256 '%s'", path, line+1, fields[2])
+		}
+		dest := filepath.Join(to, fields[0])
+		if !within(dest, to) {
+			return nil, fmt.Errorf("%s line %d: '%s' is outside %s", path, line+1, fields[0], to)
+		}
+		args := CopyArgs{File: filepath.Base(dest), Path: dest, To: filepath.Dir(dest), Size: size}
+		checks = append(checks, verifyCheck{args: args, sha256: base64.StdEncoding.EncodeToString(sum)})
+	}
+	return checks, scanner.Err()
+}
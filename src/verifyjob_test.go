@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestVerifyJobFindsDivergences(t *testing.T) {
+	fs := useMemFS(t)
+	fs.put(map[string]string{"/src/a.txt": "hello", "/src/b.txt": "world", "/src/sub/c.txt": "deep"})
+	peer := httptest.NewServer(apiMux())
+	defer peer.Close()
+
+	query := url.Values{"from": {"/src"}, "to": {"/dst"}, "targetURL": {peer.URL + "/upload"}, "recursive": {"true"}, "manifest": {"true"}}
+	rec := httptest.NewRecorder()
+	handleCopy(rec, httptest.NewRequest("POST", "/copy?"+query.Encode(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("copy failed: %d %s", rec.Code, rec.Body)
+	}
+
+	verify := func(against string) CopyResponse {
+		q := url.Values{"from": {"/src"}, "to": {"/dst"}, "targetURL": {peer.URL + "/upload"}, "recursive": {"true"}, "against": {against}}
+		rec := httptest.NewRecorder()
+		handleVerify(rec, httptest.NewRequest("POST", "/verify?"+q.Encode(), nil))
+		var resp CopyResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if rec.Code != http.StatusOK || resp.Verification == nil {
+			t.Fatalf("verify against the %s failed: %d %s", against, rec.Code, rec.Body)
+		}
+		return resp
+	}
+	for _, against := range []string{VerifyAgainstSource, VerifyAgainstManifest} {
+		if resp := verify(against); resp.State != StateSucceeded || resp.Verification.FilesVerified != 3 {
+			t.Errorf("expected the fresh copy to verify against the %s, got %+v", against, resp.Verification)
+		}
+	}
+
+	// bit rot, an out-of-band addition and a lost file
+	fs.put(map[string]string{"/dst/b.txt": "wOrld", "/dst/sub/extra.txt": "x"})
+	fs.Remove("/dst/a.txt")
+	for _, against := range []string{VerifyAgainstSource, VerifyAgainstManifest} {
+		resp := verify(against)
+		mismatches := resp.Verification.Mismatches
+		if resp.State != StateFailed || len(mismatches) != 3 {
+			t.Fatalf("expected 3 divergences against the %s, got %+v", against, resp.Verification)
+		}
+		if mismatches[0].Path != "/dst/a.txt" || mismatches[0].Reason != "missing on the target" {
+			t.Errorf("expected the lost file, got %+v", mismatches[0])
+		}
+		if mismatches[1].Path != "/dst/b.txt" || !strings.Contains(mismatches[1].Reason, "different sha256s") || mismatches[1].QuarantinedAs != "" {
+			t.Errorf("expected the rotten file reported and left in place, got %+v", mismatches[1])
+		}
+		if mismatches[2].Path != "/dst/sub/extra.txt" || !strings.HasPrefix(mismatches[2].Reason, "only on the target") {
+			t.Errorf("expected the extra file, got %+v", mismatches[2])
+		}
+		if status := getJob(resp.JobID).status(); status.Type != JobTypeVerify || status.State != StateFailed {
+			t.Errorf("expected a failed verify job, got %+v", status)
+		}
+	}
+}
+
+func TestVerifyJobParams(t *testing.T) {
+	useMemFS(t)
+	for _, query := range []string{"to=/dst&targetURL=http://peer/upload", "to=/dst&targetURL=http://peer/upload&against=nothing"} {
+		rec := httptest.NewRecorder()
+		handleVerify(rec, httptest.NewRequest("POST", "/verify?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("expected %s to be refused, got %d", query, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// with FASTCOPY_WRITE_ONCE set to comma separated dirs, e.g. /archive/compliance,/archive/legal, the files below
+// them are immutable once written: an upload, patch or swap that would replace one is refused with a 409, so
+// copied data kept for compliance is never silently replaced. new files may still be written there
+
+var (
+	writeOnce     []string
+	writeOnceOnce sync.Once
+)
+
+// a write that would replace a file below a write-once dir
+var errWriteOnce = errors.New("is write-once")
+
+// reads FASTCOPY_WRITE_ONCE, nil when every file may be replaced
+func loadWriteOnce() ([]string, error) {
+	v := os.Getenv("FASTCOPY_WRITE_ONCE")
+	if v == "" {
+		return nil, nil
+	}
+	var dirs []string
+	for _, dir := range strings.Split(v, ",") {
+		dir = strings.TrimSpace(dir)
+		if !path.IsAbs(dir) || hasDotDot(dir) {
+			return nil, fmt.Errorf("invalid FASTCOPY_WRITE_ONCE dir '%s', expected an absolute hdfs path", dir)
+		}
+		dirs = append(dirs, path.Clean(dir))
+	}
+	return dirs, nil
+}
+
+// lazy loads the write-once dirs
+func getWriteOnce() []string {
+	writeOnceOnce.Do(func() {
+		dirs, err := loadWriteOnce()
+		if err != nil {
+			log.Fatal(err)
+		}
+		writeOnce = dirs
+	})
+	return writeOnce
+}
+
+// the write-once dir p is, or is below, empty if none
+func writeOnceDir(p string) string {
+	p = path.Clean(p)
+	for _, dir := range getWriteOnce() {
+		if p == dir || within(p, dir) {
+			return dir
+		}
+	}
+	return ""
+}
+
+// fails with errWriteOnce when p is in a write-once dir and already exists
+func checkWriteOnce(client FileSystem, p string) error {
+	dir := writeOnceDir(p)
+	if dir == "" {
+		return nil
+	}
+	_, err := client.Stat(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot check whether %s in the write-once %s exists: %w", p, dir, err)
+	}
+	return fmt.Errorf("%s already exists and %s %w, it can't be replaced", p, dir, errWriteOnce)
+}
+
+// fails with errWriteOnce when swapping a dir into 'to' would replace files in a write-once dir: 'to' exists and
+// is, is below or holds one
+func checkWriteOnceSwap(client FileSystem, to string) error {
+	if err := checkWriteOnce(client, to); err != nil {
+		return err
+	}
+	to = path.Clean(to)
+	for _, dir := range getWriteOnce() {
+		if !within(dir, to) {
+			continue
+		}
+		if _, err := client.Stat(to); err == nil {
+			return fmt.Errorf("%s already exists and holds %s, which %w, it can't be replaced", to, dir, errWriteOnce)
+		}
+	}
+	return nil
+}
+
+// answers a write refused by checkWriteOnce, 409 for a file that can't be replaced
+func writeWriteOnceError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errWriteOnce) {
+		writeError(w, err.Error(), http.StatusConflict)
+		log.Printf("Rejected write: %s", err)
+		return
+	}
+	writeError(w, err.Error(), http.StatusInternalServerError)
+}
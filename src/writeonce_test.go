@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func useWriteOnce(t *testing.T, dirs ...string) {
+	writeOnceOnce.Do(func() {})
+	prev := writeOnce
+	writeOnce = dirs
+	t.Cleanup(func() { writeOnce = prev })
+}
+
+func TestWriteOnce(t *testing.T) {
+	fs := useMemFS(t)
+	useWriteOnce(t, "/archive/legal")
+	fs.put(map[string]string{"/archive/legal/2024/report.csv": "original", "/data/report.csv": "original"})
+	upload := func(query string, body string) int {
+		rec := httptest.NewRecorder()
+		handleUpload(rec, httptest.NewRequest("POST", "/upload?"+query, strings.NewReader(body)))
+		return rec.Code
+	}
+	for query, status := range map[string]int{
+		"to=/archive/legal/2024&fileName=report.csv": http.StatusConflict,
+		"to=/archive/legal/2024&fileName=new.csv":    http.StatusOK,
+		"to=/data&fileName=report.csv":               http.StatusOK,
+	} {
+		if code := upload(query, "replaced"); code != status {
+			t.Errorf("%s: expected %d, got %d", query, status, code)
+		}
+	}
+	if data, _ := fs.get("/archive/legal/2024/report.csv"); data != "original" {
+		t.Errorf("expected the write-once file kept, got %q", data)
+	}
+	if data, _ := fs.get("/data/report.csv"); data != "replaced" {
+		t.Errorf("expected a file elsewhere replaced, got %q", data)
+	}
+	if code := upload("to=/archive/legal/2024&fileName=new.csv", "again"); code != http.StatusConflict {
+		t.Errorf("expected a file written once to stay, got %d", code)
+	}
+
+	rec := httptest.NewRecorder()
+	handleSwap(rec, httptest.NewRequest("POST", "/swap?from=/.archive.fastcopy-staging-x&to=/archive", nil))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("expected swapping over a write-once dir to be refused, got %d %s", rec.Code, rec.Body)
+	}
+
+	t.Setenv("FASTCOPY_WRITE_ONCE", "/archive,relative")
+	if _, err := loadWriteOnce(); err == nil {
+		t.Error("expected a relative write-once dir to be rejected")
+	}
+}
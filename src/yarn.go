@@ -0,0 +1,553 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a copy with yarn=N runs as a YARN service of N worker containers, each copying one shard of the directory
+// in oneshot mode. this server plans the copy, submits the service through the YARN services REST API
+// (hadoop 3.1+, its framework provides the application master) and aggregates the workers' progress
+// from the destination listing into the job
+
+const (
+	// the most containers one copy may launch
+	maxYarnWorkers = 1000
+	// consecutive failed polls of the service before the job is given up on
+	maxYarnPollFailures = 20
+	// the name of the service's only component
+	yarnComponentName = "worker"
+	// the worker binary as localized into each container
+	yarnBinaryName = "fastcopy"
+)
+
+// how often a yarn copy polls its service and the destination listing
+var yarnPollInterval = 15 * time.Second
+
+// the env of this server handed to the workers, so they reach the same clusters the same way.
+// bandwidth schedules and encryption keys are not, see yarnIncompatible
+var yarnForwardedEnv = []string{"HDFS_NAMENODE", "KRB_ENABLED", "KRB_USER", "KRB_REALM", "KRB_KEYTAB", "KRB_KDC", "KRB5_CONFIG", "FASTCOPY_READ_AHEAD", "FASTCOPY_MAX_INFLIGHT_BYTES", "FASTCOPY_BREAKER_THRESHOLD", "FASTCOPY_BREAKER_COOLDOWN"}
+
+// query params of the copy that only make sense to the planner and aren't passed on to the workers
+var yarnPlannerParams = []string{"from", "to", "targetURL", "yarn", "jobId", "reconcile", "useSnapshot", "snapshotName", "deleteSnapshot", "expectedDuration", "minThroughput", "stallTimeout"}
+
+// where and how worker containers are launched, from FASTCOPY_YARN_*
+type yarnSettings struct {
+	api      string // the resourcemanager's web address, e.g. http://rm:8088
+	binary   string // the fastcopy binary on hdfs, localized into every container
+	queue    string
+	user     string // sent as user.name on clusters with simple auth
+	memoryMB int
+	vcores   int
+}
+
+const (
+	defaultYarnMemoryMB = 2048
+	defaultYarnVcores   = 2
+)
+
+var (
+	yarn     *yarnSettings
+	yarnOnce sync.Once
+)
+
+// reads FASTCOPY_YARN_*. returns nil without an error when FASTCOPY_YARN_API isn't set
+func loadYarnSettings() (*yarnSettings, error) {
+	api := os.Getenv("FASTCOPY_YARN_API")
+	if api == "" {
+		return nil, nil
+	}
+	if u, err := url.Parse(api); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid FASTCOPY_YARN_API '%s', expected an http(s) url", api)
+	}
+	s := &yarnSettings{
+		api:      strings.TrimSuffix(api, "/"),
+		binary:   os.Getenv("FASTCOPY_YARN_BINARY"),
+		queue:    os.Getenv("FASTCOPY_YARN_QUEUE"),
+		user:     os.Getenv("FASTCOPY_YARN_USER"),
+		memoryMB: defaultYarnMemoryMB,
+		vcores:   defaultYarnVcores,
+	}
+	if u, err := url.Parse(s.binary); err != nil || u.Scheme == "" || u.Path == "" {
+		return nil, fmt.Errorf("invalid FASTCOPY_YARN_BINARY '%s', expected the fastcopy binary's full hdfs url, e.g. hdfs://namenode:8020/apps/fastcopy", s.binary)
+	}
+	if v := os.Getenv("FASTCOPY_YARN_MEMORY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid FASTCOPY_YARN_MEMORY '%s', expected megabytes", v)
+		}
+		s.memoryMB = n
+	}
+	if v := os.Getenv("FASTCOPY_YARN_VCORES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid FASTCOPY_YARN_VCORES '%s', expected a positive integer", v)
+		}
+		s.vcores = n
+	}
+	return s, nil
+}
+
+// lazy loads the yarn settings, nil when yarn copies aren't configured
+func getYarnSettings() *yarnSettings {
+	yarnOnce.Do(func() {
+		s, err := loadYarnSettings()
+		if err != nil {
+			log.Fatal(err)
+		}
+		yarn = s
+	})
+	return yarn
+}
+
+// the service spec of the YARN services API, only the fields fastcopy uses
+type yarnService struct {
+	Name       string          `json:"name"`
+	Version    string          `json:"version,omitempty"`
+	ID         string          `json:"id,omitempty"`
+	Queue      string          `json:"queue,omitempty"`
+	State      string          `json:"state,omitempty"`
+	Components []yarnComponent `json:"components,omitempty"`
+}
+
+type yarnComponent struct {
+	Name               string             `json:"name"`
+	NumberOfContainers int                `json:"number_of_containers"`
+	RestartPolicy      string             `json:"restart_policy,omitempty"`
+	LaunchCommand      string             `json:"launch_command,omitempty"`
+	Resource           *yarnResource      `json:"resource,omitempty"`
+	Configuration      *yarnConfiguration `json:"configuration,omitempty"`
+	Containers         []yarnContainer    `json:"containers,omitempty"`
+}
+
+type yarnResource struct {
+	CPUs   int    `json:"cpus"`
+	Memory string `json:"memory"`
+}
+
+type yarnConfiguration struct {
+	Env   map[string]string `json:"env,omitempty"`
+	Files []yarnConfigFile  `json:"files,omitempty"`
+}
+
+type yarnConfigFile struct {
+	Type     string `json:"type"`
+	DestFile string `json:"dest_file"`
+	SrcFile  string `json:"src_file"`
+}
+
+type yarnContainer struct {
+	ID    string `json:"id"`
+	State string `json:"state"`
+	Host  string `json:"bare_host,omitempty"`
+}
+
+// the states of a service after which its workers are gone. whether they succeeded is in the
+// application's final status
+var yarnTerminalStates = []string{"STOPPED", "SUCCEEDED", "FAILED"}
+
+// the yarn side of a yarn=N copy, for GET /jobs/{id} and the copy's result
+type YarnStatus struct {
+	Service       string         `json:"service"`
+	ApplicationID string         `json:"applicationId,omitempty"`
+	Workers       int            `json:"workers"`
+	State         string         `json:"state"`
+	FinalStatus   string         `json:"finalStatus,omitempty"`
+	Containers    map[string]int `json:"containers,omitempty"` // the service's current containers by state
+	Diagnostics   string         `json:"diagnostics,omitempty"`
+}
+
+// options a yarn=N copy can't honour, because the workers would each apply them to their own shard
+// or they'd need secrets in the container spec
+func yarnIncompatible(q url.Values, opts CopyOptions) error {
+	switch {
+	case len(q["targetURL"]) > 1:
+		return errors.New("'yarn' copies to a single 'targetURL'")
+	case q.Get("shard") != "":
+		return errors.New("'shard' can't be combined with 'yarn', every worker copies its own shard")
+	case opts.Staging:
+		return errors.New("'staging' can't be combined with 'yarn'")
+	case opts.Manifest:
+		return errors.New("'manifest' can't be combined with 'yarn', each worker would overwrite it with its shard")
+	case opts.WriteSuccess:
+		return errors.New("'writeSuccess' can't be combined with 'yarn', a worker finishing first would mark the copy complete")
+	case opts.Sample > 0 || opts.SamplePercent > 0:
+		return errors.New("'sample' and 'samplePercent' can't be combined with 'yarn'")
+	case opts.Recursive:
+		return errors.New("'recursive' can't be combined with 'yarn', progress is measured from the listing of 'to'")
+	case opts.Dedup:
+		return errors.New("'dedup' can't be combined with 'yarn', the cache of delivered files is local to this server")
+	case opts.MaxBytes > 0 || opts.ResumeAfter != "":
+		return errors.New("'maxBytes' and 'resumeAfter' can't be combined with 'yarn'")
+	case opts.HiveTable != "":
+		return errors.New("'hiveTable' can't be combined with 'yarn', the workers finish independently")
+	case opts.Encrypt:
+		return errors.New("'encrypt' can't be combined with 'yarn', the keys would have to be put in the container spec")
+	}
+	return nil
+}
+
+// single quotes s for the container's shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// the command each container runs: a oneshot copy of its shard. yarn replaces ${COMPONENT_ID} with
+// the container's index, 0 to workers-1
+func yarnWorkerCommand(from string, to string, targetURL string, params url.Values, workers int) string {
+	args := []string{"./" + yarnBinaryName, "-oneshot", "-from", shellQuote(from), "-to", shellQuote(to), "-targetURL", shellQuote(targetURL)}
+	names := make([]string, 0, len(params))
+	for name := range params {
+		if !contains(yarnPlannerParams, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range params[name] {
+			args = append(args, "-param", shellQuote(name+"="+v))
+		}
+	}
+	args = append(args, "-param", "reconcile=false", "-param", fmt.Sprintf("shard=${COMPONENT_ID}/%d", workers))
+	return strings.Join(args, " ")
+}
+
+// the service running 'command' on 'workers' containers
+func yarnServiceSpec(s *yarnSettings, name string, command string, workers int) yarnService {
+	env := make(map[string]string)
+	for _, k := range yarnForwardedEnv {
+		if v := os.Getenv(k); v != "" {
+			env[k] = v
+		}
+	}
+	return yarnService{
+		Name:    name,
+		Version: "1",
+		Queue:   s.queue,
+		Components: []yarnComponent{{
+			Name:               yarnComponentName,
+			NumberOfContainers: workers,
+			RestartPolicy:      "NEVER", // a failed shard fails the copy, rerunning it is up to the caller
+			LaunchCommand:      command,
+			Resource:           &yarnResource{CPUs: s.vcores, Memory: strconv.Itoa(s.memoryMB)},
+			Configuration: &yarnConfiguration{
+				Env:   env,
+				Files: []yarnConfigFile{{Type: "STATIC", DestFile: yarnBinaryName, SrcFile: s.binary}},
+			},
+		}},
+	}
+}
+
+// the url of a resourcemanager endpoint, as FASTCOPY_YARN_USER with simple auth
+func (s *yarnSettings) url(path string) string {
+	u := s.api + path
+	if s.user != "" {
+		u += "?" + url.Values{"user.name": {s.user}}.Encode()
+	}
+	return u
+}
+
+// submits the service, the resourcemanager accepts it asynchronously
+func submitYarnService(s *yarnSettings, spec yarnService) error {
+	body, _ := json.Marshal(spec)
+	resp, err := httpClient.Post(s.url("/app/v1/services"), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("submitting service %s returned non-OK status %d: %s", spec.Name, resp.StatusCode, msg)
+	}
+	return nil
+}
+
+func getYarnService(s *yarnSettings, name string) (yarnService, error) {
+	var svc yarnService
+	resp, err := httpClient.Get(s.url("/app/v1/services/" + url.PathEscape(name)))
+	if err != nil {
+		return svc, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return svc, fmt.Errorf("service %s returned non-OK status %d: %s", name, resp.StatusCode, msg)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&svc)
+	return svc, err
+}
+
+// the final status and diagnostics of a finished application. the services API reports both successful
+// and failed services as STOPPED
+func getYarnApp(s *yarnSettings, id string) (string, string, error) {
+	resp, err := httpClient.Get(s.url("/ws/v1/cluster/apps/" + url.PathEscape(id)))
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("application %s returned non-OK status %d", id, resp.StatusCode)
+	}
+	var report struct {
+		App struct {
+			FinalStatus string `json:"finalStatus"`
+			Diagnostics string `json:"diagnostics"`
+		} `json:"app"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return "", "", err
+	}
+	return report.App.FinalStatus, report.App.Diagnostics, nil
+}
+
+// how much of the plan has landed in the destination: the planned files complete at their planned
+// size, and the bytes of planned files written so far
+func landed(plan []CopyArgs, listing []LsEntry) (int, int64) {
+	dest := make(map[string]LsEntry, len(listing))
+	for _, e := range listing {
+		dest[e.Name] = e
+	}
+	var files int
+	var written int64
+	for _, args := range plan {
+		e, ok := dest[args.File]
+		if !ok || e.IsDir {
+			continue
+		}
+		if e.Size >= args.Size {
+			files++
+			written += args.Size
+		} else {
+			written += e.Size
+		}
+	}
+	return files, written
+}
+
+// records the progress of a job whose bytes are moved elsewhere, as measured in the destination
+func (j *Job) remoteProgress(files int, written int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := j.now()
+	j.filesDone = files
+	if written > j.bytesRead {
+		j.bytesRead = written
+		j.lastProgress = now
+	}
+	j.samples = append(j.samples, rateSample{now, j.bytesRead})
+	for len(j.samples) > 2 && now.Sub(j.samples[1].at) > rateWindow {
+		j.samples = j.samples[1:]
+	}
+}
+
+func (j *Job) setYarn(status YarnStatus) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.yarn = &status
+}
+
+// starts the copy described by the query params of r as a yarn service and returns once it's submitted.
+// errors are returned with the http status to fail with
+func startYarnCopy(r *http.Request) (CopyResponse, int, error) {
+	start := time.Now()
+	q := r.URL.Query()
+	if err := validateParams(q, "from", "to", "targetURL"); err != nil {
+		return CopyResponse{}, http.StatusBadRequest, err
+	}
+	from, to, targetURL := q.Get("from"), q.Get("to"), q.Get("targetURL")
+	s := getYarnSettings()
+	if s == nil {
+		return CopyResponse{}, http.StatusBadRequest, errors.New("'yarn' copies need FASTCOPY_YARN_API and FASTCOPY_YARN_BINARY to be set")
+	}
+	workers, err := strconv.Atoi(q.Get("yarn"))
+	if err != nil || workers < 1 || workers > maxYarnWorkers {
+		return CopyResponse{}, http.StatusBadRequest, fmt.Errorf("'yarn' must be the number of workers, 1 to %d, got '%s'", maxYarnWorkers, q.Get("yarn"))
+	}
+	opts, err := parseCopyOptions(r)
+	if err != nil {
+		return CopyResponse{}, http.StatusBadRequest, err
+	}
+	if err := yarnIncompatible(q, opts); err != nil {
+		return CopyResponse{}, http.StatusBadRequest, err
+	}
+	labels, err := parseLabels(q["label"])
+	if err != nil {
+		return CopyResponse{}, http.StatusBadRequest, err
+	}
+	if err := precheckTarget(targetURL, to, opts.Precheck); err != nil {
+		log.Println(err)
+		return CopyResponse{}, http.StatusBadGateway, err
+	}
+
+	// the workers all read the snapshot taken here, so their shards come from the same listing
+	client := GetHdfsClient()
+	readFrom := from
+	params := url.Values{}
+	for k, v := range q {
+		params[k] = v
+	}
+	var snapshot string
+	if opts.UseSnapshot {
+		snapshot, readFrom, err = prepareSnapshot(client, from, opts)
+		if err != nil {
+			log.Println(err)
+			return CopyResponse{}, http.StatusInternalServerError, err
+		}
+		params.Set("useSnapshot", "true")
+		params.Set("snapshotName", snapshot)
+	}
+	release := func() {
+		if opts.UseSnapshot && opts.DeleteSnapshot {
+			releaseSnapshot(client, from, snapshot)
+		}
+	}
+	if opts.RequireSuccess {
+		if _, err := client.Stat(filepath.Join(readFrom, SuccessMarker)); err != nil {
+			release()
+			return CopyResponse{}, http.StatusPreconditionFailed, fmt.Errorf("%s has no %s marker, refusing to copy incomplete job output: %s", from, SuccessMarker, err)
+		}
+	}
+	fileInfos, err := client.ReadDir(readFrom)
+	if err != nil {
+		release()
+		return CopyResponse{}, http.StatusInternalServerError, fmt.Errorf("Failed to list the hdfs dir %s", err)
+	}
+	tasks, skipped, _ := planTasks(fileInfos, readFrom, to, opts)
+
+	job, err := startJob(q.Get("jobId"), from, to, targetURL, labels, tasks)
+	if err != nil {
+		release()
+		return CopyResponse{}, http.StatusConflict, err
+	}
+	job.setSLA(opts.SLA)
+	resp := CopyResponse{
+		JobID:          job.id,
+		Labels:         labels,
+		From:           from,
+		To:             to,
+		FilesRequested: int64(len(fileInfos)),
+		FilesSkipped:   int64(len(skipped)),
+		Skipped:        skipped,
+		Snapshot:       snapshot,
+		State:          StateRunning,
+	}
+
+	name := "fastcopy-" + newJobID()
+	spec := yarnServiceSpec(s, name, yarnWorkerCommand(from, to, targetURL, params, workers), workers)
+	if err := submitYarnService(s, spec); err != nil {
+		job.logf("Failed to submit yarn service %s: %s", name, err)
+		resp.State = StateFailed
+		resp.ElapsedSecs = time.Since(start).Seconds()
+		job.finish(resp)
+		release()
+		return CopyResponse{}, http.StatusBadGateway, err
+	}
+	status := YarnStatus{Service: name, Workers: workers, State: "ACCEPTED"}
+	job.setYarn(status)
+	job.logf("Submitted yarn service %s with %d workers to %s", name, workers, s.api)
+	resp.Yarn = &status
+
+	go func() {
+		defer release()
+		watchYarnCopy(s, job, resp, tasks, targetURL, opts.Reconcile, start)
+	}()
+	return resp, http.StatusAccepted, nil
+}
+
+// polls the service and the destination until the workers are gone, then reconciles the whole plan
+// and finishes the job
+func watchYarnCopy(s *yarnSettings, job *Job, resp CopyResponse, tasks []CopyArgs, targetURL string, reconcile bool, start time.Time) {
+	status := *resp.Yarn
+	failures := 0
+	ticker := time.NewTicker(yarnPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if listing, err := listPeer(targetURL, resp.To); err == nil {
+			job.remoteProgress(landed(tasks, listing))
+		}
+		svc, err := getYarnService(s, status.Service)
+		if err != nil {
+			failures++
+			job.logf("Failed to poll yarn service %s (%d/%d): %s", status.Service, failures, maxYarnPollFailures, err)
+			if failures < maxYarnPollFailures {
+				continue
+			}
+			status.Diagnostics = err.Error()
+			break
+		}
+		failures = 0
+		status.State, status.ApplicationID = svc.State, svc.ID
+		status.Containers = make(map[string]int)
+		for _, c := range svc.Components {
+			for _, container := range c.Containers {
+				status.Containers[container.State]++
+			}
+		}
+		if contains(yarnTerminalStates, svc.State) {
+			if svc.ID != "" {
+				if status.FinalStatus, status.Diagnostics, err = getYarnApp(s, svc.ID); err != nil {
+					job.logf("Failed to get the final status of %s: %s", svc.ID, err)
+				}
+			}
+			break
+		}
+		job.setYarn(status)
+	}
+	job.setYarn(status)
+	job.logf("yarn service %s %s, final status '%s' %s", status.Service, status.State, status.FinalStatus, status.Diagnostics)
+
+	state := StateSucceeded
+	if status.FinalStatus != "SUCCEEDED" {
+		state = StateFailed
+	}
+	if listing, err := listPeer(targetURL, resp.To); err == nil {
+		files, written := landed(tasks, listing)
+		job.remoteProgress(files, written)
+		resp.FilesCopied, resp.Written = int64(files), written
+	}
+	if reconcile {
+		ok, d := reconcileWithPeer(targetURL, resp.To, tasks)
+		resp.Reconciled, resp.Discrepancies = &ok, d
+		for _, discrepancy := range d {
+			job.logf("Reconciliation: %s", discrepancy)
+		}
+		if !ok {
+			state = StateFailed
+		}
+	}
+	elapsed := time.Since(start).Seconds()
+	resp.State = state
+	resp.Yarn = &status
+	resp.ElapsedSecs = elapsed
+	resp.Throughput = mbps(resp.Written, elapsed)
+	job.finish(resp)
+	json, _ := json.MarshalIndent(resp, "", "  ")
+	log.Println(string(json))
+}
+
+// POST /copy?yarn=N responds 202 Accepted with the job once the service is submitted, the copy's
+// outcome is the job's result
+func handleYarnCopy(w http.ResponseWriter, r *http.Request) {
+	resp, status, err := startYarnCopy(r)
+	if err != nil {
+		writeError(w, err.Error(), status, errorDetails(err)...)
+		return
+	}
+	w.Header().Set(jobIDHeader, resp.JobID)
+	json, _ := json.MarshalIndent(resp, "", "  ")
+	w.WriteHeader(status)
+	w.Write(json)
+}
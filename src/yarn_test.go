@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// points yarn copies at the resourcemanager 'api' for the duration of the test
+func useYarn(t *testing.T, api string) {
+	yarnOnce.Do(func() {})
+	prev, prevInterval := yarn, yarnPollInterval
+	yarn = &yarnSettings{api: api, binary: "hdfs://nn:8020/apps/fastcopy", queue: "copies", memoryMB: defaultYarnMemoryMB, vcores: defaultYarnVcores}
+	yarnPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { yarn, yarnPollInterval = prev, prevInterval })
+}
+
+func TestLoadYarnSettings(t *testing.T) {
+	t.Setenv("FASTCOPY_YARN_API", "")
+	if s, err := loadYarnSettings(); s != nil || err != nil {
+		t.Errorf("expected yarn copies to be off by default, got %v %v", s, err)
+	}
+	t.Setenv("FASTCOPY_YARN_API", "http://rm:8088/")
+	t.Setenv("FASTCOPY_YARN_BINARY", "/apps/fastcopy")
+	if _, err := loadYarnSettings(); err == nil {
+		t.Error("expected a binary path without a scheme to be rejected")
+	}
+	t.Setenv("FASTCOPY_YARN_BINARY", "hdfs://nn:8020/apps/fastcopy")
+	t.Setenv("FASTCOPY_YARN_MEMORY", "4096")
+	s, err := loadYarnSettings()
+	if err != nil || s.api != "http://rm:8088" || s.memoryMB != 4096 || s.vcores != defaultYarnVcores {
+		t.Errorf("unexpected settings %+v %v", s, err)
+	}
+	t.Setenv("FASTCOPY_YARN_VCORES", "many")
+	if _, err := loadYarnSettings(); err == nil {
+		t.Error("expected invalid vcores to be rejected")
+	}
+}
+
+func TestYarnWorkerCommand(t *testing.T) {
+	params := url.Values{"from": {"/src"}, "to": {"/dst"}, "targetURL": {"http://t"}, "yarn": {"4"}, "jobId": {"j"}, "reconcile": {"true"},
+		"delta": {"true"}, "label": {"team=it's"}}
+	got := yarnWorkerCommand("/src", "/dst", "http://t/upload", params, 4)
+	want := `./fastcopy -oneshot -from '/src' -to '/dst' -targetURL 'http://t/upload' -param 'delta=true' -param 'label=team=it'\''s' -param reconcile=false -param shard=${COMPONENT_ID}/4`
+	if got != want {
+		t.Errorf("unexpected command\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestLanded(t *testing.T) {
+	plan := []CopyArgs{{File: "a", Size: 10}, {File: "b", Size: 10}, {File: "c", Size: 10}}
+	listing := []LsEntry{{Name: "a", Size: 10}, {Name: "b", Size: 4}, {Name: "other", Size: 100}}
+	if files, written := landed(plan, listing); files != 1 || written != 14 {
+		t.Errorf("expected 1 file and 14 bytes landed, got %d %d", files, written)
+	}
+}
+
+// a resourcemanager whose service copies every file of /src into /dst when first polled, as its workers would
+type fakeYarn struct {
+	mu          sync.Mutex
+	fs          *memFS
+	spec        yarnService
+	polls       int
+	finalStatus string
+}
+
+func (f *fakeYarn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/app/v1/services":
+		json.NewDecoder(r.Body).Decode(&f.spec)
+		w.WriteHeader(http.StatusAccepted)
+	case r.URL.Path == "/app/v1/services/"+f.spec.Name:
+		f.polls++
+		svc := yarnService{Name: f.spec.Name, ID: "application_1_0001", State: "STABLE",
+			Components: []yarnComponent{{Name: yarnComponentName, Containers: []yarnContainer{{ID: "c1", State: "READY"}}}}}
+		if f.polls > 1 {
+			infos, _ := f.fs.ReadDir("/src")
+			for _, info := range infos {
+				data, _ := f.fs.get("/src/" + info.Name())
+				f.fs.put(map[string]string{"/dst/" + info.Name(): data})
+			}
+			svc.State, svc.Components = "STOPPED", nil
+		}
+		json.NewEncoder(w).Encode(svc)
+	case r.URL.Path == "/ws/v1/cluster/apps/application_1_0001":
+		fmt.Fprintf(w, `{"app": {"finalStatus": %q, "diagnostics": ""}}`, f.finalStatus)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestYarnCopy(t *testing.T) {
+	for _, finalStatus := range []string{"SUCCEEDED", "FAILED"} {
+		t.Run(finalStatus, func(t *testing.T) {
+			fs := useMemFS(t)
+			fs.put(map[string]string{"/src/part-00000": "aaaa", "/src/part-00001": "bb", "/src/part-00002.tmp": "x"})
+			rm := &fakeYarn{fs: fs, finalStatus: finalStatus}
+			rmServer := httptest.NewServer(rm)
+			defer rmServer.Close()
+			useYarn(t, rmServer.URL)
+
+			peer := http.NewServeMux()
+			peer.HandleFunc("/ready", handleReady)
+			peer.HandleFunc("/ls", handleLs)
+			target := httptest.NewServer(peer)
+			defer target.Close()
+
+			rec := httptest.NewRecorder()
+			q := url.Values{"from": {"/src"}, "to": {"/dst"}, "targetURL": {target.URL + "/upload"}, "yarn": {"3"}, "skipInProgress": {"true"}}
+			handleCopy(rec, httptest.NewRequest("POST", "/copy?"+q.Encode(), nil))
+			if rec.Code != http.StatusAccepted {
+				t.Fatalf("expected the copy to be accepted, got %d: %s", rec.Code, rec.Body)
+			}
+			var accepted CopyResponse
+			json.Unmarshal(rec.Body.Bytes(), &accepted)
+			if accepted.State != StateRunning || accepted.Yarn == nil || accepted.Yarn.Workers != 3 {
+				t.Fatalf("unexpected response %s", rec.Body)
+			}
+
+			rm.mu.Lock()
+			c := rm.spec.Components[0]
+			rm.mu.Unlock()
+			if c.NumberOfContainers != 3 || c.RestartPolicy != "NEVER" || !strings.Contains(c.LaunchCommand, "-param 'skipInProgress=true'") ||
+				c.Configuration.Files[0].SrcFile != "hdfs://nn:8020/apps/fastcopy" {
+				t.Errorf("unexpected component %+v", c)
+			}
+
+			job := getJob(accepted.JobID)
+			deadline := time.Now().Add(5 * time.Second)
+			for job.running() && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			s := job.status()
+			if s.Result == nil {
+				t.Fatal("expected the job to finish")
+			}
+			want := StateSucceeded
+			if finalStatus != "SUCCEEDED" {
+				want = StateFailed
+			}
+			if s.State != want || s.Result.FilesCopied != 2 || s.Result.Written != 6 || s.Result.Reconciled == nil || !*s.Result.Reconciled {
+				t.Errorf("unexpected result %+v", s.Result)
+			}
+			if s.Yarn == nil || s.Yarn.ApplicationID != "application_1_0001" || s.Yarn.FinalStatus != finalStatus {
+				t.Errorf("unexpected yarn status %+v", s.Yarn)
+			}
+		})
+	}
+}
+
+func TestYarnCopyRejectsIncompatibleOptions(t *testing.T) {
+	useMemFS(t)
+	useYarn(t, "http://rm:8088")
+	for _, param := range []string{"shard=0/2", "staging=true", "manifest=true", "writeSuccess=true", "sample=5", "yarn=0", "yarn=lots"} {
+		rec := httptest.NewRecorder()
+		handleCopy(rec, httptest.NewRequest("POST", "/copy?"+param+"&from=/src&to=/dst&targetURL=http://t/upload&yarn=2", nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("expected %s to be rejected, got %d", param, rec.Code)
+		}
+	}
+}